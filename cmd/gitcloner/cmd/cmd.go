@@ -17,8 +17,22 @@ type Options struct {
 	Username          string
 	PasswordFile      string
 	SSHPrivateKeyFile string
+	SSHPassphraseFile string
 	InsecureSkipTLS   bool
 	KnownHostsFile    string
+	ClientCertFile    string
+	ClientKeyFile     string
+	BearerTokenFile   string
+	HeadersFile       string
+
+	SSHCertificateFile       string
+	ControllerKnownHostsFile string
+	StrictHostKeyChecking    bool
+
+	GitHubAppID             string
+	GitHubAppInstallationID string
+	GitHubAppPrivateKeyFile string
+	GitHubAPIURL            string
 }
 
 var opts *Options
@@ -42,8 +56,20 @@ func New(gitCloner GitCloner) *cobra.Command {
 	cmd.Flags().StringVarP(&opts.Username, "username", "u", "", "user name for basic auth")
 	cmd.Flags().StringVar(&opts.PasswordFile, "password-file", "", "password file for basic auth")
 	cmd.Flags().StringVar(&opts.SSHPrivateKeyFile, "ssh-private-key-file", "", "ssh private key file path")
+	cmd.Flags().StringVar(&opts.SSHPassphraseFile, "ssh-passphrase-file", "", "passphrase file of an encrypted ssh private key")
+	cmd.Flags().StringVar(&opts.SSHCertificateFile, "ssh-certificate-file", "", "ssh user certificate file of the ssh private key")
 	cmd.Flags().BoolVar(&opts.InsecureSkipTLS, "insecure-skip-tls", false, "do not verify tls certificates")
 	cmd.Flags().StringVar(&opts.KnownHostsFile, "known-hosts-file", "", "known hosts file")
+	cmd.Flags().StringVar(&opts.ControllerKnownHostsFile, "controller-known-hosts-file", "", "known hosts file of the controller, merged with the known hosts file")
+	cmd.Flags().BoolVar(&opts.StrictHostKeyChecking, "strict-host-key-checking", false, "refuse to connect to ssh hosts without a known host key")
+	cmd.Flags().StringVar(&opts.ClientCertFile, "client-cert-file", "", "tls client certificate file")
+	cmd.Flags().StringVar(&opts.ClientKeyFile, "client-key-file", "", "tls client key file")
+	cmd.Flags().StringVar(&opts.BearerTokenFile, "bearer-token-file", "", "bearer token file")
+	cmd.Flags().StringVar(&opts.HeadersFile, "headers-file", "", "file of additional http headers, one \"Name: value\" per line")
+	cmd.Flags().StringVar(&opts.GitHubAppID, "github-app-id", "", "github app id")
+	cmd.Flags().StringVar(&opts.GitHubAppInstallationID, "github-app-installation-id", "", "github app installation id")
+	cmd.Flags().StringVar(&opts.GitHubAppPrivateKeyFile, "github-app-private-key-file", "", "github app private key file path")
+	cmd.Flags().StringVar(&opts.GitHubAPIURL, "github-api-url", "", "github api url used to request installation tokens, defaults to the api of the repo's host")
 
 	return cmd
 }
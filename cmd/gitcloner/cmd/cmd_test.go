@@ -8,7 +8,9 @@ func TestArgsAreSet(t *testing.T) {
 	mock := &clonerMock{}
 	cmd := New(mock)
 	cmd.SetArgs([]string{"test-repo", "test-path", "--branch", "master", "--revision", "v0.1.0", "--ca-bundle-file", "caFile", "--username", "user",
-		"--password-file", "passwordFile", "--ssh-private-key-file", "sshFile", "--insecure-skip-tls", "--known-hosts-file", "knownFile"})
+		"--password-file", "passwordFile", "--ssh-private-key-file", "sshFile", "--ssh-passphrase-file", "passphraseFile", "--ssh-certificate-file", "certificateFile", "--insecure-skip-tls", "--known-hosts-file", "knownFile", "--controller-known-hosts-file", "controllerKnownFile", "--strict-host-key-checking",
+		"--client-cert-file", "certFile", "--client-key-file", "keyFile", "--bearer-token-file", "tokenFile", "--headers-file", "headersFile",
+		"--github-app-id", "1", "--github-app-installation-id", "2", "--github-app-private-key-file", "appKeyFile", "--github-api-url", "https://github.example.com/api/v3"})
 	err := cmd.Execute()
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -34,12 +36,36 @@ func TestArgsAreSet(t *testing.T) {
 	if mock.opts.PasswordFile != "passwordFile" {
 		t.Fatalf("expected PasswordFile passwordFile, got %v", mock.opts.PasswordFile)
 	}
+	if mock.opts.SSHPassphraseFile != "passphraseFile" {
+		t.Fatalf("expected SSHPassphraseFile passphraseFile, got %v", mock.opts.SSHPassphraseFile)
+	}
+	if mock.opts.SSHCertificateFile != "certificateFile" {
+		t.Fatalf("expected SSHCertificateFile certificateFile, got %v", mock.opts.SSHCertificateFile)
+	}
 	if !mock.opts.InsecureSkipTLS {
 		t.Fatalf("expected InsecureSkipTLS to be true")
 	}
 	if mock.opts.KnownHostsFile != "knownFile" {
 		t.Fatalf("expected KnownHostsFile knownFile, got %v", mock.opts.KnownHostsFile)
 	}
+	if mock.opts.ControllerKnownHostsFile != "controllerKnownFile" || !mock.opts.StrictHostKeyChecking {
+		t.Fatalf("expected ControllerKnownHostsFile controllerKnownFile and StrictHostKeyChecking, got %v and %v", mock.opts.ControllerKnownHostsFile, mock.opts.StrictHostKeyChecking)
+	}
+	if mock.opts.ClientCertFile != "certFile" || mock.opts.ClientKeyFile != "keyFile" {
+		t.Fatalf("expected ClientCertFile certFile and ClientKeyFile keyFile, got %v and %v", mock.opts.ClientCertFile, mock.opts.ClientKeyFile)
+	}
+	if mock.opts.BearerTokenFile != "tokenFile" || mock.opts.HeadersFile != "headersFile" {
+		t.Fatalf("expected BearerTokenFile tokenFile and HeadersFile headersFile, got %v and %v", mock.opts.BearerTokenFile, mock.opts.HeadersFile)
+	}
+	if mock.opts.GitHubAppID != "1" || mock.opts.GitHubAppInstallationID != "2" {
+		t.Fatalf("expected GitHubAppID 1 and GitHubAppInstallationID 2, got %v and %v", mock.opts.GitHubAppID, mock.opts.GitHubAppInstallationID)
+	}
+	if mock.opts.GitHubAppPrivateKeyFile != "appKeyFile" {
+		t.Fatalf("expected GitHubAppPrivateKeyFile appKeyFile, got %v", mock.opts.GitHubAppPrivateKeyFile)
+	}
+	if mock.opts.GitHubAPIURL != "https://github.example.com/api/v3" {
+		t.Fatalf("expected GitHubAPIURL https://github.example.com/api/v3, got %v", mock.opts.GitHubAPIURL)
+	}
 }
 
 type clonerMock struct {
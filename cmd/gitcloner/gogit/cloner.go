@@ -1,8 +1,14 @@
 package gogit
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/rancher/gitjob/cmd/gitcloner/cmd"
 
@@ -10,12 +16,14 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	httpgit "github.com/go-git/go-git/v5/plumbing/transport/http"
-	gossh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 
 	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	"github.com/rancher/gitjob/pkg/httpauth"
+	"github.com/rancher/gitjob/pkg/sshauth"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh"
 )
 
 const defaultBranch = "master"
@@ -57,42 +65,46 @@ func (c *Cloner) CloneRepo(opts *cmd.Options) error {
 	if err != nil {
 		return err
 	}
+	cloneOpts := &git.CloneOptions{
+		URL:             opts.Repo,
+		Auth:            auth,
+		InsecureSkipTLS: opts.InsecureSkipTLS,
+		CABundle:        caBundle,
+	}
+	if opts.ClientCertFile != "" || opts.HeadersFile != "" {
+		if err := installHTTPClient(opts); err != nil {
+			return err
+		}
+		// the installed client applies the TLS settings, go-git can only apply them to a plain transport
+		cloneOpts.InsecureSkipTLS = false
+		cloneOpts.CABundle = nil
+	}
 
 	if opts.Branch == "" && opts.Revision == "" {
 		opts.Branch = defaultBranch
-		return cloneBranch(opts, auth, caBundle)
+		return cloneBranch(opts, cloneOpts)
 	}
 
 	if opts.Branch != "" {
 		if opts.Revision != "" {
 			logrus.Warn("Using branch for cloning the repo. Revision will be skipped.")
 		}
-		return cloneBranch(opts, auth, caBundle)
+		return cloneBranch(opts, cloneOpts)
 	}
 
-	return cloneRevision(opts, auth, caBundle)
+	return cloneRevision(opts, cloneOpts)
 }
 
-func cloneBranch(opts *cmd.Options, auth transport.AuthMethod, caBundle []byte) error {
-	_, err := plainClone(opts.Path, false, &git.CloneOptions{
-		URL:             opts.Repo,
-		Auth:            auth,
-		InsecureSkipTLS: opts.InsecureSkipTLS,
-		CABundle:        caBundle,
-		SingleBranch:    true,
-		ReferenceName:   plumbing.ReferenceName(opts.Branch),
-	})
+func cloneBranch(opts *cmd.Options, cloneOpts *git.CloneOptions) error {
+	cloneOpts.SingleBranch = true
+	cloneOpts.ReferenceName = plumbing.ReferenceName(opts.Branch)
+	_, err := plainClone(opts.Path, false, cloneOpts)
 
 	return err
 }
 
-func cloneRevision(opts *cmd.Options, auth transport.AuthMethod, caBundle []byte) error {
-	r, err := plainClone(opts.Path, false, &git.CloneOptions{
-		URL:             opts.Repo,
-		Auth:            auth,
-		InsecureSkipTLS: opts.InsecureSkipTLS,
-		CABundle:        caBundle,
-	})
+func cloneRevision(opts *cmd.Options, cloneOpts *git.CloneOptions) error {
+	r, err := plainClone(opts.Path, false, cloneOpts)
 	if err != nil {
 		return err
 	}
@@ -128,28 +140,60 @@ func createAuthFromOpts(opts *cmd.Options) (transport.AuthMethod, error) {
 		if err != nil {
 			return nil, err
 		}
-		auth, err := gossh.NewPublicKeys(gitURL.User.Username(), privateKey, "")
+		var passphrase []byte
+		if opts.SSHPassphraseFile != "" {
+			passphrase, err = readFile(opts.SSHPassphraseFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var certificate []byte
+		if opts.SSHCertificateFile != "" {
+			certificate, err = readFile(opts.SSHCertificateFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		auth, err := sshauth.NewPublicKeys(gitURL.User.Username(), privateKey, passphrase, certificate)
 		if err != nil {
 			return nil, err
 		}
+		var knownHosts []byte
 		if opts.KnownHostsFile != "" {
-			knownHosts, err := readFile(opts.KnownHostsFile)
+			knownHosts, err = readFile(opts.KnownHostsFile)
 			if err != nil {
 				return nil, err
 			}
-			knownHostsCallBack, err := createKnownHostsCallBack(knownHosts)
+		}
+		var controllerKnownHosts []byte
+		if opts.ControllerKnownHostsFile != "" {
+			controllerKnownHosts, err = readFile(opts.ControllerKnownHostsFile)
 			if err != nil {
 				return nil, err
 			}
-			auth.HostKeyCallback = knownHostsCallBack
-		} else {
-			//nolint G106: Use of ssh InsecureIgnoreHostKey should be audited
-			//this will run in an init-container, so there is no persistence
-			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		}
+		// the known hosts of the secret pin the host keys, so unknown hosts are rejected as if strict mode was enabled
+		strict := opts.StrictHostKeyChecking || len(knownHosts) > 0
+		auth.HostKeyCallback, err = sshauth.HostKeyCallback(sshauth.MergeKnownHosts(controllerKnownHosts, knownHosts), strict)
+		if err != nil {
+			return nil, err
 		}
 		return auth, nil
 	}
 
+	if opts.GitHubAppPrivateKeyFile != "" {
+		return createGitHubAppAuth(opts)
+	}
+
+	if opts.BearerTokenFile != "" {
+		token, err := readFile(opts.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &httpgit.TokenAuth{Token: strings.TrimSpace(string(token))}, nil
+	}
+
 	if opts.Username != "" && opts.PasswordFile != "" {
 		password, err := readFile(opts.PasswordFile)
 		if err != nil {
@@ -165,20 +209,108 @@ func createAuthFromOpts(opts *cmd.Options) (transport.AuthMethod, error) {
 	return nil, nil
 }
 
-func createKnownHostsCallBack(knownHosts []byte) (ssh.HostKeyCallback, error) {
-	f, err := os.CreateTemp("", "known_hosts")
+// createGitHubAppAuth mints an installation token of the GitHub App, which is used as the password of basic auth.
+func createGitHubAppAuth(opts *cmd.Options) (transport.AuthMethod, error) {
+	privateKey, err := readFile(opts.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := opts.GitHubAPIURL
+	if apiURL == "" {
+		repoURL, err := url.Parse(opts.Repo)
+		if err != nil {
+			return nil, err
+		}
+		apiURL = githubapp.APIURLForRepo(repoURL)
+	}
+	app, err := githubapp.New(apiURL, opts.GitHubAppID, opts.GitHubAppInstallationID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := httpClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	token, err := app.InstallationToken(context.Background(), client)
 	if err != nil {
 		return nil, err
 	}
-	defer os.RemoveAll(f.Name())
-	defer f.Close()
 
-	if _, err := f.Write(knownHosts); err != nil {
+	return &httpgit.BasicAuth{
+		Username: githubapp.Username,
+		Password: token.Value,
+	}, nil
+}
+
+// httpClient returns a client for requests to the git provider's API, using the TLS settings of opts.
+func httpClient(opts *cmd.Options) (*http.Client, error) {
+	transport, err := httpTransport(opts)
+	if err != nil {
 		return nil, err
 	}
-	if err := f.Close(); err != nil {
-		return nil, fmt.Errorf("closing knownHosts file %s: %w", f.Name(), err)
+
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// installHTTPClient makes go-git present the client certificate and send the additional headers of opts to http(s)
+// repos.
+func installHTTPClient(opts *cmd.Options) error {
+	transport, err := httpTransport(opts)
+	if err != nil {
+		return err
+	}
+	var roundTripper http.RoundTripper = transport
+	if opts.HeadersFile != "" {
+		data, err := readFile(opts.HeadersFile)
+		if err != nil {
+			return err
+		}
+		headers, err := httpauth.ParseHeaders(data)
+		if err != nil {
+			return err
+		}
+		roundTripper = &httpauth.Transport{Headers: headers, Next: transport}
+	}
+	c := httpgit.NewClient(&http.Client{Transport: roundTripper})
+	client.InstallProtocol("http", c)
+	client.InstallProtocol("https", c)
+
+	return nil
+}
+
+// httpTransport returns a transport using the CA bundle, TLS verification setting and client certificate of opts.
+func httpTransport(opts *cmd.Options) (*http.Transport, error) {
+	caBundle, err := getCABundleFromFile(opts.CABundleFile)
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G402 -- skipping verification is configured by the user
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipTLS}
+	if len(caBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM(caBundle)
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := readFile(opts.ClientCertFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readFile(opts.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
 
-	return gossh.NewKnownHostsCallback(f.Name())
+	return transport, nil
 }
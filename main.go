@@ -12,10 +12,14 @@ import (
 
 	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
 	"github.com/rancher/gitjob/pkg/controller"
+	"github.com/rancher/gitjob/pkg/git"
 	"github.com/rancher/gitjob/pkg/git/poll"
 	"github.com/rancher/gitjob/pkg/webhook"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -38,11 +42,19 @@ func init() {
 }
 
 type flags struct {
-	metricsAddr          string
-	enableLeaderElection bool
-	image                string
-	listen               string
-	debug                bool
+	metricsAddr           string
+	enableLeaderElection  bool
+	image                 string
+	listen                string
+	debug                 bool
+	pollWorkers           int
+	pollHostConcurrency   int
+	gitProtocolV2         bool
+	webhookVerifyAncestry bool
+	webhookWorkers        int
+	knownHostsConfigMap   string
+	strictHostKeyChecking bool
+	rerunFailedJobs       bool
 }
 
 func main() {
@@ -56,8 +68,21 @@ func main() {
 func run(ctx context.Context) error {
 	namespace := os.Getenv("NAMESPACE")
 	flags := bindFlags()
+	hostKeys := git.HostKeyOptions{StrictHostKeyChecking: flags.strictHostKeyChecking}
+	var cacheOpts cache.Options
+	if flags.knownHostsConfigMap != "" {
+		hostKeys.KnownHostsConfigMap = types.NamespacedName{Namespace: namespace, Name: flags.knownHostsConfigMap}
+		// only the known hosts ConfigMap is read, so other ConfigMaps are not cached
+		cacheOpts.ByObject = map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {
+				Namespaces: map[string]cache.Config{namespace: {}},
+				Field:      fields.OneTermEqualSelector("metadata.name", flags.knownHostsConfigMap),
+			},
+		}
+	}
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		Cache:  cacheOpts,
 		Metrics: metricsserver.Options{
 			BindAddress: flags.metricsAddr,
 		},
@@ -68,17 +93,36 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := webhook.AddRepoIndex(ctx, mgr.GetFieldIndexer()); err != nil {
+		return err
+	}
+	poller := poll.NewHandler(mgr.GetClient(), poll.Options{
+		Workers:         flags.pollWorkers,
+		HostConcurrency: flags.pollHostConcurrency,
+		ProtocolV2:      flags.gitProtocolV2,
+		HostKeys:        hostKeys,
+	})
+	if err := mgr.Add(poller); err != nil {
+		return err
+	}
 	reconciler := &controller.GitJobReconciler{
-		Client:    mgr.GetClient(),
-		Scheme:    mgr.GetScheme(),
-		Image:     flags.image,
-		GitPoller: poll.NewHandler(mgr.GetClient()),
-		Log:       ctrl.Log.WithName("gitjob-reconciler"),
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		Image:           flags.image,
+		GitPoller:       poller,
+		Log:             ctrl.Log.WithName("gitjob-reconciler"),
+		Recorder:        mgr.GetEventRecorderFor("gitjob"),
+		HostKeys:        hostKeys,
+		RerunFailedJobs: flags.rerunFailedJobs,
 	}
 
 	group := errgroup.Group{}
 	group.Go(func() error {
-		return startWebhook(ctx, namespace, flags.listen, mgr.GetClient(), mgr.GetCache())
+		return startWebhook(ctx, namespace, flags.listen, mgr.GetClient(), mgr.GetCache(), webhook.Options{
+			VerifyAncestry: flags.webhookVerifyAncestry,
+			Workers:        flags.webhookWorkers,
+			HostKeys:       hostKeys,
+		})
 	})
 	group.Go(func() error {
 		setupLog.Info("starting manager")
@@ -98,6 +142,14 @@ func bindFlags() flags {
 	var image string
 	var listen string
 	var debug bool
+	var pollWorkers int
+	var pollHostConcurrency int
+	var gitProtocolV2 bool
+	var webhookVerifyAncestry bool
+	var webhookWorkers int
+	var knownHostsConfigMap string
+	var strictHostKeyChecking bool
+	var rerunFailedJobs bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8081", "The address the metric endpoint binds to.")
 	flag.StringVar(&image, "gitjob-image", "rancher/gitjob:dev", "The gitjob image that will be used in the generated job.")
 	flag.StringVar(&listen, "listen", ":8080", "The port the webhook listens.")
@@ -105,6 +157,20 @@ func bindFlags() flags {
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&debug, "debug", false, "debug mode.")
+	flag.IntVar(&pollWorkers, "poll-workers", poll.DefaultWorkers, "The number of git repos polled at the same time.")
+	flag.IntVar(&pollHostConcurrency, "poll-host-concurrency", poll.DefaultHostConcurrency,
+		"The number of git repos polled at the same time per git host. 0 disables the limit.")
+	flag.BoolVar(&gitProtocolV2, "git-protocol-v2", false,
+		"List only the refs needed when polling, using the git protocol v2. Can be overridden per GitJob.")
+	flag.BoolVar(&webhookVerifyAncestry, "webhook-verify-ancestry", false,
+		"Ignore webhook revisions which don't descend from the current commit of the branch, checked against the git repo.")
+	flag.IntVar(&webhookWorkers, "webhook-workers", webhook.DefaultWorkers, "The number of webhook deliveries processed at the same time.")
+	flag.StringVar(&knownHostsConfigMap, "known-hosts-configmap", "",
+		"The ConfigMap in the namespace of the controller, whose known_hosts key is merged with the known_hosts of SSH credentials.")
+	flag.BoolVar(&strictHostKeyChecking, "strict-host-key-checking", false,
+		"Refuse to connect to SSH hosts without a known host key. Can be overridden per GitJob.")
+	flag.BoolVar(&rerunFailedJobs, "rerun-failed-jobs", false,
+		"Create failed jobs again, once a secret of their credential changed.")
 	opts := zap.Options{
 		Development: debug,
 	}
@@ -113,17 +179,25 @@ func bindFlags() flags {
 	flag.Parse()
 
 	return flags{
-		metricsAddr:          metricsAddr,
-		enableLeaderElection: enableLeaderElection,
-		image:                image,
-		listen:               listen,
-		debug:                debug,
+		metricsAddr:           metricsAddr,
+		enableLeaderElection:  enableLeaderElection,
+		image:                 image,
+		listen:                listen,
+		debug:                 debug,
+		pollWorkers:           pollWorkers,
+		pollHostConcurrency:   pollHostConcurrency,
+		gitProtocolV2:         gitProtocolV2,
+		webhookVerifyAncestry: webhookVerifyAncestry,
+		webhookWorkers:        webhookWorkers,
+		knownHostsConfigMap:   knownHostsConfigMap,
+		strictHostKeyChecking: strictHostKeyChecking,
+		rerunFailedJobs:       rerunFailedJobs,
 	}
 }
 
-func startWebhook(ctx context.Context, namespace string, addr string, client client.Client, cacheClient cache.Cache) error {
+func startWebhook(ctx context.Context, namespace string, addr string, client client.Client, cacheClient cache.Cache, opts webhook.Options) error {
 	setupLog.Info("Setting up webhook listener")
-	handler, err := webhook.HandleHooks(ctx, namespace, client, cacheClient)
+	handler, err := webhook.HandleHooks(ctx, namespace, client, cacheClient, opts)
 	if err != nil {
 		return fmt.Errorf("webhook handler can't be created: %w", err)
 	}
@@ -6,8 +6,33 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RefDeletedCondition is true while the watched branch, or the tag of the current commit, is deleted in the git repo.
+const RefDeletedCondition = "RefDeleted"
+
+// HistoryRewrittenCondition is true while the latest commit of the watched branch doesn't descend from the last
+// executed commit, e.g. after a force-push. It is only checked if spec.git.historyRewritePolicy is set.
+const HistoryRewrittenCondition = "HistoryRewritten"
+
+// HostKeyUnknownCondition is true while the SSH host of the repo offers a host key, which is not known. Its message
+// contains the fingerprint of the offered key and the known_hosts line approving it.
+const HostKeyUnknownCondition = "HostKeyUnknown"
+
+// Values of spec.git.historyRewritePolicy
+const (
+	// HistoryRewriteAllow records the rewrite in the status and runs the job
+	HistoryRewriteAllow = "allow"
+	// HistoryRewriteBlock doesn't run the job for the rewritten commit until it is acknowledged with the
+	// AcknowledgeHistoryRewriteAnnotation
+	HistoryRewriteBlock = "block"
+	// HistoryRewriteAlert runs the job and emits a warning event
+	HistoryRewriteAlert = "alert"
+)
+
+// AcknowledgeHistoryRewriteAnnotation unblocks the job of a rewritten commit, if its value is the new commit SHA.
+const AcknowledgeHistoryRewriteAnnotation = "gitjob.cattle.io/acknowledge-history-rewrite"
+
 func init() {
-	SchemeBuilder.Register(&GitJob{}, &GitJobList{})
+	SchemeBuilder.Register(&GitJob{}, &GitJobList{}, &SecretGrant{}, &SecretGrantList{})
 }
 
 // +kubebuilder:object:root=true
@@ -36,7 +61,8 @@ type GithubMeta struct {
 	// Github webhook ID. Internal use only. If not empty, means a webhook is created along with this CR
 	HookID string `json:"hookId,omitempty"`
 
-	// Github webhook validation token to validate requests that are only coming from github
+	// Webhook validation token to validate requests that are only coming from the git provider. Read from the secret
+	// referenced by spec.webhookSecretName
 	ValidationToken string `json:"secretToken,omitempty"`
 
 	// Last received github webhook event
@@ -50,20 +76,34 @@ type GitJobSpec struct {
 	// Job template applied to git commit
 	JobSpec v1.JobSpec `json:"jobSpec,omitempty"`
 
+	// CleanupJobSpec is the template of a job which runs once when the watched branch, or the tag of the current
+	// commit, is deleted. The repo is not cloned, the deleted ref and its last commit are passed in the DELETED_REF and
+	// DELETED_COMMIT env vars
+	CleanupJobSpec *v1.JobSpec `json:"cleanupJobSpec,omitempty"`
+
 	// define interval(in seconds) for controller to sync repo and fetch commits
 	SyncInterval int `json:"syncInterval,omitempty"`
 
 	// ForceUpdate is a timestamp where can be set to do a force re-sync. If it is after the last synced timestamp and before the current timestamp it will be re-synced
 	ForceUpdateGeneration int64 `json:"forceUpdateGeneration,omitempty"`
+
+	// WebhookSecretName is the name of a secret in the GitJob's namespace, whose "token" key validates webhook
+	// deliveries to /hooks/<namespace>/<name>. Deliveries to the global endpoint are ignored for this GitJob
+	WebhookSecretName string `json:"webhookSecretName,omitempty"`
 }
 
 type GitInfo struct {
 	// Git credential metadata
 	Credential `json:",inline"`
 
-	// Git provider model to fetch commit. Can be polling(regular git fetch)/webhook(github webhook)
+	// Git provider whose API is used to check for new commits before listing all refs of the repo. One of github,
+	// gitlab, gitea, gogs, bitbucket, bitbucket-server or azure-devops. Autodetected for well known hosts if empty
 	Provider string `json:"provider,omitempty"`
 
+	// ProviderAPIURL is the base URL of the provider's API, e.g. https://github.example.com/api/v3. Defaults to the
+	// API of the repo's host
+	ProviderAPIURL string `json:"providerAPIURL,omitempty"`
+
 	// Git repo URL
 	Repo string `json:"repo,omitempty" column:"name=REPO,type=string,jsonpath=.spec.git.repo"`
 
@@ -73,8 +113,41 @@ type GitInfo struct {
 	// Git branch to watch. Default to master
 	Branch string `json:"branch,omitempty" column:"name=BRANCH,type=string,jsonpath=.spec.git.branch"`
 
+	// BranchPattern watches every branch matching the pattern and runs the job for each of them independently.
+	// It is a glob like "release/*", or a regular expression if prefixed with "regexp:". Both match the whole branch
+	// name. Takes precedence over Branch.
+	BranchPattern string `json:"branchPattern,omitempty"`
+
 	// Semver matching for incoming tag event
 	OnTag string `json:"onTag,omitempty"`
+
+	// ProtocolV2 lists only the refs needed when polling, using ls-refs of the git protocol v2. Falls back to the
+	// protocol v0 if the server doesn't support it. Defaults to the --git-protocol-v2 flag of the controller
+	ProtocolV2 *bool `json:"protocolV2,omitempty"`
+
+	// PullRequest configures jobs for pull/merge request events received via webhook
+	PullRequest PullRequestInfo `json:"pullRequest,omitempty"`
+
+	// HistoryRewritePolicy checks whether new commits of the watched branch descend from the last executed commit.
+	// One of allow, block or alert. A rewritten history, e.g. after a force-push, is reported in the HistoryRewritten
+	// condition. It is not checked if empty
+	// +kubebuilder:validation:Enum=allow;block;alert
+	HistoryRewritePolicy string `json:"historyRewritePolicy,omitempty"`
+}
+
+type PullRequestInfo struct {
+	// Enabled runs a job for every opened or updated pull request of the repo
+	Enabled bool `json:"enabled,omitempty"`
+
+	// BaseBranch only handles pull requests targeting this branch. Defaults to all branches
+	BaseBranch string `json:"baseBranch,omitempty"`
+
+	// Teardown runs a last job with PULL_REQUEST_ACTION=closed when a pull request is closed
+	Teardown bool `json:"teardown,omitempty"`
+
+	// AllowForks runs jobs for pull requests from forks of the repo. Their jobs run untrusted code with the credential
+	// of the GitJob. Pull requests from forks are ignored if false
+	AllowForks bool `json:"allowForks,omitempty"`
 }
 
 type Credential struct {
@@ -86,6 +159,25 @@ type Credential struct {
 
 	// Secret Name of git credential
 	ClientSecretName string `json:"clientSecretName,omitempty"`
+
+	// ClientSecretRef references the secret of the git credential, which can be in another namespace than the gitjob.
+	// It takes precedence over ClientSecretName
+	ClientSecretRef *SecretReference `json:"clientSecretRef,omitempty"`
+
+	// StrictHostKeyChecking refuses to connect to SSH hosts, whose host key is neither in the known_hosts of the
+	// secret nor in the known hosts ConfigMap of the controller. Defaults to the --strict-host-key-checking flag of the
+	// controller
+	StrictHostKeyChecking *bool `json:"strictHostKeyChecking,omitempty"`
+}
+
+// SecretReference references a secret, which is in the namespace of the gitjob unless a namespace is set.
+type SecretReference struct {
+	// Name of the secret
+	Name string `json:"name"`
+
+	// Namespace of the secret. Defaults to the namespace of the gitjob. A secret in another namespace must be granted to
+	// the namespace of the gitjob by a SecretGrant in the namespace of the secret
+	Namespace string `json:"namespace,omitempty"`
 }
 
 type GitJobStatus struct {
@@ -102,6 +194,91 @@ type GitJobStatus struct {
 
 	// Condition of the resource
 	Conditions []genericcondition.GenericCondition `json:"conditions,omitempty"`
+
+	// Branches matching spec.git.branchPattern and their commits
+	Branches []BranchStatus `json:"branches,omitempty"`
+
+	// Pull requests received via webhook when spec.git.pullRequest is enabled
+	PullRequests []PullRequestStatus `json:"pullRequests,omitempty"`
+
+	// Last time the git repo was polled. The result is reported in the GitPolling condition. The poll times of an
+	// unchanged result are updated at most every 10 minutes
+	LastPollTime metav1.Time `json:"lastPollTime,omitempty"`
+
+	// Next time the git repo will be polled. The poll interval is backed off exponentially while polling fails
+	NextPollTime metav1.Time `json:"nextPollTime,omitempty"`
+
+	// Number of consecutive failed polls, reset by a successful poll
+	PollFailures int `json:"pollFailures,omitempty"`
+
+	// DeletedRef is the watched branch, or the tag of the current commit, if it was deleted in the git repo. It is
+	// cleared when the ref is pushed again or the spec changes. A deleted branch is polled every 10 minutes, or every
+	// syncInterval if longer
+	DeletedRef *DeletedRefStatus `json:"deletedRef,omitempty"`
+
+	// HistoryRewrite is the latest rewrite of the watched branch's history, if the current commit doesn't descend
+	// from the last executed commit
+	HistoryRewrite *HistoryRewriteStatus `json:"historyRewrite,omitempty"`
+}
+
+type HistoryRewriteStatus struct {
+	// The last executed commit SHA, which is not an ancestor of NewCommit
+	OldCommit string `json:"oldCommit"`
+
+	// The commit SHA which rewrote the history
+	NewCommit string `json:"newCommit"`
+}
+
+type DeletedRefStatus struct {
+	// Ref which was deleted, e.g. refs/heads/main
+	Ref string `json:"ref"`
+
+	// The commit SHA of the ref before it was deleted, if sent by the git provider
+	Commit string `json:"commit,omitempty"`
+
+	// Status of the cleanup job
+	JobStatus string `json:"jobStatus,omitempty"`
+}
+
+type BranchStatus struct {
+	// Branch name
+	Name string `json:"name"`
+
+	// The latest commit SHA received for this branch
+	Commit string `json:"commit,omitempty"`
+
+	// Last executed commit SHA for this branch
+	LastExecutedCommit string `json:"lastExecutedCommit,omitempty"`
+
+	// Status of the job launched for this branch
+	JobStatus string `json:"jobStatus,omitempty"`
+}
+
+type PullRequestStatus struct {
+	// Pull request number
+	Number int `json:"number"`
+
+	// The latest commit SHA of the pull request head. Gogs doesn't send it, so jobs of Gogs pull requests aren't
+	// re-run when they are updated
+	HeadCommit string `json:"headCommit,omitempty"`
+
+	// Branch of the pull request head
+	HeadBranch string `json:"headBranch,omitempty"`
+
+	// Repo URL of the pull request head, if it differs from the GitJob repo
+	HeadRepo string `json:"headRepo,omitempty"`
+
+	// Branch the pull request targets
+	BaseBranch string `json:"baseBranch,omitempty"`
+
+	// Closed is true once the pull request was closed or merged
+	Closed bool `json:"closed,omitempty"`
+
+	// Last executed commit SHA for this pull request
+	LastExecutedCommit string `json:"lastExecutedCommit,omitempty"`
+
+	// Status of the job launched for this pull request
+	JobStatus string `json:"jobStatus,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -112,3 +289,40 @@ type GitJobList struct {
 	metav1.ListMeta `json:"metadata,omitempty"`
 	Items           []GitJob `json:"items"`
 }
+
+// +kubebuilder:object:root=true
+
+// SecretGrant allows gitjobs of other namespaces to reference secrets in the namespace of the grant as their git
+// credential, similar to a ReferenceGrant of the Gateway API.
+type SecretGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              SecretGrantSpec `json:"spec,omitempty"`
+}
+
+type SecretGrantSpec struct {
+	// From lists the namespaces, whose gitjobs may reference the granted secrets
+	From []SecretGrantFrom `json:"from"`
+
+	// To lists the granted secrets. All secrets in the namespace of the grant are granted if empty
+	To []SecretGrantTo `json:"to,omitempty"`
+}
+
+type SecretGrantFrom struct {
+	// Namespace of the gitjobs
+	Namespace string `json:"namespace"`
+}
+
+type SecretGrantTo struct {
+	// Name of the secret
+	Name string `json:"name"`
+}
+
+// +kubebuilder:object:root=true
+
+// SecretGrantList contains a list of SecretGrant
+type SecretGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SecretGrant `json:"items"`
+}
@@ -22,9 +22,25 @@ package v1
 
 import (
 	"github.com/rancher/wrangler/v2/pkg/genericcondition"
+	batchv1 "k8s.io/api/batch/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BranchStatus) DeepCopyInto(out *BranchStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BranchStatus.
+func (in *BranchStatus) DeepCopy() *BranchStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BranchStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Credential) DeepCopyInto(out *Credential) {
 	*out = *in
@@ -33,6 +49,16 @@ func (in *Credential) DeepCopyInto(out *Credential) {
 		*out = make([]byte, len(*in))
 		copy(*out, *in)
 	}
+	if in.ClientSecretRef != nil {
+		in, out := &in.ClientSecretRef, &out.ClientSecretRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+	if in.StrictHostKeyChecking != nil {
+		in, out := &in.StrictHostKeyChecking, &out.StrictHostKeyChecking
+		*out = new(bool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Credential.
@@ -45,6 +71,21 @@ func (in *Credential) DeepCopy() *Credential {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeletedRefStatus) DeepCopyInto(out *DeletedRefStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeletedRefStatus.
+func (in *DeletedRefStatus) DeepCopy() *DeletedRefStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DeletedRefStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitEvent) DeepCopyInto(out *GitEvent) {
 	*out = *in
@@ -66,6 +107,12 @@ func (in *GitEvent) DeepCopy() *GitEvent {
 func (in *GitInfo) DeepCopyInto(out *GitInfo) {
 	*out = *in
 	in.Credential.DeepCopyInto(&out.Credential)
+	if in.ProtocolV2 != nil {
+		in, out := &in.ProtocolV2, &out.ProtocolV2
+		*out = new(bool)
+		**out = **in
+	}
+	out.PullRequest = in.PullRequest
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitInfo.
@@ -142,6 +189,11 @@ func (in *GitJobSpec) DeepCopyInto(out *GitJobSpec) {
 	*out = *in
 	in.Git.DeepCopyInto(&out.Git)
 	in.JobSpec.DeepCopyInto(&out.JobSpec)
+	if in.CleanupJobSpec != nil {
+		in, out := &in.CleanupJobSpec, &out.CleanupJobSpec
+		*out = new(batchv1.JobSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitJobSpec.
@@ -163,6 +215,28 @@ func (in *GitJobStatus) DeepCopyInto(out *GitJobStatus) {
 		*out = make([]genericcondition.GenericCondition, len(*in))
 		copy(*out, *in)
 	}
+	if in.Branches != nil {
+		in, out := &in.Branches, &out.Branches
+		*out = make([]BranchStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.PullRequests != nil {
+		in, out := &in.PullRequests, &out.PullRequests
+		*out = make([]PullRequestStatus, len(*in))
+		copy(*out, *in)
+	}
+	in.LastPollTime.DeepCopyInto(&out.LastPollTime)
+	in.NextPollTime.DeepCopyInto(&out.NextPollTime)
+	if in.DeletedRef != nil {
+		in, out := &in.DeletedRef, &out.DeletedRef
+		*out = new(DeletedRefStatus)
+		**out = **in
+	}
+	if in.HistoryRewrite != nil {
+		in, out := &in.HistoryRewrite, &out.HistoryRewrite
+		*out = new(HistoryRewriteStatus)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitJobStatus.
@@ -189,3 +263,176 @@ func (in *GithubMeta) DeepCopy() *GithubMeta {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HistoryRewriteStatus) DeepCopyInto(out *HistoryRewriteStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HistoryRewriteStatus.
+func (in *HistoryRewriteStatus) DeepCopy() *HistoryRewriteStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(HistoryRewriteStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullRequestInfo) DeepCopyInto(out *PullRequestInfo) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullRequestInfo.
+func (in *PullRequestInfo) DeepCopy() *PullRequestInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(PullRequestInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullRequestStatus) DeepCopyInto(out *PullRequestStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullRequestStatus.
+func (in *PullRequestStatus) DeepCopy() *PullRequestStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PullRequestStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretGrant) DeepCopyInto(out *SecretGrant) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretGrant.
+func (in *SecretGrant) DeepCopy() *SecretGrant {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretGrant)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SecretGrant) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretGrantFrom) DeepCopyInto(out *SecretGrantFrom) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretGrantFrom.
+func (in *SecretGrantFrom) DeepCopy() *SecretGrantFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretGrantFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretGrantList) DeepCopyInto(out *SecretGrantList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SecretGrant, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretGrantList.
+func (in *SecretGrantList) DeepCopy() *SecretGrantList {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretGrantList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SecretGrantList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretGrantSpec) DeepCopyInto(out *SecretGrantSpec) {
+	*out = *in
+	if in.From != nil {
+		in, out := &in.From, &out.From
+		*out = make([]SecretGrantFrom, len(*in))
+		copy(*out, *in)
+	}
+	if in.To != nil {
+		in, out := &in.To, &out.To
+		*out = make([]SecretGrantTo, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretGrantSpec.
+func (in *SecretGrantSpec) DeepCopy() *SecretGrantSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretGrantSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretGrantTo) DeepCopyInto(out *SecretGrantTo) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretGrantTo.
+func (in *SecretGrantTo) DeepCopy() *SecretGrantTo {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretGrantTo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReference) DeepCopyInto(out *SecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReference.
+func (in *SecretReference) DeepCopy() *SecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/wrangler/v2/pkg/name"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	gitJobLabel      = "gitjob.cattle.io/gitjob"
+	branchLabel      = "gitjob.cattle.io/branch"
+	branchAnnotation = "branch"
+)
+
+var invalidLabelValueChars = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+
+// reconcileBranches runs one job per branch listed in the status of a GitJob with a branchPattern, and deletes the
+// jobs of branches which are no longer present.
+func (r *GitJobReconciler) reconcileBranches(ctx context.Context, gitJob *v1.GitJob) (ctrl.Result, error) {
+	var jobList batchv1.JobList
+	if err := r.List(ctx, &jobList, client.InNamespace(gitJob.Namespace), client.MatchingLabels{gitJobLabel: gitJob.Name}, client.HasLabels{branchLabel}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("error listing branch jobs: %v", err)
+	}
+
+	forceUpdate := gitJob.Spec.ForceUpdateGeneration != gitJob.Status.UpdateGeneration
+	generationChanged := gitJob.Generation != gitJob.Status.ObservedGeneration
+	branches := map[string]bool{}
+	for i := range gitJob.Status.Branches {
+		branches[gitJob.Status.Branches[i].Name] = true
+	}
+
+	jobs := map[string]*batchv1.Job{}
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if !metav1.IsControlledBy(job, gitJob) {
+			continue
+		}
+		if !branches[job.Annotations[branchAnnotation]] || forceUpdate || generationChanged {
+			r.Log.Info("branch job deletion triggered", "job", job.Name, "branch", job.Annotations[branchAnnotation])
+			if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+				return ctrl.Result{}, fmt.Errorf("error deleting job: %v", err)
+			}
+			continue
+		}
+		jobs[job.Name] = job
+	}
+	gitJob.Status.UpdateGeneration = gitJob.Spec.ForceUpdateGeneration
+
+	for i := range gitJob.Status.Branches {
+		branch := &gitJob.Status.Branches[i]
+		if branch.Commit == "" {
+			continue
+		}
+		job, found := jobs[branchJobName(gitJob, branch)]
+		if !found {
+			if forceUpdate || generationChanged {
+				// jobs are recreated once the deletion triggered above has been observed
+				continue
+			}
+			if err := r.createBranchJob(ctx, gitJob, branch); err != nil {
+				return ctrl.Result{}, fmt.Errorf("error creating job for branch %s: %v", branch.Name, err)
+			}
+			continue
+		}
+		if rerun, err := r.rerunFailedJob(ctx, gitJob, job); err != nil {
+			return ctrl.Result{}, fmt.Errorf("error deleting failed job for branch %s: %v", branch.Name, err)
+		} else if rerun {
+			// the job is created again once its deletion has been observed
+			continue
+		}
+
+		result, err := computeJobStatus(job)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		branch.JobStatus = result.Status.String()
+		if result.Status == status.CurrentStatus && strings.Contains(result.Message, "Job Completed") {
+			branch.LastExecutedCommit = job.Annotations["commit"]
+		}
+	}
+
+	gitJob.Status.ObservedGeneration = gitJob.Generation
+	gitJob.Status.LastSyncedTime = metav1.Now()
+	if err := r.Status().Update(ctx, gitJob); err != nil {
+		if errors.IsConflict(err) {
+			r.Log.Info("conflict updating status", "message", err)
+			return ctrl.Result{Requeue: true}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("error updating gitjob status: %v", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *GitJobReconciler) createBranchJob(ctx context.Context, gitJob *v1.GitJob, branch *v1.BranchStatus) error {
+	job, err := r.newBranchJob(ctx, gitJob, branch)
+	if err != nil {
+		return err
+	}
+	if err := controllerutil.SetControllerReference(gitJob, job, r.Scheme); err != nil {
+		return err
+	}
+
+	return r.Create(ctx, job)
+}
+
+// newBranchJob creates the job for a single branch of a GitJob with a branchPattern. The job is labelled with the
+// GitJob and branch it belongs to, and gets the branch name in the BRANCH env var.
+func (r *GitJobReconciler) newBranchJob(ctx context.Context, gitJob *v1.GitJob, branch *v1.BranchStatus) (*batchv1.Job, error) {
+	branchGitJob := gitJob.DeepCopy()
+	branchGitJob.Spec.Git.Branch = branch.Name
+	branchGitJob.Status.Commit = branch.Commit
+
+	job, err := r.newJob(ctx, branchGitJob)
+	if err != nil {
+		return nil, err
+	}
+	job.Name = branchJobName(gitJob, branch)
+	job.Labels = map[string]string{
+		gitJobLabel: gitJob.Name,
+		branchLabel: branchLabelValue(branch.Name),
+	}
+	job.Annotations[branchAnnotation] = branch.Name
+	for i := range job.Spec.Template.Spec.Containers {
+		job.Spec.Template.Spec.Containers[i].Env = append(job.Spec.Template.Spec.Containers[i].Env, corev1.EnvVar{
+			Name:  "BRANCH",
+			Value: branch.Name,
+		})
+	}
+
+	return job, nil
+}
+
+// branchCommitsChanged returns true if a branch was added, removed or got a new commit.
+func branchCommitsChanged(oldBranches, newBranches []v1.BranchStatus) bool {
+	if len(oldBranches) != len(newBranches) {
+		return true
+	}
+	commits := map[string]string{}
+	for _, branch := range oldBranches {
+		commits[branch.Name] = branch.Commit
+	}
+	for _, branch := range newBranches {
+		if commit, ok := commits[branch.Name]; !ok || commit != branch.Commit {
+			return true
+		}
+	}
+
+	return false
+}
+
+func branchJobName(obj *v1.GitJob, branch *v1.BranchStatus) string {
+	return name.SafeConcatName(obj.Name, name.Hex(obj.Spec.Git.Repo+branch.Name+branch.Commit, 5))
+}
+
+// branchLabelValue converts a branch name into a valid label value, e.g. "release/v1" into "release-v1".
+func branchLabelValue(branch string) string {
+	value := name.Limit(invalidLabelValueChars.ReplaceAllString(branch, "-"), 63)
+
+	return strings.TrimFunc(value, func(r rune) bool {
+		return r == '-' || r == '_' || r == '.'
+	})
+}
@@ -0,0 +1,331 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
+	"github.com/rancher/gitjob/pkg/sshauth"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// credentialSecretIndex indexes gitjobs by the names of the secrets they read their credential from.
+	credentialSecretIndex = "spec.git.credentialSecrets"
+	// webhookSecretIndex indexes gitjobs by the namespace/name key of their webhook secret.
+	webhookSecretIndex = "spec.webhookSecretName"
+	// secretRefNamespaceIndex indexes gitjobs by the namespace of their credential secret, if it is in another
+	// namespace.
+	secretRefNamespaceIndex = "spec.git.clientSecretRef.namespace"
+	// credentialVersionAnnotation stores the resource versions of the credential secrets a job was created with.
+	credentialVersionAnnotation = "credential-version"
+	// projectedFromAnnotation is the namespace/name of the secret in another namespace, which a projected secret was
+	// copied from.
+	projectedFromAnnotation = "gitjob.cattle.io/projected-from"
+)
+
+// credentialSecrets returns the secrets, which contain the credential and CA bundle of the gitjob. The credential
+// can be in another namespace.
+func credentialSecrets(gitJob *v1.GitJob) []types.NamespacedName {
+	var secrets []types.NamespacedName
+	if secretKey := git.ClientSecretKey(gitJob); secretKey.Name != "" {
+		secrets = append(secrets, secretKey)
+	}
+	if gitJob.Spec.Git.CABundle != nil {
+		secrets = append(secrets, types.NamespacedName{Namespace: gitJob.Namespace, Name: caBundleName(gitJob)})
+	}
+
+	return secrets
+}
+
+// indexCredentialSecrets indexes gitjobs by the namespace/name keys of their credential secrets. Gitjobs without a
+// credential secret are indexed by the default secret, which is used for polling instead.
+func indexCredentialSecrets(obj client.Object) []string {
+	gitJob, ok := obj.(*v1.GitJob)
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, secret := range credentialSecrets(gitJob) {
+		keys = append(keys, secret.String())
+	}
+	if git.ClientSecretKey(gitJob).Name == "" {
+		keys = append(keys, types.NamespacedName{Namespace: gitJob.Namespace, Name: git.DefaultSecretName}.String())
+	}
+
+	return keys
+}
+
+// indexWebhookSecret indexes gitjobs by the namespace/name key of their webhook secret.
+func indexWebhookSecret(obj client.Object) []string {
+	gitJob, ok := obj.(*v1.GitJob)
+	if !ok || gitJob.Spec.WebhookSecretName == "" {
+		return nil
+	}
+
+	return []string{types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Spec.WebhookSecretName}.String()}
+}
+
+// indexSecretRefNamespace indexes gitjobs by the namespace of their credential secret, if it is in another namespace.
+func indexSecretRefNamespace(obj client.Object) []string {
+	gitJob, ok := obj.(*v1.GitJob)
+	if !ok {
+		return nil
+	}
+	secretKey := git.ClientSecretKey(gitJob)
+	if secretKey.Name == "" || secretKey.Namespace == gitJob.Namespace {
+		return nil
+	}
+
+	return []string{secretKey.Namespace}
+}
+
+// secretDataChangedPredicate ignores updates of secrets, which don't change their type or data.
+func secretDataChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldSecret, ok := e.ObjectOld.(*corev1.Secret)
+			if !ok {
+				return true
+			}
+			newSecret, ok := e.ObjectNew.(*corev1.Secret)
+			if !ok {
+				return true
+			}
+
+			return oldSecret.Type != newSecret.Type || !reflect.DeepEqual(oldSecret.Data, newSecret.Data)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// gitJobsForSecret returns the gitjobs whose credential or webhook token is read from the secret. The repos of gitjobs
+// using it as credential are polled right away, so a fixed credential is used without waiting for the next poll.
+// Reconciling the gitjobs updates their webhook validation token.
+func (r *GitJobReconciler) gitJobsForSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	var gitJobs v1.GitJobList
+	secretKey := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	if err := r.List(ctx, &gitJobs, client.MatchingFields{credentialSecretIndex: secretKey.String()}); err != nil {
+		r.Log.Error(err, "error listing gitjobs of secret", "secret", obj.GetName(), "namespace", obj.GetNamespace())
+		return nil
+	}
+	var webhookGitJobs v1.GitJobList
+	if err := r.List(ctx, &webhookGitJobs, client.InNamespace(secretKey.Namespace), client.MatchingFields{webhookSecretIndex: secretKey.String()}); err != nil {
+		r.Log.Error(err, "error listing gitjobs of webhook secret", "secret", obj.GetName(), "namespace", obj.GetNamespace())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(gitJobs.Items)+len(webhookGitJobs.Items))
+	queued := map[types.NamespacedName]bool{}
+	for _, gitJob := range gitJobs.Items {
+		r.Log.Info("credential secret changed", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "secret", obj.GetName())
+		r.GitPoller.PollGitRepoWatch(ctx, gitJob)
+		key := types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Name}
+		queued[key] = true
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	for _, gitJob := range webhookGitJobs.Items {
+		key := types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Name}
+		if queued[key] {
+			continue
+		}
+		r.Log.Info("webhook secret changed", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "secret", obj.GetName())
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+
+	return requests
+}
+
+// gitJobsForSecretGrant returns the gitjobs whose credential secret is in the namespace of the SecretGrant. Their
+// repos are polled right away, so a granted secret is used and a revoked one is refused without waiting for the next
+// poll. Reconciling the gitjobs deletes the projections of revoked secrets.
+func (r *GitJobReconciler) gitJobsForSecretGrant(ctx context.Context, obj client.Object) []reconcile.Request {
+	var gitJobs v1.GitJobList
+	if err := r.List(ctx, &gitJobs, client.MatchingFields{secretRefNamespaceIndex: obj.GetNamespace()}); err != nil {
+		r.Log.Error(err, "error listing gitjobs of secret grant", "secretgrant", obj.GetName(), "namespace", obj.GetNamespace())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(gitJobs.Items))
+	for _, gitJob := range gitJobs.Items {
+		r.Log.Info("secret grant changed", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "secretgrant", obj.GetName())
+		r.GitPoller.PollGitRepoWatch(ctx, gitJob)
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Name}})
+	}
+
+	return requests
+}
+
+// credentialVersion returns the resource versions of the existing credential secrets of the gitjob.
+func (r *GitJobReconciler) credentialVersion(ctx context.Context, gitJob *v1.GitJob) (string, error) {
+	var versions []string
+	for _, secretKey := range credentialSecrets(gitJob) {
+		var secret corev1.Secret
+		err := r.Get(ctx, secretKey, &secret)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		versions = append(versions, secretKey.String()+"="+secret.ResourceVersion)
+	}
+
+	return strings.Join(versions, ","), nil
+}
+
+// rerunFailedJob deletes the job if it failed and a credential secret changed since it was created, so the job is
+// created again with the new credential. Jobs created without the credential version are kept, as it is unknown
+// whether their credential changed. It returns whether the job was deleted.
+func (r *GitJobReconciler) rerunFailedJob(ctx context.Context, gitJob *v1.GitJob, job *batchv1.Job) (bool, error) {
+	if !r.RerunFailedJobs || !jobFailed(job) {
+		return false, nil
+	}
+	jobVersion, ok := job.Annotations[credentialVersionAnnotation]
+	if !ok {
+		return false, nil
+	}
+	version, err := r.credentialVersion(ctx, gitJob)
+	if err != nil {
+		return false, err
+	}
+	if jobVersion == version {
+		return false, nil
+	}
+
+	r.Log.Info("failed job deletion triggered because of credential change", "job", job.Name, "namespace", job.Namespace)
+	if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	result, err := computeJobStatus(job)
+	if err != nil {
+		return false
+	}
+
+	return result.Status == status.FailedStatus
+}
+
+// credentialVolumeSecretName returns the name of the secret, which is mounted into the job as the git credential. A
+// secret in another namespace than the gitjob can't be mounted, so its projection is mounted instead.
+func credentialVolumeSecretName(gitJob *v1.GitJob) string {
+	secretKey := git.ClientSecretKey(gitJob)
+	if secretKey.Name == "" || secretKey.Namespace == gitJob.Namespace {
+		return secretKey.Name
+	}
+
+	return projectedSecretName(gitJob)
+}
+
+func projectedSecretName(gitJob *v1.GitJob) string {
+	return fmt.Sprintf("%s-git-credential", gitJob.Name)
+}
+
+// projectSecret copies the secret from another namespace into the namespace of the gitjob, which owns the copy. A
+// secret of the same name, which isn't controlled by the gitjob, is not overwritten. The type of a secret is
+// immutable, so a copy of another type is replaced.
+func (r *GitJobReconciler) projectSecret(ctx context.Context, gitJob *v1.GitJob, secret *corev1.Secret) error {
+	key := types.NamespacedName{Namespace: gitJob.Namespace, Name: projectedSecretName(gitJob)}
+	var existing corev1.Secret
+	err := r.Get(ctx, key, &existing)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		// the annotation can be set by anyone, only the controller reference proves the secret is a projection
+		if !metav1.IsControlledBy(&existing, gitJob) {
+			return fmt.Errorf("secret %s exists and is not a projection of the gitjob", key)
+		}
+		if existing.Type == secret.Type {
+			if err := r.setProjection(gitJob, &existing, secret); err != nil {
+				return err
+			}
+			return r.Update(ctx, &existing)
+		}
+		if err := r.Delete(ctx, &existing); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	projected := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+	if err := r.setProjection(gitJob, projected, secret); err != nil {
+		return err
+	}
+
+	return r.Create(ctx, projected)
+}
+
+func (r *GitJobReconciler) setProjection(gitJob *v1.GitJob, projected *corev1.Secret, secret *corev1.Secret) error {
+	if projected.Annotations == nil {
+		projected.Annotations = map[string]string{}
+	}
+	projected.Annotations[projectedFromAnnotation] = secret.Namespace + "/" + secret.Name
+	projected.Type = secret.Type
+	projected.Data = secret.Data
+
+	return controllerutil.SetControllerReference(gitJob, projected, r.Scheme)
+}
+
+// deleteRevokedProjection deletes the projected secret of the gitjob, once its credential secret is in the namespace
+// of the gitjob, or is no longer granted to it.
+func (r *GitJobReconciler) deleteRevokedProjection(ctx context.Context, gitJob *v1.GitJob) error {
+	secretKey := git.ClientSecretKey(gitJob)
+	if secretKey.Name != "" && secretKey.Namespace != gitJob.Namespace {
+		err := git.CheckSecretGrant(ctx, r.Client, gitJob, secretKey)
+		if err == nil {
+			return nil
+		} else if git.ErrorReason(err) != git.ReasonSecretNotGranted {
+			return err
+		}
+	}
+
+	var projected corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Namespace: gitJob.Namespace, Name: projectedSecretName(gitJob)}, &projected)
+	if errors.IsNotFound(err) || (err == nil && !metav1.IsControlledBy(&projected, gitJob)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	r.Log.Info("deleting projected secret", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "secret", projected.Name)
+	if err := r.Delete(ctx, &projected); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// projectKnownHosts copies the known hosts of the controller into a secret in the namespace of the gitjob, which
+// owns the copy. A secret of the same name, which isn't owned by the gitjob, is not overwritten.
+func (r *GitJobReconciler) projectKnownHosts(ctx context.Context, gitJob *v1.GitJob, knownHosts []byte) error {
+	projected := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: gitJob.Namespace, Name: knownHostsName(gitJob)}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, projected, func() error {
+		if projected.ResourceVersion == "" || metav1.IsControlledBy(projected, gitJob) {
+			projected.Data = map[string][]byte{sshauth.KnownHostsKey: knownHosts}
+			return controllerutil.SetControllerReference(gitJob, projected, r.Scheme)
+		}
+		return fmt.Errorf("secret %s/%s exists and is not owned by the gitjob", projected.Namespace, projected.Name)
+	})
+
+	return err
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/wrangler/v2/pkg/name"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	cleanupLabel         = "gitjob.cattle.io/cleanup"
+	deletedRefAnnotation = "deleted-ref"
+)
+
+// reconcileDeletedRef runs the cleanup job of a GitJob whose watched ref was deleted, and reports its status. No other
+// jobs run until the ref is pushed again.
+func (r *GitJobReconciler) reconcileDeletedRef(ctx context.Context, gitJob *v1.GitJob) (ctrl.Result, error) {
+	if gitJob.Spec.CleanupJobSpec != nil {
+		var job batchv1.Job
+		err := r.Get(ctx, types.NamespacedName{Namespace: gitJob.Namespace, Name: cleanupJobName(gitJob)}, &job)
+		if err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, fmt.Errorf("error retrieving cleanup job: %v", err)
+		} else if errors.IsNotFound(err) {
+			if err := r.createCleanupJob(ctx, gitJob); err != nil {
+				return ctrl.Result{}, fmt.Errorf("error creating cleanup job: %v", err)
+			}
+		} else {
+			result, err := computeJobStatus(&job)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			gitJob.Status.DeletedRef.JobStatus = result.Status.String()
+		}
+	}
+
+	gitJob.Status.ObservedGeneration = gitJob.Generation
+	if err := r.Status().Update(ctx, gitJob); err != nil {
+		if errors.IsConflict(err) {
+			r.Log.Info("conflict updating status", "message", err)
+			return ctrl.Result{Requeue: true}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("error updating gitjob status: %v", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// deletedRefWatched returns whether the deleted ref in the status is still watched by the GitJob. It is not once the
+// spec changed, e.g. to watch another branch.
+func deletedRefWatched(gitJob *v1.GitJob) bool {
+	ref := gitJob.Status.DeletedRef.Ref
+	switch {
+	case gitJob.Generation != gitJob.Status.ObservedGeneration:
+		return false
+	case gitJob.Spec.Git.OnTag != "":
+		return strings.HasPrefix(ref, "refs/tags/")
+	case gitJob.Spec.Git.BranchPattern != "":
+		return false
+	}
+
+	return gitJob.Spec.Git.Branch != "" && ref == "refs/heads/"+gitJob.Spec.Git.Branch
+}
+
+func (r *GitJobReconciler) createCleanupJob(ctx context.Context, gitJob *v1.GitJob) error {
+	job := newCleanupJob(gitJob)
+	if err := controllerutil.SetControllerReference(gitJob, job, r.Scheme); err != nil {
+		return err
+	}
+
+	return r.Create(ctx, job)
+}
+
+// newCleanupJob creates the cleanup job for the deleted ref. The repo isn't cloned, as the ref doesn't exist anymore.
+func newCleanupJob(gitJob *v1.GitJob) *batchv1.Job {
+	deleted := gitJob.Status.DeletedRef
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"generation":         strconv.Itoa(int(gitJob.Generation)),
+				"commit":             deleted.Commit,
+				deletedRefAnnotation: deleted.Ref,
+			},
+			Labels: map[string]string{
+				gitJobLabel:  gitJob.Name,
+				cleanupLabel: "true",
+			},
+			Namespace: gitJob.Namespace,
+			Name:      cleanupJobName(gitJob),
+		},
+		Spec: *gitJob.Spec.CleanupJobSpec.DeepCopy(),
+	}
+	for i := range job.Spec.Template.Spec.Containers {
+		job.Spec.Template.Spec.Containers[i].Env = append(job.Spec.Template.Spec.Containers[i].Env,
+			corev1.EnvVar{Name: "DELETED_REF", Value: deleted.Ref},
+			corev1.EnvVar{Name: "DELETED_COMMIT", Value: deleted.Commit},
+		)
+		job.Spec.Template.Spec.Containers[i].Env = append(job.Spec.Template.Spec.Containers[i].Env, proxyEnvVars()...)
+	}
+
+	return job
+}
+
+// deletedRefChanged returns true if a ref was deleted, the deletion was cleared, or another ref was deleted.
+func deletedRefChanged(oldDeleted, newDeleted *v1.DeletedRefStatus) bool {
+	if oldDeleted == nil || newDeleted == nil {
+		return oldDeleted != newDeleted
+	}
+
+	return oldDeleted.Ref != newDeleted.Ref || oldDeleted.Commit != newDeleted.Commit
+}
+
+func cleanupJobName(obj *v1.GitJob) string {
+	return name.SafeConcatName(obj.Name, "cleanup", name.Hex(obj.Spec.Git.Repo+obj.Status.DeletedRef.Ref+obj.Status.DeletedRef.Commit, 5))
+}
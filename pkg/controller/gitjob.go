@@ -11,6 +11,10 @@ import (
 	"github.com/go-logr/logr"
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	"github.com/rancher/gitjob/pkg/httpauth"
+	"github.com/rancher/gitjob/pkg/sshauth"
 	"github.com/rancher/wrangler/v2/pkg/condition"
 	"github.com/rancher/wrangler/v2/pkg/kstatus"
 	"github.com/rancher/wrangler/v2/pkg/name"
@@ -22,12 +26,15 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
@@ -37,11 +44,16 @@ const (
 	gitCredentialVolumeName = "git-credential" // #nosec G101 this is not a credential
 	gitClonerVolumeName     = "git-cloner"
 	emptyDirVolumeName      = "git-cloner-empty-dir"
+	knownHostsVolumeName    = "known-hosts"
+
+	// webhookTokenKey is the key of the token in the secret referenced by spec.webhookSecretName
+	webhookTokenKey = "token"
 )
 
 type GitPoller interface {
 	AddOrModifyGitRepoWatch(ctx context.Context, gitJob v1.GitJob)
 	CleanUpWatches(ctx context.Context)
+	PollGitRepoWatch(ctx context.Context, gitJob v1.GitJob)
 }
 
 // CronJobReconciler reconciles a GitJob object
@@ -51,13 +63,31 @@ type GitJobReconciler struct {
 	Image     string
 	GitPoller GitPoller
 	Log       logr.Logger
+	Recorder  record.EventRecorder
+	// HostKeys configures the verification of SSH host keys by the gitcloner
+	HostKeys git.HostKeyOptions
+	// RerunFailedJobs creates failed jobs again, once a secret of their credential changed
+	RerunFailedJobs bool
 }
 
 func (r *GitJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.GitJob{}, credentialSecretIndex, indexCredentialSecrets); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.GitJob{}, webhookSecretIndex, indexWebhookSecret); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.GitJob{}, secretRefNamespaceIndex, indexSecretRefNamespace); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.GitJob{}).
 		WithEventFilter(generationOrCommitChangedPredicate()).
 		Owns(&batchv1.Job{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.gitJobsForSecret),
+			builder.WithPredicates(secretDataChangedPredicate())).
+		Watches(&v1.SecretGrant{}, handler.EnqueueRequestsFromMapFunc(r.gitJobsForSecretGrant)).
 		Complete(r)
 }
 
@@ -82,6 +112,35 @@ func (r *GitJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	r.GitPoller.AddOrModifyGitRepoWatch(ctx, gitJob)
 
+	if err := r.reconcileWebhookToken(ctx, &gitJob); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.deleteRevokedProjection(ctx, &gitJob); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if gitJob.Spec.Git.PullRequest.Enabled || len(gitJob.Status.PullRequests) > 0 {
+		if !gitJob.Spec.Git.PullRequest.Enabled {
+			gitJob.Status.PullRequests = nil
+		}
+		if err := r.reconcilePullRequests(ctx, &gitJob); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if gitJob.Status.DeletedRef != nil {
+		if deletedRefWatched(&gitJob) {
+			return r.reconcileDeletedRef(ctx, &gitJob)
+		}
+		// the status is updated below
+		git.ClearDeletedRef(&gitJob)
+	}
+
+	if gitJob.Spec.Git.BranchPattern != "" {
+		return r.reconcileBranches(ctx, &gitJob)
+	}
+
 	var job batchv1.Job
 	err := r.Get(ctx, types.NamespacedName{
 		Namespace: gitJob.Namespace,
@@ -91,10 +150,13 @@ func (r *GitJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, fmt.Errorf("error retrieving gitJob: %v", err)
 	}
 
-	if errors.IsNotFound(err) && gitJob.Status.Commit != "" {
+	if errors.IsNotFound(err) && gitJob.Status.Commit != "" && historyRewriteBlocked(&gitJob) {
+		r.Log.Info("job blocked by history rewrite", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "commit", gitJob.Status.Commit)
+	} else if errors.IsNotFound(err) && gitJob.Status.Commit != "" {
 		if err := r.createJob(ctx, &gitJob); err != nil {
 			return ctrl.Result{}, fmt.Errorf("error creating job: %v", err)
 		}
+		r.alertHistoryRewrite(&gitJob)
 	} else if gitJob.Status.Commit != "" {
 		if err = r.deleteJobIfNeeded(ctx, &gitJob, &job); err != nil {
 			return ctrl.Result{}, fmt.Errorf("error deleting job: %v", err)
@@ -112,6 +174,29 @@ func (r *GitJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	return ctrl.Result{}, nil
 }
 
+// reconcileWebhookToken stores the token of the secret referenced by spec.webhookSecretName in the status, which is
+// used by the webhook to validate deliveries to the GitJob's endpoint. The token is cleared if the secret is missing,
+// so deliveries are rejected instead of being accepted without validation.
+func (r *GitJobReconciler) reconcileWebhookToken(ctx context.Context, gitJob *v1.GitJob) error {
+	token := ""
+	if gitJob.Spec.WebhookSecretName != "" {
+		var secret corev1.Secret
+		err := r.Get(ctx, types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Spec.WebhookSecretName}, &secret)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		} else if errors.IsNotFound(err) {
+			r.Log.Info("webhook secret not found", "gitjob", gitJob.Name, "namespace", gitJob.Namespace, "secret", gitJob.Spec.WebhookSecretName)
+		}
+		token = string(secret.Data[webhookTokenKey])
+	}
+	if gitJob.Status.ValidationToken == token {
+		return nil
+	}
+
+	gitJob.Status.ValidationToken = token
+	return r.Status().Update(ctx, gitJob)
+}
+
 func generationOrCommitChangedPredicate() predicate.Predicate {
 	return predicate.Funcs{
 		UpdateFunc: func(e event.UpdateEvent) bool {
@@ -124,7 +209,11 @@ func generationOrCommitChangedPredicate() predicate.Predicate {
 				return true
 			}
 
-			return oldGitJob.Generation != newGitJob.Generation || oldGitJob.Status.Commit != newGitJob.Status.Commit
+			return oldGitJob.Generation != newGitJob.Generation || oldGitJob.Status.Commit != newGitJob.Status.Commit ||
+				branchCommitsChanged(oldGitJob.Status.Branches, newGitJob.Status.Branches) ||
+				pullRequestsChanged(oldGitJob.Status.PullRequests, newGitJob.Status.PullRequests) ||
+				deletedRefChanged(oldGitJob.Status.DeletedRef, newGitJob.Status.DeletedRef) ||
+				acknowledgedRewriteChanged(oldGitJob, newGitJob)
 		},
 	}
 }
@@ -156,13 +245,18 @@ func (r *GitJobReconciler) createJob(ctx context.Context, gitJob *v1.GitJob) err
 
 }
 
-func (r *GitJobReconciler) updateStatus(ctx context.Context, gitJob *v1.GitJob, job *batchv1.Job) error {
+func computeJobStatus(job *batchv1.Job) (*status.Result, error) {
 	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(job)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	uJob := &unstructured.Unstructured{Object: obj}
-	result, err := status.Compute(uJob)
+
+	return status.Compute(uJob)
+}
+
+func (r *GitJobReconciler) updateStatus(ctx context.Context, gitJob *v1.GitJob, job *batchv1.Job) error {
+	result, err := computeJobStatus(job)
 	if err != nil {
 		return err
 	}
@@ -228,7 +322,8 @@ func (r *GitJobReconciler) deleteJobIfNeeded(ctx context.Context, gitJob *v1.Git
 		}
 	}
 
-	return nil
+	_, err := r.rerunFailedJob(ctx, gitJob, job)
+	return err
 }
 
 func jobName(obj *v1.GitJob) string {
@@ -239,6 +334,10 @@ func caBundleName(obj *v1.GitJob) string {
 	return fmt.Sprintf("%s-cabundle", obj.Name)
 }
 
+func knownHostsName(obj *v1.GitJob) string {
+	return fmt.Sprintf("%s-known-hosts", obj.Name)
+}
+
 func (r *GitJobReconciler) newJob(ctx context.Context, obj *v1.GitJob) (*batchv1.Job, error) {
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -256,6 +355,13 @@ func (r *GitJobReconciler) newJob(ctx context.Context, obj *v1.GitJob) (*batchv1
 	if err != nil {
 		return nil, err
 	}
+	if r.RerunFailedJobs {
+		credentialVersion, err := r.credentialVersion(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		job.Annotations[credentialVersionAnnotation] = credentialVersion
+	}
 	job.Spec.Template.Spec.InitContainers = []corev1.Container{initContainer}
 	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes,
 		corev1.Volume{
@@ -282,19 +388,32 @@ func (r *GitJobReconciler) newJob(ctx context.Context, obj *v1.GitJob) (*batchv1
 		})
 	}
 
-	if obj.Spec.Git.ClientSecretName != "" {
+	if secretName := credentialVolumeSecretName(obj); secretName != "" {
 		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes,
 			corev1.Volume{
 				Name: gitCredentialVolumeName,
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						SecretName: obj.Spec.Git.ClientSecretName,
+						SecretName: secretName,
 					},
 				},
 			},
 		)
 	}
 
+	for _, mount := range initContainer.VolumeMounts {
+		if mount.Name == knownHostsVolumeName {
+			job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+				Name: knownHostsVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: knownHostsName(obj),
+					},
+				},
+			})
+		}
+	}
+
 	for i := range job.Spec.Template.Spec.Containers {
 		job.Spec.Template.Spec.Containers[i].VolumeMounts = append(job.Spec.Template.Spec.Containers[i].VolumeMounts, corev1.VolumeMount{
 			MountPath: "/workspace/source",
@@ -334,14 +453,19 @@ func (r *GitJobReconciler) generateInitContainer(ctx context.Context, obj *v1.Gi
 		args = append(args, "--revision", obj.Spec.Git.Revision)
 	}
 
-	if obj.Spec.Git.ClientSecretName != "" {
+	if secretKey := git.ClientSecretKey(obj); secretKey.Name != "" {
+		if err := git.CheckSecretGrant(ctx, r.Client, obj, secretKey); err != nil {
+			return corev1.Container{}, err
+		}
 		var secret corev1.Secret
-		if err := r.Get(ctx, types.NamespacedName{
-			Namespace: obj.Namespace,
-			Name:      obj.Spec.Git.ClientSecretName,
-		}, &secret); err != nil {
+		if err := r.Get(ctx, secretKey, &secret); err != nil {
 			return corev1.Container{}, err
 		}
+		if secretKey.Namespace != obj.Namespace {
+			if err := r.projectSecret(ctx, obj, &secret); err != nil {
+				return corev1.Container{}, err
+			}
+		}
 
 		if secret.Type == corev1.SecretTypeBasicAuth {
 			volumeMounts = append(volumeMounts, corev1.VolumeMount{
@@ -356,10 +480,75 @@ func (r *GitJobReconciler) generateInitContainer(ctx context.Context, obj *v1.Gi
 				MountPath: "/gitjob/ssh",
 			})
 			args = append(args, "--ssh-private-key-file", "/gitjob/ssh/"+corev1.SSHAuthPrivateKey)
-			knownHosts := secret.Data["known_hosts"]
+			if secret.Data[sshauth.PassphraseKey] != nil {
+				args = append(args, "--ssh-passphrase-file", "/gitjob/ssh/"+sshauth.PassphraseKey)
+			}
+			if secret.Data[sshauth.CertificateKey] != nil {
+				args = append(args, "--ssh-certificate-file", "/gitjob/ssh/"+sshauth.CertificateKey)
+			}
+			knownHosts := secret.Data[sshauth.KnownHostsKey]
 			if knownHosts != nil {
-				args = append(args, "--known-hosts-file", "/gitjob/ssh/known_hosts")
+				args = append(args, "--known-hosts-file", "/gitjob/ssh/"+sshauth.KnownHostsKey)
+			}
+			// the known hosts of the controller are in its namespace, so they are copied into the namespace of the job
+			controllerKnownHosts, err := r.HostKeys.KnownHosts(ctx, r.Client)
+			if err != nil {
+				return corev1.Container{}, err
+			}
+			if len(controllerKnownHosts) > 0 {
+				if err := r.projectKnownHosts(ctx, obj, controllerKnownHosts); err != nil {
+					return corev1.Container{}, err
+				}
+				volumeMounts = append(volumeMounts, corev1.VolumeMount{
+					Name:      knownHostsVolumeName,
+					MountPath: "/gitjob/known-hosts",
+				})
+				args = append(args, "--controller-known-hosts-file", "/gitjob/known-hosts/"+sshauth.KnownHostsKey)
 			}
+			if r.HostKeys.Strict(obj) {
+				args = append(args, "--strict-host-key-checking")
+			}
+		} else if secret.Type == corev1.SecretTypeTLS {
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      gitCredentialVolumeName,
+				MountPath: "/gitjob/tls",
+			})
+			args = append(args, "--client-cert-file", "/gitjob/tls/"+corev1.TLSCertKey)
+			args = append(args, "--client-key-file", "/gitjob/tls/"+corev1.TLSPrivateKeyKey)
+		} else if secret.Type == githubapp.SecretType {
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      gitCredentialVolumeName,
+				MountPath: "/gitjob/githubapp",
+			})
+			args = append(args, "--github-app-id", string(secret.Data[githubapp.AppIDKey]))
+			args = append(args, "--github-app-installation-id", string(secret.Data[githubapp.InstallationIDKey]))
+			args = append(args, "--github-app-private-key-file", "/gitjob/githubapp/"+githubapp.PrivateKeyKey)
+			apiURL := string(secret.Data[githubapp.APIURLKey])
+			if apiURL == "" {
+				apiURL = obj.Spec.Git.ProviderAPIURL
+			}
+			if apiURL != "" {
+				args = append(args, "--github-api-url", apiURL)
+			}
+		} else if secret.Type == httpauth.BearerTokenSecretType {
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      gitCredentialVolumeName,
+				MountPath: "/gitjob/bearer",
+			})
+			args = append(args, "--bearer-token-file", "/gitjob/bearer/"+httpauth.TokenKey)
+		}
+
+		// additional headers are supported by every credential of http(s) repos, or can be the only credential
+		if secret.Type != corev1.SecretTypeSSHAuth && secret.Data[httpauth.HeadersKey] != nil {
+			mountPath := credentialMountPath(volumeMounts)
+			if mountPath == "" {
+				mountPath = "/gitjob/headers"
+				volumeMounts = append(volumeMounts, corev1.VolumeMount{
+					Name:      gitCredentialVolumeName,
+					MountPath: mountPath,
+				})
+			}
+			args = append(args, "--headers-file", mountPath+"/"+httpauth.HeadersKey)
 		}
 	}
 
@@ -396,6 +585,17 @@ func (r *GitJobReconciler) generateInitContainer(ctx context.Context, obj *v1.Gi
 	}, nil
 }
 
+// credentialMountPath returns the path the credential secret is mounted at, or an empty string if it isn't mounted.
+func credentialMountPath(volumeMounts []corev1.VolumeMount) string {
+	for _, m := range volumeMounts {
+		if m.Name == gitCredentialVolumeName {
+			return m.MountPath
+		}
+	}
+
+	return ""
+}
+
 func proxyEnvVars() []corev1.EnvVar {
 	var envVars []corev1.EnvVar
 	for _, envVar := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
@@ -6,13 +6,18 @@ package controller
 import (
 	"context"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"go.uber.org/mock/gomock"
 
 	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	"github.com/rancher/gitjob/pkg/httpauth"
 	"github.com/rancher/gitjob/pkg/mocks"
+	"github.com/rancher/gitjob/pkg/sshauth"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -22,9 +27,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
 func TestReconcile_AddOrModifyGitRepoWatchIsCalled_WhenGitRepoIsCreatedOrModified(t *testing.T) {
@@ -115,6 +123,7 @@ func TestNewJob(t *testing.T) {
 		expectedInitContainers []corev1.Container
 		expectedVolumes        []corev1.Volume
 		expectedErr            error
+		hostKeys               git.HostKeyOptions
 	}{
 		"simple (no credentials, no ca, no skip tls)": {
 			gitjob: &gitjobv1.GitJob{
@@ -277,14 +286,14 @@ func TestNewJob(t *testing.T) {
 			},
 			client: sshSecretMock(),
 		},
-		"custom CA": {
+		"ssh credentials with passphrase": {
 			gitjob: &gitjobv1.GitJob{
 				Spec: gitjobv1.GitJobSpec{
 					Git: gitjobv1.GitInfo{
+						Repo: "repo",
 						Credential: gitjobv1.Credential{
-							CABundle: []byte("ca"),
+							ClientSecretName: "secretName",
 						},
-						Repo: "repo",
 					},
 				},
 			},
@@ -293,7 +302,8 @@ func TestNewJob(t *testing.T) {
 					Command: []string{
 						"gitcloner",
 					},
-					Args:  []string{"repo", "/workspace", "--ca-bundle-file", "/gitjob/cabundle/" + bundleCAFile},
+					Args: []string{"repo", "/workspace", "--ssh-private-key-file", "/gitjob/ssh/" + corev1.SSHAuthPrivateKey,
+						"--ssh-passphrase-file", "/gitjob/ssh/" + sshauth.PassphraseKey},
 					Image: "test",
 					Name:  "gitcloner-initializer",
 					VolumeMounts: []corev1.VolumeMount{
@@ -306,8 +316,8 @@ func TestNewJob(t *testing.T) {
 							MountPath: "/tmp",
 						},
 						{
-							Name:      bundleCAVolumeName,
-							MountPath: "/gitjob/cabundle",
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/ssh",
 						},
 					},
 					SecurityContext: securityContext,
@@ -327,23 +337,24 @@ func TestNewJob(t *testing.T) {
 					},
 				},
 				{
-					Name: bundleCAVolumeName,
+					Name: gitCredentialVolumeName,
 					VolumeSource: corev1.VolumeSource{
 						Secret: &corev1.SecretVolumeSource{
-							SecretName: "-cabundle",
+							SecretName: "secretName",
 						},
 					},
 				},
 			},
+			client: sshPassphraseSecretMock(),
 		},
-		"skip tls": {
+		"ssh credentials with certificate": {
 			gitjob: &gitjobv1.GitJob{
 				Spec: gitjobv1.GitJobSpec{
 					Git: gitjobv1.GitInfo{
+						Repo: "repo",
 						Credential: gitjobv1.Credential{
-							InsecureSkipTLSverify: true,
+							ClientSecretName: "secretName",
 						},
-						Repo: "repo",
 					},
 				},
 			},
@@ -352,7 +363,8 @@ func TestNewJob(t *testing.T) {
 					Command: []string{
 						"gitcloner",
 					},
-					Args:  []string{"repo", "/workspace", "--insecure-skip-tls"},
+					Args: []string{"repo", "/workspace", "--ssh-private-key-file", "/gitjob/ssh/" + corev1.SSHAuthPrivateKey,
+						"--ssh-certificate-file", "/gitjob/ssh/" + sshauth.CertificateKey},
 					Image: "test",
 					Name:  "gitcloner-initializer",
 					VolumeMounts: []corev1.VolumeMount{
@@ -364,6 +376,10 @@ func TestNewJob(t *testing.T) {
 							Name:      emptyDirVolumeName,
 							MountPath: "/tmp",
 						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/ssh",
+						},
 					},
 					SecurityContext: securityContext,
 				},
@@ -381,206 +397,1722 @@ func TestNewJob(t *testing.T) {
 						EmptyDir: &corev1.EmptyDirVolumeSource{},
 					},
 				},
+				{
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
+				},
 			},
+			client: sshCertificateSecretMock(),
 		},
-	}
-
-	for name, test := range tests {
-		t.Run(name, func(t *testing.T) {
-			r := GitJobReconciler{
-				Client:    test.client,
-				Scheme:    scheme,
-				Image:     "test",
-				GitPoller: poller,
-			}
-			job, err := r.newJob(ctx, test.gitjob)
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
-			if !cmp.Equal(job.Spec.Template.Spec.InitContainers, test.expectedInitContainers) {
-				t.Fatalf("expected initContainers: %v, got: %v", test.expectedInitContainers, job.Spec.Template.Spec.InitContainers)
-			}
-			if !cmp.Equal(job.Spec.Template.Spec.Volumes, test.expectedVolumes) {
-				t.Fatalf("expected volumes: %v, got: %v", test.expectedVolumes, job.Spec.Template.Spec.Volumes)
-			}
-		})
-	}
-}
-
-func TestGenerateJob_EnvVars(t *testing.T) {
-	mockCtrl := gomock.NewController(t)
-	ctx := context.TODO()
-	poller := mocks.NewMockGitPoller(mockCtrl)
-	poller.EXPECT().AddOrModifyGitRepoWatch(ctx, gomock.Any()).AnyTimes()
-	poller.EXPECT().CleanUpWatches(ctx).AnyTimes()
-
-	tests := map[string]struct {
-		gitjob                       *gitjobv1.GitJob
-		osEnv                        map[string]string
-		expectedContainerEnvVars     []corev1.EnvVar
-		expectedInitContainerEnvVars []corev1.EnvVar
-	}{
-		"no proxy": {
+		"ssh credentials with known hosts configmap and strict host key checking": {
 			gitjob: &gitjobv1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "gitjob"},
 				Spec: gitjobv1.GitJobSpec{
-					JobSpec: batchv1.JobSpec{
-						Template: corev1.PodTemplateSpec{
-							Spec: corev1.PodSpec{
-								Containers: []corev1.Container{
-									{
-										Env: []corev1.EnvVar{{
-											Name:  "foo",
-											Value: "bar",
-										}},
-									},
-								},
-							},
+					Git: gitjobv1.GitInfo{
+						Repo: "repo",
+						Credential: gitjobv1.Credential{
+							ClientSecretName: "secretName",
 						},
 					},
 				},
-				Status: gitjobv1.GitJobStatus{
-					GitEvent: gitjobv1.GitEvent{
-						Commit: "commit",
-						GithubMeta: gitjobv1.GithubMeta{
-							Event: "event",
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args: []string{"repo", "/workspace", "--ssh-private-key-file", "/gitjob/ssh/" + corev1.SSHAuthPrivateKey,
+						"--ssh-passphrase-file", "/gitjob/ssh/" + sshauth.PassphraseKey,
+						"--controller-known-hosts-file", "/gitjob/known-hosts/" + sshauth.KnownHostsKey, "--strict-host-key-checking"},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/ssh",
+						},
+						{
+							Name:      knownHostsVolumeName,
+							MountPath: "/gitjob/known-hosts",
 						},
 					},
+					SecurityContext: securityContext,
 				},
 			},
-			expectedContainerEnvVars: []corev1.EnvVar{
+			expectedVolumes: []corev1.Volume{
 				{
-					Name:  "foo",
-					Value: "bar",
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
 				},
 				{
-					Name:  "COMMIT",
-					Value: "commit",
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
 				},
 				{
-					Name:  "EVENT_TYPE",
-					Value: "event",
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
+				},
+				{
+					Name: knownHostsVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "gitjob-known-hosts",
+						},
+					},
 				},
 			},
+			client: sshKnownHostsConfigMapMock(),
+			hostKeys: git.HostKeyOptions{
+				KnownHostsConfigMap:   types.NamespacedName{Namespace: "cattle-gitjob", Name: "known-hosts"},
+				StrictHostKeyChecking: true,
+			},
 		},
-		"proxy": {
+		"tls client certificate": {
 			gitjob: &gitjobv1.GitJob{
 				Spec: gitjobv1.GitJobSpec{
-					JobSpec: batchv1.JobSpec{
-						Template: corev1.PodTemplateSpec{
-							Spec: corev1.PodSpec{
-								Containers: []corev1.Container{
-									{
-										Env: []corev1.EnvVar{{
-											Name:  "foo",
-											Value: "bar",
-										}},
-									},
-								},
-							},
+					Git: gitjobv1.GitInfo{
+						Repo: "repo",
+						Credential: gitjobv1.Credential{
+							ClientSecretName: "secretName",
 						},
 					},
 				},
-				Status: gitjobv1.GitJobStatus{
-					GitEvent: gitjobv1.GitEvent{
-						Commit: "commit",
-						GithubMeta: gitjobv1.GithubMeta{
-							Event: "event",
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args: []string{"repo", "/workspace", "--client-cert-file", "/gitjob/tls/" + corev1.TLSCertKey,
+						"--client-key-file", "/gitjob/tls/" + corev1.TLSPrivateKeyKey},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/tls",
 						},
 					},
+					SecurityContext: securityContext,
 				},
 			},
-			expectedContainerEnvVars: []corev1.EnvVar{
+			expectedVolumes: []corev1.Volume{
 				{
-					Name:  "foo",
-					Value: "bar",
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
 				},
 				{
-					Name:  "COMMIT",
-					Value: "commit",
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
 				},
 				{
-					Name:  "EVENT_TYPE",
-					Value: "event",
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
 				},
-				{
-					Name:  "HTTP_PROXY",
-					Value: "httpProxy",
+			},
+			client: tlsSecretMock(),
+		},
+		"bearer token with headers": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{
+						Repo: "repo",
+						Credential: gitjobv1.Credential{
+							ClientSecretName: "secretName",
+						},
+					},
 				},
+			},
+			expectedInitContainers: []corev1.Container{
 				{
-					Name:  "HTTPS_PROXY",
-					Value: "httpsProxy",
+					Command: []string{
+						"gitcloner",
+					},
+					Args: []string{"repo", "/workspace", "--bearer-token-file", "/gitjob/bearer/" + httpauth.TokenKey,
+						"--headers-file", "/gitjob/bearer/" + httpauth.HeadersKey},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/bearer",
+						},
+					},
+					SecurityContext: securityContext,
 				},
 			},
-			expectedInitContainerEnvVars: []corev1.EnvVar{
+			expectedVolumes: []corev1.Volume{
 				{
-					Name:  "HTTP_PROXY",
-					Value: "httpProxy",
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
 				},
 				{
-					Name:  "HTTPS_PROXY",
-					Value: "httpsProxy",
-				},
-			},
-			osEnv: map[string]string{"HTTP_PROXY": "httpProxy", "HTTPS_PROXY": "httpsProxy"},
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
+				},
+			},
+			client: bearerTokenSecretMock(),
+		},
+		"headers only": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{
+						Repo: "repo",
+						Credential: gitjobv1.Credential{
+							ClientSecretName: "secretName",
+						},
+					},
+				},
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args:  []string{"repo", "/workspace", "--headers-file", "/gitjob/headers/" + httpauth.HeadersKey},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/headers",
+						},
+					},
+					SecurityContext: securityContext,
+				},
+			},
+			expectedVolumes: []corev1.Volume{
+				{
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
+				},
+			},
+			client: headersSecretMock(),
+		},
+		"github app credentials": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{
+						Repo:           "repo",
+						ProviderAPIURL: "https://github.example.com/api/v3",
+						Credential: gitjobv1.Credential{
+							ClientSecretName: "secretName",
+						},
+					},
+				},
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args: []string{"repo", "/workspace", "--github-app-id", "1", "--github-app-installation-id", "2",
+						"--github-app-private-key-file", "/gitjob/githubapp/" + githubapp.PrivateKeyKey,
+						"--github-api-url", "https://github.example.com/api/v3"},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      gitCredentialVolumeName,
+							MountPath: "/gitjob/githubapp",
+						},
+					},
+					SecurityContext: securityContext,
+				},
+			},
+			expectedVolumes: []corev1.Volume{
+				{
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: gitCredentialVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "secretName",
+						},
+					},
+				},
+			},
+			client: githubAppSecretMock(),
+		},
+		"custom CA": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{
+						Credential: gitjobv1.Credential{
+							CABundle: []byte("ca"),
+						},
+						Repo: "repo",
+					},
+				},
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args:  []string{"repo", "/workspace", "--ca-bundle-file", "/gitjob/cabundle/" + bundleCAFile},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+						{
+							Name:      bundleCAVolumeName,
+							MountPath: "/gitjob/cabundle",
+						},
+					},
+					SecurityContext: securityContext,
+				},
+			},
+			expectedVolumes: []corev1.Volume{
+				{
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: bundleCAVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "-cabundle",
+						},
+					},
+				},
+			},
+		},
+		"skip tls": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{
+						Credential: gitjobv1.Credential{
+							InsecureSkipTLSverify: true,
+						},
+						Repo: "repo",
+					},
+				},
+			},
+			expectedInitContainers: []corev1.Container{
+				{
+					Command: []string{
+						"gitcloner",
+					},
+					Args:  []string{"repo", "/workspace", "--insecure-skip-tls"},
+					Image: "test",
+					Name:  "gitcloner-initializer",
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      gitClonerVolumeName,
+							MountPath: "/workspace",
+						},
+						{
+							Name:      emptyDirVolumeName,
+							MountPath: "/tmp",
+						},
+					},
+					SecurityContext: securityContext,
+				},
+			},
+			expectedVolumes: []corev1.Volume{
+				{
+					Name: gitClonerVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: emptyDirVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := GitJobReconciler{
+				Client:    test.client,
+				Scheme:    scheme,
+				Image:     "test",
+				GitPoller: poller,
+				HostKeys:  test.hostKeys,
+			}
+			job, err := r.newJob(ctx, test.gitjob)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.InitContainers, test.expectedInitContainers) {
+				t.Fatalf("expected initContainers: %v, got: %v", test.expectedInitContainers, job.Spec.Template.Spec.InitContainers)
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.Volumes, test.expectedVolumes) {
+				t.Fatalf("expected volumes: %v, got: %v", test.expectedVolumes, job.Spec.Template.Spec.Volumes)
+			}
+		})
+	}
+}
+
+func TestGenerateJob_EnvVars(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	ctx := context.TODO()
+	poller := mocks.NewMockGitPoller(mockCtrl)
+	poller.EXPECT().AddOrModifyGitRepoWatch(ctx, gomock.Any()).AnyTimes()
+	poller.EXPECT().CleanUpWatches(ctx).AnyTimes()
+
+	tests := map[string]struct {
+		gitjob                       *gitjobv1.GitJob
+		osEnv                        map[string]string
+		expectedContainerEnvVars     []corev1.EnvVar
+		expectedInitContainerEnvVars []corev1.EnvVar
+	}{
+		"no proxy": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					JobSpec: batchv1.JobSpec{
+						Template: corev1.PodTemplateSpec{
+							Spec: corev1.PodSpec{
+								Containers: []corev1.Container{
+									{
+										Env: []corev1.EnvVar{{
+											Name:  "foo",
+											Value: "bar",
+										}},
+									},
+								},
+							},
+						},
+					},
+				},
+				Status: gitjobv1.GitJobStatus{
+					GitEvent: gitjobv1.GitEvent{
+						Commit: "commit",
+						GithubMeta: gitjobv1.GithubMeta{
+							Event: "event",
+						},
+					},
+				},
+			},
+			expectedContainerEnvVars: []corev1.EnvVar{
+				{
+					Name:  "foo",
+					Value: "bar",
+				},
+				{
+					Name:  "COMMIT",
+					Value: "commit",
+				},
+				{
+					Name:  "EVENT_TYPE",
+					Value: "event",
+				},
+			},
+		},
+		"proxy": {
+			gitjob: &gitjobv1.GitJob{
+				Spec: gitjobv1.GitJobSpec{
+					JobSpec: batchv1.JobSpec{
+						Template: corev1.PodTemplateSpec{
+							Spec: corev1.PodSpec{
+								Containers: []corev1.Container{
+									{
+										Env: []corev1.EnvVar{{
+											Name:  "foo",
+											Value: "bar",
+										}},
+									},
+								},
+							},
+						},
+					},
+				},
+				Status: gitjobv1.GitJobStatus{
+					GitEvent: gitjobv1.GitEvent{
+						Commit: "commit",
+						GithubMeta: gitjobv1.GithubMeta{
+							Event: "event",
+						},
+					},
+				},
+			},
+			expectedContainerEnvVars: []corev1.EnvVar{
+				{
+					Name:  "foo",
+					Value: "bar",
+				},
+				{
+					Name:  "COMMIT",
+					Value: "commit",
+				},
+				{
+					Name:  "EVENT_TYPE",
+					Value: "event",
+				},
+				{
+					Name:  "HTTP_PROXY",
+					Value: "httpProxy",
+				},
+				{
+					Name:  "HTTPS_PROXY",
+					Value: "httpsProxy",
+				},
+			},
+			expectedInitContainerEnvVars: []corev1.EnvVar{
+				{
+					Name:  "HTTP_PROXY",
+					Value: "httpProxy",
+				},
+				{
+					Name:  "HTTPS_PROXY",
+					Value: "httpsProxy",
+				},
+			},
+			osEnv: map[string]string{"HTTP_PROXY": "httpProxy", "HTTPS_PROXY": "httpsProxy"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := GitJobReconciler{
+				Client:    fake.NewFakeClient(),
+				Image:     "test",
+				GitPoller: poller,
+			}
+			for k, v := range test.osEnv {
+				err := os.Setenv(k, v)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			job, err := r.newJob(ctx, test.gitjob)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.Containers[0].Env, test.expectedContainerEnvVars) {
+				t.Errorf("unexpected envVars. expected %v, but got %v", test.expectedContainerEnvVars, job.Spec.Template.Spec.Containers[0].Env)
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.InitContainers[0].Env, test.expectedInitContainerEnvVars) {
+				t.Errorf("unexpected envVars. expected %v, but got %v", test.expectedInitContainerEnvVars, job.Spec.Template.Spec.InitContainers[0].Env)
+			}
+			for k := range test.osEnv {
+				err := os.Unsetenv(k)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewBranchJob(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+		Spec: gitjobv1.GitJobSpec{
+			Git: gitjobv1.GitInfo{Repo: "repo", BranchPattern: "release/*"},
+			JobSpec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Image: "test"}},
+					},
+				},
+			},
+		},
+	}
+	branch := &gitjobv1.BranchStatus{Name: "release/1.0", Commit: "commit"}
+	r := GitJobReconciler{
+		Client: fake.NewFakeClient(),
+		Scheme: scheme,
+		Image:  "test",
+	}
+
+	job, err := r.newBranchJob(ctx, gitJob, branch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if job.Name != branchJobName(gitJob, branch) {
+		t.Errorf("expected job name %s, got %s", branchJobName(gitJob, branch), job.Name)
+	}
+	expectedLabels := map[string]string{gitJobLabel: "gitjob", branchLabel: "release-1.0"}
+	if !cmp.Equal(job.Labels, expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, job.Labels)
+	}
+	if job.Annotations[branchAnnotation] != "release/1.0" || job.Annotations["commit"] != "commit" {
+		t.Errorf("unexpected annotations %v", job.Annotations)
+	}
+	expectedArgs := []string{"repo", "/workspace", "--branch", "release/1.0"}
+	if !cmp.Equal(job.Spec.Template.Spec.InitContainers[0].Args, expectedArgs) {
+		t.Errorf("expected init container args %v, got %v", expectedArgs, job.Spec.Template.Spec.InitContainers[0].Args)
+	}
+	expectedEnv := []corev1.EnvVar{{Name: "COMMIT", Value: "commit"}, {Name: "EVENT_TYPE"}, {Name: "BRANCH", Value: "release/1.0"}}
+	if !cmp.Equal(job.Spec.Template.Spec.Containers[0].Env, expectedEnv) {
+		t.Errorf("expected env %v, got %v", expectedEnv, job.Spec.Template.Spec.Containers[0].Env)
+	}
+	if gitJob.Spec.Git.Branch != "" || gitJob.Status.Commit != "" {
+		t.Errorf("gitjob must not be modified, got %v", gitJob)
+	}
+}
+
+func TestNewPullRequestJob(t *testing.T) {
+	ctx := context.TODO()
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+		Spec: gitjobv1.GitJobSpec{
+			Git: gitjobv1.GitInfo{Repo: "git@github.com:rancher/gitjob.git", Branch: "main", PullRequest: gitjobv1.PullRequestInfo{Enabled: true, AllowForks: true}},
+			JobSpec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Image: "test"}},
+					},
+				},
+			},
+		},
+	}
+	r := GitJobReconciler{
+		Client: fake.NewFakeClient(),
+		Image:  "test",
+	}
+
+	tests := map[string]struct {
+		pr           *gitjobv1.PullRequestStatus
+		expectedArgs []string
+		action       string
+	}{
+		"open pull request clones the head branch of the head repo": {
+			pr:           &gitjobv1.PullRequestStatus{Number: 7, HeadCommit: "commit", HeadBranch: "feature", HeadRepo: "https://github.com/fork/gitjob.git", BaseBranch: "main"},
+			expectedArgs: []string{"https://github.com/fork/gitjob.git", "/workspace", "--branch", "feature"},
+			action:       "open",
+		},
+		"open pull request of the same repo keeps the url of the gitjob": {
+			pr:           &gitjobv1.PullRequestStatus{Number: 7, HeadCommit: "commit", HeadBranch: "feature", HeadRepo: "https://github.com/rancher/gitjob.git", BaseBranch: "main"},
+			expectedArgs: []string{"git@github.com:rancher/gitjob.git", "/workspace", "--branch", "feature"},
+			action:       "open",
+		},
+		"closed pull request clones the base branch": {
+			pr:           &gitjobv1.PullRequestStatus{Number: 7, HeadCommit: "commit", HeadBranch: "feature", HeadRepo: "https://github.com/fork/gitjob.git", BaseBranch: "main", Closed: true},
+			expectedArgs: []string{"git@github.com:rancher/gitjob.git", "/workspace", "--branch", "main"},
+			action:       "closed",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			job, err := r.newPullRequestJob(ctx, gitJob, test.pr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if job.Name != pullRequestJobName(gitJob, test.pr) {
+				t.Errorf("expected job name %s, got %s", pullRequestJobName(gitJob, test.pr), job.Name)
+			}
+			expectedLabels := map[string]string{gitJobLabel: "gitjob", pullRequestLabel: "7"}
+			if !cmp.Equal(job.Labels, expectedLabels) {
+				t.Errorf("expected labels %v, got %v", expectedLabels, job.Labels)
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.InitContainers[0].Args, test.expectedArgs) {
+				t.Errorf("expected init container args %v, got %v", test.expectedArgs, job.Spec.Template.Spec.InitContainers[0].Args)
+			}
+			expectedEnv := []corev1.EnvVar{
+				{Name: "COMMIT", Value: "commit"},
+				{Name: "EVENT_TYPE", Value: "pull_request"},
+				{Name: "PULL_REQUEST_NUMBER", Value: "7"},
+				{Name: "PULL_REQUEST_HEAD_COMMIT", Value: "commit"},
+				{Name: "PULL_REQUEST_HEAD_BRANCH", Value: "feature"},
+				{Name: "PULL_REQUEST_BASE_BRANCH", Value: "main"},
+				{Name: "PULL_REQUEST_ACTION", Value: test.action},
+			}
+			if !cmp.Equal(job.Spec.Template.Spec.Containers[0].Env, expectedEnv) {
+				t.Errorf("expected env %v, got %v", expectedEnv, job.Spec.Template.Spec.Containers[0].Env)
+			}
+		})
+	}
+}
+
+func TestReconcilePullRequestsIgnoresForks(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	ctx := context.TODO()
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+		Spec: gitjobv1.GitJobSpec{
+			Git: gitjobv1.GitInfo{Repo: "git@github.com:rancher/gitjob.git", PullRequest: gitjobv1.PullRequestInfo{Enabled: true}},
+			JobSpec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Image: "test"}},
+					},
+				},
+			},
+		},
+		Status: gitjobv1.GitJobStatus{PullRequests: []gitjobv1.PullRequestStatus{
+			{Number: 1, HeadCommit: "commit", HeadBranch: "feature", BaseBranch: "main"},
+			{Number: 2, HeadCommit: "commit", HeadBranch: "feature", HeadRepo: "https://github.com/fork/gitjob.git", BaseBranch: "main"},
+		}},
+	}
+	r := GitJobReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		Scheme: scheme,
+		Image:  "test",
+	}
+
+	if err := r.reconcilePullRequests(ctx, gitJob); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gitJob.Status.PullRequests) != 1 || gitJob.Status.PullRequests[0].Number != 1 {
+		t.Errorf("expected only pull request 1, got %v", gitJob.Status.PullRequests)
+	}
+	var jobs batchv1.JobList
+	if err := r.List(ctx, &jobs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(jobs.Items) != 1 || jobs.Items[0].Annotations[pullRequestAnnotation] != "1" {
+		t.Errorf("expected a job for pull request 1, got %v", jobs.Items)
+	}
+}
+
+func httpSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("user"),
+			corev1.BasicAuthPasswordKey: []byte("pass"),
+		},
+		Type: corev1.SecretTypeBasicAuth,
+	}).Build()
+}
+
+func sshSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.SSHAuthPrivateKey: []byte("ssh key"),
+		},
+		Type: corev1.SecretTypeSSHAuth,
+	}).Build()
+}
+
+func sshPassphraseSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.SSHAuthPrivateKey: []byte("ssh key"),
+			sshauth.PassphraseKey:    []byte("passphrase"),
+		},
+		Type: corev1.SecretTypeSSHAuth,
+	}).Build()
+}
+
+func sshCertificateSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.SSHAuthPrivateKey: []byte("ssh key"),
+			sshauth.CertificateKey:   []byte("ssh certificate"),
+		},
+		Type: corev1.SecretTypeSSHAuth,
+	}).Build()
+}
+
+func sshKnownHostsConfigMapMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.SSHAuthPrivateKey: []byte("ssh key"),
+			sshauth.PassphraseKey:    []byte("passphrase"),
+		},
+		Type: corev1.SecretTypeSSHAuth,
+	}, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cattle-gitjob", Name: "known-hosts"},
+		Data: map[string]string{
+			sshauth.KnownHostsKey: "git.example.com ssh-ed25519 AAAA\n",
+		},
+	}).Build()
+}
+
+func tlsSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte("cert"),
+			corev1.TLSPrivateKeyKey: []byte("key"),
+		},
+		Type: corev1.SecretTypeTLS,
+	}).Build()
+}
+
+func bearerTokenSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			httpauth.TokenKey:   []byte("token"),
+			httpauth.HeadersKey: []byte("X-Tenant-Id: team-a"),
+		},
+		Type: httpauth.BearerTokenSecretType,
+	}).Build()
+}
+
+func headersSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			httpauth.HeadersKey: []byte("Authorization: Bearer token"),
+		},
+		Type: corev1.SecretTypeOpaque,
+	}).Build()
+}
+
+func githubAppSecretMock() client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+		Data: map[string][]byte{
+			githubapp.AppIDKey:          []byte("1"),
+			githubapp.InstallationIDKey: []byte("2"),
+			githubapp.PrivateKeyKey:     []byte("private key"),
+		},
+		Type: githubapp.SecretType,
+	}).Build()
+}
+
+func TestReconcileWebhookToken(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	tests := map[string]struct {
+		secretName    string
+		oldToken      string
+		expectedToken string
+	}{
+		"token from secret": {
+			secretName:    "webhook",
+			expectedToken: "token",
+		},
+		"secret not found": {
+			secretName:    "missing",
+			oldToken:      "old",
+			expectedToken: "",
+		},
+		"no secret": {
+			oldToken:      "old",
+			expectedToken: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := &gitjobv1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+				Spec:       gitjobv1.GitJobSpec{WebhookSecretName: test.secretName},
+				Status: gitjobv1.GitJobStatus{
+					GitEvent: gitjobv1.GitEvent{GithubMeta: gitjobv1.GithubMeta{ValidationToken: test.oldToken}},
+				},
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "webhook", Namespace: "default"},
+				Data:       map[string][]byte{webhookTokenKey: []byte("token")},
+			}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(gitJob, secret).WithStatusSubresource(gitJob).Build()
+			r := GitJobReconciler{Client: client, Scheme: scheme}
+
+			if err := client.Get(context.TODO(), types.NamespacedName{Name: "gitjob", Namespace: "default"}, gitJob); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := r.reconcileWebhookToken(context.TODO(), gitJob); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+
+			var updated gitjobv1.GitJob
+			if err := client.Get(context.TODO(), types.NamespacedName{Name: "gitjob", Namespace: "default"}, &updated); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if updated.Status.ValidationToken != test.expectedToken {
+				t.Errorf("expected token %q, but got %q", test.expectedToken, updated.Status.ValidationToken)
+			}
+		})
+	}
+}
+
+func TestReconcileDeletedRef(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+		Spec: gitjobv1.GitJobSpec{
+			Git: gitjobv1.GitInfo{Repo: "repo", Branch: "feature"},
+			CleanupJobSpec: &batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Image: "cleanup"}},
+					},
+				},
+			},
+		},
+		Status: gitjobv1.GitJobStatus{
+			GitEvent:   gitjobv1.GitEvent{Commit: "commit"},
+			DeletedRef: &gitjobv1.DeletedRefStatus{Ref: "refs/heads/feature", Commit: "commit"},
+		},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(gitJob).WithStatusSubresource(gitJob).Build()
+	r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+	if err := client.Get(ctx, types.NamespacedName{Name: "gitjob", Namespace: "default"}, gitJob); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !deletedRefWatched(gitJob) {
+		t.Fatalf("expected deleted ref to be watched")
+	}
+	if _, err := r.reconcileDeletedRef(ctx, gitJob); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	var job batchv1.Job
+	if err := client.Get(ctx, types.NamespacedName{Name: cleanupJobName(gitJob), Namespace: "default"}, &job); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(job.Spec.Template.Spec.InitContainers) != 0 {
+		t.Errorf("expected no init containers, got %v", job.Spec.Template.Spec.InitContainers)
+	}
+	expectedEnv := []corev1.EnvVar{{Name: "DELETED_REF", Value: "refs/heads/feature"}, {Name: "DELETED_COMMIT", Value: "commit"}}
+	if !cmp.Equal(job.Spec.Template.Spec.Containers[0].Env, expectedEnv) {
+		t.Errorf("expected env %v, got %v", expectedEnv, job.Spec.Template.Spec.Containers[0].Env)
+	}
+	if job.Labels[cleanupLabel] != "true" || job.Annotations[deletedRefAnnotation] != "refs/heads/feature" {
+		t.Errorf("unexpected labels %v and annotations %v", job.Labels, job.Annotations)
+	}
+
+	// the status of the cleanup job is reported
+	if err := client.Get(ctx, types.NamespacedName{Name: "gitjob", Namespace: "default"}, gitJob); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := r.reconcileDeletedRef(ctx, gitJob); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	var updated gitjobv1.GitJob
+	if err := client.Get(ctx, types.NamespacedName{Name: "gitjob", Namespace: "default"}, &updated); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if updated.Status.DeletedRef == nil || updated.Status.DeletedRef.JobStatus == "" {
+		t.Errorf("expected cleanup job status, got %v", updated.Status.DeletedRef)
+	}
+}
+
+func TestDeletedRefWatched(t *testing.T) {
+	tests := map[string]struct {
+		git        gitjobv1.GitInfo
+		ref        string
+		generation int64
+		expected   bool
+	}{
+		"branch": {
+			git:      gitjobv1.GitInfo{Branch: "main"},
+			ref:      "refs/heads/main",
+			expected: true,
+		},
+		"other branch": {
+			git: gitjobv1.GitInfo{Branch: "main"},
+			ref: "refs/heads/feature",
+		},
+		"spec changed": {
+			git:        gitjobv1.GitInfo{Branch: "main"},
+			ref:        "refs/heads/main",
+			generation: 2,
+		},
+		"tag": {
+			git:      gitjobv1.GitInfo{OnTag: ">=1.0.0"},
+			ref:      "refs/tags/v1.0.0",
+			expected: true,
+		},
+		"branch pattern": {
+			git: gitjobv1.GitInfo{BranchPattern: "release/*"},
+			ref: "refs/heads/release/1.0",
 		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			r := GitJobReconciler{
-				Client:    fake.NewFakeClient(),
-				Image:     "test",
-				GitPoller: poller,
+			gitJob := &gitjobv1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Generation: 1},
+				Spec:       gitjobv1.GitJobSpec{Git: test.git},
+				Status: gitjobv1.GitJobStatus{
+					ObservedGeneration: 1,
+					DeletedRef:         &gitjobv1.DeletedRefStatus{Ref: test.ref},
+				},
 			}
-			for k, v := range test.osEnv {
-				err := os.Setenv(k, v)
-				if err != nil {
-					t.Errorf("unexpected error: %v", err)
-				}
+			if test.generation != 0 {
+				gitJob.Generation = test.generation
 			}
-			job, err := r.newJob(ctx, test.gitjob)
+			if watched := deletedRefWatched(gitJob); watched != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, watched)
+			}
+		})
+	}
+}
+
+func TestReconcileHistoryRewrite(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	ctx := context.TODO()
+
+	tests := map[string]struct {
+		policy        string
+		acknowledged  string
+		expectedJob   bool
+		expectedEvent bool
+	}{
+		"allow": {
+			policy:      gitjobv1.HistoryRewriteAllow,
+			expectedJob: true,
+		},
+		"block": {
+			policy: gitjobv1.HistoryRewriteBlock,
+		},
+		"block acknowledged for another commit": {
+			policy:       gitjobv1.HistoryRewriteBlock,
+			acknowledged: "oldCommit",
+		},
+		"block acknowledged": {
+			policy:       gitjobv1.HistoryRewriteBlock,
+			acknowledged: "newCommit",
+			expectedJob:  true,
+		},
+		"alert": {
+			policy:        gitjobv1.HistoryRewriteAlert,
+			expectedJob:   true,
+			expectedEvent: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := &gitjobv1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "default"},
+				Spec: gitjobv1.GitJobSpec{
+					Git: gitjobv1.GitInfo{Repo: "repo", Branch: "main", HistoryRewritePolicy: test.policy},
+				},
+				Status: gitjobv1.GitJobStatus{
+					GitEvent:       gitjobv1.GitEvent{Commit: "newCommit", LastExecutedCommit: "oldCommit"},
+					HistoryRewrite: &gitjobv1.HistoryRewriteStatus{OldCommit: "oldCommit", NewCommit: "newCommit"},
+				},
+			}
+			if test.acknowledged != "" {
+				gitJob.Annotations = map[string]string{gitjobv1.AcknowledgeHistoryRewriteAnnotation: test.acknowledged}
+			}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(gitJob).WithStatusSubresource(gitJob).Build()
+			poller := mocks.NewMockGitPoller(mockCtrl)
+			poller.EXPECT().AddOrModifyGitRepoWatch(ctx, gomock.Any())
+			recorder := record.NewFakeRecorder(1)
+			r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test", GitPoller: poller, Recorder: recorder}
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "gitjob", Namespace: "default"}})
 			if err != nil {
-				t.Errorf("unexpected error: %v", err)
+				t.Errorf("unexpected error %v", err)
 			}
-			if !cmp.Equal(job.Spec.Template.Spec.Containers[0].Env, test.expectedContainerEnvVars) {
-				t.Errorf("unexpected envVars. expected %v, but got %v", test.expectedContainerEnvVars, job.Spec.Template.Spec.Containers[0].Env)
+
+			var jobs batchv1.JobList
+			if err := client.List(ctx, &jobs); err != nil {
+				t.Fatalf("unexpected error %v", err)
 			}
-			if !cmp.Equal(job.Spec.Template.Spec.InitContainers[0].Env, test.expectedInitContainerEnvVars) {
-				t.Errorf("unexpected envVars. expected %v, but got %v", test.expectedInitContainerEnvVars, job.Spec.Template.Spec.InitContainers[0].Env)
+			if created := len(jobs.Items) == 1; created != test.expectedJob {
+				t.Errorf("expected job %v, got %v", test.expectedJob, jobs.Items)
 			}
-			for k := range test.osEnv {
-				err := os.Unsetenv(k)
-				if err != nil {
-					t.Errorf("unexpected error: %v", err)
+			if emitted := len(recorder.Events) == 1; emitted != test.expectedEvent {
+				t.Errorf("expected event %v, got %d events", test.expectedEvent, len(recorder.Events))
+			}
+		})
+	}
+}
+
+func TestGenerationOrCommitChangedPredicate_AcknowledgedRewrite(t *testing.T) {
+	oldGitJob := &gitjobv1.GitJob{}
+	newGitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{gitjobv1.AcknowledgeHistoryRewriteAnnotation: "newCommit"},
+		},
+	}
+	if !generationOrCommitChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldGitJob, ObjectNew: newGitJob}) {
+		t.Errorf("expected acknowledging a history rewrite to trigger a reconcile")
+	}
+}
+
+func TestGitJobsForSecret(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	ctx := context.TODO()
+	credential := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "credential", Namespace: "test"},
+		Spec:       gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{ClientSecretName: "secret"}}},
+	}
+	caBundle := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "test"},
+		Spec:       gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{CABundle: []byte("ca")}}},
+	}
+	otherNamespace := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "credential", Namespace: "other"},
+		Spec:       gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{ClientSecretName: "secret"}}},
+	}
+	crossNamespace := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "cross-namespace", Namespace: "test"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretRef: &gitjobv1.SecretReference{Name: "secret", Namespace: "shared"},
+		}}},
+	}
+	webhook := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook", Namespace: "test"},
+		Spec:       gitjobv1.GitJobSpec{WebhookSecretName: "webhook-secret"},
+	}
+	webhookAndCredential := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook-and-credential", Namespace: "test"},
+		Spec: gitjobv1.GitJobSpec{
+			WebhookSecretName: "shared-secret",
+			Git:               gitjobv1.GitInfo{Credential: gitjobv1.Credential{ClientSecretName: "shared-secret"}},
+		},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).
+		WithRuntimeObjects(credential, caBundle, otherNamespace, crossNamespace, webhook, webhookAndCredential).
+		WithIndex(&gitjobv1.GitJob{}, credentialSecretIndex, indexCredentialSecrets).
+		WithIndex(&gitjobv1.GitJob{}, webhookSecretIndex, indexWebhookSecret).Build()
+	poller := mocks.NewMockGitPoller(mockCtrl)
+	r := GitJobReconciler{Client: client, Scheme: scheme, GitPoller: poller}
+
+	tests := map[string]struct {
+		secret          string
+		secretNamespace string
+		expected        []string
+		expectedPolls   int
+	}{
+		"client secret": {
+			secret:        "secret",
+			expected:      []string{"credential"},
+			expectedPolls: 1,
+		},
+		"client secret in another namespace": {
+			secret:          "secret",
+			secretNamespace: "shared",
+			expected:        []string{"cross-namespace"},
+			expectedPolls:   1,
+		},
+		"ca bundle secret": {
+			secret:        "secret-cabundle",
+			expected:      []string{"secret"},
+			expectedPolls: 1,
+		},
+		"webhook secret is not polled": {
+			secret:   "webhook-secret",
+			expected: []string{"webhook"},
+		},
+		"webhook and client secret is queued once": {
+			secret:        "shared-secret",
+			expected:      []string{"webhook-and-credential"},
+			expectedPolls: 1,
+		},
+		"default secret of gitjobs without client secret": {
+			secret:        git.DefaultSecretName,
+			expected:      []string{"secret", "webhook"},
+			expectedPolls: 2,
+		},
+		"unreferenced secret": {
+			secret: "other",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var expected []ctrl.Request
+			for _, gitJob := range test.expected {
+				expected = append(expected, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: gitJob}})
+			}
+			poller.EXPECT().PollGitRepoWatch(ctx, gomock.Any()).Do(func(_ context.Context, gitJob gitjobv1.GitJob) {
+				if gitJob.Namespace != "test" {
+					t.Errorf("unexpected poll of gitjob %s/%s", gitJob.Namespace, gitJob.Name)
 				}
+			}).Times(test.expectedPolls)
+			secretNamespace := test.secretNamespace
+			if secretNamespace == "" {
+				secretNamespace = "test"
+			}
+			requests := r.gitJobsForSecret(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: test.secret, Namespace: secretNamespace}})
+			if len(requests) != len(expected) || (len(expected) > 0 && !cmp.Equal(requests, expected)) {
+				t.Errorf("expected requests %v, got %v", expected, requests)
 			}
 		})
 	}
 }
 
-func httpSecretMock() client.Client {
+func TestSecretDataChangedPredicate(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", ResourceVersion: "1"},
+		Data:       map[string][]byte{"token": []byte("old")},
+	}
+	relabeled := secret.DeepCopy()
+	relabeled.ResourceVersion = "2"
+	relabeled.Labels = map[string]string{"foo": "bar"}
+	rotated := secret.DeepCopy()
+	rotated.Data["token"] = []byte("new")
+
+	p := secretDataChangedPredicate()
+	if p.Update(event.UpdateEvent{ObjectOld: secret, ObjectNew: relabeled}) {
+		t.Errorf("expected metadata changes to be ignored")
+	}
+	if !p.Update(event.UpdateEvent{ObjectOld: secret, ObjectNew: rotated}) {
+		t.Errorf("expected data changes to be processed")
+	}
+}
+
+func TestRerunFailedJob(t *testing.T) {
 	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
 	utilruntime.Must(corev1.AddToScheme(scheme))
+	ctx := context.TODO()
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "test"},
+		Spec:       gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{ClientSecretName: "secret"}}},
+	}
+	failed := []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
 
-	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+	tests := map[string]struct {
+		disabled          bool
+		credentialVersion string
+		withoutVersion    bool
+		conditions        []batchv1.JobCondition
+		expectedRerun     bool
+	}{
+		"failed job with changed credential": {
+			credentialVersion: "test/secret=1",
+			conditions:        failed,
+			expectedRerun:     true,
+		},
+		"failed job created before the secret": {
+			conditions:    failed,
+			expectedRerun: true,
+		},
+		"failed job created without credential version": {
+			withoutVersion: true,
+			conditions:     failed,
+		},
+		"failed job with unchanged credential": {
+			credentialVersion: "test/secret=2",
+			conditions:        failed,
+		},
+		"running job with changed credential": {
+			credentialVersion: "test/secret=1",
+		},
+		"disabled": {
+			disabled:          true,
+			credentialVersion: "test/secret=1",
+			conditions:        failed,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			job := &batchv1.Job{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+				ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "test", Annotations: map[string]string{}},
+				Status:     batchv1.JobStatus{Conditions: test.conditions},
+			}
+			if !test.withoutVersion {
+				job.Annotations[credentialVersionAnnotation] = test.credentialVersion
+			}
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "test", ResourceVersion: "2"}}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(job, secret).Build()
+			r := GitJobReconciler{Client: client, Scheme: scheme, RerunFailedJobs: !test.disabled}
+
+			rerun, err := r.rerunFailedJob(ctx, gitJob, job)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if rerun != test.expectedRerun {
+				t.Errorf("expected rerun %v, got %v", test.expectedRerun, rerun)
+			}
+			err = client.Get(ctx, types.NamespacedName{Namespace: "test", Name: "job"}, &batchv1.Job{})
+			if deleted := errors.IsNotFound(err); deleted != test.expectedRerun {
+				t.Errorf("expected job deletion %v, got %v", test.expectedRerun, err)
+			}
+		})
+	}
+}
+
+func TestNewJobCrossNamespaceCredential(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	ctx := context.TODO()
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "team", UID: "gitjob-uid"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{
+			Repo: "repo",
+			Credential: gitjobv1.Credential{
+				ClientSecretRef: &gitjobv1.SecretReference{Name: "shared-credential", Namespace: "shared"},
+			},
+		}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared-credential", Namespace: "shared"},
 		Data: map[string][]byte{
 			corev1.BasicAuthUsernameKey: []byte("user"),
 			corev1.BasicAuthPasswordKey: []byte("pass"),
 		},
 		Type: corev1.SecretTypeBasicAuth,
-	}).Build()
+	}
+	grant := &gitjobv1.SecretGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shared"},
+		Spec: gitjobv1.SecretGrantSpec{
+			From: []gitjobv1.SecretGrantFrom{{Namespace: "team"}},
+			To:   []gitjobv1.SecretGrantTo{{Name: "shared-credential"}},
+		},
+	}
+
+	t.Run("granted", func(t *testing.T) {
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, grant).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+		job, err := r.newJob(ctx, gitJob)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var volumeSecret string
+		for _, volume := range job.Spec.Template.Spec.Volumes {
+			if volume.Name == gitCredentialVolumeName {
+				volumeSecret = volume.Secret.SecretName
+			}
+		}
+		if volumeSecret != "gitjob-git-credential" {
+			t.Errorf("expected the projected secret to be mounted, got %q", volumeSecret)
+		}
+
+		var projected corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &projected); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if projected.Type != secret.Type || !cmp.Equal(projected.Data, secret.Data) {
+			t.Errorf("expected projected secret to be a copy of %v, got %v", secret, projected)
+		}
+		if projected.Annotations[projectedFromAnnotation] != "shared/shared-credential" {
+			t.Errorf("unexpected projected-from annotation %q", projected.Annotations[projectedFromAnnotation])
+		}
+		if !metav1.IsControlledBy(&projected, gitJob) {
+			t.Errorf("expected projected secret to be owned by the gitjob")
+		}
+	})
+
+	t.Run("not granted", func(t *testing.T) {
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+		if _, err := r.newJob(ctx, gitJob); git.ErrorReason(err) != git.ReasonSecretNotGranted {
+			t.Fatalf("expected reason %s, got %v", git.ReasonSecretNotGranted, err)
+		}
+		err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &corev1.Secret{})
+		if !errors.IsNotFound(err) {
+			t.Errorf("expected no projected secret, got %v", err)
+		}
+	})
+
+	t.Run("projection of another type is replaced", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gitjob-git-credential", Namespace: "team"},
+			Data:       map[string][]byte{"token": []byte("old")},
+			Type:       corev1.SecretTypeOpaque,
+		}
+		utilruntime.Must(controllerutil.SetControllerReference(gitJob, existing, scheme))
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, grant, existing).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+		if _, err := r.newJob(ctx, gitJob); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var projected corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &projected); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if projected.Type != secret.Type || !cmp.Equal(projected.Data, secret.Data) {
+			t.Errorf("expected projected secret to be a copy of %v, got %v", secret, projected)
+		}
+	})
+
+	t.Run("annotated secret not controlled by the gitjob", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "gitjob-git-credential",
+				Namespace:   "team",
+				Annotations: map[string]string{projectedFromAnnotation: "shared/shared-credential"},
+			},
+			Data: map[string][]byte{"token": []byte("user data")},
+			Type: corev1.SecretTypeOpaque,
+		}
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, grant, existing).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+		if _, err := r.newJob(ctx, gitJob); err == nil {
+			t.Fatalf("expected error")
+		}
+		var unchanged corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &unchanged); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if unchanged.Type != existing.Type || !cmp.Equal(unchanged.Data, existing.Data) || len(unchanged.OwnerReferences) != 0 {
+			t.Errorf("expected existing secret to be unchanged, got %v", unchanged)
+		}
+	})
+
+	t.Run("existing secret is not a projection", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gitjob-git-credential", Namespace: "team"},
+			Data:       map[string][]byte{"token": []byte("user data")},
+			Type:       corev1.SecretTypeOpaque,
+		}
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, grant, existing).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test"}
+
+		if _, err := r.newJob(ctx, gitJob); err == nil {
+			t.Fatalf("expected error")
+		}
+		var unchanged corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &unchanged); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if unchanged.Type != existing.Type || !cmp.Equal(unchanged.Data, existing.Data) {
+			t.Errorf("expected existing secret to be unchanged, got %v", unchanged)
+		}
+	})
 }
 
-func sshSecretMock() client.Client {
+func TestDeleteRevokedProjection(t *testing.T) {
 	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
 	utilruntime.Must(corev1.AddToScheme(scheme))
+	ctx := context.TODO()
+	crossNamespace := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "team", UID: "gitjob-uid"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretRef: &gitjobv1.SecretReference{Name: "shared-credential", Namespace: "shared"},
+		}}},
+	}
+	local := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "team", UID: "gitjob-uid"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretName: "local-credential",
+		}}},
+	}
+	grant := &gitjobv1.SecretGrant{
+		ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shared"},
+		Spec:       gitjobv1.SecretGrantSpec{From: []gitjobv1.SecretGrantFrom{{Namespace: "team"}}},
+	}
 
-	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{Name: "secretName"},
+	tests := map[string]struct {
+		gitJob          *gitjobv1.GitJob
+		grant           bool
+		notOwned        bool
+		expectedDeleted bool
+	}{
+		"granted": {
+			gitJob: crossNamespace,
+			grant:  true,
+		},
+		"not granted": {
+			gitJob:          crossNamespace,
+			expectedDeleted: true,
+		},
+		"local secret": {
+			gitJob:          local,
+			grant:           true,
+			expectedDeleted: true,
+		},
+		"not owned by the gitjob": {
+			gitJob:   local,
+			notOwned: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			projected := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "gitjob-git-credential", Namespace: "team"}}
+			if !test.notOwned {
+				utilruntime.Must(controllerutil.SetControllerReference(test.gitJob, projected, scheme))
+			}
+			objs := []client.Object{projected}
+			if test.grant {
+				objs = append(objs, grant)
+			}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+			r := GitJobReconciler{Client: client, Scheme: scheme}
+
+			if err := r.deleteRevokedProjection(ctx, test.gitJob); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-git-credential"}, &corev1.Secret{})
+			if deleted := errors.IsNotFound(err); deleted != test.expectedDeleted {
+				t.Errorf("expected deletion %v, got %v", test.expectedDeleted, err)
+			}
+		})
+	}
+}
+
+func TestGitJobsForSecretGrant(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	ctx := context.TODO()
+	crossNamespace := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "cross-namespace", Namespace: "team"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretRef: &gitjobv1.SecretReference{Name: "secret", Namespace: "shared"},
+		}}},
+	}
+	otherNamespace := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "team"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretRef: &gitjobv1.SecretReference{Name: "secret", Namespace: "other"},
+		}}},
+	}
+	local := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "local", Namespace: "shared"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: gitjobv1.Credential{
+			ClientSecretRef: &gitjobv1.SecretReference{Name: "secret"},
+		}}},
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).
+		WithRuntimeObjects(crossNamespace, otherNamespace, local).
+		WithIndex(&gitjobv1.GitJob{}, secretRefNamespaceIndex, indexSecretRefNamespace).Build()
+	poller := mocks.NewMockGitPoller(mockCtrl)
+	poller.EXPECT().PollGitRepoWatch(ctx, gomock.Any()).Do(func(_ context.Context, gitJob gitjobv1.GitJob) {
+		if gitJob.Name != "cross-namespace" {
+			t.Errorf("unexpected poll of gitjob %s/%s", gitJob.Namespace, gitJob.Name)
+		}
+	}).Times(1)
+	r := GitJobReconciler{Client: client, Scheme: scheme, GitPoller: poller}
+
+	requests := r.gitJobsForSecretGrant(ctx, &gitjobv1.SecretGrant{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shared"}})
+	expected := []ctrl.Request{{NamespacedName: types.NamespacedName{Namespace: "team", Name: "cross-namespace"}}}
+	if !cmp.Equal(requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestNewJobControllerKnownHosts(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	ctx := context.TODO()
+	gitJob := &gitjobv1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "team", UID: "gitjob-uid"},
+		Spec: gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{
+			Repo: "repo",
+			Credential: gitjobv1.Credential{
+				ClientSecretName: "ssh-credential",
+			},
+		}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssh-credential", Namespace: "team"},
 		Data: map[string][]byte{
 			corev1.SSHAuthPrivateKey: []byte("ssh key"),
 		},
 		Type: corev1.SecretTypeSSHAuth,
-	}).Build()
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cattle-gitjob", Name: "known-hosts"},
+		Data: map[string]string{
+			sshauth.KnownHostsKey: "git.example.com ssh-ed25519 AAAA\n",
+		},
+	}
+	hostKeys := git.HostKeyOptions{KnownHostsConfigMap: types.NamespacedName{Namespace: "cattle-gitjob", Name: "known-hosts"}}
+
+	t.Run("projected", func(t *testing.T) {
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, configMap).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test", HostKeys: hostKeys}
+
+		job, err := r.newJob(ctx, gitJob)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, arg := range job.Spec.Template.Spec.InitContainers[0].Args {
+			if strings.Contains(arg, "ssh-ed25519") {
+				t.Errorf("expected known hosts not to be passed as an argument, got %q", arg)
+			}
+		}
+
+		var projected corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-known-hosts"}, &projected); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(projected.Data[sshauth.KnownHostsKey]) != configMap.Data[sshauth.KnownHostsKey] {
+			t.Errorf("expected projected known hosts %q, got %q", configMap.Data[sshauth.KnownHostsKey], projected.Data[sshauth.KnownHostsKey])
+		}
+		if !metav1.IsControlledBy(&projected, gitJob) {
+			t.Errorf("expected projected secret to be owned by the gitjob")
+		}
+	})
+
+	t.Run("existing secret not owned by the gitjob", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gitjob-known-hosts", Namespace: "team"},
+			Data:       map[string][]byte{"other": []byte("data")},
+		}
+		client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, configMap, existing).Build()
+		r := GitJobReconciler{Client: client, Scheme: scheme, Image: "test", HostKeys: hostKeys}
+
+		if _, err := r.newJob(ctx, gitJob); err == nil {
+			t.Fatalf("expected error")
+		}
+		var unchanged corev1.Secret
+		if err := client.Get(ctx, types.NamespacedName{Namespace: "team", Name: "gitjob-known-hosts"}, &unchanged); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !cmp.Equal(unchanged.Data, existing.Data) {
+			t.Errorf("expected existing secret to be unchanged, got %v", unchanged.Data)
+		}
+	})
 }
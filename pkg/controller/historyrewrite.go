@@ -0,0 +1,40 @@
+package controller
+
+import (
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// historyRewriteBlocked returns whether the job of the current commit is blocked, as the commit rewrote the history of
+// the branch and wasn't acknowledged yet.
+func historyRewriteBlocked(gitJob *v1.GitJob) bool {
+	rewrite := rewriteOfCommit(gitJob)
+	return rewrite != nil && gitJob.Spec.Git.HistoryRewritePolicy == v1.HistoryRewriteBlock &&
+		gitJob.Annotations[v1.AcknowledgeHistoryRewriteAnnotation] != rewrite.NewCommit
+}
+
+// alertHistoryRewrite emits a warning event, if the current commit rewrote the history of the branch and the GitJob's
+// policy is alert.
+func (r *GitJobReconciler) alertHistoryRewrite(gitJob *v1.GitJob) {
+	rewrite := rewriteOfCommit(gitJob)
+	if rewrite == nil || gitJob.Spec.Git.HistoryRewritePolicy != v1.HistoryRewriteAlert {
+		return
+	}
+	r.Recorder.Eventf(gitJob, corev1.EventTypeWarning, v1.HistoryRewrittenCondition,
+		"History of the branch was rewritten, running job for %s which doesn't descend from the last executed commit %s",
+		rewrite.NewCommit, rewrite.OldCommit)
+}
+
+func rewriteOfCommit(gitJob *v1.GitJob) *v1.HistoryRewriteStatus {
+	rewrite := gitJob.Status.HistoryRewrite
+	if rewrite == nil || rewrite.NewCommit != gitJob.Status.Commit {
+		return nil
+	}
+
+	return rewrite
+}
+
+// acknowledgedRewriteChanged returns true if the annotation acknowledging a history rewrite changed.
+func acknowledgedRewriteChanged(oldGitJob, newGitJob *v1.GitJob) bool {
+	return oldGitJob.Annotations[v1.AcknowledgeHistoryRewriteAnnotation] != newGitJob.Annotations[v1.AcknowledgeHistoryRewriteAnnotation]
+}
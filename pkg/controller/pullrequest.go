@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"github.com/rancher/wrangler/v2/pkg/name"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	pullRequestLabel      = "gitjob.cattle.io/pull-request"
+	pullRequestAnnotation = "pull-request"
+	pullRequestEventType  = "pull_request"
+
+	pullRequestActionOpen   = "open"
+	pullRequestActionClosed = "closed"
+)
+
+// reconcilePullRequests runs a job for every open pull request in the status of the GitJob, and a teardown job for
+// closed ones. Closed pull requests are removed from the status once their teardown job completed, and the jobs of
+// pull requests which are no longer in the status are deleted. Pull requests from forks are removed, unless the GitJob
+// allows them. The status is updated by the caller.
+func (r *GitJobReconciler) reconcilePullRequests(ctx context.Context, gitJob *v1.GitJob) error {
+	var jobList batchv1.JobList
+	if err := r.List(ctx, &jobList, client.InNamespace(gitJob.Namespace), client.MatchingLabels{gitJobLabel: gitJob.Name}, client.HasLabels{pullRequestLabel}); err != nil {
+		return fmt.Errorf("error listing pull request jobs: %v", err)
+	}
+	jobs := map[string]*batchv1.Job{}
+	for i := range jobList.Items {
+		if metav1.IsControlledBy(&jobList.Items[i], gitJob) {
+			jobs[jobList.Items[i].Name] = &jobList.Items[i]
+		}
+	}
+
+	var pullRequests []v1.PullRequestStatus
+	numbers := map[string]bool{}
+	for _, pr := range gitJob.Status.PullRequests {
+		pr := pr
+		if isFork(gitJob, &pr) && !gitJob.Spec.Git.PullRequest.AllowForks {
+			continue
+		}
+		job, found := jobs[pullRequestJobName(gitJob, &pr)]
+		if !found {
+			if err := r.createPullRequestJob(ctx, gitJob, &pr); err != nil {
+				return fmt.Errorf("error creating job for pull request %d: %v", pr.Number, err)
+			}
+		} else {
+			result, err := computeJobStatus(job)
+			if err != nil {
+				return err
+			}
+			pr.JobStatus = result.Status.String()
+			if result.Status == status.CurrentStatus && strings.Contains(result.Message, "Job Completed") {
+				pr.LastExecutedCommit = job.Annotations["commit"]
+				if pr.Closed {
+					// teardown is done, forget about the pull request
+					continue
+				}
+			}
+		}
+		numbers[strconv.Itoa(pr.Number)] = true
+		pullRequests = append(pullRequests, pr)
+	}
+	gitJob.Status.PullRequests = pullRequests
+
+	for _, job := range jobs {
+		if numbers[job.Annotations[pullRequestAnnotation]] {
+			continue
+		}
+		r.Log.Info("pull request job deletion triggered", "job", job.Name, "pullRequest", job.Annotations[pullRequestAnnotation])
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error deleting job: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *GitJobReconciler) createPullRequestJob(ctx context.Context, gitJob *v1.GitJob, pr *v1.PullRequestStatus) error {
+	job, err := r.newPullRequestJob(ctx, gitJob, pr)
+	if err != nil {
+		return err
+	}
+	if err := controllerutil.SetControllerReference(gitJob, job, r.Scheme); err != nil {
+		return err
+	}
+
+	return r.Create(ctx, job)
+}
+
+// newPullRequestJob creates the job for a pull request. Open pull requests clone the head branch, teardown jobs for
+// closed pull requests clone the base branch, as the head branch might have been deleted.
+func (r *GitJobReconciler) newPullRequestJob(ctx context.Context, gitJob *v1.GitJob, pr *v1.PullRequestStatus) (*batchv1.Job, error) {
+	prGitJob := gitJob.DeepCopy()
+	prGitJob.Spec.Git.Revision = ""
+	prGitJob.Status.Commit = pr.HeadCommit
+	prGitJob.Status.Event = pullRequestEventType
+	action := pullRequestActionOpen
+	if pr.Closed {
+		action = pullRequestActionClosed
+		prGitJob.Spec.Git.Branch = pr.BaseBranch
+	} else {
+		prGitJob.Spec.Git.Branch = pr.HeadBranch
+		if isFork(gitJob, pr) {
+			prGitJob.Spec.Git.Repo = pr.HeadRepo
+		}
+	}
+
+	job, err := r.newJob(ctx, prGitJob)
+	if err != nil {
+		return nil, err
+	}
+	number := strconv.Itoa(pr.Number)
+	job.Name = pullRequestJobName(gitJob, pr)
+	job.Labels = map[string]string{
+		gitJobLabel:      gitJob.Name,
+		pullRequestLabel: number,
+	}
+	job.Annotations[pullRequestAnnotation] = number
+	for i := range job.Spec.Template.Spec.Containers {
+		job.Spec.Template.Spec.Containers[i].Env = append(job.Spec.Template.Spec.Containers[i].Env,
+			corev1.EnvVar{Name: "PULL_REQUEST_NUMBER", Value: number},
+			corev1.EnvVar{Name: "PULL_REQUEST_HEAD_COMMIT", Value: pr.HeadCommit},
+			corev1.EnvVar{Name: "PULL_REQUEST_HEAD_BRANCH", Value: pr.HeadBranch},
+			corev1.EnvVar{Name: "PULL_REQUEST_BASE_BRANCH", Value: pr.BaseBranch},
+			corev1.EnvVar{Name: "PULL_REQUEST_ACTION", Value: action},
+		)
+	}
+
+	return job, nil
+}
+
+// isFork returns true if the head of the pull request is in another repo than the GitJob.
+func isFork(gitJob *v1.GitJob, pr *v1.PullRequestStatus) bool {
+	return pr.HeadRepo != "" && !giturls.SameRepo(pr.HeadRepo, gitJob.Spec.Git.Repo)
+}
+
+// pullRequestsChanged returns true if a pull request was added, removed, updated or closed.
+func pullRequestsChanged(oldPullRequests, newPullRequests []v1.PullRequestStatus) bool {
+	if len(oldPullRequests) != len(newPullRequests) {
+		return true
+	}
+	for i := range oldPullRequests {
+		if oldPullRequests[i].Number != newPullRequests[i].Number ||
+			oldPullRequests[i].HeadCommit != newPullRequests[i].HeadCommit ||
+			oldPullRequests[i].Closed != newPullRequests[i].Closed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func pullRequestJobName(obj *v1.GitJob, pr *v1.PullRequestStatus) string {
+	action := pullRequestActionOpen
+	if pr.Closed {
+		action = pullRequestActionClosed
+	}
+
+	return name.SafeConcatName(obj.Name, "pr", strconv.Itoa(pr.Number), name.Hex(obj.Spec.Git.Repo+pr.HeadCommit+action, 5))
+}
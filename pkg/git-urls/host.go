@@ -0,0 +1,13 @@
+package giturls
+
+import "net/url"
+
+// HTTPSHost returns the host of the repo's web server and API. The port of ssh and scp-like URLs is the port of the
+// SSH server, so it is dropped. The port of http(s) URLs is kept.
+func HTTPSHost(repo *url.URL) string {
+	if repo.Scheme == "http" || repo.Scheme == "https" {
+		return repo.Host
+	}
+
+	return repo.Hostname()
+}
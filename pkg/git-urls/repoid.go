@@ -0,0 +1,68 @@
+package giturls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RepoID returns the identity of the repo at rawurl as "host/path". URLs of the same repo result in the same identity,
+// regardless of their transport (https, ssh or scp-like), user, port, case, trailing slash and ".git" suffix. Azure
+// DevOps URLs are normalized to "dev.azure.com/<organization>/<project>/<repo>".
+func RepoID(rawurl string) (string, error) {
+	u, err := Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.ToLower(u.Hostname())
+	path := strings.ToLower(strings.Trim(u.Path, "/"))
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+	if host == "" || path == "" {
+		return "", fmt.Errorf("no host or path in %q", rawurl)
+	}
+
+	if id, ok := azureDevOpsRepoID(host, strings.Split(path, "/")); ok {
+		return id, nil
+	}
+
+	return host + "/" + path, nil
+}
+
+// azureDevOpsRepoID returns the identity of Azure DevOps repos, which have different paths for https and ssh URLs:
+//
+//	https://dev.azure.com/<organization>/<project>/_git/<repo>
+//	git@ssh.dev.azure.com:v3/<organization>/<project>/<repo>
+//	https://<organization>.visualstudio.com/[DefaultCollection/]<project>/_git/<repo>
+//	git@vs-ssh.visualstudio.com:v3/<organization>/<project>/<repo>
+func azureDevOpsRepoID(host string, parts []string) (string, bool) {
+	const azureHost = "dev.azure.com"
+
+	switch {
+	case (host == "ssh."+azureHost || host == "vs-ssh.visualstudio.com") && len(parts) == 4 && parts[0] == "v3":
+		return strings.Join(append([]string{azureHost}, parts[1:]...), "/"), true
+	case host == azureHost && len(parts) == 4 && parts[2] == "_git":
+		return strings.Join([]string{azureHost, parts[0], parts[1], parts[3]}, "/"), true
+	case strings.HasSuffix(host, ".visualstudio.com"):
+		if len(parts) == 4 && parts[0] == "defaultcollection" {
+			parts = parts[1:]
+		}
+		if len(parts) == 3 && parts[1] == "_git" {
+			org := strings.TrimSuffix(host, ".visualstudio.com")
+			return strings.Join([]string{azureHost, org, parts[0], parts[2]}, "/"), true
+		}
+	}
+
+	return "", false
+}
+
+// SameRepo returns true if both URLs point to the same repo. URLs whose identity can't be determined are compared as
+// is.
+func SameRepo(a, b string) bool {
+	idA, errA := RepoID(a)
+	idB, errB := RepoID(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	return idA == idB
+}
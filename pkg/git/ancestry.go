@@ -0,0 +1,110 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxAncestryDepth is the number of commits of a branch fetched to check whether a commit descends from another one.
+// Commits further behind the head of the branch are treated as not being an ancestor.
+const maxAncestryDepth = 1000
+
+// IsAncestor returns whether ancestor is an ancestor of commit, or the same commit, on the branch of the gitjob's repo.
+// Only the last maxAncestryDepth commits of the branch are fetched, without their files.
+func (f *Fetch) IsAncestor(ctx context.Context, gitjob *gitjobv1.GitJob, client client.Client, branch, ancestor, commit string) (bool, error) {
+	if err := validateBranch(branch); err != nil {
+		return false, err
+	}
+	if err := validateCommit(ancestor); err != nil {
+		return false, err
+	}
+	if err := validateCommit(commit); err != nil {
+		return false, err
+	}
+	git, err := f.gitForGitJob(ctx, gitjob, client)
+	if err != nil {
+		return false, err
+	}
+
+	return git.isAncestor(ctx, branch, ancestor, commit)
+}
+
+func (g *git) isAncestor(ctx context.Context, branch, ancestor, commit string) (bool, error) {
+	if ancestor == commit {
+		return true, nil
+	}
+
+	repo, err := gogit.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := g.fetchBranch(ctx, repo, branch); err != nil {
+		return false, err
+	}
+
+	// walk the fetched history of commit, which ends at the shallow boundary. A commit which is not on the branch
+	// doesn't descend from anything on it.
+	start := plumbing.NewHash(commit)
+	if _, err := repo.CommitObject(start); errors.Is(err, plumbing.ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	target := plumbing.NewHash(ancestor)
+	seen := map[plumbing.Hash]bool{start: true}
+	queue := []plumbing.Hash{start}
+	for len(queue) > 0 {
+		c, err := repo.CommitObject(queue[0])
+		queue = queue[1:]
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		for _, parent := range c.ParentHashes {
+			if parent == target {
+				return true, nil
+			}
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// fetchBranch fetches the last maxAncestryDepth commits of the branch into repo.
+func (g *git) fetchBranch(ctx context.Context, repo *gogit.Repository, branch string) error {
+	ref := formatRefForBranch(branch)
+	if g.clientCert != nil || len(g.headers) > 0 {
+		return g.fetchWithClient(ctx, repo.Storer, ref)
+	}
+
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: gogit.DefaultRemoteName, URLs: []string{g.URL}})
+	if err != nil {
+		return err
+	}
+	err = remote.FetchContext(ctx, &gogit.FetchOptions{
+		RefSpecs:        []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))},
+		Depth:           maxAncestryDepth,
+		Auth:            g.auth,
+		CABundle:        g.caBundle,
+		InsecureSkipTLS: g.insecureTLSVerify,
+		Tags:            gogit.NoTags,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return err
+	}
+
+	return nil
+}
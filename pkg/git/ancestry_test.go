@@ -0,0 +1,169 @@
+package git
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+func TestIsAncestor(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	commit := func(msg string) string {
+		hash, err := wt.Commit(msg, &gogit.CommitOptions{
+			AllowEmptyCommits: true,
+			Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return hash.String()
+	}
+	first := commit("first")
+	second := commit("second")
+	third := commit("third")
+	if err := wt.Checkout(&gogit.CheckoutOptions{Hash: plumbing.NewHash(first), Branch: "refs/heads/rewritten", Create: true}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rewritten := commit("rewritten")
+
+	tests := map[string]struct {
+		branch   string
+		ancestor string
+		commit   string
+		expected bool
+	}{
+		"descendant": {
+			branch:   "master",
+			ancestor: first,
+			commit:   third,
+			expected: true,
+		},
+		"same commit": {
+			branch:   "master",
+			ancestor: second,
+			commit:   second,
+			expected: true,
+		},
+		"older commit": {
+			branch:   "master",
+			ancestor: third,
+			commit:   first,
+			expected: false,
+		},
+		"rewritten history": {
+			branch:   "rewritten",
+			ancestor: second,
+			commit:   rewritten,
+			expected: false,
+		},
+		"commit not on branch": {
+			branch:   "master",
+			ancestor: first,
+			commit:   rewritten,
+			expected: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			g := &git{URL: dir}
+			isAncestor, err := g.isAncestor(context.TODO(), test.branch, test.ancestor, test.commit)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if isAncestor != test.expected {
+				t.Errorf("expected %v, but got %v", test.expected, isAncestor)
+			}
+		})
+	}
+}
+
+// newUploadPackHandler serves the repo in dir at /repo with the smart HTTP protocol of git.
+func newUploadPackHandler(t *testing.T, dir string) http.HandlerFunc {
+	ep, err := transport.NewEndpoint(filepath.Join(dir, ".git"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := server.DefaultServer.NewUploadPackSession(ep, nil)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+		switch r.URL.Path {
+		case "/repo/info/refs":
+			advRefs, err := session.AdvertisedReferencesContext(r.Context())
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+			advRefs.Prefix = [][]byte{[]byte("# service=git-upload-pack"), pktline.Flush}
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			if err := advRefs.Encode(w); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		case "/repo/git-upload-pack":
+			req := packp.NewUploadPackRequest()
+			if err := req.UploadRequest.Decode(r.Body); err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+			res, err := session.UploadPack(r.Context(), req)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			if err := res.Encode(w); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+// newTestRepo creates a repo with the given number of commits on master, and returns its dir and commits.
+func newTestRepo(t *testing.T, commits int) (string, []string) {
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var hashes []string
+	for i := 0; i < commits; i++ {
+		hash, err := wt.Commit("commit", &gogit.CommitOptions{
+			AllowEmptyCommits: true,
+			Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		hashes = append(hashes, hash.String())
+	}
+
+	return dir, hashes
+}
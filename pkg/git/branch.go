@@ -0,0 +1,50 @@
+package git
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// branchPatternRegexpPrefix marks a branch pattern as a regular expression instead of a glob.
+const branchPatternRegexpPrefix = "regexp:"
+
+// BranchMatcher matches branch names against the branchPattern of a GitJob.
+type BranchMatcher struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// NewBranchMatcher returns a BranchMatcher for pattern. The pattern is a glob as understood by path.Match, where
+// "*" does not match "/", unless it is prefixed with "regexp:". Like globs, regular expressions match the whole branch
+// name.
+func NewBranchMatcher(pattern string) (*BranchMatcher, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("invalid branch pattern: cannot be empty")
+	}
+
+	if expr, ok := strings.CutPrefix(pattern, branchPatternRegexpPrefix); ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid branch pattern: %w", err)
+		}
+		return &BranchMatcher{regexp: re}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid branch pattern: %w", err)
+	}
+
+	return &BranchMatcher{glob: pattern}, nil
+}
+
+// Match returns true if branch matches the pattern.
+func (m *BranchMatcher) Match(branch string) bool {
+	if m.regexp != nil {
+		return m.regexp.MatchString(branch)
+	}
+	matched, _ := path.Match(m.glob, branch)
+
+	return matched
+}
@@ -0,0 +1,56 @@
+package git
+
+import "testing"
+
+func TestBranchMatcher(t *testing.T) {
+	tests := map[string]struct {
+		pattern  string
+		branch   string
+		expected bool
+	}{
+		"glob": {
+			pattern:  "release/*",
+			branch:   "release/v1",
+			expected: true,
+		},
+		"glob does not match across slashes": {
+			pattern: "release/*",
+			branch:  "release/v1/fix",
+		},
+		"regexp": {
+			pattern:  "regexp:release-.*",
+			branch:   "release-1",
+			expected: true,
+		},
+		"regexp does not match a prefix": {
+			pattern: "regexp:release-.*",
+			branch:  "prerelease-1",
+		},
+		"regexp does not match a suffix": {
+			pattern: "regexp:release",
+			branch:  "release-1",
+		},
+		"regexp with alternatives": {
+			pattern:  "regexp:main|release-.*",
+			branch:   "release-1",
+			expected: true,
+		},
+		"regexp with anchors": {
+			pattern:  "regexp:^feature/.*$",
+			branch:   "feature/x",
+			expected: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			matcher, err := NewBranchMatcher(test.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if matched := matcher.Match(test.branch); matched != test.expected {
+				t.Errorf("expected match %v, got %v", test.expected, matched)
+			}
+		})
+	}
+}
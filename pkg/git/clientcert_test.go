@@ -0,0 +1,212 @@
+package git
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestListRefsWithClientCert(t *testing.T) {
+	ca, caKey, caPEM := newTestCA(t)
+	serverCert := newTestCert(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/info/refs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		advRefs := packp.NewAdvRefs()
+		head := plumbing.NewHash(headCommit)
+		advRefs.Head = &head
+		advRefs.References["refs/heads/main"] = head
+		advRefs.Prefix = [][]byte{[]byte("# service=git-upload-pack"), pktline.Flush}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		if err := advRefs.Encode(w); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	tests := map[string]struct {
+		secret      *corev1.Secret
+		expectedErr bool
+	}{
+		"client certificate": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					corev1.TLSCertKey:       clientCert.certPEM,
+					corev1.TLSPrivateKeyKey: clientCert.keyPEM,
+				},
+			},
+		},
+		"no client certificate": {
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			g, err := newGit("", server.URL+"/repo", &options{Credential: test.secret, CABundle: caPEM})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			commit, err := g.lsRemote("main", "")
+			if test.expectedErr {
+				if err == nil {
+					t.Errorf("expected the server to reject the connection")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if commit != headCommit {
+				t.Errorf("expected commit %s, but got %s", headCommit, commit)
+			}
+		})
+	}
+}
+
+func TestIsAncestorWithClientCert(t *testing.T) {
+	ca, caKey, caPEM := newTestCA(t)
+	serverCert := newTestCert(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+	dir, commits := newTestRepo(t, 2)
+
+	server := httptest.NewUnstartedServer(newUploadPackHandler(t, dir))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	g, err := newGit("", server.URL+"/repo", &options{CABundle: caPEM, Credential: &corev1.Secret{
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       clientCert.certPEM,
+			corev1.TLSPrivateKeyKey: clientCert.keyPEM,
+		},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	isAncestor, err := g.isAncestor(context.TODO(), "master", commits[0], commits[1])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !isAncestor {
+		t.Errorf("expected %s to be an ancestor of %s", commits[0], commits[1])
+	}
+	if _, err := g.isAncestor(context.TODO(), "missing", commits[0], commits[1]); err == nil {
+		t.Errorf("expected an error for a missing branch")
+	}
+}
+
+func TestInvalidClientCert(t *testing.T) {
+	_, err := newGit("", "https://example.com/repo", &options{Credential: &corev1.Secret{
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte("cert"),
+			corev1.TLSPrivateKeyKey: []byte("key"),
+		},
+	}})
+	if ErrorReason(err) != ReasonInvalidCredential {
+		t.Errorf("expected invalid credential, but got %v", err)
+	}
+}
+
+type testCert struct {
+	tls     tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	return ca, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	return testCert{tls: cert, certPEM: certPEM, keyPEM: keyPEM}
+}
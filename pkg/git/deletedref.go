@@ -0,0 +1,20 @@
+package git
+
+import (
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+)
+
+// ClearDeletedRef removes the deleted ref from the status of the gitjob and sets the RefDeleted condition to false, if
+// a ref was deleted.
+func ClearDeletedRef(gitjob *gitjobv1.GitJob) {
+	if gitjob.Status.DeletedRef == nil {
+		return
+	}
+
+	gitjob.Status.DeletedRef = nil
+	c := condition.Cond(gitjobv1.RefDeletedCondition)
+	c.SetStatusBool(gitjob, false)
+	c.Reason(gitjob, "")
+	c.Message(gitjob, "")
+}
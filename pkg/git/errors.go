@@ -0,0 +1,92 @@
+package git
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	"github.com/rancher/gitjob/pkg/sshauth"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Reasons of a failed poll, as returned by ErrorReason.
+const (
+	ReasonAuthFailed         = "AuthFailed"
+	ReasonNotFound           = "NotFound"
+	ReasonTimeout            = "Timeout"
+	ReasonInvalidBranch      = "InvalidBranch"
+	ReasonInvalidURL         = "InvalidURL"
+	ReasonInvalidCredential  = "InvalidCredential"
+	ReasonInvalidPassphrase  = "InvalidPassphrase"
+	ReasonCertificateExpired = "CertificateExpired"
+	ReasonSecretNotGranted   = "SecretNotGranted"
+	ReasonHostKeyMismatch    = "HostKeyMismatch"
+	ReasonHostKeyUnknown     = "HostKeyUnknown"
+	ReasonTLSError           = "TLSError"
+	ReasonNetworkError       = "NetworkError"
+	ReasonUnknown            = "Unknown"
+)
+
+var (
+	errInvalidBranch     = errors.New("invalid branch name")
+	errBranchNotFound    = errors.New("branch not found")
+	errInvalidURL        = errors.New("invalid url")
+	errInvalidCredential = errors.New("invalid git credential")
+)
+
+// ErrorReason classifies an error returned by Fetch into one of the Reason constants.
+func ErrorReason(err error) string {
+	var (
+		netErr      net.Error
+		dnsErr      *net.DNSError
+		opErr       *net.OpError
+		keyErr      *knownhosts.KeyError
+		unknownErr  *sshauth.HostKeyUnknownError
+		unknownCA   x509.UnknownAuthorityError
+		invalidCert x509.CertificateInvalidError
+		hostnameErr x509.HostnameError
+		verifyErr   *tls.CertificateVerificationError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errInvalidBranch), errors.Is(err, errBranchNotFound):
+		return ReasonInvalidBranch
+	case errors.Is(err, errInvalidURL):
+		return ReasonInvalidURL
+	case errors.Is(err, sshauth.ErrPassphraseMissing), errors.Is(err, sshauth.ErrWrongPassphrase):
+		return ReasonInvalidPassphrase
+	case errors.Is(err, ErrSecretNotGranted):
+		return ReasonSecretNotGranted
+	case errors.Is(err, sshauth.ErrCertificateExpired):
+		return ReasonCertificateExpired
+	case errors.Is(err, errInvalidCredential), errors.Is(err, sshauth.ErrInvalidCertificate):
+		return ReasonInvalidCredential
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		errors.Is(err, githubapp.ErrAuthFailed),
+		strings.Contains(err.Error(), "unable to authenticate"):
+		return ReasonAuthFailed
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return ReasonNotFound
+	case errors.As(err, &unknownErr):
+		return ReasonHostKeyUnknown
+	case errors.As(err, &keyErr):
+		return ReasonHostKeyMismatch
+	case errors.As(err, &unknownCA), errors.As(err, &invalidCert), errors.As(err, &hostnameErr), errors.As(err, &verifyErr):
+		return ReasonTLSError
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.As(err, &dnsErr), errors.As(err, &opErr):
+		return ReasonNetworkError
+	}
+
+	return ReasonUnknown
+}
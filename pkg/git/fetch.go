@@ -6,7 +6,6 @@ import (
 	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -14,20 +13,16 @@ const (
 	DefaultSecretName = "gitcredential" //nolint:gosec // this is a resource name
 )
 
-type Fetch struct{}
+type Fetch struct {
+	// ProtocolV2 lists only the refs needed with the git protocol v2, unless spec.git.protocolV2 of the gitjob is set
+	ProtocolV2 bool
+	// HostKeys configures the verification of SSH host keys
+	HostKeys HostKeyOptions
+}
 
 func (f *Fetch) LatestCommit(ctx context.Context, gitjob *gitjobv1.GitJob, client client.Client) (string, error) {
-	secretName := DefaultSecretName
-	if gitjob.Spec.Git.ClientSecretName != "" {
-		secretName = gitjob.Spec.Git.ClientSecretName
-	}
-	var secret corev1.Secret
-	err := client.Get(ctx, types.NamespacedName{
-		Namespace: gitjob.Namespace,
-		Name:      secretName,
-	}, &secret)
-
-	if err != nil && !errors.IsNotFound(err) {
+	git, err := f.gitForGitJob(ctx, gitjob, client)
+	if err != nil {
 		return "", err
 	}
 
@@ -36,14 +31,55 @@ func (f *Fetch) LatestCommit(ctx context.Context, gitjob *gitjobv1.GitJob, clien
 		branch = "master"
 	}
 
-	git, err := newGit("", gitjob.Spec.Git.Repo, &options{
-		CABundle:          gitjob.Spec.Git.Credential.CABundle,
-		Credential:        &secret,
-		InsecureTLSVerify: gitjob.Spec.Git.Credential.InsecureSkipTLSverify,
-	})
+	return git.lsRemote(branch, gitjob.Status.Commit)
+}
+
+// LatestBranchCommits returns the HEAD commit SHA of every branch matching the gitjob's branchPattern, keyed by branch name.
+func (f *Fetch) LatestBranchCommits(ctx context.Context, gitjob *gitjobv1.GitJob, client client.Client) (map[string]string, error) {
+	matcher, err := NewBranchMatcher(gitjob.Spec.Git.BranchPattern)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return git.lsRemote(branch, gitjob.Status.Commit)
+	git, err := f.gitForGitJob(ctx, gitjob, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return git.lsRemoteBranches(matcher)
+}
+
+func (f *Fetch) gitForGitJob(ctx context.Context, gitjob *gitjobv1.GitJob, client client.Client) (*git, error) {
+	secretKey := ClientSecretKey(gitjob)
+	if secretKey.Name == "" {
+		secretKey.Name = DefaultSecretName
+	}
+	if err := CheckSecretGrant(ctx, client, gitjob, secretKey); err != nil {
+		return nil, err
+	}
+	var secret corev1.Secret
+	err := client.Get(ctx, secretKey, &secret)
+
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	knownHosts, err := f.HostKeys.KnownHosts(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	protocolV2 := f.ProtocolV2
+	if gitjob.Spec.Git.ProtocolV2 != nil {
+		protocolV2 = *gitjob.Spec.Git.ProtocolV2
+	}
+
+	return newGit("", gitjob.Spec.Git.Repo, &options{
+		CABundle:              gitjob.Spec.Git.Credential.CABundle,
+		Credential:            &secret,
+		InsecureTLSVerify:     gitjob.Spec.Git.Credential.InsecureSkipTLSverify,
+		Provider:              gitjob.Spec.Git.Provider,
+		ProviderAPIURL:        gitjob.Spec.Git.ProviderAPIURL,
+		ProtocolV2:            protocolV2,
+		KnownHosts:            knownHosts,
+		StrictHostKeyChecking: f.HostKeys.Strict(gitjob),
+	})
 }
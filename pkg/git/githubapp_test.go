@@ -0,0 +1,89 @@
+package git
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	httpgit "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGitHubAppCredential(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	minted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/app/installations/2/access_tokens":
+			minted++
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"token":"installation-token","expires_at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+		case "/api/v3/app/installations/3/access_tokens":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/api/v3/repos/org/repo/commits/main":
+			// the installation token authenticates API requests
+			if user, password, _ := r.BasicAuth(); user != githubapp.Username || password != "installation-token" {
+				t.Errorf("unexpected credentials %s:%s", user, password)
+			}
+			_, _ = w.Write([]byte(headCommit))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	secret := func(installationID string) *corev1.Secret {
+		return &corev1.Secret{
+			Type: githubapp.SecretType,
+			Data: map[string][]byte{
+				githubapp.AppIDKey:          []byte("1"),
+				githubapp.InstallationIDKey: []byte(installationID),
+				githubapp.PrivateKeyKey:     keyPEM,
+				githubapp.APIURLKey:         []byte(server.URL + "/api/v3"),
+			},
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		g, err := newGit("", "https://github.example.com/org/repo", &options{
+			Credential: secret("2"),
+			Provider:   ProviderGitHub,
+			// the API URL of the secret is used to mint tokens
+			ProviderAPIURL: server.URL + "/api/v3",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		auth, ok := g.auth.(*httpgit.BasicAuth)
+		if !ok || auth.Username != githubapp.Username || auth.Password != "installation-token" {
+			t.Errorf("unexpected auth %v", g.auth)
+		}
+		if changed, err := g.remoteSHAChanged("main", headCommit); err != nil || changed {
+			t.Errorf("expected unchanged commit, got %v, %v", changed, err)
+		}
+	}
+	if minted != 1 {
+		t.Errorf("expected the installation token to be cached, but it was minted %d times", minted)
+	}
+
+	_, err = newGit("", "https://github.example.com/org/repo", &options{Credential: secret("3")})
+	if !errors.Is(err, githubapp.ErrAuthFailed) || ErrorReason(err) != ReasonAuthFailed {
+		t.Errorf("expected %v, but got %v", githubapp.ErrAuthFailed, err)
+	}
+
+	_, err = newGit("", "git@github.com:org/repo", &options{Credential: secret("2")})
+	if ErrorReason(err) != ReasonInvalidCredential {
+		t.Errorf("expected invalid credential for ssh url, but got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package git
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/rancher/gitjob/pkg/httpauth"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestListRefsWithBearerTokenAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Tenant-Id") != "team-a" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		advRefs := packp.NewAdvRefs()
+		head := plumbing.NewHash(headCommit)
+		advRefs.Head = &head
+		advRefs.References["refs/heads/main"] = head
+		advRefs.Prefix = [][]byte{[]byte("# service=git-upload-pack"), pktline.Flush}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		if err := advRefs.Encode(w); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := map[string]struct {
+		secret      *corev1.Secret
+		expectedErr bool
+	}{
+		"bearer token with headers": {
+			secret: &corev1.Secret{
+				Type: httpauth.BearerTokenSecretType,
+				Data: map[string][]byte{
+					httpauth.TokenKey:   []byte("token\n"),
+					httpauth.HeadersKey: []byte("X-Tenant-Id: team-a"),
+				},
+			},
+		},
+		"headers only": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					httpauth.HeadersKey: []byte("Authorization: Bearer token\nX-Tenant-Id: team-a"),
+				},
+			},
+		},
+		"missing header": {
+			secret: &corev1.Secret{
+				Type: httpauth.BearerTokenSecretType,
+				Data: map[string][]byte{
+					httpauth.TokenKey: []byte("token"),
+				},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			g, err := newGit("", server.URL+"/repo", &options{Credential: test.secret})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			commit, err := g.lsRemote("main", "")
+			if test.expectedErr {
+				if err == nil {
+					t.Errorf("expected the server to reject the request")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if commit != headCommit {
+				t.Errorf("expected commit %s, but got %s", headCommit, commit)
+			}
+		})
+	}
+}
+
+func TestIsAncestorWithHeaders(t *testing.T) {
+	dir, commits := newTestRepo(t, 2)
+	handler := newUploadPackHandler(t, dir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant-Id") != "team-a" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	g, err := newGit("", server.URL+"/repo", &options{Credential: &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			httpauth.HeadersKey: []byte("X-Tenant-Id: team-a"),
+		},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	isAncestor, err := g.isAncestor(context.TODO(), "master", commits[0], commits[1])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !isAncestor {
+		t.Errorf("expected %s to be an ancestor of %s", commits[0], commits[1])
+	}
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	_, err := newGit("", "https://example.com/repo", &options{Credential: &corev1.Secret{
+		Type: corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("user"),
+			corev1.BasicAuthPasswordKey: []byte("pass"),
+			httpauth.HeadersKey:         []byte("X-Tenant-Id team-a"),
+		},
+	}})
+	if ErrorReason(err) != ReasonInvalidCredential {
+		t.Errorf("expected invalid credential, but got %v", err)
+	}
+}
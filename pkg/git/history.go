@@ -0,0 +1,70 @@
+package git
+
+import (
+	"context"
+	"fmt"
+
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ReasonForcePushed is the reason of the HistoryRewritten condition, if a commit doesn't descend from the last
+// executed commit.
+const ReasonForcePushed = "ForcePushed"
+
+// AncestryChecker checks whether a commit descends from another one on a branch of a GitJob's repo.
+type AncestryChecker interface {
+	IsAncestor(ctx context.Context, gitjob *gitjobv1.GitJob, client client.Client, branch, ancestor, commit string) (bool, error)
+}
+
+// HistoryRewrite returns the rewrite of the gitjob's branch, if commit doesn't descend from the last executed commit.
+// It is nil if the gitjob has no historyRewritePolicy, doesn't watch a single branch or didn't execute a commit yet.
+// Commits more than maxAncestryDepth commits ahead of the last executed commit are reported as a rewrite.
+func HistoryRewrite(ctx context.Context, checker AncestryChecker, gitjob *gitjobv1.GitJob, client client.Client, commit string) (*gitjobv1.HistoryRewriteStatus, error) {
+	last := gitjob.Status.LastExecutedCommit
+	if gitjob.Spec.Git.HistoryRewritePolicy == "" || gitjob.Spec.Git.BranchPattern != "" || gitjob.Spec.Git.OnTag != "" ||
+		last == "" || last == commit {
+		return nil, nil
+	}
+
+	branch := gitjob.Spec.Git.Branch
+	if branch == "" {
+		branch = "master"
+	}
+	ok, err := checker.IsAncestor(ctx, gitjob, client, branch, last, commit)
+	if err != nil {
+		return nil, fmt.Errorf("checking history of branch %s: %w", branch, err)
+	}
+	if ok {
+		return nil, nil
+	}
+
+	return &gitjobv1.HistoryRewriteStatus{OldCommit: last, NewCommit: commit}, nil
+}
+
+// SetHistoryRewrite stores the rewrite in the status of the gitjob and sets the HistoryRewritten condition to true. A
+// nil rewrite clears both.
+func SetHistoryRewrite(gitjob *gitjobv1.GitJob, rewrite *gitjobv1.HistoryRewriteStatus) {
+	c := condition.Cond(gitjobv1.HistoryRewrittenCondition)
+	if rewrite == nil {
+		if gitjob.Status.HistoryRewrite != nil {
+			gitjob.Status.HistoryRewrite = nil
+			c.SetStatusBool(gitjob, false)
+			c.Reason(gitjob, "")
+			c.Message(gitjob, "")
+		}
+		return
+	}
+
+	gitjob.Status.HistoryRewrite = rewrite
+	msg := fmt.Sprintf("history of the branch was rewritten, %s doesn't descend from the last executed commit %s",
+		rewrite.NewCommit, rewrite.OldCommit)
+	if gitjob.Spec.Git.HistoryRewritePolicy == gitjobv1.HistoryRewriteBlock {
+		msg += fmt.Sprintf(", the job is blocked until the GitJob is annotated with %s=%s",
+			gitjobv1.AcknowledgeHistoryRewriteAnnotation, rewrite.NewCommit)
+	}
+	c.SetStatusBool(gitjob, true)
+	c.Reason(gitjob, ReasonForcePushed)
+	c.Message(gitjob, msg)
+}
@@ -0,0 +1,69 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/sshauth"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// HostKeyOptions configures the verification of SSH host keys.
+type HostKeyOptions struct {
+	// KnownHostsConfigMap contains known_hosts entries of all git hosts, which are merged with the known_hosts of SSH
+	// credentials. It is not used if the name is empty
+	KnownHostsConfigMap types.NamespacedName
+	// StrictHostKeyChecking refuses to connect to SSH hosts without a known host key, unless
+	// spec.git.strictHostKeyChecking of the gitjob is set
+	StrictHostKeyChecking bool
+}
+
+// KnownHosts returns the known_hosts entries of the ConfigMap. A missing ConfigMap has no entries.
+func (o HostKeyOptions) KnownHosts(ctx context.Context, c client.Client) ([]byte, error) {
+	if o.KnownHostsConfigMap.Name == "" {
+		return nil, nil
+	}
+	var configMap corev1.ConfigMap
+	if err := c.Get(ctx, o.KnownHostsConfigMap, &configMap); apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading known hosts ConfigMap %s: %w", o.KnownHostsConfigMap, err)
+	}
+
+	return []byte(configMap.Data[sshauth.KnownHostsKey]), nil
+}
+
+// Strict returns whether unknown SSH hosts are refused for the gitjob.
+func (o HostKeyOptions) Strict(gitjob *gitjobv1.GitJob) bool {
+	if gitjob.Spec.Git.StrictHostKeyChecking != nil {
+		return *gitjob.Spec.Git.StrictHostKeyChecking
+	}
+
+	return o.StrictHostKeyChecking
+}
+
+// SetHostKeyUnknown sets the HostKeyUnknown condition to true, if err is caused by an unknown SSH host key. The
+// message contains the fingerprint of the offered key and the known_hosts line, which approves it. Other results
+// clear the condition.
+func SetHostKeyUnknown(gitjob *gitjobv1.GitJob, err error) {
+	c := condition.Cond(gitjobv1.HostKeyUnknownCondition)
+	var unknownErr *sshauth.HostKeyUnknownError
+	if !errors.As(err, &unknownErr) {
+		if c.GetStatus(gitjob) != "" {
+			c.SetStatusBool(gitjob, false)
+			c.Reason(gitjob, "")
+			c.Message(gitjob, "")
+		}
+		return
+	}
+
+	c.SetStatusBool(gitjob, true)
+	c.Reason(gitjob, ReasonHostKeyUnknown)
+	c.Message(gitjob, fmt.Sprintf("%s, add %q to the known hosts to approve it", unknownErr.Error(), unknownErr.KnownHostsLine()))
+}
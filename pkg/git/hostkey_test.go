@@ -0,0 +1,100 @@
+package git
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/sshauth"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKnownHosts(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cattle-gitjob", Name: "known-hosts"},
+		Data:       map[string]string{sshauth.KnownHostsKey: "git.example.com ssh-ed25519 AAAA"},
+	}).Build()
+
+	tests := map[string]struct {
+		configMap  types.NamespacedName
+		knownHosts string
+	}{
+		"configmap": {
+			configMap:  types.NamespacedName{Namespace: "cattle-gitjob", Name: "known-hosts"},
+			knownHosts: "git.example.com ssh-ed25519 AAAA",
+		},
+		"missing configmap": {
+			configMap: types.NamespacedName{Namespace: "cattle-gitjob", Name: "missing"},
+		},
+		"no configmap": {},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			knownHosts, err := HostKeyOptions{KnownHostsConfigMap: test.configMap}.KnownHosts(context.TODO(), c)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if string(knownHosts) != test.knownHosts {
+				t.Errorf("expected known hosts %q, got %q", test.knownHosts, knownHosts)
+			}
+		})
+	}
+}
+
+func TestStrict(t *testing.T) {
+	disabled := false
+	gitjob := &gitjobv1.GitJob{}
+	if !(HostKeyOptions{StrictHostKeyChecking: true}).Strict(gitjob) {
+		t.Errorf("expected strict host key checking of the controller")
+	}
+	gitjob.Spec.Git.StrictHostKeyChecking = &disabled
+	if (HostKeyOptions{StrictHostKeyChecking: true}).Strict(gitjob) {
+		t.Errorf("expected strict host key checking to be disabled by the gitjob")
+	}
+}
+
+func TestSetHostKeyUnknown(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	unknownErr := fmt.Errorf("listing refs: %w", &sshauth.HostKeyUnknownError{Host: "git.example.com:22", Key: key})
+	c := condition.Cond(gitjobv1.HostKeyUnknownCondition)
+	gitjob := &gitjobv1.GitJob{}
+
+	SetHostKeyUnknown(gitjob, errors.New("other error"))
+	if c.GetStatus(gitjob) != "" {
+		t.Errorf("expected no condition, got %q", c.GetStatus(gitjob))
+	}
+
+	SetHostKeyUnknown(gitjob, unknownErr)
+	if !c.IsTrue(gitjob) || c.GetReason(gitjob) != ReasonHostKeyUnknown {
+		t.Errorf("expected condition to be true with reason %s, got %q %q", ReasonHostKeyUnknown, c.GetStatus(gitjob), c.GetReason(gitjob))
+	}
+	if msg := c.GetMessage(gitjob); !strings.Contains(msg, ssh.FingerprintSHA256(key)) || !strings.Contains(msg, "git.example.com ssh-ed25519") {
+		t.Errorf("expected fingerprint and known hosts line in message, got %q", msg)
+	}
+	if reason := ErrorReason(unknownErr); reason != ReasonHostKeyUnknown {
+		t.Errorf("expected reason %s, got %s", ReasonHostKeyUnknown, reason)
+	}
+
+	SetHostKeyUnknown(gitjob, nil)
+	if !c.IsFalse(gitjob) || c.GetMessage(gitjob) != "" {
+		t.Errorf("expected condition to be cleared, got %q %q", c.GetStatus(gitjob), c.GetMessage(gitjob))
+	}
+}
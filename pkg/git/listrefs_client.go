@@ -0,0 +1,165 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	httpgit "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/rancher/gitjob/pkg/httpauth"
+)
+
+// listTimeout is the timeout of listing refs, the same as the default of go-git's Remote.List.
+const listTimeout = 10 * time.Second
+
+// listRefsWithClient lists the refs of the repo like go-git's Remote.List, but with an HTTP client presenting the
+// client certificate and sending the additional headers. go-git's remotes only use the HTTP client installed for all
+// repos.
+func (g *git) listRefsWithClient() (_ []*plumbing.Reference, err error) {
+	client, err := g.uploadPackClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.CloseIdleConnections()
+
+	// the client already applies the CA bundle and TLS verification setting, go-git can only apply them to a plain
+	// transport
+	ep, err := transport.NewEndpoint(g.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+	session, err := httpgit.NewClient(client).NewUploadPackSession(ep, g.auth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	advRefs, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := advRefs.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := refs.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		result = append(result, ref)
+		return nil
+	})
+
+	return result, err
+}
+
+// fetchWithClient fetches the last maxAncestryDepth commits of ref into the storer like go-git's Remote.Fetch, but with
+// an HTTP client presenting the client certificate and sending the additional headers. Only the objects are stored,
+// not the ref itself.
+func (g *git) fetchWithClient(ctx context.Context, s storage.Storer, ref string) (err error) {
+	client, err := g.uploadPackClient()
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+
+	ep, err := transport.NewEndpoint(g.URL)
+	if err != nil {
+		return err
+	}
+	session, err := httpgit.NewClient(client).NewUploadPackSession(ep, g.auth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	advRefs, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+	refs, err := advRefs.AllReferences()
+	if err != nil {
+		return err
+	}
+	head, err := refs.Reference(plumbing.ReferenceName(ref))
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return fmt.Errorf("%w: %s", errBranchNotFound, ref)
+	} else if err != nil {
+		return err
+	}
+
+	req := packp.NewUploadPackRequestFromCapabilities(advRefs.Capabilities)
+	req.Wants = []plumbing.Hash{head.Hash()}
+	if advRefs.Capabilities.Supports(capability.Shallow) {
+		req.Depth = packp.DepthCommits(maxAncestryDepth)
+		if err := req.Capabilities.Set(capability.Shallow); err != nil {
+			return err
+		}
+	}
+	if advRefs.Capabilities.Supports(capability.NoProgress) {
+		if err := req.Capabilities.Set(capability.NoProgress); err != nil {
+			return err
+		}
+	}
+
+	res, err := session.UploadPack(ctx, req)
+	if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := res.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var reader io.Reader = res
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		reader = sideband.NewDemuxer(sideband.Sideband64k, res)
+	case req.Capabilities.Supports(capability.Sideband):
+		reader = sideband.NewDemuxer(sideband.Sideband, res)
+	}
+
+	return packfile.UpdateObjectStorage(s, reader)
+}
+
+// uploadPackClient returns the HTTP client of the repo, which sends the additional headers. It has no timeout, as
+// requests are limited by their context.
+func (g *git) uploadPackClient() (*http.Client, error) {
+	client, err := g.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 0
+	if len(g.headers) > 0 {
+		client.Transport = &httpauth.Transport{Headers: g.headers, Next: client.Transport}
+	}
+
+	return client, nil
+}
@@ -0,0 +1,272 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gossh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	protocolV2Header = "Git-Protocol"
+	protocolV2       = "version=2"
+	uploadPack       = "git-upload-pack"
+)
+
+// errProtocolV2NotSupported is returned if the server doesn't support ls-refs of the git protocol v2.
+var errProtocolV2NotSupported = errors.New("git protocol v2 ls-refs not supported by the server")
+
+// lsRefsV2 lists the refs of the repo matching one of the prefixes with the ls-refs command of the git protocol v2.
+// Unlike the ref advertisement of the protocol v0, only the requested refs are sent by the server.
+func (g *git) lsRefsV2(prefixes []string) ([]*plumbing.Reference, error) {
+	u, err := giturls.Parse(g.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return g.lsRefsHTTP(prefixes)
+	case "ssh":
+		return g.lsRefsSSH(u.Host, u.Path, prefixes)
+	}
+
+	return nil, errProtocolV2NotSupported
+}
+
+func (g *git) lsRefsHTTP(prefixes []string) ([]*plumbing.Reference, error) {
+	client, err := g.httpClientWithCreds("")
+	if err != nil {
+		return nil, err
+	}
+	defer client.CloseIdleConnections()
+	repoURL := strings.TrimSuffix(g.URL, "/")
+
+	req, err := http.NewRequest(http.MethodGet, repoURL+"/info/refs?service="+uploadPack, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.setProtocolV2Headers(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := httpStatusError(resp); err != nil {
+		return nil, err
+	}
+	if err := readCapabilities(resp.Body); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	if err := writeLsRefs(&body, prefixes); err != nil {
+		return nil, err
+	}
+	req, err = http.NewRequest(http.MethodPost, repoURL+"/"+uploadPack, &body)
+	if err != nil {
+		return nil, err
+	}
+	g.setProtocolV2Headers(req)
+	req.Header.Set("Content-Type", "application/x-"+uploadPack+"-request")
+	req.Header.Set("Accept", "application/x-"+uploadPack+"-result")
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := httpStatusError(resp); err != nil {
+		return nil, err
+	}
+
+	return readRefs(resp.Body)
+}
+
+func (g *git) setProtocolV2Headers(req *http.Request) {
+	for k, v := range g.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(protocolV2Header, protocolV2)
+}
+
+func (g *git) lsRefsSSH(host, path string, prefixes []string) ([]*plumbing.Reference, error) {
+	auth, ok := g.auth.(*gossh.PublicKeys)
+	if !ok {
+		return nil, errProtocolV2NotSupported
+	}
+	config, err := auth.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	// the whole exchange is bounded by the list timeout, a server which doesn't answer must not block polling
+	config.Timeout = listTimeout
+	conn, err := net.DialTimeout("tcp", host, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(listTimeout)); err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, host, config)
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// servers which don't accept the variable answer with the protocol v0, which is detected by readCapabilities
+	_ = session.Setenv("GIT_PROTOCOL", protocolV2)
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Start(fmt.Sprintf("%s '%s'", uploadPack, strings.ReplaceAll(path, "'", `'\''`))); err != nil {
+		return nil, err
+	}
+
+	if err := readCapabilities(stdout); err != nil {
+		return nil, err
+	}
+	if err := writeLsRefs(stdin, prefixes); err != nil {
+		return nil, err
+	}
+	refs, err := readRefs(stdout)
+	if err != nil {
+		return nil, err
+	}
+	// end the session, the server closes the connection after a flush-pkt
+	_ = pktline.NewEncoder(stdin).Flush()
+
+	return refs, nil
+}
+
+// readCapabilities reads the capability advertisement of a protocol v2 server, and returns errProtocolV2NotSupported
+// if the server answered with the protocol v0 or doesn't support the ls-refs command.
+func readCapabilities(r io.Reader) error {
+	scanner := pktline.NewScanner(r)
+	if !scanner.Scan() {
+		return capabilitiesError(scanner.Err())
+	}
+	line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+	if strings.HasPrefix(line, "# service=") {
+		// some HTTP servers send the service line of the protocol v0 first
+		if !scanner.Scan() || len(scanner.Bytes()) != 0 || !scanner.Scan() {
+			return capabilitiesError(scanner.Err())
+		}
+		line = strings.TrimSuffix(string(scanner.Bytes()), "\n")
+	}
+	if line != "version 2" {
+		return errProtocolV2NotSupported
+	}
+
+	lsRefs := false
+	for scanner.Scan() {
+		capability := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		if capability == "" {
+			break
+		}
+		if capability == "ls-refs" || strings.HasPrefix(capability, "ls-refs=") {
+			lsRefs = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !lsRefs {
+		return errProtocolV2NotSupported
+	}
+
+	return nil
+}
+
+func capabilitiesError(err error) error {
+	if err != nil {
+		return err
+	}
+
+	return errProtocolV2NotSupported
+}
+
+// writeLsRefs writes an ls-refs command requesting the refs matching one of the prefixes.
+func writeLsRefs(w io.Writer, prefixes []string) error {
+	e := pktline.NewEncoder(w)
+	if err := e.EncodeString("command=ls-refs\n"); err != nil {
+		return err
+	}
+	// delim-pkt, which separates the capabilities from the arguments of the command
+	if _, err := w.Write([]byte("0001")); err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if err := e.Encodef("ref-prefix %s\n", prefix); err != nil {
+			return err
+		}
+	}
+
+	return e.Flush()
+}
+
+// readRefs reads the response of an ls-refs command, each line being "<oid> <ref name>[ <attributes>]".
+func readRefs(r io.Reader) ([]*plumbing.Reference, error) {
+	var refs []*plumbing.Reference
+	scanner := pktline.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		if line == "" {
+			return refs, nil
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid ls-refs response line %q", line)
+		}
+		if fields[0] == "unborn" {
+			continue
+		}
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(fields[1]), plumbing.NewHash(fields[0])))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("unexpected end of ls-refs response")
+}
+
+func httpStatusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return transport.ErrAuthenticationRequired
+	case http.StatusForbidden:
+		return transport.ErrAuthorizationFailed
+	case http.StatusNotFound:
+		return transport.ErrRepositoryNotFound
+	}
+
+	return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
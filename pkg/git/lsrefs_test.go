@@ -0,0 +1,206 @@
+package git
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLsRemoteProtocolV2(t *testing.T) {
+	tests := map[string]struct {
+		v2Server bool
+	}{
+		"protocol v2": {
+			v2Server: true,
+		},
+		"fallback to protocol v0": {
+			v2Server: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				lsRefsBody []byte
+				infoRefs   int
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				e := pktline.NewEncoder(w)
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/repo.git/info/refs":
+					infoRefs++
+					// the fallback to the protocol v0 requests the refs again, without the header
+					if infoRefs == 1 && r.Header.Get(protocolV2Header) != protocolV2 {
+						t.Errorf("expected header %s=%s, but got %s", protocolV2Header, protocolV2, r.Header.Get(protocolV2Header))
+					}
+					w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+					_ = e.EncodeString("# service=git-upload-pack\n")
+					_ = e.Flush()
+					if test.v2Server {
+						_ = e.EncodeString("version 2\n", "agent=git/2.42.0\n", "ls-refs=unborn\n", "fetch=shallow\n")
+					} else {
+						_ = e.EncodeString(headCommit+" HEAD\x00symref=HEAD:refs/heads/main\n", headCommit+" refs/heads/main\n")
+					}
+					_ = e.Flush()
+				case r.Method == http.MethodPost && r.URL.Path == "/repo.git/git-upload-pack" && test.v2Server:
+					lsRefsBody, _ = io.ReadAll(r.Body)
+					_ = e.EncodeString(headCommit + " refs/heads/main\n")
+					_ = e.Flush()
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.RequestURI())
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			g, err := newGit("", server.URL+"/repo.git", &options{ProtocolV2: true})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			commit, err := g.lsRemote("main", "")
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if commit != headCommit {
+				t.Errorf("expected commit %s, but got %s", headCommit, commit)
+			}
+
+			if test.v2Server {
+				expected := "0014command=ls-refs\n0001001fref-prefix refs/heads/main\n0000"
+				if string(lsRefsBody) != expected {
+					t.Errorf("expected ls-refs request %q, but got %q", expected, lsRefsBody)
+				}
+			}
+		})
+	}
+}
+
+func TestLsRefsSSHTimeout(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the server accepts connections, but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	g, err := newGit("", "ssh://git@"+l.Addr().String()+"/repo.git", &options{Credential: &corev1.Secret{
+		Type: corev1.SecretTypeSSHAuth,
+		Data: map[string][]byte{corev1.SSHAuthPrivateKey: pem.EncodeToMemory(block)},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	start := time.Now()
+	_, err = g.lsRefsSSH(l.Addr().String(), "/repo.git", []string{"refs/heads/main"})
+	if reason := ErrorReason(err); reason != ReasonTimeout {
+		t.Errorf("expected reason %q, but got %q: %v", ReasonTimeout, reason, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*listTimeout {
+		t.Errorf("expected the list timeout of %s, but listing took %s", listTimeout, elapsed)
+	}
+}
+
+func TestReadCapabilities(t *testing.T) {
+	tests := map[string]struct {
+		lines       []string
+		expectedErr error
+	}{
+		"ls-refs": {
+			lines: []string{"version 2\n", "ls-refs\n", ""},
+		},
+		"ls-refs with features": {
+			lines: []string{"version 2\n", "ls-refs=unborn\n", ""},
+		},
+		"without ls-refs": {
+			lines:       []string{"version 2\n", "fetch\n", ""},
+			expectedErr: errProtocolV2NotSupported,
+		},
+		"protocol v0": {
+			lines:       []string{headCommit + " refs/heads/main\x00multi_ack\n", ""},
+			expectedErr: errProtocolV2NotSupported,
+		},
+		"empty": {
+			lines:       []string{""},
+			expectedErr: errProtocolV2NotSupported,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			e := pktline.NewEncoder(&buf)
+			for _, line := range test.lines {
+				if line == "" {
+					_ = e.Flush()
+					continue
+				}
+				_ = e.EncodeString(line)
+			}
+
+			err := readCapabilities(&buf)
+			if err != test.expectedErr {
+				t.Errorf("expected error %v, but got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestReadRefs(t *testing.T) {
+	var buf bytes.Buffer
+	e := pktline.NewEncoder(&buf)
+	_ = e.EncodeString(
+		"unborn HEAD symref-target:refs/heads/main\n",
+		headCommit+" refs/heads/main\n",
+		headCommit+" refs/heads/dev peeled:"+headCommit+"\n",
+	)
+	_ = e.Flush()
+
+	refs, err := readRefs(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 refs, but got %v", refs)
+	}
+	if refs[0].Name().String() != "refs/heads/main" || refs[1].Name().String() != "refs/heads/dev" {
+		t.Errorf("unexpected refs %v", refs)
+	}
+	if refs[0].Hash().String() != headCommit {
+		t.Errorf("expected commit %s, but got %s", headCommit, refs[0].Hash())
+	}
+
+	if _, err := readRefs(bytes.NewBufferString("0010refs/heads\n")); err == nil {
+		t.Errorf("expected an error for a truncated response")
+	}
+}
@@ -1,33 +1,49 @@
 package git
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
 	gogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	httpgit "github.com/go-git/go-git/v5/plumbing/transport/http"
-	gossh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
 	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"github.com/rancher/gitjob/pkg/githubapp"
+	"github.com/rancher/gitjob/pkg/httpauth"
+	"github.com/rancher/gitjob/pkg/sshauth"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh"
 	corev1 "k8s.io/api/core/v1"
 )
 
+// maxCommitResponseSize limits the response read from a git provider's API when checking for a new commit.
+const maxCommitResponseSize = 1 << 20
+
+// githubAppTokens caches the installation tokens of GitHub App credentials between polls.
+var githubAppTokens = githubapp.NewTokenCache()
+
 type options struct {
 	Credential        *corev1.Secret
 	CABundle          []byte
 	InsecureTLSVerify bool
 	Headers           map[string]string
+	Provider          string
+	ProviderAPIURL    string
+	ProtocolV2        bool
+	// KnownHosts are merged with the known hosts of SSH credentials
+	KnownHosts []byte
+	// StrictHostKeyChecking rejects SSH hosts without a known host key
+	StrictHostKeyChecking bool
 }
 
 func newGit(directory, url string, opts *options) (*git, error) {
@@ -40,24 +56,45 @@ func newGit(directory, url string, opts *options) (*git, error) {
 	}
 
 	g := &git{
-		URL:               url,
-		Directory:         directory,
-		caBundle:          opts.CABundle,
-		insecureTLSVerify: opts.InsecureTLSVerify,
-		secret:            opts.Credential,
-		headers:           opts.Headers,
-	}
-	return g, g.setCredential(opts.Credential)
+		URL:                   url,
+		Directory:             directory,
+		caBundle:              opts.CABundle,
+		insecureTLSVerify:     opts.InsecureTLSVerify,
+		secret:                opts.Credential,
+		headers:               opts.Headers,
+		provider:              opts.Provider,
+		providerAPIURL:        opts.ProviderAPIURL,
+		protocolV2:            opts.ProtocolV2,
+		knownHosts:            opts.KnownHosts,
+		strictHostKeyChecking: opts.StrictHostKeyChecking,
+	}
+	if err := g.setCredential(opts.Credential); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidCredential, err)
+	}
+	if g.githubApp != nil {
+		if err := g.setGitHubAppToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
 }
 
 type git struct {
-	URL               string
-	Directory         string
-	caBundle          []byte
-	insecureTLSVerify bool
-	secret            *corev1.Secret
-	headers           map[string]string
-	auth              transport.AuthMethod
+	URL                   string
+	Directory             string
+	caBundle              []byte
+	insecureTLSVerify     bool
+	secret                *corev1.Secret
+	headers               map[string]string
+	auth                  transport.AuthMethod
+	githubApp             *githubapp.App
+	clientCert            *tls.Certificate
+	provider              string
+	providerAPIURL        string
+	protocolV2            bool
+	knownHosts            []byte
+	strictHostKeyChecking bool
 }
 
 // LsRemote runs ls-remote on git repo and returns the HEAD commit SHA
@@ -75,15 +112,7 @@ func (g *git) lsRemote(branch string, commit string) (string, error) {
 	}
 
 	refBranch := formatRefForBranch(branch)
-	rem := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
-		URLs: []string{g.URL},
-	})
-
-	refs, err := rem.List(&gogit.ListOptions{
-		Auth:            g.auth,
-		CABundle:        g.caBundle,
-		InsecureSkipTLS: g.insecureTLSVerify,
-	})
+	refs, err := g.listRefs(refBranch)
 	if err != nil {
 		return "", err
 	}
@@ -94,14 +123,62 @@ func (g *git) lsRemote(branch string, commit string) (string, error) {
 		}
 	}
 
-	return "", errors.New("commit not found")
+	return "", fmt.Errorf("%w: %s", errBranchNotFound, branch)
+}
+
+// lsRemoteBranches runs ls-remote on git repo and returns the HEAD commit SHA of every branch accepted by matcher
+func (g *git) lsRemoteBranches(matcher *BranchMatcher) (map[string]string, error) {
+	refs, err := g.listRefs(formatRefForBranch(""))
+	if err != nil {
+		return nil, err
+	}
+
+	commits := map[string]string{}
+	for _, ref := range refs {
+		if !ref.Name().IsBranch() {
+			continue
+		}
+		branch := ref.Name().Short()
+		if matcher.Match(branch) {
+			commits[branch] = ref.Hash().String()
+		}
+	}
+
+	return commits, nil
+}
+
+// listRefs lists the refs of the repo. If the git protocol v2 is enabled, only the refs matching one of the prefixes
+// are requested from the server. It falls back to listing all refs, if the server doesn't support the protocol v2.
+func (g *git) listRefs(prefixes ...string) ([]*plumbing.Reference, error) {
+	if g.protocolV2 && len(prefixes) > 0 {
+		refs, err := g.lsRefsV2(prefixes)
+		if err == nil {
+			return refs, nil
+		}
+		logrus.Debugf("Listing refs of repo [%v] with git protocol v2 failed, falling back to v0: %v", g.URL, err)
+	}
+
+	if g.clientCert != nil || len(g.headers) > 0 {
+		return g.listRefsWithClient()
+	}
+
+	rem := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		URLs: []string{g.URL},
+	})
+
+	return rem.List(&gogit.ListOptions{
+		Auth:            g.auth,
+		CABundle:        g.caBundle,
+		InsecureSkipTLS: g.insecureTLSVerify,
+	})
 }
 
-func (g *git) httpClientWithCreds() (*http.Client, error) {
+// httpClientWithCreds returns a client using the credential of the repo. The password of basic auth credentials is sent
+// in tokenHeader instead, if set. Bearer tokens are always sent in the Authorization header.
+func (g *git) httpClientWithCreds(tokenHeader string) (*http.Client, error) {
 	var (
-		username  string
-		password  string
-		tlsConfig tls.Config
+		username string
+		password string
 	)
 
 	if g.secret != nil {
@@ -109,25 +186,69 @@ func (g *git) httpClientWithCreds() (*http.Client, error) {
 		case corev1.SecretTypeBasicAuth:
 			username = string(g.secret.Data[corev1.BasicAuthUsernameKey])
 			password = string(g.secret.Data[corev1.BasicAuthPasswordKey])
-		case corev1.SecretTypeTLS:
-			cert, err := tls.X509KeyPair(g.secret.Data[corev1.TLSCertKey], g.secret.Data[corev1.TLSPrivateKeyKey])
-			if err != nil {
-				return nil, err
+		case githubapp.SecretType:
+			if auth, ok := g.auth.(*httpgit.BasicAuth); ok {
+				username, password = auth.Username, auth.Password
 			}
-			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
 		}
 	}
 
-	if len(g.caBundle) > 0 {
-		cert, err := x509.ParseCertificate(g.caBundle)
-		if err != nil {
-			return nil, err
+	client, err := g.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if auth, ok := g.auth.(*httpgit.TokenAuth); ok {
+		client.Transport = &httpauth.Transport{
+			Headers: map[string]string{"Authorization": "Bearer " + auth.Token},
+			Next:    client.Transport,
+		}
+	}
+	if username != "" || password != "" {
+		client.Transport = &basicRoundTripper{
+			username:    username,
+			password:    password,
+			tokenHeader: tokenHeader,
+			next:        client.Transport,
 		}
+	}
+
+	return client, nil
+}
+
+// hasAPICredential returns whether the credential of the repo can authenticate requests to the provider's API.
+func (g *git) hasAPICredential() bool {
+	if g.githubApp != nil {
+		return true
+	}
+	if _, ok := g.auth.(*httpgit.TokenAuth); ok {
+		return true
+	}
+
+	return g.secret != nil && g.secret.Type == corev1.SecretTypeBasicAuth
+}
+
+// httpClient returns a client using the CA bundle and TLS settings of the repo, and the client certificate of TLS
+// credentials.
+func (g *git) httpClient() (*http.Client, error) {
+	var tlsConfig tls.Config
+
+	if g.clientCert != nil {
+		tlsConfig.Certificates = append(tlsConfig.Certificates, *g.clientCert)
+	}
+
+	if len(g.caBundle) > 0 {
 		pool, err := x509.SystemCertPool()
 		if err != nil {
 			pool = x509.NewCertPool()
 		}
-		pool.AddCert(cert)
+		// the CA bundle is PEM encoded, like for go-git, single DER encoded certificates are accepted as well
+		if !pool.AppendCertsFromPEM(g.caBundle) {
+			cert, err := x509.ParseCertificate(g.caBundle)
+			if err != nil {
+				return nil, err
+			}
+			pool.AddCert(cert)
+		}
 		tlsConfig.RootCAs = pool
 	}
 
@@ -135,41 +256,32 @@ func (g *git) httpClientWithCreds() (*http.Client, error) {
 	transport.TLSClientConfig = &tlsConfig
 	transport.TLSClientConfig.InsecureSkipVerify = g.insecureTLSVerify
 
-	client := &http.Client{
+	return &http.Client{
 		Transport: transport,
 		Timeout:   30 * time.Second,
-	}
-	if username != "" || password != "" {
-		client.Transport = &basicRoundTripper{
-			username: username,
-			password: password,
-			next:     client.Transport,
-		}
-	}
-
-	return client, nil
+	}, nil
 }
 
+// remoteSHAChanged asks the API of the repo's git provider whether the head commit of branch differs from sha. It
+// returns true if the provider is unknown or its API can't be used, so the refs of the repo are listed instead.
 func (g *git) remoteSHAChanged(branch, sha string) (bool, error) {
-	formattedURL := formatGitURL(g.URL, branch)
-	if formattedURL == "" {
+	req, api, err := newCommitRequest(g.provider, g.providerAPIURL, g.URL, branch, g.hasAPICredential())
+	if err != nil {
+		logrus.Warnf("Problem creating request to check git remote sha of repo [%v]: %v", g.URL, err)
 		return true, nil
 	}
-
-	client, err := g.httpClientWithCreds()
-	if err != nil {
-		logrus.Warnf("Problem creating http client to check git remote sha of repo [%v]: %v", g.URL, err)
+	if req == nil {
 		return true, nil
 	}
-	defer client.CloseIdleConnections()
 
-	req, err := http.NewRequest("GET", formattedURL, nil)
+	client, err := g.httpClientWithCreds(api.tokenHeader)
 	if err != nil {
-		logrus.Warnf("Problem creating request to check git remote sha of repo [%v]: %v", g.URL, err)
+		logrus.Warnf("Problem creating http client to check git remote sha of repo [%v]: %v", g.URL, err)
 		return true, nil
 	}
+	defer client.CloseIdleConnections()
 
-	req.Header.Set("Accept", "application/vnd.github.v3.sha")
+	// GitHub responds with 304 Not Modified if the commit didn't change
 	req.Header.Set("If-None-Match", fmt.Sprintf("\"%s\"", sha))
 	for k, v := range g.headers {
 		req.Header.Set(k, v)
@@ -189,8 +301,21 @@ func (g *git) remoteSHAChanged(branch, sha string) (bool, error) {
 	if resp.StatusCode == http.StatusNotModified {
 		return false, nil
 	}
+	if resp.StatusCode != http.StatusOK {
+		return true, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCommitResponseSize))
+	if err != nil {
+		return true, nil
+	}
+	commit, err := api.commit(body, branch)
+	if err != nil || commit == "" {
+		logrus.Debugf("Unexpected response checking git remote sha of repo [%v]: %v", g.URL, err)
+		return true, nil
+	}
 
-	return true, nil
+	return commit != sha, nil
 }
 
 func (g *git) setCredential(cred *corev1.Secret) error {
@@ -217,64 +342,89 @@ func (g *git) setCredential(cred *corev1.Secret) error {
 		if err != nil {
 			return err
 		}
-		auth, err := gossh.NewPublicKeys(gitURL.User.Username(), cred.Data[corev1.SSHAuthPrivateKey], "")
+		auth, err := sshauth.NewPublicKeys(gitURL.User.Username(), cred.Data[corev1.SSHAuthPrivateKey], cred.Data[sshauth.PassphraseKey],
+			cred.Data[sshauth.CertificateKey])
 		if err != nil {
 			return err
 		}
-		if cred.Data["known_hosts"] != nil {
-			auth.HostKeyCallback, err = createKnownHosts(cred.Data["known_hosts"])
-		} else {
-			//nolint G106: Use of ssh InsecureIgnoreHostKey should be audited
-			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		// the known hosts of the secret pin the host keys, so unknown hosts are rejected as if strict mode was enabled
+		knownHosts := cred.Data[sshauth.KnownHostsKey]
+		strict := g.strictHostKeyChecking || len(knownHosts) > 0
+		auth.HostKeyCallback, err = sshauth.HostKeyCallback(sshauth.MergeKnownHosts(g.knownHosts, knownHosts), strict)
+		if err != nil {
+			return err
 		}
 		g.auth = auth
+	} else if cred.Type == corev1.SecretTypeTLS {
+		cert, err := tls.X509KeyPair(cred.Data[corev1.TLSCertKey], cred.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return err
+		}
+		g.clientCert = &cert
+	} else if cred.Type == httpauth.BearerTokenSecretType {
+		if token := strings.TrimSpace(string(cred.Data[httpauth.TokenKey])); token != "" {
+			g.auth = &httpgit.TokenAuth{Token: token}
+		}
+	} else if cred.Type == githubapp.SecretType {
+		u, err := url.Parse(g.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("github app credentials require an http(s) repo url")
+		}
+		apiURL := g.providerAPIURL
+		if apiURL == "" {
+			apiURL = githubapp.APIURLForRepo(u)
+		}
+		g.githubApp, err = githubapp.FromSecretData(cred.Data, apiURL)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return g.setHeaders(cred)
 }
 
-func createKnownHosts(knownHosts []byte) (ssh.HostKeyCallback, error) {
-	f, err := os.CreateTemp("", "known_hosts")
-	if err != nil {
-		return nil, err
+// setHeaders adds the headers of the credential to the headers sent to the git server. SSH credentials have no
+// headers.
+func (g *git) setHeaders(cred *corev1.Secret) error {
+	if cred.Type == corev1.SecretTypeSSHAuth || cred.Data[httpauth.HeadersKey] == nil {
+		return nil
 	}
-	defer os.RemoveAll(f.Name())
-	defer f.Close()
-
-	if _, err := f.Write(knownHosts); err != nil {
-		return nil, err
+	headers, err := httpauth.ParseHeaders(cred.Data[httpauth.HeadersKey])
+	if err != nil {
+		return err
 	}
-	if err := f.Close(); err != nil {
-		return nil, fmt.Errorf("closing knownHosts file %s: %w", f.Name(), err)
+	// the headers of the options are copied, the credential's headers take precedence
+	for k, v := range g.headers {
+		if _, ok := headers[k]; !ok {
+			headers[k] = v
+		}
 	}
+	g.headers = headers
 
-	return gossh.NewKnownHostsCallback(f.Name())
+	return nil
 }
 
-func formatGitURL(endpoint, branch string) string {
-	u, err := url.Parse(endpoint)
+// setGitHubAppToken authenticates as the GitHub App installation, with a cached installation token.
+func (g *git) setGitHubAppToken() error {
+	client, err := g.httpClient()
 	if err != nil {
-		return ""
+		return err
 	}
+	defer client.CloseIdleConnections()
 
-	pathParts := strings.Split(u.Path, "/")
-	switch u.Hostname() {
-	case "github.com":
-		if len(pathParts) >= 3 {
-			org := pathParts[1]
-			repo := strings.TrimSuffix(pathParts[2], ".git")
-			return fmt.Sprintf("https://api.github.com/repos/%s/%s/commits/%s", org, repo, branch)
-		}
-	case "git.rancher.io":
-		repo := strings.TrimSuffix(pathParts[1], ".git")
-		u.Path = fmt.Sprintf("/repos/%s/commits/%s", repo, branch)
-		return u.String()
+	token, err := githubAppTokens.Token(context.Background(), g.githubApp, client)
+	if err != nil {
+		return err
+	}
+	g.auth = &httpgit.BasicAuth{
+		Username: githubapp.Username,
+		Password: token,
 	}
 
-	return ""
+	return nil
 }
 
 func formatRefForBranch(branch string) string {
@@ -282,12 +432,17 @@ func formatRefForBranch(branch string) string {
 }
 
 type basicRoundTripper struct {
-	username string
-	password string
-	next     http.RoundTripper
+	username    string
+	password    string
+	tokenHeader string
+	next        http.RoundTripper
 }
 
 func (b *basicRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
-	request.SetBasicAuth(b.username, b.password)
+	if b.tokenHeader != "" {
+		request.Header.Set(b.tokenHeader, b.password)
+	} else {
+		request.SetBasicAuth(b.username, b.password)
+	}
 	return b.next.RoundTrip(request)
 }
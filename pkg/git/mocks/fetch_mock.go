@@ -40,6 +40,36 @@ func (m *MockGitFetcher) EXPECT() *MockGitFetcherMockRecorder {
 	return m.recorder
 }
 
+// IsAncestor mocks base method.
+func (m *MockGitFetcher) IsAncestor(arg0 context.Context, arg1 *v1.GitJob, arg2 client.Client, arg3, arg4, arg5 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsAncestor", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// IsAncestor indicates an expected call of IsAncestor.
+func (mr *MockGitFetcherMockRecorder) IsAncestor(arg0, arg1, arg2, arg3, arg4, arg5 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsAncestor", reflect.TypeOf((*MockGitFetcher)(nil).IsAncestor), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+// LatestBranchCommits mocks base method.
+func (m *MockGitFetcher) LatestBranchCommits(arg0 context.Context, arg1 *v1.GitJob, arg2 client.Client) (map[string]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LatestBranchCommits", arg0, arg1, arg2)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LatestBranchCommits indicates an expected call of LatestBranchCommits.
+func (mr *MockGitFetcherMockRecorder) LatestBranchCommits(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LatestBranchCommits", reflect.TypeOf((*MockGitFetcher)(nil).LatestBranchCommits), arg0, arg1, arg2)
+}
+
 // LatestCommit mocks base method.
 func (m *MockGitFetcher) LatestCommit(arg0 context.Context, arg1 *v1.GitJob, arg2 client.Client) (string, error) {
 	m.ctrl.T.Helper()
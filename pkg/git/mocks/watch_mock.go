@@ -11,9 +11,11 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
 	gomock "go.uber.org/mock/gomock"
+	types "k8s.io/apimachinery/pkg/types"
 )
 
 // MockWatcher is a mock of Watcher interface.
@@ -39,18 +41,6 @@ func (m *MockWatcher) EXPECT() *MockWatcherMockRecorder {
 	return m.recorder
 }
 
-// Finish mocks base method.
-func (m *MockWatcher) Finish() {
-	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Finish")
-}
-
-// Finish indicates an expected call of Finish.
-func (mr *MockWatcherMockRecorder) Finish() *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Finish", reflect.TypeOf((*MockWatcher)(nil).Finish))
-}
-
 // GetSyncInterval mocks base method.
 func (m *MockWatcher) GetSyncInterval() int {
 	m.ctrl.T.Helper()
@@ -65,38 +55,54 @@ func (mr *MockWatcherMockRecorder) GetSyncInterval() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSyncInterval", reflect.TypeOf((*MockWatcher)(nil).GetSyncInterval))
 }
 
-// Restart mocks base method.
-func (m *MockWatcher) Restart(arg0 context.Context) {
+// HasSubscribers mocks base method.
+func (m *MockWatcher) HasSubscribers() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HasSubscribers")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// HasSubscribers indicates an expected call of HasSubscribers.
+func (mr *MockWatcherMockRecorder) HasSubscribers() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasSubscribers", reflect.TypeOf((*MockWatcher)(nil).HasSubscribers))
+}
+
+// Poll mocks base method.
+func (m *MockWatcher) Poll(arg0 context.Context) time.Duration {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Restart", arg0)
+	ret := m.ctrl.Call(m, "Poll", arg0)
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
 }
 
-// Restart indicates an expected call of Restart.
-func (mr *MockWatcherMockRecorder) Restart(arg0 any) *gomock.Call {
+// Poll indicates an expected call of Poll.
+func (mr *MockWatcherMockRecorder) Poll(arg0 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Restart", reflect.TypeOf((*MockWatcher)(nil).Restart), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Poll", reflect.TypeOf((*MockWatcher)(nil).Poll), arg0)
 }
 
-// StartBackgroundSync mocks base method.
-func (m *MockWatcher) StartBackgroundSync(arg0 context.Context) {
+// Subscribe mocks base method.
+func (m *MockWatcher) Subscribe(arg0 v1.GitJob) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "StartBackgroundSync", arg0)
+	m.ctrl.Call(m, "Subscribe", arg0)
 }
 
-// StartBackgroundSync indicates an expected call of StartBackgroundSync.
-func (mr *MockWatcherMockRecorder) StartBackgroundSync(arg0 any) *gomock.Call {
+// Subscribe indicates an expected call of Subscribe.
+func (mr *MockWatcherMockRecorder) Subscribe(arg0 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartBackgroundSync", reflect.TypeOf((*MockWatcher)(nil).StartBackgroundSync), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockWatcher)(nil).Subscribe), arg0)
 }
 
-// UpdateGitJob mocks base method.
-func (m *MockWatcher) UpdateGitJob(arg0 v1.GitJob) {
+// Unsubscribe mocks base method.
+func (m *MockWatcher) Unsubscribe(arg0 types.NamespacedName) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "UpdateGitJob", arg0)
+	m.ctrl.Call(m, "Unsubscribe", arg0)
 }
 
-// UpdateGitJob indicates an expected call of UpdateGitJob.
-func (mr *MockWatcherMockRecorder) UpdateGitJob(arg0 any) *gomock.Call {
+// Unsubscribe indicates an expected call of Unsubscribe.
+func (mr *MockWatcherMockRecorder) Unsubscribe(arg0 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateGitJob", reflect.TypeOf((*MockWatcher)(nil).UpdateGitJob), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*MockWatcher)(nil).Unsubscribe), arg0)
 }
@@ -2,86 +2,314 @@ package poll
 
 import (
 	"context"
-	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
 
 	"github.com/go-logr/logr"
+	"github.com/rancher/wrangler/v2/pkg/name"
+	"golang.org/x/time/rate"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	// queueName is the name of the poll queue in the workqueue metrics, e.g. workqueue_depth{name="gitjob-poll"}.
+	queueName = "gitjob-poll"
+
+	DefaultWorkers         = 10
+	DefaultHostConcurrency = 5
+	DefaultQPS             = 10
+	DefaultBurst           = 100
+
+	// hostBusyDelay is the delay before a watch is retried, if its host already has HostConcurrency polls in progress.
+	hostBusyDelay = time.Second
+)
+
 type Watcher interface {
-	StartBackgroundSync(ctx context.Context)
-	Finish()
-	Restart(ctx context.Context)
-	UpdateGitJob(gitJob v1.GitJob)
+	Poll(ctx context.Context) time.Duration
+	Subscribe(gitJob v1.GitJob)
+	Unsubscribe(key types.NamespacedName)
+	HasSubscribers() bool
 	GetSyncInterval() int
 }
 
+// Options configures the workers of a Handler.
+type Options struct {
+	// Workers is the number of watches polled at the same time.
+	Workers int
+	// HostConcurrency is the number of watches polled at the same time per git host. Zero disables the limit.
+	HostConcurrency int
+	// QPS and Burst limit the rate of immediate polls, e.g. of new gitjobs after a restart of the controller.
+	QPS   float64
+	Burst int
+	// ProtocolV2 lists only the refs needed with the git protocol v2, unless set otherwise in the gitjob.
+	ProtocolV2 bool
+	// HostKeys configures the verification of SSH host keys.
+	HostKeys git.HostKeyOptions
+}
+
 // Handler handles all the watches for the git repositories. These watches are pulling the latest commit every syncPeriod.
+// GitJobs which poll the same repo and branch with the same credential share a single watch.
+// Watches are polled by a fixed number of workers, which take them from a delaying work queue.
 type Handler struct {
-	client      client.Client
-	watches     map[string]Watcher
-	createWatch func(gitJob v1.GitJob, client client.Client) Watcher // this func creates a watch. It's a struct field, so it can be replaced for a mock in unit tests.
-	log         logr.Logger
+	client          client.Client
+	mu              sync.Mutex
+	watches         map[string]Watcher                                   // watches by watchKey
+	subscriptions   map[types.NamespacedName]string                      // watchKey of the watch each gitjob is subscribed to
+	hosts           map[string]string                                    // git host of each watch
+	hostPolls       map[string]int                                       // polls in progress per git host
+	createWatch     func(gitJob v1.GitJob, client client.Client) Watcher // this func creates a watch. It's a struct field, so it can be replaced for a mock in unit tests.
+	queue           workqueue.RateLimitingInterface
+	workers         int
+	hostConcurrency int
+	protocolV2      bool
+	log             logr.Logger
 }
 
-func NewHandler(client client.Client) *Handler {
+func NewHandler(client client.Client, opts Options) *Handler {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QPS <= 0 {
+		opts.QPS = DefaultQPS
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = DefaultBurst
+	}
+
 	return &Handler{
-		client:      client,
-		watches:     make(map[string]Watcher),
-		createWatch: NewWatch,
-		log:         ctrl.Log.WithName("git-latest-commit-poll-handler"),
+		client:        client,
+		watches:       make(map[string]Watcher),
+		subscriptions: make(map[types.NamespacedName]string),
+		hosts:         make(map[string]string),
+		hostPolls:     make(map[string]int),
+		createWatch:   watchCreator(&git.Fetch{ProtocolV2: opts.ProtocolV2, HostKeys: opts.HostKeys}),
+		queue: workqueue.NewRateLimitingQueueWithConfig(
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(opts.QPS), opts.Burst)},
+			workqueue.RateLimitingQueueConfig{Name: queueName},
+		),
+		workers:         opts.Workers,
+		hostConcurrency: opts.HostConcurrency,
+		protocolV2:      opts.ProtocolV2,
+		log:             ctrl.Log.WithName("git-latest-commit-poll-handler"),
+	}
+}
+
+// watchCreator returns a func creating watches which use fetcher.
+func watchCreator(fetcher GitFetcher) func(gitJob v1.GitJob, client client.Client) Watcher {
+	return func(gitJob v1.GitJob, client client.Client) Watcher {
+		return newWatch(gitJob, client, fetcher)
 	}
 }
 
-// AddOrModifyGitRepoWatch adds a new watch for the gitjob if no watch was already present.
-// It updates the existing watch for this gitjob if present.
-func (h *Handler) AddOrModifyGitRepoWatch(ctx context.Context, gitJob v1.GitJob) {
+// Start runs the workers until ctx is cancelled, then shuts down the queue and waits for the polls in progress.
+// It implements manager.Runnable, so polling only runs on the leader.
+func (h *Handler) Start(ctx context.Context) error {
+	h.log.Info("starting poll workers", "workers", h.workers, "hostConcurrency", h.hostConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < h.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h.processNextWatch(ctx) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	h.queue.ShutDown()
+	wg.Wait()
+	h.log.Info("poll workers stopped")
+
+	return nil
+}
+
+// AddOrModifyGitRepoWatch subscribes the gitjob to the watch of its repo, branch and credential, and creates the watch
+// if none is present. If the gitjob was subscribed to another watch before, e.g. because its branch changed, it is
+// unsubscribed from it. New watches, and watches whose sync interval got shorter, are polled right away. GitJobs whose
+// branch was deleted are subscribed to a watch of their own, which rechecks the branch every
+// deletedBranchRecheckInterval and clears the deletion once the branch is pushed again.
+func (h *Handler) AddOrModifyGitRepoWatch(_ context.Context, gitJob v1.GitJob) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	key := getKey(gitJob)
-	watch, found := h.watches[key]
+	wKey := watchKey(gitJob, h.protocolV2)
+	if branchDeleted(gitJob) {
+		wKey = "deleted|" + wKey
+	}
+	if oldWKey, found := h.subscriptions[key]; found && oldWKey != wKey {
+		h.unsubscribe(key)
+	}
+
+	watch, found := h.watches[wKey]
 	if !found {
-		h.watches[key] = h.createWatch(gitJob, h.client)
-		h.watches[key].StartBackgroundSync(ctx)
-	} else {
-		oldSyncInterval := watch.GetSyncInterval()
-		watch.UpdateGitJob(gitJob)
-		if oldSyncInterval != gitJob.Spec.SyncInterval {
-			watch.Restart(ctx)
-		}
+		h.watches[wKey] = h.createWatch(gitJob, h.client)
+		h.hosts[wKey] = repoHost(gitJob.Spec.Git.Repo)
+		h.subscriptions[key] = wKey
+		h.queue.AddRateLimited(wKey)
+		return
+	}
+
+	oldSyncInterval := watch.GetSyncInterval()
+	watch.Subscribe(gitJob)
+	h.subscriptions[key] = wKey
+	if watch.GetSyncInterval() < oldSyncInterval {
+		h.queue.AddRateLimited(wKey)
 	}
 }
 
-// CleanUpWatches removes all watches whose gitjob is not present in the cluster.
+// PollGitRepoWatch polls the watch of the gitjob right away, e.g. because its credential changed. Nothing is polled
+// if the gitjob isn't subscribed to a watch.
+func (h *Handler) PollGitRepoWatch(_ context.Context, gitJob v1.GitJob) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if wKey, found := h.subscriptions[getKey(gitJob)]; found {
+		h.queue.AddRateLimited(wKey)
+	}
+}
+
+// CleanUpWatches unsubscribes all gitjobs which are not present in the cluster, and removes watches without subscribers.
 func (h *Handler) CleanUpWatches(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	var gitJob v1.GitJob
-	for key, watch := range h.watches {
-		namespacedName, err := getTypeNamespaceFromKey(key)
-		if err != nil {
-			h.log.Error(err, "can't get namespacedName", key)
-		}
-		if err = h.client.Get(ctx, namespacedName, &gitJob); errors.IsNotFound(err) {
-			watch.Finish()
-			delete(h.watches, key)
+	for key := range h.subscriptions {
+		if err := h.client.Get(ctx, key, &gitJob); errors.IsNotFound(err) {
+			h.unsubscribe(key)
 		}
 	}
 }
 
-func getTypeNamespaceFromKey(key string) (types.NamespacedName, error) {
-	split := strings.Split(key, "-")
-	if len(split) < 2 {
-		return types.NamespacedName{}, fmt.Errorf("invalid key")
+// unsubscribe removes the gitjob from its watch. The watch is removed if it has no subscribers left, and is dropped
+// from the queue the next time a worker gets it. h.mu must be held by the caller.
+func (h *Handler) unsubscribe(key types.NamespacedName) {
+	wKey := h.subscriptions[key]
+	delete(h.subscriptions, key)
+	watch, found := h.watches[wKey]
+	if !found {
+		return
+	}
+
+	watch.Unsubscribe(key)
+	if !watch.HasSubscribers() {
+		delete(h.watches, wKey)
+		delete(h.hosts, wKey)
+	}
+}
+
+// processNextWatch polls the next watch of the queue and schedules its next poll. It returns false once the queue is
+// shut down.
+func (h *Handler) processNextWatch(ctx context.Context) bool {
+	item, shutdown := h.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer h.queue.Done(item)
+	if ctx.Err() != nil {
+		return false
+	}
+	wKey := item.(string)
+
+	h.mu.Lock()
+	watch, found := h.watches[wKey]
+	if !found {
+		h.mu.Unlock()
+		h.queue.Forget(wKey)
+		return true
+	}
+	host := h.hosts[wKey]
+	if h.hostConcurrency > 0 && h.hostPolls[host] >= h.hostConcurrency {
+		h.mu.Unlock()
+		h.queue.AddAfter(wKey, hostBusyDelay)
+		return true
+	}
+	h.hostPolls[host]++
+	h.mu.Unlock()
+
+	next := watch.Poll(ctx)
+
+	h.mu.Lock()
+	h.hostPolls[host]--
+	if h.hostPolls[host] == 0 {
+		delete(h.hostPolls, host)
 	}
-	return types.NamespacedName{
-		Namespace: split[1],
-		Name:      split[0],
-	}, nil
+	h.mu.Unlock()
+
+	h.queue.Forget(wKey)
+	h.queue.AddAfter(wKey, next)
+
+	return true
 }
 
-func getKey(gitJob v1.GitJob) string {
-	return gitJob.Name + "-" + gitJob.Namespace
+func getKey(gitJob v1.GitJob) types.NamespacedName {
+	return types.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Name}
+}
+
+// watchKey identifies what is fetched for a gitjob: the repo, the branch or branch pattern, the provider, and the
+// credential used to access the repo. Secrets are namespaced, so gitjobs of different namespaces never share a watch.
+// protocolV2 is the default for gitjobs which don't set spec.git.protocolV2.
+func watchKey(gitJob v1.GitJob, protocolV2 bool) string {
+	selector := "branch:" + gitJob.Spec.Git.Branch
+	if gitJob.Spec.Git.Branch == "" {
+		selector = "branch:master"
+	}
+	if gitJob.Spec.Git.BranchPattern != "" {
+		selector = "pattern:" + gitJob.Spec.Git.BranchPattern
+	}
+
+	secretKey := git.ClientSecretKey(&gitJob)
+	if secretKey.Name == "" {
+		secretKey.Name = git.DefaultSecretName
+	}
+	// the secret grant is checked for the namespace of the gitjob, so it is part of the key
+	secret := gitJob.Namespace + "/" + secretKey.Name
+	if secretKey.Namespace != gitJob.Namespace {
+		secret = gitJob.Namespace + "/" + secretKey.String()
+	}
+	caBundle := ""
+	if len(gitJob.Spec.Git.CABundle) > 0 {
+		caBundle = name.Hex(string(gitJob.Spec.Git.CABundle), 16)
+	}
+	if gitJob.Spec.Git.ProtocolV2 != nil {
+		protocolV2 = *gitJob.Spec.Git.ProtocolV2
+	}
+	strictHostKeyChecking := ""
+	if gitJob.Spec.Git.StrictHostKeyChecking != nil {
+		strictHostKeyChecking = strconv.FormatBool(*gitJob.Spec.Git.StrictHostKeyChecking)
+	}
+
+	return strings.Join([]string{
+		gitJob.Spec.Git.Repo,
+		selector,
+		secret,
+		gitJob.Spec.Git.Provider,
+		gitJob.Spec.Git.ProviderAPIURL,
+		caBundle,
+		strconv.FormatBool(gitJob.Spec.Git.InsecureSkipTLSverify),
+		strictHostKeyChecking,
+		strconv.FormatBool(protocolV2),
+	}, "|")
+}
+
+// repoHost returns the host of a repo URL, which is used to limit the polls per git host. Repo URLs which can't be
+// parsed share the empty host.
+func repoHost(repo string) string {
+	u, err := giturls.Parse(repo)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
 }
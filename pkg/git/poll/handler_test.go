@@ -4,8 +4,10 @@ package poll
 import (
 	"context"
 	"testing"
+	"time"
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
 	"github.com/rancher/gitjob/pkg/git/mocks"
 
 	"github.com/google/go-cmp/cmp"
@@ -13,7 +15,10 @@ import (
 	"golang.org/x/exp/maps"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestAddOrModifyWatchGitRepo(t *testing.T) {
@@ -26,44 +31,107 @@ func TestAddOrModifyWatchGitRepo(t *testing.T) {
 			Name:      "gitjob",
 			Namespace: "test",
 		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo: "https://github.com/rancher/gitjob",
+			},
+		},
 	}
+	key := watchKey(gitJob, false)
+	otherBranch := gitJob.DeepCopy()
+	otherBranch.Spec.Git.Branch = "main"
+	otherKey := watchKey(*otherBranch, false)
 
 	tests := map[string]struct {
-		watches         func(mockWatcher *mocks.MockWatcher) map[string]Watcher
-		syncInterval    int
-		expectedWatches []string
-		expectedCalls   func(mockWatcher *mocks.MockWatcher)
+		watches               func(mockWatcher *mocks.MockWatcher) map[string]Watcher
+		subscriptions         map[types.NamespacedName]string
+		syncInterval          int
+		deletedRef            *v1.DeletedRefStatus
+		expectedWatches       []string
+		expectedSubscriptions map[types.NamespacedName]string
+		expectedQueued        int
+		expectedCalls         func(mockWatcher *mocks.MockWatcher)
 	}{
 		"gitrepo not present": {
 			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
 				return make(map[string]Watcher)
 			},
-			expectedWatches: []string{"gitjob-test"},
-			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
-				mockWatcher.EXPECT().StartBackgroundSync(ctx).Times(1)
-			},
+			subscriptions:         map[types.NamespacedName]string{},
+			expectedWatches:       []string{key},
+			expectedSubscriptions: map[types.NamespacedName]string{getKey(gitJob): key},
+			expectedQueued:        1,
+			expectedCalls:         func(mockWatcher *mocks.MockWatcher) {},
 		},
 		"gitrepo present with same syncInterval": {
 			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
-				return map[string]Watcher{"gitjob-test": mockWatcher}
+				return map[string]Watcher{key: mockWatcher}
 			},
-			syncInterval:    10,
-			expectedWatches: []string{"gitjob-test"},
+			subscriptions:         map[types.NamespacedName]string{getKey(gitJob): key},
+			syncInterval:          10,
+			expectedWatches:       []string{key},
+			expectedSubscriptions: map[types.NamespacedName]string{getKey(gitJob): key},
 			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
-				mockWatcher.EXPECT().GetSyncInterval().Return(10).Times(1)
-				mockWatcher.EXPECT().UpdateGitJob(gitJob)
+				mockWatcher.EXPECT().GetSyncInterval().Return(10).Times(2)
+				mockWatcher.EXPECT().Subscribe(gomock.Any())
 			},
 		},
 		"gitrepo present with different syncInterval": {
 			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
-				return map[string]Watcher{"gitjob-test": mockWatcher}
+				return map[string]Watcher{key: mockWatcher}
+			},
+			subscriptions:         map[types.NamespacedName]string{getKey(gitJob): key},
+			syncInterval:          1,
+			expectedWatches:       []string{key},
+			expectedSubscriptions: map[types.NamespacedName]string{getKey(gitJob): key},
+			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
+				gomock.InOrder(
+					mockWatcher.EXPECT().GetSyncInterval().Return(10),
+					mockWatcher.EXPECT().Subscribe(gomock.Any()),
+					mockWatcher.EXPECT().GetSyncInterval().Return(1),
+				)
+			},
+			expectedQueued: 1,
+		},
+		"another gitjob polls the same repo": {
+			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
+				return map[string]Watcher{key: mockWatcher}
+			},
+			subscriptions:   map[types.NamespacedName]string{{Namespace: "test", Name: "other"}: key},
+			expectedWatches: []string{key},
+			expectedSubscriptions: map[types.NamespacedName]string{
+				{Namespace: "test", Name: "other"}: key,
+				getKey(gitJob):                     key,
 			},
-			syncInterval:    1,
-			expectedWatches: []string{"gitjob-test"},
 			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
-				mockWatcher.EXPECT().GetSyncInterval().Return(10).Times(1)
-				mockWatcher.EXPECT().UpdateGitJob(gitJob)
-				mockWatcher.EXPECT().Restart(ctx)
+				mockWatcher.EXPECT().GetSyncInterval().Return(15).Times(2)
+				mockWatcher.EXPECT().Subscribe(gomock.Any())
+			},
+		},
+		"gitrepo changed its branch": {
+			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
+				return map[string]Watcher{otherKey: mockWatcher}
+			},
+			subscriptions:         map[types.NamespacedName]string{getKey(gitJob): otherKey},
+			expectedWatches:       []string{key},
+			expectedSubscriptions: map[types.NamespacedName]string{getKey(gitJob): key},
+			expectedQueued:        1,
+			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
+				mockWatcher.EXPECT().Unsubscribe(getKey(gitJob))
+				mockWatcher.EXPECT().HasSubscribers().Return(false)
+			},
+		},
+		"branch of gitrepo was deleted": {
+			watches: func(mockWatcher *mocks.MockWatcher) map[string]Watcher {
+				return map[string]Watcher{key: mockWatcher}
+			},
+			subscriptions:         map[types.NamespacedName]string{getKey(gitJob): key},
+			deletedRef:            &v1.DeletedRefStatus{Ref: "refs/heads/master"},
+			expectedWatches:       []string{"deleted|" + key},
+			expectedSubscriptions: map[types.NamespacedName]string{getKey(gitJob): "deleted|" + key},
+			expectedQueued:        1,
+			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
+				mockWatcher.EXPECT().Unsubscribe(getKey(gitJob))
+				mockWatcher.EXPECT().HasSubscribers().Return(false)
 			},
 		},
 	}
@@ -71,13 +139,14 @@ func TestAddOrModifyWatchGitRepo(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			watcher := mocks.NewMockWatcher(ctrl)
-			h := Handler{
-				watches: test.watches(watcher),
-				createWatch: func(_ v1.GitJob, _ client.Client) Watcher {
-					return watcher
-				},
+			h := NewHandler(nil, Options{})
+			h.watches = test.watches(watcher)
+			h.subscriptions = test.subscriptions
+			h.createWatch = func(_ v1.GitJob, _ client.Client) Watcher {
+				return watcher
 			}
 			gitJob.Spec.SyncInterval = test.syncInterval
+			gitJob.Status.DeletedRef = test.deletedRef
 
 			test.expectedCalls(watcher)
 			h.AddOrModifyGitRepoWatch(ctx, gitJob)
@@ -85,6 +154,303 @@ func TestAddOrModifyWatchGitRepo(t *testing.T) {
 			if !cmp.Equal(maps.Keys(h.watches), test.expectedWatches) {
 				t.Errorf("expected %v, but got %v", test.expectedWatches, maps.Keys(h.watches))
 			}
+			if !cmp.Equal(h.subscriptions, test.expectedSubscriptions) {
+				t.Errorf("expected %v, but got %v", test.expectedSubscriptions, h.subscriptions)
+			}
+			if h.queue.Len() != test.expectedQueued {
+				t.Errorf("expected %d queued watches, but got %d", test.expectedQueued, h.queue.Len())
+			}
 		})
 	}
 }
+
+func TestPollGitRepoWatch(t *testing.T) {
+	ctx := context.TODO()
+	subscribed := v1.GitJob{ObjectMeta: metav1.ObjectMeta{Name: "subscribed", Namespace: "test"}}
+	unsubscribed := v1.GitJob{ObjectMeta: metav1.ObjectMeta{Name: "unsubscribed", Namespace: "test"}}
+	h := NewHandler(nil, Options{})
+	h.subscriptions = map[types.NamespacedName]string{getKey(subscribed): "watch"}
+
+	h.PollGitRepoWatch(ctx, unsubscribed)
+	if h.queue.Len() != 0 {
+		t.Errorf("expected no queued watches, but got %d", h.queue.Len())
+	}
+	h.PollGitRepoWatch(ctx, subscribed)
+	if h.queue.Len() != 1 {
+		t.Errorf("expected 1 queued watch, but got %d", h.queue.Len())
+	}
+}
+
+func TestCleanUpWatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.TODO()
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-gitjob",
+			Namespace: "test",
+		},
+	}
+	deleted := types.NamespacedName{Namespace: "test", Name: "deleted-gitjob"}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).Build()
+
+	shared := mocks.NewMockWatcher(ctrl)
+	orphaned := mocks.NewMockWatcher(ctrl)
+	h := NewHandler(client, Options{})
+	h.watches = map[string]Watcher{
+		"shared":   shared,
+		"orphaned": orphaned,
+	}
+	h.subscriptions = map[types.NamespacedName]string{
+		getKey(gitJob): "shared",
+		deleted:        "orphaned",
+	}
+	orphaned.EXPECT().Unsubscribe(deleted)
+	orphaned.EXPECT().HasSubscribers().Return(false)
+
+	h.CleanUpWatches(ctx)
+
+	if !cmp.Equal(maps.Keys(h.watches), []string{"shared"}) {
+		t.Errorf("expected only the shared watch, but got %v", maps.Keys(h.watches))
+	}
+	if !cmp.Equal(h.subscriptions, map[types.NamespacedName]string{getKey(gitJob): "shared"}) {
+		t.Errorf("unexpected subscriptions %v", h.subscriptions)
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "gitjob",
+			Namespace: "test",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo: "https://github.com/rancher/gitjob",
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		modify   func(gitJob *v1.GitJob)
+		expected bool
+	}{
+		"other name and sync interval": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Name = "other"
+				gitJob.Spec.SyncInterval = 60
+			},
+			expected: true,
+		},
+		"default branch": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.Branch = "master"
+			},
+			expected: true,
+		},
+		"other branch": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.Branch = "main"
+			},
+		},
+		"branch pattern": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.BranchPattern = "*"
+			},
+		},
+		"other repo": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.Repo = "https://github.com/rancher/fleet"
+			},
+		},
+		"other namespace": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Namespace = "other"
+			},
+		},
+		"other secret": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ClientSecretName = "secret"
+			},
+		},
+		"secret in another namespace": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ClientSecretRef = &v1.SecretReference{Name: git.DefaultSecretName, Namespace: "shared"}
+			},
+		},
+		"secret ref in the same namespace": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ClientSecretRef = &v1.SecretReference{Name: git.DefaultSecretName}
+			},
+			expected: true,
+		},
+		"provider": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.Provider = "gitlab"
+			},
+		},
+		"provider api url": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ProviderAPIURL = "https://github.example.com/api/v3"
+			},
+		},
+		"ca bundle": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.CABundle = []byte("ca")
+			},
+		},
+		"strict host key checking": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.StrictHostKeyChecking = &[]bool{true}[0]
+			},
+		},
+		"protocol v2": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ProtocolV2 = &[]bool{true}[0]
+			},
+		},
+		"protocol v2 disabled like the default": {
+			modify: func(gitJob *v1.GitJob) {
+				gitJob.Spec.Git.ProtocolV2 = &[]bool{false}[0]
+			},
+			expected: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			other := gitJob.DeepCopy()
+			test.modify(other)
+			if shared := watchKey(gitJob, false) == watchKey(*other, false); shared != test.expected {
+				t.Errorf("expected shared watch to be %v, but got %v", test.expected, shared)
+			}
+		})
+	}
+}
+
+func TestWatchKeyProtocolV2Default(t *testing.T) {
+	gitJob := v1.GitJob{Spec: v1.GitJobSpec{Git: v1.GitInfo{Repo: "https://github.com/rancher/gitjob"}}}
+	optedOut := gitJob.DeepCopy()
+	optedOut.Spec.Git.ProtocolV2 = &[]bool{false}[0]
+
+	if watchKey(gitJob, true) == watchKey(*optedOut, true) {
+		t.Error("expected a gitjob opting out of protocol v2 to not share the watch of the default")
+	}
+	if watchKey(gitJob, true) == watchKey(gitJob, false) {
+		t.Error("expected the default of protocol v2 to be part of the watch key")
+	}
+}
+
+func TestProcessNextWatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.TODO()
+
+	tests := map[string]struct {
+		hostPolls      int
+		watchRemoved   bool
+		expectedCalls  func(mockWatcher *mocks.MockWatcher)
+		expectedQueued int
+	}{
+		"watch is polled and requeued": {
+			expectedCalls: func(mockWatcher *mocks.MockWatcher) {
+				mockWatcher.EXPECT().Poll(ctx).Return(time.Duration(0))
+			},
+			expectedQueued: 1,
+		},
+		"host has too many polls in progress": {
+			hostPolls:      2,
+			expectedCalls:  func(mockWatcher *mocks.MockWatcher) {},
+			expectedQueued: 0, // retried after hostBusyDelay
+		},
+		"removed watch is dropped": {
+			watchRemoved:   true,
+			expectedCalls:  func(mockWatcher *mocks.MockWatcher) {},
+			expectedQueued: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			watcher := mocks.NewMockWatcher(ctrl)
+			h := NewHandler(nil, Options{HostConcurrency: 2})
+			if !test.watchRemoved {
+				h.watches["watch"] = watcher
+				h.hosts["watch"] = "github.com"
+			}
+			if test.hostPolls > 0 {
+				h.hostPolls["github.com"] = test.hostPolls
+			}
+			h.queue.Add("watch")
+
+			test.expectedCalls(watcher)
+			if !h.processNextWatch(ctx) {
+				t.Errorf("expected the worker to continue")
+			}
+
+			if h.queue.Len() != test.expectedQueued {
+				t.Errorf("expected %d queued watches, but got %d", test.expectedQueued, h.queue.Len())
+			}
+			if h.hostPolls["github.com"] != test.hostPolls {
+				t.Errorf("expected %d polls in progress, but got %d", test.hostPolls, h.hostPolls["github.com"])
+			}
+		})
+	}
+}
+
+func TestStartStopsOnCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	watcher := mocks.NewMockWatcher(ctrl)
+	h := NewHandler(nil, Options{Workers: 2})
+	h.watches["watch"] = watcher
+	polled := make(chan struct{})
+	watcher.EXPECT().Poll(gomock.Any()).DoAndReturn(func(context.Context) time.Duration {
+		close(polled)
+		return time.Hour
+	})
+	h.queue.Add("watch")
+
+	done := make(chan error)
+	go func() {
+		done <- h.Start(ctx)
+	}()
+	<-polled
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers didn't stop")
+	}
+	if !h.queue.ShuttingDown() {
+		t.Errorf("expected queue to be shut down")
+	}
+}
+
+func TestRepoHost(t *testing.T) {
+	tests := map[string]string{
+		"https://GitHub.com/rancher/gitjob":     "github.com",
+		"git@github.com:rancher/gitjob.git":     "github.com",
+		"ssh://git@gitlab.example.com:22/a/b":   "gitlab.example.com",
+		"https://dev.azure.com/org/proj/_git/r": "dev.azure.com",
+	}
+
+	for repo, expected := range tests {
+		if host := repoHost(repo); host != expected {
+			t.Errorf("expected host %s for %s, but got %s", expected, repo, host)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package poll
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,104 +14,303 @@ import (
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
 	"github.com/rancher/gitjob/pkg/git"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const defaultSyncInterval = 15
+const (
+	defaultSyncInterval = 15
+
+	// pollingCondition is the condition of a GitJob which reports the result of the last poll.
+	pollingCondition = "GitPolling"
+
+	// maxPollBackoff is the longest interval between two polls of a failing git repo, unless the syncInterval is longer.
+	maxPollBackoff = 10 * time.Minute
+	// pollJitterFactor adds up to 10% of the poll interval, so watches with the same syncInterval don't poll at once.
+	pollJitterFactor = 0.1
+	// deletedBranchRecheckInterval is the shortest interval between two polls of a deleted branch, which is
+	// rechecked until it is pushed again.
+	deletedBranchRecheckInterval = 10 * time.Minute
+	// pollTimeRefreshInterval is the longest interval between two status updates, which only refresh the poll times
+	// of an unchanged poll result.
+	pollTimeRefreshInterval = 10 * time.Minute
+)
 
 type GitFetcher interface {
 	LatestCommit(ctx context.Context, gitjob *v1.GitJob, client client.Client) (string, error)
+	LatestBranchCommits(ctx context.Context, gitjob *v1.GitJob, client client.Client) (map[string]string, error)
+	IsAncestor(ctx context.Context, gitjob *v1.GitJob, client client.Client, branch, ancestor, commit string) (bool, error)
 }
 
-// Watch fetches the latest commit of a git repository referenced by a gitJob with the syncInterval provided.
+// Watch fetches the latest commit of a git repository, and stores it in the status of every subscribed gitJob. It
+// is polled by the workers of the Handler. Consecutive failures back off the interval between polls exponentially,
+// and every interval is jittered.
 type Watch struct {
-	gitJob  v1.GitJob
-	client  client.Client
-	done    chan bool
-	mu      *sync.Mutex
-	fetcher GitFetcher
-	log     logr.Logger
+	subscribers  map[types.NamespacedName]v1.GitJob
+	client       client.Client
+	mu           *sync.Mutex
+	fetcher      GitFetcher
+	log          logr.Logger
+	failures     int
+	nextInterval time.Duration
 }
 
 func NewWatch(gitJob v1.GitJob, client client.Client) Watcher {
+	return newWatch(gitJob, client, &git.Fetch{})
+}
+
+func newWatch(gitJob v1.GitJob, client client.Client, fetcher GitFetcher) *Watch {
 	return &Watch{
-		gitJob:  gitJob,
-		client:  client,
-		mu:      new(sync.Mutex),
-		fetcher: &git.Fetch{},
-		log:     ctrl.Log.WithName("git-latest-commit-poll-watch"),
+		subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+		client:      client,
+		mu:          new(sync.Mutex),
+		fetcher:     fetcher,
+		log:         ctrl.Log.WithName("git-latest-commit-poll-watch"),
 	}
 }
 
-// StartBackgroundSync fetches the latest commit every syncInternal in a goroutine.
-func (w *Watch) StartBackgroundSync(ctx context.Context) {
-	go w.fetchBySyncInterval(ctx, time.NewTicker(calculateSyncInterval(w.gitJob)))
+// Poll fetches the latest commit once, stores it in the status of all subscribers and returns the delay until the
+// next poll. It must not be called concurrently for the same watch.
+func (w *Watch) Poll(ctx context.Context) time.Duration {
+	w.fetchLatestCommitAndUpdateStatus(ctx)
+
+	return w.nextInterval
 }
 
-// Finish stops watching for changes in the git repo.
-func (w *Watch) Finish() {
-	w.done <- true
+// Subscribe adds the gitJob to the gitJobs whose status is updated by this watch, or updates it if already present.
+func (w *Watch) Subscribe(gitJob v1.GitJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers[getKey(gitJob)] = gitJob
 }
 
-func (w *Watch) Restart(ctx context.Context) {
-	w.Finish()
-	w.StartBackgroundSync(ctx)
+func (w *Watch) Unsubscribe(key types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subscribers, key)
 }
 
-func (w *Watch) UpdateGitJob(gitJob v1.GitJob) {
-	w.gitJob = gitJob
+func (w *Watch) HasSubscribers() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.subscribers) > 0
 }
 
+// GetSyncInterval returns the shortest sync interval of all subscribers in seconds.
 func (w *Watch) GetSyncInterval() int {
-	return w.gitJob.Spec.SyncInterval
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int(w.syncInterval() / time.Second)
 }
 
-func (w *Watch) fetchBySyncInterval(ctx context.Context, ticker *time.Ticker) {
-	w.log.V(1).Info("start watching latest commit", "gitjob-name", w.gitJob.Name)
-	defer ticker.Stop()
-	w.done = make(chan bool)
-	w.fetchLatestCommitAndUpdateStatus(ctx)
-
-	for {
-		select {
-		case <-w.done:
-			return
-		case <-ticker.C:
-			w.mu.Lock()
-			w.fetchLatestCommitAndUpdateStatus(ctx)
-			w.mu.Unlock()
+func (w *Watch) syncInterval() time.Duration {
+	var interval time.Duration
+	for _, gitJob := range w.subscribers {
+		if i := calculateSyncInterval(gitJob); interval == 0 || i < interval {
+			interval = i
 		}
 	}
+	if interval == 0 {
+		return time.Duration(defaultSyncInterval) * time.Second
+	}
+
+	return interval
+}
+
+// snapshot returns the keys of all subscribers, the subscriber used to fetch the repo and the shortest sync interval.
+// All subscribers share the same repo, branch and credential.
+func (w *Watch) snapshot() ([]types.NamespacedName, v1.GitJob, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var keys []types.NamespacedName
+	for key := range w.subscribers {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, v1.GitJob{}, 0
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys, w.subscribers[keys[0]], w.syncInterval()
 }
 
+// fetchLatestCommitAndUpdateStatus polls the git repository once and stores the result in the status of every
+// subscribed GitJob: the latest commit, or the latest commit of every branch matching the branchPattern, the poll
+// times and the GitPolling condition, which contains the reason and message of a failed poll. The status is only
+// updated if the result changed, or its poll times are older than pollTimeRefreshInterval.
 func (w *Watch) fetchLatestCommitAndUpdateStatus(ctx context.Context) {
-	commit, err := w.fetcher.LatestCommit(ctx, &w.gitJob, w.client)
-	if err != nil {
-		w.log.Error(err, "error fetching commit", "gitjob name", w.gitJob.Name)
+	subscribers, fetchGitJob, syncInterval := w.snapshot()
+	if len(subscribers) == 0 {
 		return
 	}
-	if w.gitJob.Status.Commit != commit {
-		w.log.Info("new commit found", "gitjob name", w.gitJob.Name, "commit", commit)
+
+	var (
+		updateCommits func(gitJob *v1.GitJob) error
+		fetchErr      error
+	)
+	if fetchGitJob.Spec.Git.BranchPattern != "" {
+		var commits map[string]string
+		commits, fetchErr = w.fetcher.LatestBranchCommits(ctx, &fetchGitJob, w.client)
+		if fetchErr != nil {
+			w.log.Error(fetchErr, "error fetching branch commits", "repo", fetchGitJob.Spec.Git.Repo, "subscribers", len(subscribers))
+		} else {
+			updateCommits = func(gitJob *v1.GitJob) error {
+				// branches which are no longer present in the repo are removed from the status
+				branches := mergeBranchCommits(gitJob.Status.Branches, commits)
+				if !equality.Semantic.DeepEqual(gitJob.Status.Branches, branches) {
+					w.log.Info("branch commits changed", "gitjob name", gitJob.Name, "branches", len(branches))
+				}
+				gitJob.Status.Branches = branches
+				return nil
+			}
+		}
+	} else {
+		var commit string
+		commit, fetchErr = w.fetcher.LatestCommit(ctx, &fetchGitJob, w.client)
+		if fetchErr != nil {
+			w.log.Error(fetchErr, "error fetching commit", "repo", fetchGitJob.Spec.Git.Repo, "subscribers", len(subscribers))
+		} else {
+			// rewrites are cached by last executed commit, as retried status updates and subscribers share them
+			rewrites := map[string]*v1.HistoryRewriteStatus{}
+			updateCommits = func(gitJob *v1.GitJob) error {
+				deleted := branchDeleted(*gitJob)
+				if gitJob.Status.Commit == commit && !deleted {
+					return nil
+				}
+				rewrite, ok := rewrites[gitJob.Status.LastExecutedCommit]
+				if !ok {
+					var err error
+					rewrite, err = git.HistoryRewrite(ctx, w.fetcher, gitJob, w.client, commit)
+					if err != nil {
+						// the commit isn't updated, so no job runs for a possibly rewritten history
+						return err
+					}
+					rewrites[gitJob.Status.LastExecutedCommit] = rewrite
+				}
+				if rewrite != nil {
+					w.log.Info("history rewritten", "gitjob name", gitJob.Name, "commit", commit, "last executed commit", rewrite.OldCommit)
+				}
+				if deleted {
+					w.log.Info("deleted branch was pushed again", "gitjob name", gitJob.Name, "ref", gitJob.Status.DeletedRef.Ref)
+					git.ClearDeletedRef(gitJob)
+				}
+				w.log.Info("new commit found", "gitjob name", gitJob.Name, "commit", commit)
+				gitJob.Status.Commit = commit
+				git.SetHistoryRewrite(gitJob, rewrite)
+				return nil
+			}
+		}
+	}
+
+	if fetchErr != nil {
+		w.failures++
+	} else {
+		w.failures = 0
+	}
+	w.nextInterval = calculatePollInterval(syncInterval, w.failures)
+	now := time.Now()
+
+	for _, key := range subscribers {
+		key := key
 		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			var gitJobFomCluster v1.GitJob
-			err := w.client.Get(ctx, types.NamespacedName{Name: w.gitJob.Name, Namespace: w.gitJob.Namespace}, &gitJobFomCluster)
+			err := w.client.Get(ctx, key, &gitJobFomCluster)
 			if err != nil {
 				return err
 			}
-			gitJobFomCluster.Status.Commit = commit
+			oldStatus := gitJobFomCluster.Status.DeepCopy()
+			pollErr := fetchErr
+			if updateCommits != nil {
+				pollErr = updateCommits(&gitJobFomCluster)
+			}
+			gitJobFomCluster.Status.PollFailures = w.failures
+			setPollingCondition(&gitJobFomCluster, pollErr)
+			git.SetHostKeyUnknown(&gitJobFomCluster, pollErr)
+			if equality.Semantic.DeepEqual(oldStatus, &gitJobFomCluster.Status) && now.Sub(oldStatus.LastPollTime.Time) < pollTimeRefreshInterval {
+				return nil
+			}
+			gitJobFomCluster.Status.LastPollTime = metav1.NewTime(now)
+			gitJobFomCluster.Status.NextPollTime = metav1.NewTime(now.Add(w.nextInterval))
 
 			return w.client.Status().Update(ctx, &gitJobFomCluster)
-		}); err != nil {
-			w.log.Error(err, "error updating status when a new commit was found by polling", "gitjob", w.gitJob)
+		}); client.IgnoreNotFound(err) != nil {
+			w.log.Error(err, "error updating status after polling", "gitjob", key)
 		}
 	}
 }
 
+// setPollingCondition sets the GitPolling condition to true, or to false with the reason of the error.
+func setPollingCondition(gitJob *v1.GitJob, err error) {
+	c := condition.Cond(pollingCondition)
+	if err == nil {
+		c.SetStatusBool(gitJob, true)
+		c.Reason(gitJob, "")
+		c.Message(gitJob, "")
+		return
+	}
+	c.SetStatusBool(gitJob, false)
+	c.Reason(gitJob, git.ErrorReason(err))
+	c.Message(gitJob, err.Error())
+}
+
+// mergeBranchCommits returns the branch status for the given commits, keeping the job information of existing branches.
+func mergeBranchCommits(branches []v1.BranchStatus, commits map[string]string) []v1.BranchStatus {
+	existing := map[string]v1.BranchStatus{}
+	for _, branch := range branches {
+		existing[branch.Name] = branch
+	}
+
+	var result []v1.BranchStatus
+	for name, commit := range commits {
+		branch, ok := existing[name]
+		if !ok {
+			branch = v1.BranchStatus{Name: name}
+		}
+		branch.Commit = commit
+		result = append(result, branch)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// calculatePollInterval returns the jittered interval until the next poll. The syncInterval is doubled for every
+// consecutive failure, up to maxPollBackoff.
+func calculatePollInterval(syncInterval time.Duration, failures int) time.Duration {
+	interval := syncInterval
+	for i := 0; i < failures && interval < maxPollBackoff; i++ {
+		interval *= 2
+		if interval > maxPollBackoff {
+			interval = maxPollBackoff
+		}
+	}
+
+	return wait.Jitter(interval, pollJitterFactor)
+}
+
 func calculateSyncInterval(gitJob v1.GitJob) time.Duration {
+	interval := time.Duration(defaultSyncInterval) * time.Second
 	if gitJob.Spec.SyncInterval != 0 {
-		return time.Duration(gitJob.Spec.SyncInterval) * time.Second
+		interval = time.Duration(gitJob.Spec.SyncInterval) * time.Second
+	}
+	if branchDeleted(gitJob) && interval < deletedBranchRecheckInterval {
+		return deletedBranchRecheckInterval
 	}
 
-	return time.Duration(defaultSyncInterval) * time.Second
+	return interval
+}
+
+// branchDeleted returns whether the watched branch of the gitJob was deleted in the git repo.
+func branchDeleted(gitJob v1.GitJob) bool {
+	deleted := gitJob.Status.DeletedRef
+	return deleted != nil && strings.HasPrefix(deleted.Ref, "refs/heads/")
 }
@@ -4,22 +4,28 @@ package poll
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
 	"github.com/rancher/gitjob/pkg/git/mocks"
 
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/google/go-cmp/cmp"
 	"go.uber.org/mock/gomock"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
-func TestFetchBySyncInterval(t *testing.T) {
+func TestPoll(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -39,10 +45,10 @@ func TestFetchBySyncInterval(t *testing.T) {
 	commit := "fakeCommit"
 
 	tests := map[string]struct {
-		numTimeTickMock int
+		numPolls int
 	}{
-		".Status.LastPulledCommit is updated before syncPeriod": {
-			0,
+		".Status.LastPulledCommit is updated by the first poll": {
+			1,
 		},
 		"Latest commit is fetched 10 times": {
 			10,
@@ -52,24 +58,18 @@ func TestFetchBySyncInterval(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			w := Watch{
-				gitJob:  gitJob,
-				client:  client,
-				mu:      new(sync.Mutex),
-				fetcher: fetcher,
-			}
-			tickerC := make(chan time.Time)
-			ticker := &time.Ticker{
-				C: tickerC,
-			}
-			fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return(commit, nil).Times(test.numTimeTickMock + 1)
-			go func() {
-				for i := 0; i < test.numTimeTickMock; i++ {
-					tickerC <- time.Now() // simulate syncInterval has passed
+				subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+				client:      client,
+				mu:          new(sync.Mutex),
+				fetcher:     fetcher,
+			}
+			fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return(commit, nil).Times(test.numPolls)
+			for i := 0; i < test.numPolls; i++ {
+				next := w.Poll(ctx)
+				if next < defaultSyncInterval*time.Second || next > defaultSyncInterval*time.Second*11/10 {
+					t.Errorf("expected the next poll after the sync interval plus jitter, but got %v", next)
 				}
-				w.Finish()
-			}()
-
-			w.fetchBySyncInterval(ctx, ticker)
+			}
 
 			updatedGitJob := v1.GitJob{}
 			err = client.Get(ctx, types.NamespacedName{Name: gitJob.Name, Namespace: gitJob.Namespace}, &updatedGitJob)
@@ -82,3 +82,542 @@ func TestFetchBySyncInterval(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchBranchCommitsUpdatesStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gitjob",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				BranchPattern: "release/*",
+			},
+		},
+		Status: v1.GitJobStatus{
+			Branches: []v1.BranchStatus{
+				{Name: "release/1.0", Commit: "oldCommit", LastExecutedCommit: "oldCommit"},
+				{Name: "release/0.9", Commit: "deletedCommit"},
+			},
+		},
+	}
+	fetcher := mocks.NewMockGitFetcher(ctrl)
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+	ctx := context.TODO()
+
+	w := Watch{
+		subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+		client:      client,
+		mu:          new(sync.Mutex),
+		fetcher:     fetcher,
+	}
+	fetcher.EXPECT().LatestBranchCommits(ctx, gomock.Any(), client).Return(map[string]string{
+		"release/1.0": "newCommit",
+		"release/1.1": "otherCommit",
+	}, nil)
+
+	w.fetchLatestCommitAndUpdateStatus(ctx)
+
+	updatedGitJob := v1.GitJob{}
+	err = client.Get(ctx, types.NamespacedName{Name: gitJob.Name, Namespace: gitJob.Namespace}, &updatedGitJob)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expected := []v1.BranchStatus{
+		{Name: "release/1.0", Commit: "newCommit", LastExecutedCommit: "oldCommit"},
+		{Name: "release/1.1", Commit: "otherCommit"},
+	}
+	if !cmp.Equal(updatedGitJob.Status.Branches, expected) {
+		t.Errorf("expected .Status.Branches %v, but got %v", expected, updatedGitJob.Status.Branches)
+	}
+}
+
+func TestFetchSetsPollingCondition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+
+	tests := map[string]struct {
+		fetchErr         error
+		expectedStatus   corev1.ConditionStatus
+		expectedReason   string
+		expectedMessage  string
+		expectedCommit   string
+		expectedInterval time.Duration
+		expectedFailures int
+	}{
+		"poll succeeds": {
+			fetchErr:         nil,
+			expectedStatus:   corev1.ConditionTrue,
+			expectedCommit:   "fakeCommit",
+			expectedInterval: 30 * time.Second,
+		},
+		"authentication fails": {
+			fetchErr:         transport.ErrAuthenticationRequired,
+			expectedStatus:   corev1.ConditionFalse,
+			expectedReason:   git.ReasonAuthFailed,
+			expectedMessage:  transport.ErrAuthenticationRequired.Error(),
+			expectedCommit:   "oldCommit",
+			expectedInterval: 60 * time.Second,
+			expectedFailures: 1,
+		},
+		"repository not found": {
+			fetchErr:         transport.ErrRepositoryNotFound,
+			expectedStatus:   corev1.ConditionFalse,
+			expectedReason:   git.ReasonNotFound,
+			expectedMessage:  transport.ErrRepositoryNotFound.Error(),
+			expectedCommit:   "oldCommit",
+			expectedInterval: 60 * time.Second,
+			expectedFailures: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "gitjob",
+				},
+				Spec: v1.GitJobSpec{
+					SyncInterval: 30,
+				},
+				Status: v1.GitJobStatus{
+					GitEvent: v1.GitEvent{Commit: "oldCommit"},
+				},
+			}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+			fetcher := mocks.NewMockGitFetcher(ctrl)
+			w := Watch{
+				subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+				client:      client,
+				mu:          new(sync.Mutex),
+				fetcher:     fetcher,
+			}
+			commit := ""
+			if test.fetchErr == nil {
+				commit = "fakeCommit"
+			}
+			fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return(commit, test.fetchErr)
+
+			w.fetchLatestCommitAndUpdateStatus(ctx)
+
+			updatedGitJob := v1.GitJob{}
+			err = client.Get(ctx, types.NamespacedName{Name: gitJob.Name, Namespace: gitJob.Namespace}, &updatedGitJob)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if updatedGitJob.Status.Commit != test.expectedCommit {
+				t.Errorf("expected .Status.Commit %v, but got %v", test.expectedCommit, updatedGitJob.Status.Commit)
+			}
+			if updatedGitJob.Status.LastPollTime.IsZero() {
+				t.Errorf("expected .Status.LastPollTime to be set")
+			}
+			if interval := updatedGitJob.Status.NextPollTime.Sub(updatedGitJob.Status.LastPollTime.Time); interval < test.expectedInterval || interval > test.expectedInterval*11/10 {
+				t.Errorf("expected .Status.NextPollTime to be %v after .Status.LastPollTime plus jitter, but got %v", test.expectedInterval, interval)
+			}
+			if updatedGitJob.Status.PollFailures != test.expectedFailures {
+				t.Errorf("expected .Status.PollFailures %v, but got %v", test.expectedFailures, updatedGitJob.Status.PollFailures)
+			}
+			if len(updatedGitJob.Status.Conditions) != 1 {
+				t.Fatalf("expected one condition, but got %v", updatedGitJob.Status.Conditions)
+			}
+			c := updatedGitJob.Status.Conditions[0]
+			if c.Type != pollingCondition || c.Status != test.expectedStatus || c.Reason != test.expectedReason || c.Message != test.expectedMessage {
+				t.Errorf("unexpected condition %v", c)
+			}
+		})
+	}
+}
+
+func TestFetchSkipsUnchangedStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+
+	tests := map[string]struct {
+		commit          string
+		lastPoll        time.Duration
+		expectedUpdated bool
+	}{
+		"unchanged": {
+			commit:   "commit",
+			lastPoll: time.Minute,
+		},
+		"unchanged with stale poll times": {
+			commit:          "commit",
+			lastPoll:        pollTimeRefreshInterval + time.Minute,
+			expectedUpdated: true,
+		},
+		"new commit": {
+			commit:          "newCommit",
+			lastPoll:        time.Minute,
+			expectedUpdated: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "gitjob",
+				},
+				Status: v1.GitJobStatus{
+					GitEvent:     v1.GitEvent{Commit: "commit"},
+					LastPollTime: metav1.NewTime(time.Now().Add(-test.lastPoll)),
+				},
+			}
+			setPollingCondition(&gitJob, nil)
+			client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+			var existing v1.GitJob
+			if err := client.Get(ctx, getKey(gitJob), &existing); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			fetcher := mocks.NewMockGitFetcher(ctrl)
+			fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return(test.commit, nil)
+			w := Watch{
+				subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+				client:      client,
+				mu:          new(sync.Mutex),
+				fetcher:     fetcher,
+			}
+
+			w.fetchLatestCommitAndUpdateStatus(ctx)
+
+			var updatedGitJob v1.GitJob
+			if err := client.Get(ctx, getKey(gitJob), &updatedGitJob); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if updated := updatedGitJob.ResourceVersion != existing.ResourceVersion; updated != test.expectedUpdated {
+				t.Errorf("expected status update %v, but got %v", test.expectedUpdated, updated)
+			}
+		})
+	}
+}
+
+func TestFetchDetectsHistoryRewrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+
+	tests := map[string]struct {
+		policy          string
+		isAncestor      bool
+		ancestorErr     error
+		expectedCommit  string
+		expectedRewrite *v1.HistoryRewriteStatus
+		expectedPolling corev1.ConditionStatus
+	}{
+		"fast-forward": {
+			policy:          v1.HistoryRewriteBlock,
+			isAncestor:      true,
+			expectedCommit:  "newCommit",
+			expectedPolling: corev1.ConditionTrue,
+		},
+		"force-push": {
+			policy:          v1.HistoryRewriteBlock,
+			expectedCommit:  "newCommit",
+			expectedRewrite: &v1.HistoryRewriteStatus{OldCommit: "executedCommit", NewCommit: "newCommit"},
+			expectedPolling: corev1.ConditionTrue,
+		},
+		"history isn't checked without policy": {
+			expectedCommit:  "newCommit",
+			expectedPolling: corev1.ConditionTrue,
+		},
+		"commit isn't updated if the history can't be checked": {
+			policy:          v1.HistoryRewriteAlert,
+			ancestorErr:     transport.ErrAuthenticationRequired,
+			expectedCommit:  "executedCommit",
+			expectedPolling: corev1.ConditionFalse,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "gitjob",
+				},
+				Spec: v1.GitJobSpec{
+					Git: v1.GitInfo{
+						Branch:               "main",
+						HistoryRewritePolicy: test.policy,
+					},
+				},
+				Status: v1.GitJobStatus{
+					GitEvent: v1.GitEvent{Commit: "executedCommit", LastExecutedCommit: "executedCommit"},
+				},
+			}
+			client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+			fetcher := mocks.NewMockGitFetcher(ctrl)
+			w := Watch{
+				subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+				client:      client,
+				mu:          new(sync.Mutex),
+				fetcher:     fetcher,
+			}
+			fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return("newCommit", nil)
+			if test.policy != "" {
+				fetcher.EXPECT().IsAncestor(ctx, gomock.Any(), client, "main", "executedCommit", "newCommit").Return(test.isAncestor, test.ancestorErr)
+			}
+
+			w.fetchLatestCommitAndUpdateStatus(ctx)
+
+			updatedGitJob := v1.GitJob{}
+			err = client.Get(ctx, types.NamespacedName{Name: gitJob.Name, Namespace: gitJob.Namespace}, &updatedGitJob)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if updatedGitJob.Status.Commit != test.expectedCommit {
+				t.Errorf("expected .Status.Commit %v, but got %v", test.expectedCommit, updatedGitJob.Status.Commit)
+			}
+			if !cmp.Equal(updatedGitJob.Status.HistoryRewrite, test.expectedRewrite) {
+				t.Errorf("unexpected .Status.HistoryRewrite %v", cmp.Diff(test.expectedRewrite, updatedGitJob.Status.HistoryRewrite))
+			}
+			rewritten := false
+			for _, c := range updatedGitJob.Status.Conditions {
+				switch c.Type {
+				case v1.HistoryRewrittenCondition:
+					rewritten = c.Status == "True"
+				case pollingCondition:
+					if c.Status != test.expectedPolling {
+						t.Errorf("unexpected polling condition %v", c)
+					}
+				}
+			}
+			if rewritten != (test.expectedRewrite != nil) {
+				t.Errorf("unexpected conditions %v", updatedGitJob.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gitjob",
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+	fetcher := mocks.NewMockGitFetcher(ctrl)
+	ctx := context.TODO()
+	w := Watch{
+		subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+		client:      client,
+		mu:          new(sync.Mutex),
+		fetcher:     fetcher,
+	}
+
+	steps := []struct {
+		err              error
+		expectedInterval time.Duration
+	}{
+		{transport.ErrAuthenticationRequired, 30 * time.Second},
+		{transport.ErrAuthenticationRequired, 60 * time.Second},
+		{transport.ErrAuthenticationRequired, 120 * time.Second},
+		{nil, 15 * time.Second},
+	}
+	for i, step := range steps {
+		fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return("", step.err)
+
+		w.fetchLatestCommitAndUpdateStatus(ctx)
+
+		if w.nextInterval < step.expectedInterval || w.nextInterval > step.expectedInterval*11/10 {
+			t.Errorf("step %d: expected interval %v plus jitter, but got %v", i, step.expectedInterval, w.nextInterval)
+		}
+	}
+	if w.failures != 0 {
+		t.Errorf("expected failures to be reset after a successful poll, but got %d", w.failures)
+	}
+}
+
+func TestCalculatePollInterval(t *testing.T) {
+	tests := map[string]struct {
+		syncInterval  int
+		failures      int
+		branchDeleted bool
+		expected      time.Duration
+	}{
+		"default interval": {
+			expected: 15 * time.Second,
+		},
+		"no failures": {
+			syncInterval: 60,
+			expected:     60 * time.Second,
+		},
+		"backoff is doubled per failure": {
+			syncInterval: 60,
+			failures:     3,
+			expected:     8 * time.Minute,
+		},
+		"backoff is capped": {
+			syncInterval: 60,
+			failures:     20,
+			expected:     maxPollBackoff,
+		},
+		"sync interval longer than cap": {
+			syncInterval: 3600,
+			failures:     2,
+			expected:     time.Hour,
+		},
+		"deleted branch is rechecked slowly": {
+			syncInterval:  60,
+			branchDeleted: true,
+			expected:      deletedBranchRecheckInterval,
+		},
+		"deleted branch with a longer sync interval": {
+			syncInterval:  3600,
+			branchDeleted: true,
+			expected:      time.Hour,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitJob := v1.GitJob{Spec: v1.GitJobSpec{SyncInterval: test.syncInterval}}
+			if test.branchDeleted {
+				gitJob.Status.DeletedRef = &v1.DeletedRefStatus{Ref: "refs/heads/master"}
+			}
+			interval := calculatePollInterval(calculateSyncInterval(gitJob), test.failures)
+			if interval < test.expected || interval > test.expected*11/10 {
+				t.Errorf("expected %v plus jitter, but got %v", test.expected, interval)
+			}
+		})
+	}
+}
+
+func TestFetchClearsDeletedBranch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitjob"},
+		Status: v1.GitJobStatus{
+			GitEvent:   v1.GitEvent{Commit: "commit"},
+			DeletedRef: &v1.DeletedRefStatus{Ref: "refs/heads/master", Commit: "commit"},
+		},
+	}
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1.AddToScheme(scheme))
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob).WithStatusSubresource(&gitJob).Build()
+	ctx := context.TODO()
+	fetcher := mocks.NewMockGitFetcher(ctrl)
+	w := newWatch(gitJob, client, fetcher)
+
+	// the branch is still deleted
+	fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return("", errors.New("branch not found"))
+	w.Poll(ctx)
+	var updatedGitJob v1.GitJob
+	if err := client.Get(ctx, getKey(gitJob), &updatedGitJob); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if updatedGitJob.Status.DeletedRef == nil {
+		t.Errorf("expected the deleted ref to be kept")
+	}
+
+	// the branch was pushed again with the same commit
+	fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return("commit", nil)
+	w.Poll(ctx)
+	if err := client.Get(ctx, getKey(gitJob), &updatedGitJob); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if updatedGitJob.Status.DeletedRef != nil {
+		t.Errorf("expected the deleted ref to be cleared, but got %v", updatedGitJob.Status.DeletedRef)
+	}
+	if updatedGitJob.Status.Commit != "commit" {
+		t.Errorf("expected commit %q, but got %q", "commit", updatedGitJob.Status.Commit)
+	}
+}
+
+func TestFetchUpdatesAllSubscribers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	gitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "gitjob",
+			Namespace: "test",
+		},
+		Spec: v1.GitJobSpec{
+			SyncInterval: 60,
+		},
+	}
+	otherGitJob := v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: "test",
+		},
+		Spec: v1.GitJobSpec{
+			SyncInterval: 30,
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(&gitJob, &otherGitJob).WithStatusSubresource(&gitJob, &otherGitJob).Build()
+	fetcher := mocks.NewMockGitFetcher(ctrl)
+	ctx := context.TODO()
+	w := Watch{
+		subscribers: map[types.NamespacedName]v1.GitJob{getKey(gitJob): gitJob},
+		client:      client,
+		mu:          new(sync.Mutex),
+		fetcher:     fetcher,
+	}
+	w.Subscribe(otherGitJob)
+	if w.GetSyncInterval() != 30 {
+		t.Errorf("expected the shortest sync interval 30, but got %d", w.GetSyncInterval())
+	}
+	fetcher.EXPECT().LatestCommit(ctx, gomock.Any(), client).Return("fakeCommit", nil).Times(1)
+
+	w.fetchLatestCommitAndUpdateStatus(ctx)
+
+	for _, key := range []types.NamespacedName{getKey(gitJob), getKey(otherGitJob)} {
+		updatedGitJob := v1.GitJob{}
+		err = client.Get(ctx, key, &updatedGitJob)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if updatedGitJob.Status.Commit != "fakeCommit" {
+			t.Errorf("expected .Status.Commit of %v to be fakeCommit, but got %v", key, updatedGitJob.Status.Commit)
+		}
+	}
+
+	w.Unsubscribe(getKey(otherGitJob))
+	if w.GetSyncInterval() != 60 {
+		t.Errorf("expected sync interval 60 after unsubscribing, but got %d", w.GetSyncInterval())
+	}
+}
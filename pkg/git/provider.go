@@ -0,0 +1,307 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"github.com/rancher/gitjob/pkg/githubapp"
+)
+
+// Git providers whose API is used to check whether the head commit of a branch changed, before listing all refs of
+// the repo. They are autodetected for well known hosts, and can be set for self-hosted instances in spec.git.provider.
+const (
+	ProviderGitHub          = "github"
+	ProviderGitLab          = "gitlab"
+	ProviderGitea           = "gitea"
+	ProviderGogs            = "gogs"
+	ProviderBitbucket       = "bitbucket"
+	ProviderBitbucketServer = "bitbucket-server"
+	ProviderAzureDevOps     = "azure-devops"
+
+	// providerRancher is git.rancher.io, which serves a GitHub compatible commits endpoint
+	providerRancher = "rancher"
+)
+
+// commitAPI requests the head commit of a branch from the API of a git provider.
+type commitAPI struct {
+	// url returns the API URL for the head commit of branch in repo, or "" if the repo path is not supported.
+	url func(apiURL string, repo *url.URL, branch string) string
+	// defaultAPIURL returns the API URL of the provider at the repo's host, if none is configured.
+	defaultAPIURL func(repo *url.URL) string
+	// commit returns the head commit of branch from the response body.
+	commit func(body []byte, branch string) (string, error)
+	// tokenHeader sends the password of a basic auth credential in this header, instead of using basic auth.
+	tokenHeader string
+	// accept is the Accept header of the request.
+	accept string
+}
+
+var commitAPIs = map[string]commitAPI{
+	ProviderGitHub: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			parts := repoPathParts(repo)
+			if len(parts) < 2 {
+				return ""
+			}
+			return fmt.Sprintf("%s/repos/%s/%s/commits/%s", apiURL, parts[0], parts[1], branch)
+		},
+		defaultAPIURL: githubapp.APIURLForRepo,
+		commit:        plainCommit,
+		accept:        "application/vnd.github.v3.sha",
+	},
+	providerRancher: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			parts := repoPathParts(repo)
+			if len(parts) < 1 {
+				return ""
+			}
+			return fmt.Sprintf("%s/repos/%s/commits/%s", apiURL, parts[0], branch)
+		},
+		defaultAPIURL: func(repo *url.URL) string {
+			return "https://" + giturls.HTTPSHost(repo)
+		},
+		commit: plainCommit,
+		accept: "application/vnd.github.v3.sha",
+	},
+	ProviderGitLab: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			parts := repoPathParts(repo)
+			if len(parts) < 2 {
+				return ""
+			}
+			return fmt.Sprintf("%s/projects/%s/repository/branches/%s", apiURL, escapePath(strings.Join(parts, "/")), escapePath(branch))
+		},
+		defaultAPIURL: func(repo *url.URL) string {
+			return "https://" + giturls.HTTPSHost(repo) + "/api/v4"
+		},
+		commit: func(body []byte, _ string) (string, error) {
+			var branch struct {
+				Commit struct {
+					ID string `json:"id"`
+				} `json:"commit"`
+			}
+			err := json.Unmarshal(body, &branch)
+			return branch.Commit.ID, err
+		},
+		tokenHeader: "PRIVATE-TOKEN",
+	},
+	ProviderGitea: {
+		url:           giteaURL,
+		defaultAPIURL: giteaAPIURL,
+		commit:        giteaCommit,
+	},
+	ProviderGogs: {
+		url:           giteaURL,
+		defaultAPIURL: giteaAPIURL,
+		commit:        giteaCommit,
+	},
+	ProviderBitbucket: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			parts := repoPathParts(repo)
+			if len(parts) < 2 {
+				return ""
+			}
+			return fmt.Sprintf("%s/repositories/%s/%s/refs/branches/%s", apiURL, parts[0], parts[1], escapePath(branch))
+		},
+		defaultAPIURL: func(_ *url.URL) string {
+			return "https://api.bitbucket.org/2.0"
+		},
+		commit: func(body []byte, _ string) (string, error) {
+			var branch struct {
+				Target struct {
+					Hash string `json:"hash"`
+				} `json:"target"`
+			}
+			err := json.Unmarshal(body, &branch)
+			return branch.Target.Hash, err
+		},
+	},
+	ProviderBitbucketServer: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			parts := repoPathParts(repo)
+			// http clone URLs are prefixed with /scm, ssh clone URLs aren't
+			if len(parts) > 0 && parts[0] == "scm" {
+				parts = parts[1:]
+			}
+			if len(parts) < 2 {
+				return ""
+			}
+			return fmt.Sprintf("%s/projects/%s/repos/%s/branches?filterText=%s", apiURL, parts[0], parts[1], url.QueryEscape(branch))
+		},
+		defaultAPIURL: func(repo *url.URL) string {
+			return "https://" + giturls.HTTPSHost(repo) + "/rest/api/1.0"
+		},
+		commit: func(body []byte, branch string) (string, error) {
+			var branches struct {
+				Values []struct {
+					DisplayID    string `json:"displayId"`
+					LatestCommit string `json:"latestCommit"`
+				} `json:"values"`
+			}
+			if err := json.Unmarshal(body, &branches); err != nil {
+				return "", err
+			}
+			for _, b := range branches.Values {
+				if b.DisplayID == branch {
+					return b.LatestCommit, nil
+				}
+			}
+			return "", nil
+		},
+	},
+	ProviderAzureDevOps: {
+		url: func(apiURL string, repo *url.URL, branch string) string {
+			org, project, name, ok := azureDevOpsRepo(repo)
+			if !ok {
+				return ""
+			}
+			return fmt.Sprintf("%s/%s/%s/_apis/git/repositories/%s/refs?filter=%s&api-version=7.0", apiURL, org, project, name, url.QueryEscape("heads/"+branch))
+		},
+		defaultAPIURL: func(_ *url.URL) string {
+			return "https://dev.azure.com"
+		},
+		commit: func(body []byte, branch string) (string, error) {
+			var refs struct {
+				Value []struct {
+					Name     string `json:"name"`
+					ObjectID string `json:"objectId"`
+				} `json:"value"`
+			}
+			if err := json.Unmarshal(body, &refs); err != nil {
+				return "", err
+			}
+			// the filter matches ref name prefixes
+			for _, ref := range refs.Value {
+				if ref.Name == formatRefForBranch(branch) {
+					return ref.ObjectID, nil
+				}
+			}
+			return "", nil
+		},
+	},
+}
+
+// detectProvider returns the provider configured for the repo, or the provider of well known hosts.
+func detectProvider(provider string, repo *url.URL) string {
+	if _, ok := commitAPIs[provider]; ok {
+		return provider
+	}
+
+	host := strings.ToLower(repo.Hostname())
+	switch {
+	case host == "github.com":
+		return ProviderGitHub
+	case host == "git.rancher.io":
+		return providerRancher
+	case host == "gitlab.com":
+		return ProviderGitLab
+	case host == "gitea.com", host == "codeberg.org":
+		return ProviderGitea
+	case host == "bitbucket.org":
+		return ProviderBitbucket
+	case host == "dev.azure.com", host == "ssh.dev.azure.com", strings.HasSuffix(host, ".visualstudio.com"):
+		return ProviderAzureDevOps
+	}
+
+	return ""
+}
+
+// newCommitRequest returns the request for the head commit of branch from the provider's API, and the API used to
+// read the response. It returns nil if the provider of the repo is unknown or its repo URL is not supported. SSH
+// credentials can't authenticate API requests, so repos which aren't served over http(s) are only supported with an
+// API credential, like a token or a GitHub App. Otherwise requests fail for private repos and count against the rate
+// limit of anonymous requests.
+func newCommitRequest(provider, apiURL, repoURL, branch string, apiCredential bool) (*http.Request, *commitAPI, error) {
+	repo, err := giturls.Parse(repoURL)
+	if err != nil {
+		return nil, nil, nil
+	}
+	if repo.Scheme != "http" && repo.Scheme != "https" && !apiCredential {
+		return nil, nil, nil
+	}
+	provider = detectProvider(provider, repo)
+	api, ok := commitAPIs[provider]
+	if !ok {
+		return nil, nil, nil
+	}
+	if apiURL == "" {
+		apiURL = api.defaultAPIURL(repo)
+	}
+
+	u := api.url(strings.TrimSuffix(apiURL, "/"), repo, branch)
+	if u == "" {
+		return nil, nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if api.accept != "" {
+		req.Header.Set("Accept", api.accept)
+	}
+
+	return req, &api, nil
+}
+
+func giteaURL(apiURL string, repo *url.URL, branch string) string {
+	parts := repoPathParts(repo)
+	if len(parts) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%s/repos/%s/%s/branches/%s", apiURL, parts[0], parts[1], branch)
+}
+
+func giteaAPIURL(repo *url.URL) string {
+	return "https://" + giturls.HTTPSHost(repo) + "/api/v1"
+}
+
+func giteaCommit(body []byte, _ string) (string, error) {
+	var branch struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	err := json.Unmarshal(body, &branch)
+	return branch.Commit.ID, err
+}
+
+func plainCommit(body []byte, _ string) (string, error) {
+	return strings.TrimSpace(string(body)), nil
+}
+
+// azureDevOpsRepo returns the organization, project and repo name of an Azure DevOps repo URL, e.g.
+// https://dev.azure.com/org/project/_git/repo, https://org.visualstudio.com/project/_git/repo or
+// git@ssh.dev.azure.com:v3/org/project/repo.
+func azureDevOpsRepo(repo *url.URL) (string, string, string, bool) {
+	parts := repoPathParts(repo)
+	host := strings.ToLower(repo.Hostname())
+	switch {
+	case len(parts) == 4 && parts[0] == "v3":
+		return parts[1], parts[2], parts[3], true
+	case strings.HasSuffix(host, ".visualstudio.com") && len(parts) == 3 && parts[1] == "_git":
+		return strings.TrimSuffix(host, ".visualstudio.com"), parts[0], parts[2], true
+	case len(parts) == 4 && parts[2] == "_git":
+		return parts[0], parts[1], parts[3], true
+	}
+
+	return "", "", "", false
+}
+
+// repoPathParts returns the segments of the repo's path, without the .git suffix.
+func repoPathParts(repo *url.URL) []string {
+	path := strings.TrimSuffix(strings.Trim(repo.Path, "/"), ".git")
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, "/")
+}
+
+// escapePath escapes s as a single path segment, including slashes.
+func escapePath(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), "/", "%2F")
+}
@@ -0,0 +1,256 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const headCommit = "2c8d3e3f0b7a4f4f9e0f1c2d3b4a5968778695a4"
+
+func TestRemoteSHAChanged(t *testing.T) {
+	tests := map[string]struct {
+		provider       string
+		repo           string
+		branch         string
+		expectedURI    string
+		response       string
+		expectedHeader map[string]string
+	}{
+		"github enterprise": {
+			provider:       ProviderGitHub,
+			repo:           "https://github.example.com/org/repo.git",
+			branch:         "main",
+			expectedURI:    "/repos/org/repo/commits/main",
+			response:       headCommit,
+			expectedHeader: map[string]string{"Accept": "application/vnd.github.v3.sha"},
+		},
+		"gitlab": {
+			provider:       ProviderGitLab,
+			repo:           "https://gitlab.example.com/group/subgroup/repo.git",
+			branch:         "release/v1",
+			expectedURI:    "/projects/group%2Fsubgroup%2Frepo/repository/branches/release%2Fv1",
+			response:       fmt.Sprintf(`{"name":"release/v1","commit":{"id":%q}}`, headCommit),
+			expectedHeader: map[string]string{"PRIVATE-TOKEN": "token"},
+		},
+		"gitea": {
+			provider:    ProviderGitea,
+			repo:        "https://gitea.example.com/org/repo",
+			branch:      "main",
+			expectedURI: "/repos/org/repo/branches/main",
+			response:    fmt.Sprintf(`{"name":"main","commit":{"id":%q}}`, headCommit),
+		},
+		"gogs ssh repo with api token": {
+			provider:    ProviderGogs,
+			repo:        "ssh://git@gogs.example.com:2222/org/repo.git",
+			branch:      "main",
+			expectedURI: "/repos/org/repo/branches/main",
+			response:    fmt.Sprintf(`{"name":"main","commit":{"id":%q}}`, headCommit),
+		},
+		"bitbucket cloud": {
+			provider:    ProviderBitbucket,
+			repo:        "https://bitbucket.org/workspace/repo.git",
+			branch:      "main",
+			expectedURI: "/repositories/workspace/repo/refs/branches/main",
+			response:    fmt.Sprintf(`{"name":"main","target":{"hash":%q}}`, headCommit),
+		},
+		"bitbucket server": {
+			provider:    ProviderBitbucketServer,
+			repo:        "https://bitbucket.example.com/scm/proj/repo.git",
+			branch:      "main",
+			expectedURI: "/projects/proj/repos/repo/branches?filterText=main",
+			response:    fmt.Sprintf(`{"values":[{"displayId":"main-old","latestCommit":"0000"},{"displayId":"main","latestCommit":%q}]}`, headCommit),
+		},
+		"azure devops": {
+			provider:    ProviderAzureDevOps,
+			repo:        "https://dev.azure.com/org/project/_git/repo",
+			branch:      "main",
+			expectedURI: "/org/project/_apis/git/repositories/repo/refs?filter=heads%2Fmain&api-version=7.0",
+			response:    fmt.Sprintf(`{"value":[{"name":"refs/heads/main","objectId":%q},{"name":"refs/heads/main2","objectId":"0000"}]}`, headCommit),
+		},
+		"azure devops visualstudio.com": {
+			provider:    ProviderAzureDevOps,
+			repo:        "https://org.visualstudio.com/project/_git/repo",
+			branch:      "main",
+			expectedURI: "/org/project/_apis/git/repositories/repo/refs?filter=heads%2Fmain&api-version=7.0",
+			response:    fmt.Sprintf(`{"value":[{"name":"refs/heads/main","objectId":%q}]}`, headCommit),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.RequestURI() != test.expectedURI {
+					t.Errorf("expected request %s, but got %s", test.expectedURI, r.URL.RequestURI())
+				}
+				for k, v := range test.expectedHeader {
+					if r.Header.Get(k) != v {
+						t.Errorf("expected header %s=%s, but got %s", k, v, r.Header.Get(k))
+					}
+				}
+				_, _ = w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			secret := &corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{
+					corev1.BasicAuthUsernameKey: []byte("user"),
+					corev1.BasicAuthPasswordKey: []byte("token"),
+				},
+			}
+			g, err := newGit("", test.repo, &options{
+				Credential:     secret,
+				Provider:       test.provider,
+				ProviderAPIURL: server.URL,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			changed, err := g.remoteSHAChanged(test.branch, headCommit)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if changed {
+				t.Errorf("expected the head commit to be unchanged")
+			}
+
+			changed, err = g.remoteSHAChanged(test.branch, "1111111111111111111111111111111111111111")
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !changed {
+				t.Errorf("expected the head commit to be changed")
+			}
+		})
+	}
+}
+
+func TestRemoteSHAChangedFallsBackToListingRefs(t *testing.T) {
+	tests := map[string]struct {
+		provider string
+		repo     string
+		status   int
+		response string
+	}{
+		"unknown provider": {
+			status: http.StatusOK,
+		},
+		"ssh repo without api credential": {
+			provider: ProviderGitea,
+			repo:     "git@gitea.example.com:org/repo.git",
+			status:   http.StatusOK,
+			response: fmt.Sprintf(`{"name":"main","commit":{"id":%q}}`, headCommit),
+		},
+		"api error": {
+			provider: ProviderGitea,
+			status:   http.StatusNotFound,
+		},
+		"unexpected response": {
+			provider: ProviderGitea,
+			status:   http.StatusOK,
+			response: "<html></html>",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			repo := test.repo
+			if repo == "" {
+				repo = "https://git.example.com/org/repo"
+			}
+			g, err := newGit("", repo, &options{
+				Provider:       test.provider,
+				ProviderAPIURL: server.URL,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			changed, err := g.remoteSHAChanged("main", headCommit)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !changed {
+				t.Errorf("expected a fallback to listing the refs")
+			}
+		})
+	}
+}
+
+func TestGitHubNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != fmt.Sprintf("%q", headCommit) {
+			t.Errorf("unexpected If-None-Match header %s", r.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	g, err := newGit("", "https://github.com/org/repo", &options{ProviderAPIURL: server.URL})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	changed, err := g.remoteSHAChanged("main", headCommit)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if changed {
+		t.Errorf("expected the head commit to be unchanged")
+	}
+}
+
+func TestDefaultAPIURL(t *testing.T) {
+	tests := map[string]struct {
+		provider    string
+		repo        string
+		expectedURL string
+	}{
+		"github enterprise ssh": {
+			provider:    ProviderGitHub,
+			repo:        "ssh://git@github.example.com:2222/org/repo.git",
+			expectedURL: "https://github.example.com/api/v3/repos/org/repo/commits/main",
+		},
+		"gitlab ssh": {
+			provider:    ProviderGitLab,
+			repo:        "ssh://git@gitlab.example.com:2222/org/repo.git",
+			expectedURL: "https://gitlab.example.com/api/v4/projects/org%2Frepo/repository/branches/main",
+		},
+		"gitea https with port": {
+			provider:    ProviderGitea,
+			repo:        "https://gitea.example.com:3000/org/repo.git",
+			expectedURL: "https://gitea.example.com:3000/api/v1/repos/org/repo/branches/main",
+		},
+		"bitbucket server ssh": {
+			provider:    ProviderBitbucketServer,
+			repo:        "ssh://git@bitbucket.example.com:7999/proj/repo.git",
+			expectedURL: "https://bitbucket.example.com/rest/api/1.0/projects/proj/repos/repo/branches?filterText=main",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, _, err := newCommitRequest(test.provider, "", test.repo, "main", true)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if req == nil {
+				t.Fatalf("expected a request")
+			}
+			if req.URL.String() != test.expectedURL {
+				t.Errorf("expected request to %s, but got %s", test.expectedURL, req.URL)
+			}
+		})
+	}
+}
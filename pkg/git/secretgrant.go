@@ -0,0 +1,72 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrSecretNotGranted is returned if a gitjob references a secret in another namespace, which is not granted to the
+// namespace of the gitjob by a SecretGrant.
+var ErrSecretNotGranted = errors.New("secret is not granted to the namespace of the gitjob")
+
+// ClientSecretKey returns the secret of the git credential of the gitjob, referenced by spec.git.clientSecretRef or
+// spec.git.clientSecretName. The name is empty if neither is set.
+func ClientSecretKey(gitjob *gitjobv1.GitJob) types.NamespacedName {
+	if ref := gitjob.Spec.Git.ClientSecretRef; ref != nil && ref.Name != "" {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = gitjob.Namespace
+		}
+		return types.NamespacedName{Namespace: namespace, Name: ref.Name}
+	}
+
+	return types.NamespacedName{Namespace: gitjob.Namespace, Name: gitjob.Spec.Git.ClientSecretName}
+}
+
+// CheckSecretGrant returns ErrSecretNotGranted, unless the secret is in the namespace of the gitjob, or a SecretGrant
+// in the namespace of the secret grants it to the namespace of the gitjob.
+func CheckSecretGrant(ctx context.Context, c client.Reader, gitjob *gitjobv1.GitJob, secret types.NamespacedName) error {
+	if secret.Namespace == gitjob.Namespace {
+		return nil
+	}
+
+	var grants gitjobv1.SecretGrantList
+	if err := c.List(ctx, &grants, client.InNamespace(secret.Namespace)); err != nil {
+		return fmt.Errorf("listing secret grants in namespace %s: %w", secret.Namespace, err)
+	}
+	for _, grant := range grants.Items {
+		if grantsFrom(grant.Spec, gitjob.Namespace) && grantsTo(grant.Spec, secret.Name) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: secret %s, namespace %s", ErrSecretNotGranted, secret, gitjob.Namespace)
+}
+
+func grantsFrom(spec gitjobv1.SecretGrantSpec, namespace string) bool {
+	for _, from := range spec.From {
+		if from.Namespace == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+func grantsTo(spec gitjobv1.SecretGrantSpec, name string) bool {
+	if len(spec.To) == 0 {
+		return true
+	}
+	for _, to := range spec.To {
+		if to.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
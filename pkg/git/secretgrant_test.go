@@ -0,0 +1,119 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	gitjobv1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestClientSecretKey(t *testing.T) {
+	tests := map[string]struct {
+		credential gitjobv1.Credential
+		expected   types.NamespacedName
+	}{
+		"none": {
+			expected: types.NamespacedName{Namespace: "team"},
+		},
+		"secret name": {
+			credential: gitjobv1.Credential{ClientSecretName: "secret"},
+			expected:   types.NamespacedName{Namespace: "team", Name: "secret"},
+		},
+		"secret ref without namespace": {
+			credential: gitjobv1.Credential{ClientSecretRef: &gitjobv1.SecretReference{Name: "secret"}},
+			expected:   types.NamespacedName{Namespace: "team", Name: "secret"},
+		},
+		"secret ref takes precedence": {
+			credential: gitjobv1.Credential{
+				ClientSecretName: "local",
+				ClientSecretRef:  &gitjobv1.SecretReference{Name: "secret", Namespace: "shared"},
+			},
+			expected: types.NamespacedName{Namespace: "shared", Name: "secret"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &gitjobv1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: "team"},
+				Spec:       gitjobv1.GitJobSpec{Git: gitjobv1.GitInfo{Credential: test.credential}},
+			}
+			if key := ClientSecretKey(gitjob); key != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, key)
+			}
+		})
+	}
+}
+
+func TestCheckSecretGrant(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(gitjobv1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&gitjobv1.SecretGrant{
+			ObjectMeta: metav1.ObjectMeta{Name: "all", Namespace: "shared"},
+			Spec: gitjobv1.SecretGrantSpec{
+				From: []gitjobv1.SecretGrantFrom{{Namespace: "team-a"}},
+			},
+		},
+		&gitjobv1.SecretGrant{
+			ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "shared"},
+			Spec: gitjobv1.SecretGrantSpec{
+				From: []gitjobv1.SecretGrantFrom{{Namespace: "team-b"}},
+				To:   []gitjobv1.SecretGrantTo{{Name: "token"}},
+			},
+		},
+	).Build()
+
+	tests := map[string]struct {
+		namespace   string
+		secret      types.NamespacedName
+		expectedErr error
+	}{
+		"same namespace": {
+			namespace: "team-c",
+			secret:    types.NamespacedName{Namespace: "team-c", Name: "token"},
+		},
+		"all secrets granted": {
+			namespace: "team-a",
+			secret:    types.NamespacedName{Namespace: "shared", Name: "ssh-key"},
+		},
+		"secret granted": {
+			namespace: "team-b",
+			secret:    types.NamespacedName{Namespace: "shared", Name: "token"},
+		},
+		"other secret not granted": {
+			namespace:   "team-b",
+			secret:      types.NamespacedName{Namespace: "shared", Name: "ssh-key"},
+			expectedErr: ErrSecretNotGranted,
+		},
+		"namespace not granted": {
+			namespace:   "team-c",
+			secret:      types.NamespacedName{Namespace: "shared", Name: "token"},
+			expectedErr: ErrSecretNotGranted,
+		},
+		"no grants": {
+			namespace:   "team-a",
+			secret:      types.NamespacedName{Namespace: "other", Name: "token"},
+			expectedErr: ErrSecretNotGranted,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &gitjobv1.GitJob{ObjectMeta: metav1.ObjectMeta{Name: "gitjob", Namespace: test.namespace}}
+			err := CheckSecretGrant(context.TODO(), c, gitjob, test.secret)
+			if !errors.Is(err, test.expectedErr) {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+			if test.expectedErr != nil && ErrorReason(err) != ReasonSecretNotGranted {
+				t.Errorf("expected reason %s, got %s", ReasonSecretNotGranted, ErrorReason(err))
+			}
+		})
+	}
+}
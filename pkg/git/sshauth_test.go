@@ -0,0 +1,131 @@
+package git
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	gossh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/rancher/gitjob/pkg/sshauth"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSSHPassphrase(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+
+	tests := map[string]struct {
+		passphrase     []byte
+		expectedReason string
+	}{
+		"passphrase": {
+			passphrase: []byte("secret"),
+		},
+		"missing passphrase": {
+			expectedReason: ReasonInvalidPassphrase,
+		},
+		"wrong passphrase": {
+			passphrase:     []byte("wrong"),
+			expectedReason: ReasonInvalidPassphrase,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := map[string][]byte{corev1.SSHAuthPrivateKey: encrypted}
+			if test.passphrase != nil {
+				data[sshauth.PassphraseKey] = test.passphrase
+			}
+			_, err := newGit("", "ssh://git@example.com/repo", &options{Credential: &corev1.Secret{
+				Type: corev1.SecretTypeSSHAuth,
+				Data: data,
+			}})
+			if reason := ErrorReason(err); reason != test.expectedReason {
+				t.Errorf("expected reason %q, but got %q: %v", test.expectedReason, reason, err)
+			}
+		})
+	}
+}
+
+func TestSSHCertificate(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	privateKey := pem.EncodeToMemory(block)
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cert := func(validBefore time.Time) []byte {
+		c := &ssh.Certificate{Key: pub, CertType: ssh.UserCert, ValidBefore: uint64(validBefore.Unix())}
+		if err := c.SignCert(rand.Reader, ca); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return ssh.MarshalAuthorizedKey(c)
+	}
+
+	tests := map[string]struct {
+		certificate    []byte
+		expectedReason string
+	}{
+		"certificate": {
+			certificate: cert(time.Now().Add(time.Hour)),
+		},
+		"expired certificate": {
+			certificate:    cert(time.Now().Add(-time.Hour)),
+			expectedReason: ReasonCertificateExpired,
+		},
+		"invalid certificate": {
+			certificate:    ssh.MarshalAuthorizedKey(pub),
+			expectedReason: ReasonInvalidCredential,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			g, err := newGit("", "ssh://git@example.com/repo", &options{Credential: &corev1.Secret{
+				Type: corev1.SecretTypeSSHAuth,
+				Data: map[string][]byte{
+					corev1.SSHAuthPrivateKey: privateKey,
+					sshauth.CertificateKey:   test.certificate,
+				},
+			}})
+			if reason := ErrorReason(err); reason != test.expectedReason {
+				t.Fatalf("expected reason %q, but got %q: %v", test.expectedReason, reason, err)
+			}
+			if err != nil {
+				return
+			}
+			auth, ok := g.auth.(*gossh.PublicKeys)
+			if !ok {
+				t.Fatalf("expected ssh auth, got %T", g.auth)
+			}
+			if _, ok := auth.Signer.PublicKey().(*ssh.Certificate); !ok {
+				t.Errorf("expected signer to present the certificate, got %s", auth.Signer.PublicKey().Type())
+			}
+		})
+	}
+}
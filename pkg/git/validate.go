@@ -49,24 +49,24 @@ const (
 func validateBranch(name string) error {
 	switch {
 	case len(name) > branchMaxLength:
-		return fmt.Errorf("invalid branch name: too long")
+		return fmt.Errorf("%w: too long", errInvalidBranch)
 	case strings.HasSuffix(name, branchInvalidSuffix):
-		return fmt.Errorf("invalid branch name: cannot end with %q", branchInvalidSuffix)
+		return fmt.Errorf("%w: cannot end with %q", errInvalidBranch, branchInvalidSuffix)
 	case strings.HasPrefix(name, branchInvalidPrefix):
-		return fmt.Errorf("invalid branch name: cannot start with %q", branchInvalidPrefix)
+		return fmt.Errorf("%w: cannot start with %q", errInvalidBranch, branchInvalidPrefix)
 	case name == branchInvalidValues:
-		return fmt.Errorf("invalid branch name: %q", name)
+		return fmt.Errorf("%w: %q", errInvalidBranch, name)
 	}
 
 	for _, invalid := range branchInvalidContains {
 		if strings.Contains(name, invalid) {
-			return fmt.Errorf("invalid branch name: cannot contain %q", invalid)
+			return fmt.Errorf("%w: cannot contain %q", errInvalidBranch, invalid)
 		}
 	}
 
 	for _, r := range name {
 		if unicode.IsControl(r) {
-			return fmt.Errorf("invalid branch name: control chars are not supported")
+			return fmt.Errorf("%w: control chars are not supported", errInvalidBranch)
 		}
 	}
 
@@ -90,9 +90,9 @@ func validateCommit(commit string) error {
 func validateURL(u string) error {
 	switch {
 	case u == "":
-		return fmt.Errorf("invalid url: cannot be empty")
+		return fmt.Errorf("%w: cannot be empty", errInvalidURL)
 	case len(u) > urlMaxLength:
-		return fmt.Errorf("invalid url: exceeds max length %d", urlMaxLength)
+		return fmt.Errorf("%w: exceeds max length %d", errInvalidURL, urlMaxLength)
 	default:
 		return nil
 	}
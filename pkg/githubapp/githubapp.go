@@ -0,0 +1,265 @@
+// Package githubapp mints installation access tokens of GitHub Apps, which authenticate git operations as the app.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// SecretType is the type of a credential secret holding a GitHub App
+	SecretType = "gitjob.cattle.io/github-app"
+	// AppIDKey is the key of the app ID in the secret
+	AppIDKey = "github_app_id"
+	// InstallationIDKey is the key of the installation ID in the secret
+	InstallationIDKey = "github_app_installation_id"
+	// PrivateKeyKey is the key of the PEM encoded private key of the app in the secret
+	PrivateKeyKey = "github_app_private_key"
+	// APIURLKey is the key of the optional API base URL in the secret, e.g. https://github.example.com/api/v3
+	APIURLKey = "github_api_url"
+
+	// DefaultAPIURL is the API base URL of github.com
+	DefaultAPIURL = "https://api.github.com"
+	// Username is the username of basic auth credentials for git operations with an installation token
+	Username = "x-access-token"
+
+	// jwtLifetime is the lifetime of the JWT authenticating the app, GitHub accepts up to 10 minutes
+	jwtLifetime = 9 * time.Minute
+	// clockSkew backdates the JWT, in case the clock of the API server is behind
+	clockSkew = time.Minute
+	// refreshBefore is the time before expiry, when a cached installation token is replaced
+	refreshBefore = 5 * time.Minute
+	// maxResponseSize limits the response of the token endpoint
+	maxResponseSize = 1 << 20
+)
+
+// ErrAuthFailed is returned if the token endpoint rejects the app or installation.
+var ErrAuthFailed = errors.New("github app authentication failed")
+
+// App is a GitHub App installation.
+type App struct {
+	// APIURL is the API base URL, defaults to DefaultAPIURL
+	APIURL         string
+	AppID          int64
+	InstallationID int64
+	PrivateKey     *rsa.PrivateKey
+	// key identifies the installation and private key in the TokenCache
+	key string
+}
+
+// Token is an installation access token.
+type Token struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+// New parses the app and installation IDs and the PEM encoded PKCS#1 or PKCS#8 private key of an app.
+func New(apiURL, appID, installationID string, privateKey []byte) (*App, error) {
+	id, err := strconv.ParseInt(strings.TrimSpace(appID), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github app id: %w", err)
+	}
+	installation, err := strconv.ParseInt(strings.TrimSpace(installationID), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github app installation id: %w", err)
+	}
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	sum := sha256.Sum256(privateKey)
+
+	return &App{
+		APIURL:         apiURL,
+		AppID:          id,
+		InstallationID: installation,
+		PrivateKey:     key,
+		key:            fmt.Sprintf("%s|%d|%d|%x", apiURL, id, installation, sum),
+	}, nil
+}
+
+// FromSecretData creates the app from the data of a secret of SecretType. The API URL of the secret takes precedence
+// over apiURL.
+func FromSecretData(data map[string][]byte, apiURL string) (*App, error) {
+	if u := string(data[APIURLKey]); u != "" {
+		apiURL = u
+	}
+
+	return New(apiURL, string(data[AppIDKey]), string(data[InstallationIDKey]), data[PrivateKeyKey])
+}
+
+// APIURLForRepo returns the API base URL of the repo's host, which is DefaultAPIURL for github.com and the API of a
+// GitHub Enterprise Server otherwise.
+func APIURLForRepo(repo *url.URL) string {
+	if repo.Hostname() == "github.com" {
+		return DefaultAPIURL
+	}
+
+	return "https://" + giturls.HTTPSHost(repo) + "/api/v3"
+}
+
+// InstallationToken mints a new installation access token, authenticated with a JWT signed by the app's private key.
+func (a *App) InstallationToken(ctx context.Context, client *http.Client) (Token, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return Token{}, err
+	}
+	tokenURL := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.APIURL, a.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, nil)
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return Token{}, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound:
+		return Token{}, fmt.Errorf("%w: %s responded with %s", ErrAuthFailed, tokenURL, resp.Status)
+	case resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK:
+		return Token{}, fmt.Errorf("requesting github app installation token from %s: %s", tokenURL, resp.Status)
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return Token{}, fmt.Errorf("decoding github app installation token: %w", err)
+	}
+	if token.Token == "" {
+		return Token{}, fmt.Errorf("%s didn't return a github app installation token", tokenURL)
+	}
+
+	return Token{Value: token.Token, ExpiresAt: token.ExpiresAt}, nil
+}
+
+// jwt returns a JWT signed with RS256, which authenticates the app.
+func (a *App) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-clockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(a.AppID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// TokenCache caches installation tokens of apps, until they are about to expire.
+type TokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]Token
+	now    func() time.Time
+	// mints deduplicates concurrent mints of the same app, so the lock isn't held while a token is minted
+	mints singleflight.Group
+}
+
+func NewTokenCache() *TokenCache {
+	return &TokenCache{tokens: map[string]Token{}, now: time.Now}
+}
+
+// Token returns the cached installation token of the app, or mints a new one if there is none or it expires within
+// refreshBefore.
+func (c *TokenCache) Token(ctx context.Context, app *App, client *http.Client) (string, error) {
+	if token, ok := c.cached(app.key); ok {
+		return token, nil
+	}
+	token, err, _ := c.mints.Do(app.key, func() (interface{}, error) {
+		// the token may have been minted while waiting for a concurrent mint which just finished
+		if token, ok := c.cached(app.key); ok {
+			return token, nil
+		}
+		token, err := app.InstallationToken(ctx, client)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			delete(c.tokens, app.key)
+			return "", err
+		}
+		c.tokens[app.key] = token
+
+		return token.Value, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token.(string), nil
+}
+
+// cached returns the cached installation token of the app, unless it expires within refreshBefore.
+func (c *TokenCache) cached(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token, ok := c.tokens[key]; ok && c.now().Add(refreshBefore).Before(token.ExpiresAt) {
+		return token.Value, true
+	}
+
+	return "", false
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("github app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing github app private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("github app private key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
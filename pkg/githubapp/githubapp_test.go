@@ -0,0 +1,275 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInstallationToken(t *testing.T) {
+	key, keyPEM := newPrivateKey(t)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	server := newTokenServer(t, &key.PublicKey, expiresAt, new(int))
+	defer server.Close()
+
+	app, err := New(server.URL+"/api/v3/", "1", "2", keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	token, err := app.InstallationToken(context.TODO(), server.Client())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if token.Value != "token-1" || !token.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	// another installation is rejected by the fake endpoint
+	app, err = New(server.URL+"/api/v3", "1", "3", keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := app.InstallationToken(context.TODO(), server.Client()); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expected %v, but got %v", ErrAuthFailed, err)
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	key, keyPEM := newPrivateKey(t)
+	now := time.Now()
+	minted := 0
+	server := newTokenServer(t, &key.PublicKey, now.Add(time.Hour), &minted)
+	defer server.Close()
+	app, err := New(server.URL+"/api/v3", "1", "2", keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		token, err := cache.Token(context.TODO(), app, server.Client())
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if token != "token-1" {
+			t.Errorf("expected cached token-1, but got %s", token)
+		}
+	}
+
+	// the token is refreshed before it expires
+	cache.now = func() time.Time { return now.Add(time.Hour - refreshBefore) }
+	token, err := cache.Token(context.TODO(), app, server.Client())
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if token != "token-2" || minted != 2 {
+		t.Errorf("expected refreshed token-2 after 2 requests, but got %s after %d", token, minted)
+	}
+}
+
+func TestTokenCacheConcurrentMints(t *testing.T) {
+	_, keyPEM := newPrivateKey(t)
+	var minted int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&minted, 1)
+		<-release
+		rw.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("token-%d", n),
+			"expires_at": time.Now().Add(time.Hour),
+		})
+	}))
+	defer server.Close()
+	app, err := New(server.URL+"/api/v3", "1", "2", keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	otherApp, err := New(server.URL+"/api/v3", "1", "3", keyPEM)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	cache := NewTokenCache()
+	cache.tokens[otherApp.key] = Token{Value: "other", ExpiresAt: time.Now().Add(time.Hour)}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := cache.Token(context.TODO(), app, server.Client())
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+
+	// cached tokens of other apps are returned while a token is minted
+	for atomic.LoadInt32(&minted) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	token, err := cache.Token(context.TODO(), otherApp, server.Client())
+	if err != nil || token != "other" {
+		t.Errorf("expected cached token of the other app, but got %q: %v", token, err)
+	}
+
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&minted); n != 1 {
+		t.Errorf("expected a single mint, but got %d", n)
+	}
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("expected token-1, but got %s", token)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, keyPEM := newPrivateKey(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+
+	tests := map[string]struct {
+		appID          string
+		installationID string
+		privateKey     []byte
+		expectedErr    string
+	}{
+		"pkcs1": {
+			appID:          "1",
+			installationID: "2",
+			privateKey:     keyPEM,
+		},
+		"pkcs8": {
+			appID:          "1",
+			installationID: "2\n",
+			privateKey:     pkcs8PEM,
+		},
+		"invalid app id": {
+			appID:          "app",
+			installationID: "2",
+			privateKey:     keyPEM,
+			expectedErr:    "invalid github app id",
+		},
+		"invalid installation id": {
+			appID:       "1",
+			privateKey:  keyPEM,
+			expectedErr: "invalid github app installation id",
+		},
+		"invalid private key": {
+			appID:          "1",
+			installationID: "2",
+			privateKey:     []byte("key"),
+			expectedErr:    "not PEM encoded",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			app, err := New("", test.appID, test.installationID, test.privateKey)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Errorf("expected error %q, but got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if app.APIURL != DefaultAPIURL || app.AppID != 1 || app.InstallationID != 2 {
+				t.Errorf("unexpected app %+v", app)
+			}
+		})
+	}
+}
+
+func newPrivateKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// newTokenServer returns a fake GitHub Enterprise token endpoint for installation 2 of app 1, which verifies the JWT
+// and counts the minted tokens.
+func newTokenServer(t *testing.T, publicKey *rsa.PublicKey, expiresAt time.Time, minted *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app/installations/2/access_tokens" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := verifyJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), publicKey); err != nil {
+			t.Errorf("unexpected error %v", err)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		*minted++
+		rw.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("token-%d", *minted),
+			"expires_at": expiresAt,
+		})
+	}))
+}
+
+func verifyJWT(jwt string, publicKey *rsa.PublicKey) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid jwt %q", jwt)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != "1" || claims.Exp-claims.Iat > int64((10*time.Minute).Seconds()) || time.Unix(claims.Exp, 0).Before(time.Now()) {
+		return fmt.Errorf("unexpected claims %+v", claims)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+// Package httpauth defines the credential secrets, which authenticate to git servers with a bearer token or additional
+// HTTP headers.
+package httpauth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// BearerTokenSecretType is the type of a credential secret holding a bearer token, which is sent in the
+	// Authorization header
+	BearerTokenSecretType = "gitjob.cattle.io/bearer-token"
+	// TokenKey is the key of the bearer token in the secret
+	TokenKey = "token"
+	// HeadersKey is the key of additional HTTP headers in a credential secret, one "Name: value" per line. It is
+	// supported by every credential secret used with http(s) repos, including Opaque secrets holding only headers.
+	HeadersKey = "headers"
+)
+
+// ParseHeaders parses headers, one "Name: value" per line. Empty lines and lines starting with # are skipped.
+func ParseHeaders(data []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		name = strings.TrimSpace(name)
+		if !ok || !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header in line %d, expected \"Name: value\"", line)
+		}
+		headers[textproto.CanonicalMIMEHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return headers, nil
+}
+
+// validHeaderName returns whether name consists of token characters only, as required by RFC 7230.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 127 || !strings.ContainsRune("!#$%&'*+-.^_`|~", c) &&
+			(c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Transport sets the headers on every request, before passing it to Next.
+type Transport struct {
+	Headers map[string]string
+	Next    http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return t.Next.RoundTrip(req)
+}
@@ -0,0 +1,87 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := map[string]struct {
+		data        string
+		expected    map[string]string
+		expectedErr bool
+	}{
+		"headers": {
+			data: "# tenant of the proxy\nx-tenant-id: team-a\n\nProxy-Authorization:  Basic dXNlcjpwYXNz \n",
+			expected: map[string]string{
+				"X-Tenant-Id":         "team-a",
+				"Proxy-Authorization": "Basic dXNlcjpwYXNz",
+			},
+		},
+		"empty value": {
+			data:     "X-Empty:",
+			expected: map[string]string{"X-Empty": ""},
+		},
+		"missing colon": {
+			data:        "X-Tenant-Id team-a",
+			expectedErr: true,
+		},
+		"invalid name": {
+			data:        "X Tenant: team-a",
+			expectedErr: true,
+		},
+		"empty name": {
+			data:        ": team-a",
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			headers, err := ParseHeaders([]byte(test.data))
+			if test.expectedErr {
+				if err == nil {
+					t.Errorf("expected error for %q", test.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(headers, test.expected) {
+				t.Errorf("expected %v, but got %v", test.expected, headers)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Tenant-Id") != "team-a" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{
+		Headers: map[string]string{"Authorization": "Bearer token", "X-Tenant-Id": "team-a"},
+		Next:    http.DefaultTransport,
+	}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected headers to be sent, but got %s", resp.Status)
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("expected the request to be unmodified, but got %v", req.Header)
+	}
+}
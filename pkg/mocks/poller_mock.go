@@ -62,3 +62,15 @@ func (mr *MockGitPollerMockRecorder) CleanUpWatches(arg0 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CleanUpWatches", reflect.TypeOf((*MockGitPoller)(nil).CleanUpWatches), arg0)
 }
+
+// PollGitRepoWatch mocks base method.
+func (m *MockGitPoller) PollGitRepoWatch(arg0 context.Context, arg1 v1.GitJob) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "PollGitRepoWatch", arg0, arg1)
+}
+
+// PollGitRepoWatch indicates an expected call of PollGitRepoWatch.
+func (mr *MockGitPollerMockRecorder) PollGitRepoWatch(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollGitRepoWatch", reflect.TypeOf((*MockGitPoller)(nil).PollGitRepoWatch), arg0, arg1)
+}
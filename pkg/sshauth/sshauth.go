@@ -0,0 +1,200 @@
+// Package sshauth creates the SSH authentication of git operations from the private key and the optional user
+// certificate of a credential secret, and verifies the host keys of git servers.
+package sshauth
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	gossh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// PassphraseKey is the key of the optional passphrase of an encrypted private key in a secret of type
+	// kubernetes.io/ssh-auth.
+	PassphraseKey = "passphrase"
+	// KnownHostsKey is the key of the known hosts in a secret of type kubernetes.io/ssh-auth, or in the known hosts
+	// ConfigMap of the controller.
+	KnownHostsKey = "known_hosts"
+	// CertificateKey is the key of an optional OpenSSH user certificate in a secret of type kubernetes.io/ssh-auth,
+	// which is signed by a CA trusted by the git server and certifies the public key of the private key.
+	CertificateKey = "ssh-certificate"
+)
+
+var (
+	// ErrPassphraseMissing is returned if the private key is encrypted, but no passphrase was given.
+	ErrPassphraseMissing = errors.New("ssh private key is encrypted, but no passphrase was provided")
+	// ErrWrongPassphrase is returned if the private key can't be decrypted with the passphrase.
+	ErrWrongPassphrase = errors.New("ssh private key passphrase is incorrect")
+	// ErrInvalidCertificate is returned if the certificate is not an OpenSSH user certificate of the private key.
+	ErrInvalidCertificate = errors.New("invalid ssh certificate")
+	// ErrCertificateExpired is returned if the certificate is no longer valid.
+	ErrCertificateExpired = errors.New("ssh certificate expired")
+)
+
+// NewPublicKeys parses the PEM encoded private key, which is decrypted with the passphrase if it is encrypted. A
+// trailing newline of the passphrase, as added when it is created from a file, is ignored. If a certificate in the
+// authorized_keys format is given, the certificate is presented instead of the plain public key.
+func NewPublicKeys(user string, privateKey, passphrase, certificate []byte) (*gossh.PublicKeys, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		pass := strings.TrimRight(string(passphrase), "\r\n")
+		if pass == "" {
+			return nil, ErrPassphraseMissing
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(pass))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(certificate)) > 0 {
+		signer, err = certSigner(signer, certificate, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &gossh.PublicKeys{User: user, Signer: signer}, nil
+}
+
+// certSigner returns a signer, which presents the user certificate of the signer's key. Expired certificates are
+// rejected, so polling reports them instead of failing authentication.
+func certSigner(signer ssh.Signer, certificate []byte, now time.Time) (ssh.Signer, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a certificate", ErrInvalidCertificate, key.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%w: not a user certificate", ErrInvalidCertificate)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && now.Unix() >= int64(cert.ValidBefore) {
+		return nil, fmt.Errorf("%w at %s", ErrCertificateExpired, time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+
+	return certSigner, nil
+}
+
+// HostKeyUnknownError is returned if a host offers a key, which is not in the known hosts. Add the KnownHostsLine to
+// the known hosts to approve the key.
+type HostKeyUnknownError struct {
+	Host string
+	Key  ssh.PublicKey
+}
+
+func (e *HostKeyUnknownError) Error() string {
+	return fmt.Sprintf("ssh host key of %s is unknown, the host offered the %s key %s", e.Host, e.Key.Type(),
+		ssh.FingerprintSHA256(e.Key))
+}
+
+// KnownHostsLine returns the known_hosts line, which approves the offered key.
+func (e *HostKeyUnknownError) KnownHostsLine() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(e.Host)}, e.Key)
+}
+
+// HostKeyCallback verifies host keys against the known hosts, e.g. the known_hosts key of a secret. Keys which don't
+// match the known key of a host are rejected. Hosts without a known key are rejected with a HostKeyUnknownError in
+// strict mode, and accepted otherwise. Host certificates are accepted if they are signed by a @cert-authority of the
+// known hosts. Like OpenSSH does, other host certificates are verified by their plain key.
+func HostKeyCallback(knownHosts []byte, strict bool) (ssh.HostKeyCallback, error) {
+	if len(bytes.TrimSpace(knownHosts)) == 0 && !strict {
+		//nolint G106: Use of ssh InsecureIgnoreHostKey should be audited
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	certCallback, err := knownHostsCallback(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	// knownhosts treats the keys of @cert-authority lines as known keys of the matching hosts, which makes plain
+	// keys of these hosts mismatch
+	callback, err := knownHostsCallback(withoutCertAuthorities(knownHosts))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var err error
+		if cert, ok := key.(*ssh.Certificate); ok {
+			var revokedErr *knownhosts.RevokedError
+			if err = certCallback(hostname, remote, key); err == nil || errors.As(err, &revokedErr) {
+				return err
+			}
+			key = cert.Key
+		}
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			if !strict {
+				return nil
+			}
+			return &HostKeyUnknownError{Host: hostname, Key: key}
+		}
+		return err
+	}, nil
+}
+
+func knownHostsCallback(knownHosts []byte) (ssh.HostKeyCallback, error) {
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(knownHosts); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("closing knownHosts file %s: %w", f.Name(), err)
+	}
+
+	return knownhosts.New(f.Name())
+}
+
+// withoutCertAuthorities removes the @cert-authority lines of known hosts.
+func withoutCertAuthorities(knownHosts []byte) []byte {
+	var result []byte
+	for _, line := range bytes.SplitAfter(knownHosts, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("@cert-authority")) {
+			continue
+		}
+		result = append(result, line...)
+	}
+
+	return result
+}
+
+// MergeKnownHosts concatenates known_hosts files.
+func MergeKnownHosts(knownHosts ...[]byte) []byte {
+	var merged []byte
+	for _, k := range knownHosts {
+		if len(k) == 0 {
+			continue
+		}
+		merged = append(merged, k...)
+		if merged[len(merged)-1] != '\n' {
+			merged = append(merged, '\n')
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,330 @@
+package sshauth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestNewPublicKeys(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	plain, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	//nolint:staticcheck // legacy encrypted PEM keys are still in use
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := map[string]struct {
+		privateKey  []byte
+		passphrase  string
+		expectedErr error
+	}{
+		"unencrypted": {
+			privateKey: pem.EncodeToMemory(plain),
+		},
+		"unencrypted with passphrase": {
+			privateKey: pem.EncodeToMemory(plain),
+			passphrase: "secret",
+		},
+		"encrypted": {
+			privateKey: pem.EncodeToMemory(encrypted),
+			passphrase: "secret\n",
+		},
+		"legacy pem encrypted": {
+			privateKey: pem.EncodeToMemory(legacy),
+			passphrase: "secret",
+		},
+		"missing passphrase": {
+			privateKey:  pem.EncodeToMemory(encrypted),
+			expectedErr: ErrPassphraseMissing,
+		},
+		"wrong passphrase": {
+			privateKey:  pem.EncodeToMemory(encrypted),
+			passphrase:  "wrong",
+			expectedErr: ErrWrongPassphrase,
+		},
+		"legacy pem wrong passphrase": {
+			privateKey:  pem.EncodeToMemory(legacy),
+			passphrase:  "wrong",
+			expectedErr: ErrWrongPassphrase,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth, err := NewPublicKeys("git", test.privateKey, []byte(test.passphrase), nil)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Errorf("expected error %v, but got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if auth.User != "git" || auth.Signer == nil {
+				t.Errorf("unexpected auth %v", auth)
+			}
+		})
+	}
+}
+
+func TestNewPublicKeysWithCertificate(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	privateKey := pem.EncodeToMemory(block)
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ca := newSigner(t)
+	now := time.Now()
+
+	tests := map[string]struct {
+		certificate []byte
+		expectedErr error
+	}{
+		"certificate": {
+			certificate: signCert(t, ca, pub, ssh.UserCert, now.Add(time.Hour)),
+		},
+		"expired certificate": {
+			certificate: signCert(t, ca, pub, ssh.UserCert, now.Add(-time.Hour)),
+			expectedErr: ErrCertificateExpired,
+		},
+		"host certificate": {
+			certificate: signCert(t, ca, pub, ssh.HostCert, now.Add(time.Hour)),
+			expectedErr: ErrInvalidCertificate,
+		},
+		"certificate of another key": {
+			certificate: signCert(t, ca, newSigner(t).PublicKey(), ssh.UserCert, now.Add(time.Hour)),
+			expectedErr: ErrInvalidCertificate,
+		},
+		"plain public key": {
+			certificate: ssh.MarshalAuthorizedKey(pub),
+			expectedErr: ErrInvalidCertificate,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth, err := NewPublicKeys("git", privateKey, nil, test.certificate)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Errorf("expected error %v, but got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			cert, ok := auth.Signer.PublicKey().(*ssh.Certificate)
+			if !ok || !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+				t.Errorf("expected signer to present the certificate, got %v", auth.Signer.PublicKey().Type())
+			}
+		})
+	}
+}
+
+func TestHostKeyCallbackCertAuthority(t *testing.T) {
+	ca := newSigner(t)
+	hostKey := newHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	knownHosts := []byte("@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	parseCert := func(certificate []byte) ssh.PublicKey {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return key
+	}
+	hostCert := parseCert(signCert(t, ca, hostKey, ssh.HostCert, time.Now().Add(time.Hour), "git.example.com"))
+	otherCACert := parseCert(signCert(t, newSigner(t), hostKey, ssh.HostCert, time.Now().Add(time.Hour), "git.example.com"))
+
+	callback, err := HostKeyCallback(knownHosts, true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := callback("git.example.com:22", addr, hostCert); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	var unknownErr *HostKeyUnknownError
+	if err := callback("git.example.com:22", addr, otherCACert); !errors.As(err, &unknownErr) {
+		t.Errorf("expected unknown host key error, got %v", err)
+	}
+	if err := callback("other.test:22", addr, hostCert); !errors.As(err, &unknownErr) {
+		t.Errorf("expected unknown host key error, got %v", err)
+	}
+
+	// a certificate of an unknown CA is verified by its plain key
+	callback, err = HostKeyCallback(MergeKnownHosts(knownHosts, []byte(knownhosts.Line([]string{"git.example.com"}, hostKey))), true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := callback("git.example.com:22", addr, otherCACert); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	known := newHostKey(t)
+	other := newHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	knownHosts := []byte(knownhosts.Line([]string{"git.example.com"}, known) + "\n")
+
+	tests := map[string]struct {
+		knownHosts  []byte
+		strict      bool
+		host        string
+		key         ssh.PublicKey
+		expectedErr bool
+		unknown     bool
+	}{
+		"no known hosts": {
+			host: "git.example.com:22",
+			key:  other,
+		},
+		"known key": {
+			knownHosts: knownHosts,
+			strict:     true,
+			host:       "git.example.com:22",
+			key:        known,
+		},
+		"mismatched key": {
+			knownHosts:  knownHosts,
+			host:        "git.example.com:22",
+			key:         other,
+			expectedErr: true,
+		},
+		"unknown host": {
+			knownHosts: knownHosts,
+			host:       "other.example.com:22",
+			key:        other,
+		},
+		"unknown host strict": {
+			knownHosts:  knownHosts,
+			strict:      true,
+			host:        "other.example.com:22",
+			key:         other,
+			expectedErr: true,
+			unknown:     true,
+		},
+		"no known hosts strict": {
+			strict:      true,
+			host:        "git.example.com:22",
+			key:         known,
+			expectedErr: true,
+			unknown:     true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			callback, err := HostKeyCallback(test.knownHosts, test.strict)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			err = callback(test.host, addr, test.key)
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("expected error %v, got %v", test.expectedErr, err)
+			}
+			var unknownErr *HostKeyUnknownError
+			if errors.As(err, &unknownErr) != test.unknown {
+				t.Fatalf("expected unknown host key error %v, got %v", test.unknown, err)
+			}
+			if !test.unknown {
+				return
+			}
+			if !strings.Contains(err.Error(), ssh.FingerprintSHA256(test.key)) {
+				t.Errorf("expected fingerprint in error, got %v", err)
+			}
+			// approving the offered key makes it known
+			callback, err = HostKeyCallback(MergeKnownHosts(test.knownHosts, []byte(unknownErr.KnownHostsLine())), true)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := callback(test.host, addr, test.key); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeKnownHosts(t *testing.T) {
+	merged := string(MergeKnownHosts([]byte("a"), nil, []byte("b\n"), []byte("c")))
+	if merged != "a\nb\nc\n" {
+		t.Errorf("unexpected merged known hosts %q", merged)
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return signer
+}
+
+func signCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, validBefore time.Time, principals ...string) []byte {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validBefore.Add(-2 * time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return key
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	// maxDeliveries is the number of delivery IDs remembered to ignore duplicate deliveries
+	maxDeliveries = 10000
+	// deliveryTTL is how long a delivery ID is remembered
+	deliveryTTL = 24 * time.Hour
+)
+
+// deliveryHeaders contain the unique ID of a delivery, which is kept by the providers when retrying a delivery.
+var deliveryHeaders = []string{
+	"X-GitHub-Delivery",
+	"X-Gitlab-Event-UUID",
+	"X-Request-UUID", // Bitbucket Cloud
+	"X-Request-Id",   // Bitbucket Server
+	"X-Forgejo-Delivery",
+	"X-Gitea-Delivery",
+	"X-Gogs-Delivery",
+}
+
+// deliveryStore remembers the IDs of processed deliveries for deliveryTTL, up to maxDeliveries. A nil store doesn't
+// remember anything.
+type deliveryStore struct {
+	mu    sync.Mutex
+	cache *cache.LRUExpireCache
+}
+
+func newDeliveryStore() *deliveryStore {
+	return &deliveryStore{cache: cache.NewLRUExpireCache(maxDeliveries)}
+}
+
+// claim records the delivery and returns true, or returns false if the delivery was seen before. Deliveries without an
+// ID are always claimed.
+func (s *deliveryStore) claim(id string) bool {
+	if s == nil || id == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.cache.Get(id); found {
+		return false
+	}
+	s.cache.Add(id, struct{}{}, deliveryTTL)
+
+	return true
+}
+
+// release forgets a claimed delivery, which failed to be processed, so it is processed when retried by the provider.
+func (s *deliveryStore) release(id string) {
+	if s == nil || id == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Remove(id)
+}
+
+// deliveryID returns the ID of the delivery, prefixed with the endpoint and the header it was read from, or "" if the
+// provider doesn't send one.
+func deliveryID(r *http.Request, generic *genericProvider) string {
+	h, id := deliveryHeader(r, generic)
+	if id == "" {
+		return ""
+	}
+
+	return r.URL.Path + "|" + h + "|" + id
+}
+
+// providerDeliveryID returns the ID of the delivery sent by the provider, or "" if the provider doesn't send one.
+func providerDeliveryID(r *http.Request, generic *genericProvider) string {
+	_, id := deliveryHeader(r, generic)
+	return id
+}
+
+func deliveryHeader(r *http.Request, generic *genericProvider) (string, string) {
+	headers := deliveryHeaders
+	if generic != nil {
+		headers = nil
+		if generic.DeliveryHeader != "" {
+			headers = []string{generic.DeliveryHeader}
+		}
+	}
+	for _, h := range headers {
+		if id := r.Header.Get(h); id != "" {
+			return h, id
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,272 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // GitHub signs webhooks with HMAC-SHA1
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	oldCommit = "135f8a827edae980466f72eef385881bb4e158d8"
+	newCommit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+)
+
+func TestDuplicateDeliveries(t *testing.T) {
+	gitjob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "https://github.com/rancher/gitjob",
+				Branch: "main",
+			},
+		},
+	}
+	client, w := newDeliveryTestWebhook(t, gitjob)
+	w.github, _ = github.New(github.Options.Secret("secret"))
+
+	send := func(delivery, commit, secret string) int {
+		jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + commit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		mac := hmac.New(sha1.New, []byte(secret))
+		_, _ = mac.Write(jsonBody)
+		req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// a failed delivery is processed when retried
+	if code := send("1", oldCommit, "wrong"); code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, but got %d", http.StatusInternalServerError, code)
+	}
+	if code := send("1", oldCommit, "secret"); code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, code)
+	}
+	assertCommit(t, client, gitjob, oldCommit)
+
+	if code := send("2", newCommit, "secret"); code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, code)
+	}
+	assertCommit(t, client, gitjob, newCommit)
+
+	// replaying the first delivery doesn't roll back the commit
+	if code := send("1", oldCommit, "secret"); code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, code)
+	}
+	assertCommit(t, client, gitjob, newCommit)
+}
+
+func TestVerifyAncestry(t *testing.T) {
+	tests := map[string]struct {
+		isAncestor     bool
+		expectedCommit string
+	}{
+		"descendant": {
+			isAncestor:     true,
+			expectedCommit: newCommit,
+		},
+		"not a descendant": {
+			isAncestor:     false,
+			expectedCommit: oldCommit,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: v1.GitJobSpec{
+					Git: v1.GitInfo{
+						Repo:   "https://github.com/rancher/gitjob",
+						Branch: "main",
+					},
+				},
+				Status: v1.GitJobStatus{
+					GitEvent: v1.GitEvent{Commit: oldCommit},
+				},
+			}
+			client, w := newDeliveryTestWebhook(t, gitjob)
+			w.github, _ = github.New()
+			ancestry := &fakeAncestryChecker{isAncestor: test.isAncestor}
+			w.ancestry = ancestry
+
+			jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + newCommit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+			req.Header.Set("X-GitHub-Event", "push")
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d, but got %d", http.StatusOK, rec.Code)
+			}
+			expectedCall := [3]string{"main", oldCommit, newCommit}
+			if len(ancestry.calls) != 1 || ancestry.calls[0] != expectedCall {
+				t.Errorf("expected a single ancestry check %v, but got %v", expectedCall, ancestry.calls)
+			}
+			assertCommit(t, client, gitjob, test.expectedCommit)
+		})
+	}
+}
+
+func TestHistoryRewrite(t *testing.T) {
+	tests := map[string]struct {
+		isAncestor      bool
+		expectedRewrite *v1.HistoryRewriteStatus
+	}{
+		"fast-forward clears previous rewrite": {
+			isAncestor: true,
+		},
+		"force-push": {
+			isAncestor:      false,
+			expectedRewrite: &v1.HistoryRewriteStatus{OldCommit: oldCommit, NewCommit: newCommit},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: v1.GitJobSpec{
+					Git: v1.GitInfo{
+						Repo:                 "https://github.com/rancher/gitjob",
+						Branch:               "main",
+						HistoryRewritePolicy: v1.HistoryRewriteBlock,
+					},
+				},
+				Status: v1.GitJobStatus{
+					GitEvent:       v1.GitEvent{Commit: oldCommit, LastExecutedCommit: oldCommit},
+					HistoryRewrite: &v1.HistoryRewriteStatus{OldCommit: "previous", NewCommit: oldCommit},
+				},
+			}
+			client, w := newDeliveryTestWebhook(t, gitjob)
+			w.github, _ = github.New()
+			history := &fakeAncestryChecker{isAncestor: test.isAncestor}
+			w.history = history
+
+			jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + newCommit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+			req.Header.Set("X-GitHub-Event", "push")
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d, but got %d", http.StatusOK, rec.Code)
+			}
+			expectedCall := [3]string{"main", oldCommit, newCommit}
+			if len(history.calls) != 1 || history.calls[0] != expectedCall {
+				t.Errorf("expected a single ancestry check %v, but got %v", expectedCall, history.calls)
+			}
+			// the commit is updated either way, the policy is enforced by the controller
+			assertCommit(t, client, gitjob, newCommit)
+
+			var updated v1.GitJob
+			if err := client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name}, &updated); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(updated.Status.HistoryRewrite, test.expectedRewrite) {
+				t.Errorf("expected history rewrite %v, but got %v", test.expectedRewrite, updated.Status.HistoryRewrite)
+			}
+			if rewritten := condition.Cond(v1.HistoryRewrittenCondition).IsTrue(&updated); rewritten != (test.expectedRewrite != nil) {
+				t.Errorf("unexpected %s condition %v", v1.HistoryRewrittenCondition, updated.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	tests := map[string]struct {
+		header     map[string]string
+		generic    *genericProvider
+		expectedID string
+	}{
+		"github": {
+			header:     map[string]string{"X-GitHub-Delivery": "1"},
+			expectedID: "/|X-GitHub-Delivery|1",
+		},
+		"gitlab": {
+			header:     map[string]string{"X-Gitlab-Event-UUID": "2"},
+			expectedID: "/|X-Gitlab-Event-UUID|2",
+		},
+		"no id": {
+			header: map[string]string{"X-Vss-Activityid": "3"},
+		},
+		"generic": {
+			header:     map[string]string{"X-CI-Delivery": "4", "X-GitHub-Delivery": "1"},
+			generic:    &genericProvider{DeliveryHeader: "X-CI-Delivery"},
+			expectedID: "/|X-CI-Delivery|4",
+		},
+		"generic without delivery header": {
+			header:  map[string]string{"X-GitHub-Delivery": "1"},
+			generic: &genericProvider{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			if id := deliveryID(req, test.generic); id != test.expectedID {
+				t.Errorf("expected id %q, but got %q", test.expectedID, id)
+			}
+		})
+	}
+}
+
+type fakeAncestryChecker struct {
+	isAncestor bool
+	calls      [][3]string
+}
+
+func (f *fakeAncestryChecker) IsAncestor(_ context.Context, _ *v1.GitJob, _ client.Client, branch, ancestor, commit string) (bool, error) {
+	f.calls = append(f.calls, [3]string{branch, ancestor, commit})
+	return f.isAncestor, nil
+}
+
+func newDeliveryTestWebhook(t *testing.T, gitjob *v1.GitJob) (client.Client, *Webhook) {
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).Build()
+
+	return client, &Webhook{client: client, deliveries: newDeliveryStore()}
+}
+
+func assertCommit(t *testing.T, client client.Client, gitjob *v1.GitJob, expectedCommit string) {
+	t.Helper()
+	updatedGitJob := &v1.GitJob{}
+	err := client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	if updatedGitJob.Status.Commit != expectedCommit {
+		t.Errorf("expected commit %q, but got %q", expectedCommit, updatedGitJob.Status.Commit)
+	}
+}
@@ -0,0 +1,247 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // some git servers only sign webhooks with HMAC-SHA1
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// genericKey is the key of the generic providers in the gitjob-webhook secret
+	genericKey = "generic"
+	// genericProviderVar is the mux variable of the generic provider's name in /generic/{provider}
+	genericProviderVar = "provider"
+)
+
+var (
+	errGenericAuthFailed   = errors.New("generic webhook authentication failed")
+	errGenericInvalidMAC   = errors.New("generic webhook HMAC verification failed")
+	errGenericInvalidToken = errors.New("generic webhook bearer token verification failed")
+)
+
+// genericProvider is a webhook provider configured in the generic key of the gitjob-webhook secret, for git servers
+// and CI systems which aren't supported natively. It is selected by the path /generic/<name>, or by a header of the
+// delivery. The repo URL, ref and revision are extracted from the JSON payload with JSONPath expressions.
+type genericProvider struct {
+	// Name selects the provider for deliveries to /generic/<name>
+	Name string `json:"name"`
+	// Header selects the provider for deliveries with this header. If HeaderValue is set, the header must have this value
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty"`
+
+	// HMAC validates the signature of the payload
+	HMAC *genericHMAC `json:"hmac,omitempty"`
+	// BearerToken validates the "Authorization: Bearer <token>" header
+	BearerToken string `json:"bearerToken,omitempty"`
+	// DeliveryHeader contains the unique ID of a delivery, which is used to ignore duplicate deliveries
+	DeliveryHeader string `json:"deliveryHeader,omitempty"`
+
+	// Repo, Ref and Revision are JSONPath expressions, e.g. "{.repository.clone_url}". Ref is either a full ref like
+	// refs/heads/main or refs/tags/v1.0.0, or a branch name
+	Repo     string `json:"repo"`
+	Ref      string `json:"ref"`
+	Revision string `json:"revision,omitempty"`
+
+	repo, ref, revision *jsonpath.JSONPath
+}
+
+type genericHMAC struct {
+	// Header contains the hex encoded signature
+	Header string `json:"header"`
+	// Prefix of the signature in the header, e.g. "sha256="
+	Prefix string `json:"prefix,omitempty"`
+	// Algorithm is sha256 or sha1. Defaults to sha256
+	Algorithm string `json:"algorithm,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+// genericPayload contains the values extracted from the payload of a generic provider.
+type genericPayload struct {
+	repoURL  string
+	ref      string
+	revision string
+}
+
+// parseGenericProviders parses the generic providers in the gitjob-webhook secret, which are a YAML or JSON list.
+func parseGenericProviders(data []byte) ([]*genericProvider, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var providers []*genericProvider
+	if err := yaml.Unmarshal(data, &providers); err != nil {
+		return nil, fmt.Errorf("invalid generic webhook providers: %w", err)
+	}
+	names := map[string]bool{}
+	for _, p := range providers {
+		if p.Name == "" {
+			return nil, errors.New("invalid generic webhook provider: name is required")
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		if p.HMAC != nil && (p.HMAC.Header == "" || p.HMAC.Secret == "") {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: hmac requires a header and a secret", p.Name)
+		}
+		if p.HMAC != nil && p.HMAC.Algorithm != "" && p.HMAC.Algorithm != "sha256" && p.HMAC.Algorithm != "sha1" {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: unsupported hmac algorithm %s", p.Name, p.HMAC.Algorithm)
+		}
+		if p.HMAC == nil && p.BearerToken == "" {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: hmac or bearerToken is required", p.Name)
+		}
+		if p.Repo == "" || p.Ref == "" {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: repo and ref are required", p.Name)
+		}
+
+		var err error
+		if p.repo, err = parseJSONPath(p.Repo); err != nil {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: repo: %w", p.Name, err)
+		}
+		if p.ref, err = parseJSONPath(p.Ref); err != nil {
+			return nil, fmt.Errorf("invalid generic webhook provider %s: ref: %w", p.Name, err)
+		}
+		if p.Revision != "" {
+			if p.revision, err = parseJSONPath(p.Revision); err != nil {
+				return nil, fmt.Errorf("invalid generic webhook provider %s: revision: %w", p.Name, err)
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+// parseJSONPath parses a JSONPath expression. The braces of the template syntax are optional, e.g. ".ref" and "{.ref}"
+// are the same.
+func parseJSONPath(expr string) (*jsonpath.JSONPath, error) {
+	if !strings.Contains(expr, "{") {
+		expr = "{" + expr + "}"
+	}
+	j := jsonpath.New("").AllowMissingKeys(true)
+	if err := j.Parse(expr); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// genericProvider returns the generic provider selected by the path or a header of the request, or nil.
+func (w *Webhook) genericProvider(r *http.Request) *genericProvider {
+	name := mux.Vars(r)[genericProviderVar]
+	for _, p := range w.generic {
+		if name != "" {
+			if p.Name == name {
+				return p
+			}
+			continue
+		}
+		if p.Header == "" {
+			continue
+		}
+		if v := r.Header.Get(p.Header); v != "" && (p.HeaderValue == "" || v == p.HeaderValue) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Parse authenticates the request and extracts the repo URL, ref and revision of the payload.
+func (p *genericProvider) Parse(r *http.Request) (genericPayload, error) {
+	defer func() {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_ = r.Body.Close()
+	}()
+
+	if r.Method != http.MethodPost {
+		return genericPayload{}, fmt.Errorf("invalid HTTP method %s", r.Method)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		return genericPayload{}, errors.New("error parsing payload")
+	}
+	if err := p.authenticate(r, body); err != nil {
+		return genericPayload{}, err
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return genericPayload{}, fmt.Errorf("error parsing payload: %w", err)
+	}
+	var payload genericPayload
+	if payload.repoURL, err = evalJSONPath(p.repo, data); err != nil {
+		return genericPayload{}, err
+	}
+	if payload.ref, err = evalJSONPath(p.ref, data); err != nil {
+		return genericPayload{}, err
+	}
+	if p.revision != nil {
+		if payload.revision, err = evalJSONPath(p.revision, data); err != nil {
+			return genericPayload{}, err
+		}
+	}
+	if payload.repoURL == "" {
+		return genericPayload{}, fmt.Errorf("no repo found in payload of generic webhook provider %s", p.Name)
+	}
+
+	return payload, nil
+}
+
+func (p *genericProvider) authenticate(r *http.Request, body []byte) error {
+	if p.BearerToken != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(p.BearerToken)) != 1 {
+			return errGenericInvalidToken
+		}
+	}
+
+	if p.HMAC != nil {
+		signature, found := strings.CutPrefix(r.Header.Get(p.HMAC.Header), p.HMAC.Prefix)
+		if !found || signature == "" {
+			return errGenericAuthFailed
+		}
+		newHash := sha256.New
+		if p.HMAC.Algorithm == "sha1" {
+			newHash = func() hash.Hash { return sha1.New() } //nolint:gosec // configured by the user
+		}
+		mac := hmac.New(newHash, []byte(p.HMAC.Secret))
+		_, _ = mac.Write(body)
+		if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			return errGenericInvalidMAC
+		}
+	}
+
+	return nil
+}
+
+func evalJSONPath(j *jsonpath.JSONPath, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := j.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// fullRef returns the payload's ref. Refs without the refs/ prefix are branch names.
+func (p genericPayload) fullRef() string {
+	if p.ref == "" || strings.HasPrefix(p.ref, "refs/") {
+		return p.ref
+	}
+
+	return branchRefPrefix + p.ref
+}
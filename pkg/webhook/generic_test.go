@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	cfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const genericProviders = `
+- name: ci
+  hmac:
+    header: X-CI-Signature
+    prefix: sha256=
+    secret: secret
+  repo: "{.project.gitUrl}"
+  ref: "{.build.ref}"
+  revision: "{.build.sha}"
+- name: internal
+  header: X-Internal-Git-Event
+  headerValue: push
+  bearerToken: token
+  repo: .repo
+  ref: .branch
+  revision: .commit
+`
+
+func TestGenericWebhook(t *testing.T) {
+	const commit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+	ciBody := `{"project":{"gitUrl":"git@git.example.com:team/app.git"},"build":{"ref":"refs/heads/main","sha":"` + commit + `"}}`
+	internalBody := `{"repo":"https://git.example.com/team/app","branch":"main","commit":"` + commit + `"}`
+	tests := map[string]struct {
+		path           string
+		body           string
+		header         map[string]string
+		hmacSecret     string
+		expectedStatus int
+		expectedCommit string
+	}{
+		"path with hmac": {
+			path:           "/generic/ci",
+			body:           ciBody,
+			hmacSecret:     "secret",
+			expectedStatus: http.StatusOK,
+			expectedCommit: commit,
+		},
+		"path with invalid hmac": {
+			path:           "/generic/ci",
+			body:           ciBody,
+			hmacSecret:     "wrong",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		"path without hmac": {
+			path:           "/generic/ci",
+			body:           ciBody,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		"unknown provider": {
+			path:           "/generic/unknown",
+			body:           ciBody,
+			expectedStatus: http.StatusNotFound,
+		},
+		"header with bearer token": {
+			path:           "/",
+			body:           internalBody,
+			header:         map[string]string{"X-Internal-Git-Event": "push", "Authorization": "Bearer token"},
+			expectedStatus: http.StatusOK,
+			expectedCommit: commit,
+		},
+		"header with invalid bearer token": {
+			path:           "/",
+			body:           internalBody,
+			header:         map[string]string{"X-Internal-Git-Event": "push", "Authorization": "Bearer wrong"},
+			expectedStatus: http.StatusInternalServerError,
+		},
+		"header with other value": {
+			path:           "/",
+			body:           internalBody,
+			header:         map[string]string{"X-Internal-Git-Event": "tag", "Authorization": "Bearer token"},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: v1.GitJobSpec{
+					Git: v1.GitInfo{
+						Repo:   "https://git.example.com/team/app.git",
+						Branch: "main",
+					},
+				},
+			}
+			scheme := runtime.NewScheme()
+			err := v1.AddToScheme(scheme)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+				WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).Build()
+			w := &Webhook{client: client}
+			if err := w.setGitProviders(map[string][]byte{genericKey: []byte(genericProviders)}); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			router := mux.NewRouter()
+			router.Handle("/", w)
+			router.Handle("/generic/{provider}", w)
+
+			req := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader([]byte(test.body)))
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			if test.hmacSecret != "" {
+				mac := hmac.New(sha256.New, []byte(test.hmacSecret))
+				_, _ = mac.Write([]byte(test.body))
+				req.Header.Set("X-CI-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedStatus {
+				t.Errorf("expected status %d, but got %d: %s", test.expectedStatus, rec.Code, rec.Body.String())
+			}
+			updatedGitJob := &v1.GitJob{}
+			err = client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+			if err != nil {
+				t.Errorf("unexpected err %v", err)
+			}
+			if updatedGitJob.Status.Commit != test.expectedCommit {
+				t.Errorf("expected commit %q, but got %q", test.expectedCommit, updatedGitJob.Status.Commit)
+			}
+		})
+	}
+}
+
+func TestParseGenericProviders(t *testing.T) {
+	tests := map[string]struct {
+		config      string
+		expectedErr bool
+	}{
+		"valid": {
+			config: genericProviders,
+		},
+		"empty": {
+			config: "",
+		},
+		"missing name": {
+			config:      `[{"repo": ".repo", "ref": ".ref"}]`,
+			expectedErr: true,
+		},
+		"duplicate name": {
+			config:      `[{"name": "a", "bearerToken": "t", "repo": ".repo", "ref": ".ref"}, {"name": "a", "bearerToken": "t", "repo": ".repo", "ref": ".ref"}]`,
+			expectedErr: true,
+		},
+		"missing ref": {
+			config:      `[{"name": "a", "bearerToken": "t", "repo": ".repo"}]`,
+			expectedErr: true,
+		},
+		"invalid jsonpath": {
+			config:      `[{"name": "a", "bearerToken": "t", "repo": "{.repo", "ref": ".ref"}]`,
+			expectedErr: true,
+		},
+		"no authentication": {
+			config:      `[{"name": "a", "repo": ".repo", "ref": ".ref"}]`,
+			expectedErr: true,
+		},
+		"hmac without secret": {
+			config:      `[{"name": "a", "repo": ".repo", "ref": ".ref", "hmac": {"header": "X-Signature"}}]`,
+			expectedErr: true,
+		},
+		"unsupported algorithm": {
+			config:      `[{"name": "a", "repo": ".repo", "ref": ".ref", "hmac": {"header": "X-Signature", "secret": "s", "algorithm": "md5"}}]`,
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseGenericProviders([]byte(test.config))
+			if test.expectedErr && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !test.expectedErr && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
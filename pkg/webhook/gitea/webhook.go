@@ -0,0 +1,154 @@
+// Package gitea parses webhooks of Gitea and Forgejo. It is based on https://github.com/go-playground/webhooks/blob/master/gitea/gitea.go,
+// which only reads the X-Gitea-* headers, while Forgejo sends X-Forgejo-* headers.
+package gitea
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/gitea"
+)
+
+// parse errors
+var (
+	ErrEventNotSpecifiedToParse = errors.New("no Event specified to parse")
+	ErrInvalidHTTPMethod        = errors.New("invalid HTTP Method")
+	ErrMissingEventHeader       = errors.New("missing X-Gitea-Event or X-Forgejo-Event Header")
+	ErrMissingSignatureHeader   = errors.New("missing X-Gitea-Signature or X-Forgejo-Signature Header")
+	ErrEventNotFound            = errors.New("event not defined to be parsed")
+	ErrParsingPayload           = errors.New("error parsing payload")
+	ErrHMACVerificationFailed   = errors.New("HMAC verification failed")
+)
+
+// Headers sent by Gitea and Forgejo. Forgejo sends the Gitea headers as well.
+const (
+	GiteaEventHeader       = "X-Gitea-Event"
+	GiteaSignatureHeader   = "X-Gitea-Signature"
+	ForgejoEventHeader     = "X-Forgejo-Event"
+	ForgejoSignatureHeader = "X-Forgejo-Signature"
+)
+
+// Option is a configuration option for the webhook
+type Option func(*Webhook) error
+
+// Options is a namespace var for configuration options
+var Options = WebhookOptions{}
+
+// WebhookOptions is a namespace for configuration option methods
+type WebhookOptions struct{}
+
+// Secret verifies the HMAC-SHA256 signature of the payload with secret
+func (WebhookOptions) Secret(secret string) Option {
+	return func(hook *Webhook) error {
+		hook.secret = secret
+		return nil
+	}
+}
+
+// Webhook instance contains all methods needed to process events
+type Webhook struct {
+	secret string
+}
+
+// New creates and returns a WebHook instance
+func New(options ...Option) (*Webhook, error) {
+	hook := new(Webhook)
+	for _, opt := range options {
+		if err := opt(hook); err != nil {
+			return nil, errors.New("Error applying Option")
+		}
+	}
+	return hook, nil
+}
+
+// Parse verifies and parses the events specified and returns the payload object or an error
+func (hook Webhook) Parse(r *http.Request, events ...gitea.Event) (interface{}, error) {
+	defer func() {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_ = r.Body.Close()
+	}()
+
+	if len(events) == 0 {
+		return nil, ErrEventNotSpecifiedToParse
+	}
+	if r.Method != http.MethodPost {
+		return nil, ErrInvalidHTTPMethod
+	}
+
+	event := header(r, ForgejoEventHeader, GiteaEventHeader)
+	if event == "" {
+		return nil, ErrMissingEventHeader
+	}
+	giteaEvent := gitea.Event(event)
+
+	var found bool
+	for _, evt := range events {
+		if evt == giteaEvent {
+			found = true
+			break
+		}
+	}
+	// event not defined to be parsed
+	if !found {
+		return nil, ErrEventNotFound
+	}
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil || len(payload) == 0 {
+		return nil, ErrParsingPayload
+	}
+
+	// If we have a Secret set, we should check the MAC
+	if len(hook.secret) > 0 {
+		signature := strings.TrimPrefix(header(r, ForgejoSignatureHeader, GiteaSignatureHeader), "sha256=")
+		if signature == "" {
+			return nil, ErrMissingSignatureHeader
+		}
+		mac := hmac.New(sha256.New, []byte(hook.secret))
+		_, _ = mac.Write(payload)
+		expectedMAC := hex.EncodeToString(mac.Sum(nil))
+
+		if !hmac.Equal([]byte(signature), []byte(expectedMAC)) {
+			return nil, ErrHMACVerificationFailed
+		}
+	}
+
+	switch giteaEvent {
+	case gitea.PushEvent:
+		var pl gitea.PushPayload
+		err = json.Unmarshal(payload, &pl)
+		return pl, err
+	case gitea.CreateEvent:
+		var pl gitea.CreatePayload
+		err = json.Unmarshal(payload, &pl)
+		return pl, err
+	case gitea.DeleteEvent:
+		var pl gitea.DeletePayload
+		err = json.Unmarshal(payload, &pl)
+		return pl, err
+	case gitea.PullRequestEvent:
+		var pl gitea.PullRequestPayload
+		err = json.Unmarshal(payload, &pl)
+		return pl, err
+	default:
+		return nil, fmt.Errorf("unknown event %s", giteaEvent)
+	}
+}
+
+// header returns the value of the first of the headers which is set.
+func header(r *http.Request, headers ...string) string {
+	for _, h := range headers {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
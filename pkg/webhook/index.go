@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"context"
+	"sort"
+
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RepoIndex is the field index of GitJobs by the identity of their repo, see giturls.RepoID.
+const RepoIndex = "spec.git.repoID"
+
+// AddRepoIndex registers RepoIndex in the indexer. It has to be called before the manager's cache is started.
+func AddRepoIndex(ctx context.Context, indexer client.FieldIndexer) error {
+	return indexer.IndexField(ctx, &v1.GitJob{}, RepoIndex, repoIndexFunc)
+}
+
+func repoIndexFunc(obj client.Object) []string {
+	gitJob, ok := obj.(*v1.GitJob)
+	if !ok {
+		return nil
+	}
+	id, err := giturls.RepoID(gitJob.Spec.Git.Repo)
+	if err != nil {
+		return nil
+	}
+
+	return []string{id}
+}
+
+// gitJobsForRepos returns the GitJobs of the repos, which are the URLs of a single repo in a webhook payload. They are
+// sorted by namespace and name. If scope is set, e.g. for deliveries to a GitJob's endpoint, only that GitJob is
+// returned. Otherwise GitJobs with their own webhook secret are skipped.
+func (w *Webhook) gitJobsForRepos(ctx context.Context, scope *ktypes.NamespacedName, repoURLs []string) ([]v1.GitJob, error) {
+	var gitJobs []v1.GitJob
+	found := map[ktypes.NamespacedName]bool{}
+	for _, repo := range repoURLs {
+		id, err := giturls.RepoID(repo)
+		if err != nil {
+			return nil, err
+		}
+		var gitJobList v1.GitJobList
+		if err := w.client.List(ctx, &gitJobList, client.MatchingFields{RepoIndex: id}); err != nil {
+			return nil, err
+		}
+		for _, gitJob := range gitJobList.Items {
+			key := ktypes.NamespacedName{Namespace: gitJob.Namespace, Name: gitJob.Name}
+			if found[key] {
+				continue
+			}
+			if scope != nil && key != *scope || scope == nil && gitJob.Spec.WebhookSecretName != "" {
+				continue
+			}
+			found[key] = true
+			gitJobs = append(gitJobs, gitJob)
+		}
+	}
+
+	sort.Slice(gitJobs, func(i, j int) bool {
+		if gitJobs[i].Namespace != gitJobs[j].Namespace {
+			return gitJobs[i].Namespace < gitJobs[j].Namespace
+		}
+		return gitJobs[i].Name < gitJobs[j].Name
+	})
+
+	return gitJobs, nil
+}
@@ -0,0 +1,269 @@
+package webhook
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	goPlaygroundAzuredevops "github.com/go-playground/webhooks/v6/azuredevops"
+	goPlaygroundGitea "github.com/go-playground/webhooks/v6/gitea"
+	gogsclient "github.com/gogits/go-gogs-client"
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	giturls "github.com/rancher/gitjob/pkg/git-urls"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/go-playground/webhooks.v5/bitbucket"
+	bitbucketserver "gopkg.in/go-playground/webhooks.v5/bitbucket-server"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"gopkg.in/go-playground/webhooks.v5/gitlab"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// pullRequest is a pull/merge request event, independent of the git provider which sent it.
+type pullRequest struct {
+	repoURLs   []string
+	number     int
+	closed     bool
+	headCommit string
+	headBranch string
+	headRepo   string
+	baseBranch string
+}
+
+// parsePullRequest converts a pull request payload into a pullRequest. It returns false if the payload is not a pull
+// request event, or if its action does not open, update or close the pull request.
+func parsePullRequest(payload interface{}) (*pullRequest, bool) {
+	switch t := payload.(type) {
+	case github.PullRequestPayload:
+		pr := &pullRequest{
+			repoURLs:   []string{t.Repository.HTMLURL},
+			number:     int(t.Number),
+			headCommit: t.PullRequest.Head.Sha,
+			headBranch: t.PullRequest.Head.Ref,
+			headRepo:   t.PullRequest.Head.Repo.CloneURL,
+			baseBranch: t.PullRequest.Base.Ref,
+		}
+		switch t.Action {
+		case "opened", "reopened", "synchronize":
+		case "closed":
+			pr.closed = true
+		default:
+			return nil, false
+		}
+		return pr, true
+	case gitlab.MergeRequestEventPayload:
+		pr := &pullRequest{
+			repoURLs:   []string{t.Project.WebURL},
+			number:     int(t.ObjectAttributes.IID),
+			headCommit: t.ObjectAttributes.LastCommit.ID,
+			headBranch: t.ObjectAttributes.SourceBranch,
+			headRepo:   t.ObjectAttributes.Source.GitHTTPURL,
+			baseBranch: t.ObjectAttributes.TargetBranch,
+		}
+		switch t.ObjectAttributes.Action {
+		case "open", "reopen", "update":
+		case "close", "merge":
+			pr.closed = true
+		default:
+			return nil, false
+		}
+		return pr, true
+	case gogsclient.PullRequestPayload:
+		if t.PullRequest == nil || t.Repository == nil {
+			return nil, false
+		}
+		// gogs doesn't send the head commit of the pull request
+		pr := &pullRequest{
+			repoURLs:   []string{t.Repository.HTMLURL},
+			number:     int(t.Index),
+			headBranch: t.PullRequest.HeadBranch,
+			baseBranch: t.PullRequest.BaseBranch,
+		}
+		if t.PullRequest.HeadRepo != nil {
+			pr.headRepo = t.PullRequest.HeadRepo.CloneURL
+		}
+		switch t.Action {
+		case gogsclient.HOOK_ISSUE_OPENED, gogsclient.HOOK_ISSUE_REOPENED, gogsclient.HOOK_ISSUE_SYNCHRONIZED:
+		case gogsclient.HOOK_ISSUE_CLOSED:
+			pr.closed = true
+		default:
+			return nil, false
+		}
+		return pr, true
+	case goPlaygroundGitea.PullRequestPayload:
+		if t.PullRequest == nil || t.PullRequest.Head == nil || t.PullRequest.Base == nil || t.Repository == nil {
+			return nil, false
+		}
+		pr := &pullRequest{
+			repoURLs:   []string{t.Repository.HTMLURL},
+			number:     int(t.Index),
+			headCommit: t.PullRequest.Head.Sha,
+			headBranch: t.PullRequest.Head.Ref,
+			baseBranch: t.PullRequest.Base.Ref,
+		}
+		if t.PullRequest.Head.Repository != nil {
+			pr.headRepo = t.PullRequest.Head.Repository.CloneURL
+		}
+		// Gitea and Forgejo send the closed action for merged pull requests as well
+		switch t.Action {
+		case "opened", "reopened", "synchronized":
+		case "closed":
+			pr.closed = true
+		default:
+			return nil, false
+		}
+		return pr, true
+	case bitbucket.PullRequestCreatedPayload:
+		return bitbucketPullRequest(t.Repository, t.PullRequest, false), true
+	case bitbucket.PullRequestUpdatedPayload:
+		return bitbucketPullRequest(t.Repository, t.PullRequest, false), true
+	case bitbucket.PullRequestMergedPayload:
+		return bitbucketPullRequest(t.Repository, t.PullRequest, true), true
+	case bitbucket.PullRequestDeclinedPayload:
+		return bitbucketPullRequest(t.Repository, t.PullRequest, true), true
+	case bitbucketserver.PullRequestOpenedPayload:
+		return bitbucketServerPullRequest(t.PullRequest, false), true
+	case bitbucketserver.PullRequestFromReferenceUpdatedPayload:
+		return bitbucketServerPullRequest(t.PullRequest, false), true
+	case bitbucketserver.PullRequestMergedPayload:
+		return bitbucketServerPullRequest(t.PullRequest, true), true
+	case bitbucketserver.PullRequestDeclinedPayload:
+		return bitbucketServerPullRequest(t.PullRequest, true), true
+	case bitbucketserver.PullRequestDeletedPayload:
+		return bitbucketServerPullRequest(t.PullRequest, true), true
+	case goPlaygroundAzuredevops.GitPullRequestEvent:
+		pr := &pullRequest{
+			repoURLs:   []string{t.Resource.Repository.RemoteURL},
+			number:     t.Resource.PullRequestID,
+			headCommit: t.Resource.LastMergeSourceCommit.CommitID,
+			headBranch: strings.TrimPrefix(t.Resource.SourceRefName, branchRefPrefix),
+			baseBranch: strings.TrimPrefix(t.Resource.TargetRefName, branchRefPrefix),
+		}
+		switch t.Resource.Status {
+		case "active":
+		case "completed", "abandoned":
+			pr.closed = true
+		default:
+			return nil, false
+		}
+		return pr, true
+	}
+
+	return nil, false
+}
+
+func bitbucketPullRequest(repo bitbucket.Repository, pr bitbucket.PullRequest, closed bool) *pullRequest {
+	return &pullRequest{
+		repoURLs:   []string{repo.Links.HTML.Href},
+		number:     int(pr.ID),
+		closed:     closed,
+		headCommit: pr.Source.Commit.Hash,
+		headBranch: pr.Source.Branch.Name,
+		headRepo:   pr.Source.Repository.Links.HTML.Href,
+		baseBranch: pr.Destination.Branch.Name,
+	}
+}
+
+func bitbucketServerPullRequest(pr bitbucketserver.PullRequest, closed bool) *pullRequest {
+	result := &pullRequest{
+		repoURLs:   bitbucketServerCloneURLs(pr.ToRef.Repository),
+		number:     int(pr.ID),
+		closed:     closed,
+		headCommit: pr.FromRef.LatestCommit,
+		headBranch: pr.FromRef.DisplayId,
+		baseBranch: pr.ToRef.DisplayId,
+	}
+	// the clone URLs of the same repo differ in their form, so a pull request of the same repo is detected by its ID
+	if pr.FromRef.Repository.ID != pr.ToRef.Repository.ID {
+		if headRepos := bitbucketServerCloneURLs(pr.FromRef.Repository); len(headRepos) > 0 {
+			result.headRepo = headRepos[0]
+		}
+	}
+
+	return result
+}
+
+func bitbucketServerCloneURLs(repo bitbucketserver.Repository) []string {
+	var repoURLs []string
+	links, _ := repo.Links["clone"].([]interface{})
+	for _, l := range links {
+		link, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if href, ok := link["href"].(string); ok && (link["name"] == "http" || link["name"] == "ssh") {
+			repoURLs = append(repoURLs, href)
+		}
+	}
+
+	return repoURLs
+}
+
+// handlePullRequest stores the pull request in the status of every GitJob of the repo which has pull requests
+// enabled. Closed pull requests are removed, unless a teardown job has to run for them. Pull requests from forks are
+// ignored, unless the GitJob allows them.
+func (w *Webhook) handlePullRequest(ctx context.Context, scope *ktypes.NamespacedName, pr *pullRequest) error {
+	gitJobs, err := w.gitJobsForRepos(ctx, scope, pr.repoURLs)
+	if err != nil {
+		return err
+	}
+	for _, gitjob := range gitJobs {
+		if !gitjob.Spec.Git.PullRequest.Enabled {
+			continue
+		}
+		if baseBranch := gitjob.Spec.Git.PullRequest.BaseBranch; baseBranch != "" && baseBranch != pr.baseBranch {
+			continue
+		}
+		gitJobPR := *pr
+		if pr.headRepo == "" || giturls.SameRepo(pr.headRepo, gitjob.Spec.Git.Repo) {
+			// jobs clone spec.git.repo, so the URL form of the GitJob is kept
+			gitJobPR.headRepo = ""
+		} else if !gitjob.Spec.Git.PullRequest.AllowForks {
+			logrus.Debugf("Ignoring pull request %d of %s/%s from fork %s", pr.number, gitjob.Namespace, gitjob.Name, pr.headRepo)
+			continue
+		}
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var gitJobFomCluster v1.GitJob
+			err := w.client.Get(ctx, ktypes.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, &gitJobFomCluster)
+			if err != nil {
+				return err
+			}
+			gitJobFomCluster.Status.PullRequests = setPullRequest(gitJobFomCluster.Status.PullRequests, &gitJobPR, gitjob.Spec.Git.PullRequest.Teardown)
+			return w.client.Status().Update(ctx, &gitJobFomCluster)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPullRequest adds or updates pr in pullRequests. A closed pull request is removed if no teardown job is needed.
+func setPullRequest(pullRequests []v1.PullRequestStatus, pr *pullRequest, teardown bool) []v1.PullRequestStatus {
+	var result []v1.PullRequestStatus
+	status := v1.PullRequestStatus{Number: pr.number}
+	for _, existing := range pullRequests {
+		if existing.Number == pr.number {
+			status = existing
+			continue
+		}
+		result = append(result, existing)
+	}
+	if pr.closed && !teardown {
+		return result
+	}
+
+	if pr.headCommit != "" {
+		status.HeadCommit = pr.headCommit
+	}
+	status.HeadBranch = pr.headBranch
+	status.HeadRepo = pr.headRepo
+	status.BaseBranch = pr.baseBranch
+	status.Closed = pr.closed
+	result = append(result, status)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Number < result[j].Number
+	})
+
+	return result
+}
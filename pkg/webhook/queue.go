@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	queueName = "webhook"
+	// DefaultWorkers is the number of deliveries processed concurrently, if not configured
+	DefaultWorkers = 5
+	// maxRetries is the number of times a delivery is retried, before it is marked as failed
+	maxRetries = 5
+	// deliveryIDVar is the mux variable of the delivery ID in /deliveries/{id}
+	deliveryIDVar = "id"
+
+	stateQueued     = "queued"
+	stateProcessing = "processing"
+	stateSucceeded  = "succeeded"
+	stateFailed     = "failed"
+)
+
+// event is a validated delivery, which is processed by the queue.
+type event struct {
+	// id is the delivery ID of the provider, or a generated one
+	id string
+	// claim is the key of the delivery in the deliveryStore, which is released if processing fails
+	claim string
+	// gitJob restricts the event to a single GitJob, if set
+	gitJob *ktypes.NamespacedName
+
+	repoURLs []string
+	updates  []refUpdate
+	pr       *pullRequest
+}
+
+// outcome is the processing outcome of a delivery, returned by /deliveries/{id}. The endpoint isn't authenticated, so
+// errors, which can contain hosts and namespaces, are only logged.
+type outcome struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Attempts is the number of times processing was started
+	Attempts int `json:"attempts"`
+	// Updated is the number of GitJobs updated by the delivery
+	Updated  int        `json:"updated"`
+	Received time.Time  `json:"received"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// outcomeStore remembers the outcomes of deliveries for deliveryTTL, up to maxDeliveries.
+type outcomeStore struct {
+	mu    sync.Mutex
+	cache *cache.LRUExpireCache
+}
+
+func newOutcomeStore() *outcomeStore {
+	return &outcomeStore{cache: cache.NewLRUExpireCache(maxDeliveries)}
+}
+
+func (s *outcomeStore) get(id string) (outcome, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, found := s.cache.Get(id)
+	if !found {
+		return outcome{}, false
+	}
+
+	return o.(outcome), true
+}
+
+// update applies f to the outcome of the delivery. Outcomes which expired in the meantime are recreated.
+func (s *outcomeStore) update(id string, f func(o *outcome)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := outcome{ID: id}
+	if v, found := s.cache.Get(id); found {
+		o = v.(outcome)
+	}
+	f(&o)
+	s.cache.Add(id, o, deliveryTTL)
+}
+
+func newQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewRateLimitingQueueWithConfig(
+		workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute),
+		workqueue.RateLimitingQueueConfig{Name: queueName},
+	)
+}
+
+// enqueue records the event as queued and adds it to the queue. It returns the queued outcome.
+func (w *Webhook) enqueue(e *event) outcome {
+	queued := outcome{ID: e.id, State: stateQueued, Received: time.Now().UTC()}
+	w.outcomes.update(e.id, func(o *outcome) {
+		*o = queued
+	})
+	w.queue.Add(e)
+
+	return queued
+}
+
+// run processes the queue with the given number of workers, until ctx is done.
+func (w *Webhook) run(ctx context.Context, workers int) {
+	defer w.queue.ShutDown()
+
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, w.worker, time.Second)
+	}
+
+	<-ctx.Done()
+}
+
+func (w *Webhook) worker(ctx context.Context) {
+	for w.processNextEvent(ctx) {
+	}
+}
+
+func (w *Webhook) processNextEvent(ctx context.Context) bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+
+	e := item.(*event)
+	w.outcomes.update(e.id, func(o *outcome) {
+		o.State = stateProcessing
+		o.Attempts++
+	})
+
+	updated, err := w.process(ctx, e)
+	if err == nil {
+		w.queue.Forget(e)
+		w.finish(e, stateSucceeded, updated)
+		return true
+	}
+
+	if w.queue.NumRequeues(e) < maxRetries {
+		logrus.Warnf("Webhook delivery %s failed, retrying: %s", e.id, err)
+		w.outcomes.update(e.id, func(o *outcome) {
+			o.State = stateQueued
+			o.Updated += updated
+		})
+		w.queue.AddRateLimited(e)
+		return true
+	}
+
+	logrus.Errorf("Webhook processing failed: %s", err)
+	w.queue.Forget(e)
+	// the provider received a 202 response, but a redelivery is processed again
+	w.deliveries.release(e.claim)
+	w.finish(e, stateFailed, updated)
+
+	return true
+}
+
+func (w *Webhook) finish(e *event, state string, updated int) {
+	now := time.Now().UTC()
+	w.outcomes.update(e.id, func(o *outcome) {
+		o.State = state
+		o.Updated += updated
+		o.Finished = &now
+	})
+}
+
+// serveDelivery returns the processing outcome of a delivery.
+func (w *Webhook) serveDelivery(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := url.PathUnescape(mux.Vars(r)[deliveryIDVar])
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if w.outcomes == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	o, found := w.outcomes.get(id)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeOutcome(rw, http.StatusOK, o)
+}
+
+func writeOutcome(rw http.ResponseWriter, status int, o outcome) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(o)
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestQueuedDeliveries(t *testing.T) {
+	gitjob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "https://github.com/rancher/gitjob",
+				Branch: "main",
+			},
+		},
+	}
+	client, w := newDeliveryTestWebhook(t, gitjob)
+	w.github, _ = github.New()
+	w.queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0))
+	w.outcomes = newOutcomeStore()
+	router := mux.NewRouter()
+	router.Handle("/", w)
+	router.HandleFunc("/deliveries/{"+deliveryIDVar+"}", w.serveDelivery)
+
+	jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + newCommit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("expected status %d, but got %d", http.StatusAccepted, rec.Code)
+	}
+	accepted := decodeOutcome(t, rec)
+	if accepted.ID != "1" || accepted.State != stateQueued {
+		t.Errorf("expected queued delivery 1, but got %+v", accepted)
+	}
+	// status is only updated by the queue
+	assertCommit(t, client, gitjob, "")
+
+	if !w.processNextEvent(context.TODO()) {
+		t.Fatal("expected an event to be processed")
+	}
+	assertCommit(t, client, gitjob, newCommit)
+
+	o := getOutcome(t, router, "1", http.StatusOK)
+	if o.State != stateSucceeded || o.Attempts != 1 || o.Updated != 1 || o.Finished == nil {
+		t.Errorf("unexpected outcome %+v", o)
+	}
+	getOutcome(t, router, "2", http.StatusNotFound)
+}
+
+func TestQueuedDeliveryFails(t *testing.T) {
+	gitjob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "https://github.com/rancher/gitjob",
+				Branch: "main",
+			},
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	fakeClient := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).WithInterceptorFuncs(interceptor.Funcs{
+		SubResourceUpdate: func(_ context.Context, _ client.Client, _ string, _ client.Object, _ ...client.SubResourceUpdateOption) error {
+			return errors.New("status update failed")
+		},
+	}).Build()
+	w := &Webhook{
+		client:     fakeClient,
+		deliveries: newDeliveryStore(),
+		queue:      workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0)),
+		outcomes:   newOutcomeStore(),
+	}
+	w.github, _ = github.New()
+	router := mux.NewRouter()
+	router.Handle("/", w)
+	router.HandleFunc("/deliveries/{"+deliveryIDVar+"}", w.serveDelivery)
+
+	jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + newCommit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("expected status %d, but got %d", http.StatusAccepted, rec.Code)
+	}
+
+	for i := 0; i < maxRetries; i++ {
+		w.processNextEvent(context.TODO())
+		if o := getOutcome(t, router, "1", http.StatusOK); o.State != stateQueued || o.Attempts != i+1 {
+			t.Errorf("expected delivery to be retried, but got %+v", o)
+		}
+	}
+	w.processNextEvent(context.TODO())
+	o := getOutcome(t, router, "1", http.StatusOK)
+	if o.State != stateFailed || o.Attempts != maxRetries+1 || o.Finished == nil {
+		t.Errorf("unexpected outcome %+v", o)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/deliveries/1", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if strings.Contains(rec.Body.String(), "status update failed") {
+		t.Errorf("expected the error to not be returned, but got %s", rec.Body.String())
+	}
+	if w.queue.Len() != 0 {
+		t.Errorf("expected empty queue, but got %d events", w.queue.Len())
+	}
+	// the failed delivery is released, so a redelivery is processed again
+	if !w.deliveries.claim("/|X-GitHub-Delivery|1") {
+		t.Errorf("expected failed delivery to be released")
+	}
+}
+
+func getOutcome(t *testing.T, router http.Handler, id string, expectedStatus int) outcome {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/deliveries/"+id, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != expectedStatus {
+		t.Errorf("expected status %d, but got %d", expectedStatus, rec.Code)
+	}
+	if rec.Code != http.StatusOK {
+		return outcome{}
+	}
+
+	return decodeOutcome(t, rec)
+}
+
+func decodeOutcome(t *testing.T, rec *httptest.ResponseRecorder) outcome {
+	t.Helper()
+	var o outcome
+	if err := json.NewDecoder(rec.Body).Decode(&o); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	return o
+}
@@ -4,18 +4,20 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/url"
-	"regexp"
+	"sort"
 	"strings"
 
 	goPlaygroundAzuredevops "github.com/go-playground/webhooks/v6/azuredevops"
+	goPlaygroundGitea "github.com/go-playground/webhooks/v6/gitea"
 	"github.com/rancher/gitjob/pkg/webhook/azuredevops"
+	"github.com/rancher/gitjob/pkg/webhook/gitea"
 
 	"github.com/go-logr/logr"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/gorilla/mux"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	kcache "k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
@@ -23,14 +25,17 @@ import (
 	"github.com/Masterminds/semver/v3"
 	gogsclient "github.com/gogits/go-gogs-client"
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
+	"github.com/rancher/gitjob/pkg/git"
+	"github.com/rancher/wrangler/v2/pkg/condition"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/go-playground/webhooks.v5/bitbucket"
 	bitbucketserver "gopkg.in/go-playground/webhooks.v5/bitbucket-server"
 	"gopkg.in/go-playground/webhooks.v5/github"
 	"gopkg.in/go-playground/webhooks.v5/gitlab"
 	"gopkg.in/go-playground/webhooks.v5/gogs"
-	"k8s.io/apimachinery/pkg/labels"
 	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -42,11 +47,17 @@ const (
 	bitbucketKey               = "bitbucket"
 	bitbucketServerKey         = "bitbucket-server"
 	gogsKey                    = "gogs"
+	giteaKey                   = "gitea"
+	forgejoKey                 = "forgejo"
 	azureUsername              = "azure-username"
 	azurePassword              = "azure-password"
 
 	branchRefPrefix = "refs/heads/"
 	tagRefPrefix    = "refs/tags/"
+
+	// zeroSHA is the commit of deleted refs
+	zeroSHA          = "0000000000000000000000000000000000000000"
+	refDeletedReason = "Deleted"
 )
 
 type Webhook struct {
@@ -57,15 +68,48 @@ type Webhook struct {
 	bitbucket       *bitbucket.Webhook
 	bitbucketServer *bitbucketserver.Webhook
 	gogs            *gogs.Webhook
+	gitea           *gitea.Webhook
+	forgejo         *gitea.Webhook
+	generic         []*genericProvider
 	log             logr.Logger
 	azureDevops     *azuredevops.Webhook
+	// gitJob restricts deliveries to a single GitJob, if set
+	gitJob *ktypes.NamespacedName
+	// deliveries contains the IDs of processed deliveries, to ignore duplicates
+	deliveries *deliveryStore
+	// ancestry verifies that revisions descend from the current commit of a GitJob, if set
+	ancestry git.AncestryChecker
+	// history checks whether revisions descend from the last executed commit of GitJobs with a historyRewritePolicy
+	history git.AncestryChecker
+	// queue processes validated deliveries in the background. Without a queue, deliveries are processed before
+	// responding
+	queue workqueue.RateLimitingInterface
+	// outcomes contains the processing outcomes of queued deliveries
+	outcomes *outcomeStore
+}
+
+// Options configures the webhook.
+type Options struct {
+	// VerifyAncestry ignores revisions which don't descend from the current commit of a GitJob's branch
+	VerifyAncestry bool
+	// Workers is the number of deliveries processed concurrently
+	Workers int
+	// HostKeys configures the verification of SSH host keys, when revisions are checked against the git repo
+	HostKeys git.HostKeyOptions
 }
 
-func New(namespace string, client client.Client) (*Webhook, error) {
+func New(namespace string, client client.Client, opts Options) (*Webhook, error) {
 	webhook := &Webhook{
-		client:    client,
-		namespace: namespace,
-		log:       ctrl.Log.WithName("webhook"),
+		client:     client,
+		namespace:  namespace,
+		log:        ctrl.Log.WithName("webhook"),
+		deliveries: newDeliveryStore(),
+		queue:      newQueue(),
+		outcomes:   newOutcomeStore(),
+		history:    &git.Fetch{HostKeys: opts.HostKeys},
+	}
+	if opts.VerifyAncestry {
+		webhook.ancestry = &git.Fetch{HostKeys: opts.HostKeys}
 	}
 	err := webhook.initGitProviders()
 	if err != nil {
@@ -98,6 +142,14 @@ func (w *Webhook) initGitProviders() error {
 	if err != nil {
 		return err
 	}
+	w.gitea, err = gitea.New()
+	if err != nil {
+		return err
+	}
+	w.forgejo, err = gitea.New()
+	if err != nil {
+		return err
+	}
 	w.azureDevops, err = azuredevops.New()
 	if err != nil {
 		return err
@@ -111,37 +163,58 @@ func (w *Webhook) onSecretChange(obj interface{}) error {
 	if !ok {
 		return fmt.Errorf("expected secret object but got %T", obj)
 	}
-	if secret.Name != webhookSecretName && secret.Namespace != w.namespace {
+	if secret.Name != webhookSecretName || secret.Namespace != w.namespace {
 		return nil
 	}
 
+	return w.setGitProviders(secret.Data)
+}
+
+// setGitProviders configures the git providers with the secrets in data, which uses the keys of the gitjob-webhook
+// secret.
+func (w *Webhook) setGitProviders(data map[string][]byte) error {
 	var err error
-	github, err := github.New(github.Options.Secret(string(secret.Data[githubKey])))
+	github, err := github.New(github.Options.Secret(string(data[githubKey])))
 	if err != nil {
 		return err
 	}
 	w.github = github
-	gitlab, err := gitlab.New(gitlab.Options.Secret(string(secret.Data[gitlabKey])))
+	gitlab, err := gitlab.New(gitlab.Options.Secret(string(data[gitlabKey])))
 	if err != nil {
 		return err
 	}
 	w.gitlab = gitlab
-	bitbucket, err := bitbucket.New(bitbucket.Options.UUID(string(secret.Data[bitbucketKey])))
+	bitbucket, err := bitbucket.New(bitbucket.Options.UUID(string(data[bitbucketKey])))
 	if err != nil {
 		return err
 	}
 	w.bitbucket = bitbucket
-	bitbucketServer, err := bitbucketserver.New(bitbucketserver.Options.Secret(string(secret.Data[bitbucketServerKey])))
+	bitbucketServer, err := bitbucketserver.New(bitbucketserver.Options.Secret(string(data[bitbucketServerKey])))
 	if err != nil {
 		return err
 	}
 	w.bitbucketServer = bitbucketServer
-	gogs, err := gogs.New(gogs.Options.Secret(string(secret.Data[gogsKey])))
+	gogs, err := gogs.New(gogs.Options.Secret(string(data[gogsKey])))
 	if err != nil {
 		return err
 	}
 	w.gogs = gogs
-	azureDevops, err := azuredevops.New(azuredevops.Options.BasicAuth(string(secret.Data[azureUsername]), string(secret.Data[azurePassword])))
+	giteaWebhook, err := gitea.New(gitea.Options.Secret(string(data[giteaKey])))
+	if err != nil {
+		return err
+	}
+	w.gitea = giteaWebhook
+	forgejoWebhook, err := gitea.New(gitea.Options.Secret(string(data[forgejoKey])))
+	if err != nil {
+		return err
+	}
+	w.forgejo = forgejoWebhook
+	generic, err := parseGenericProviders(data[genericKey])
+	if err != nil {
+		return err
+	}
+	w.generic = generic
+	azureDevops, err := azuredevops.New(azuredevops.Options.BasicAuth(string(data[azureUsername]), string(data[azurePassword])))
 	if err != nil {
 		return err
 	}
@@ -150,26 +223,91 @@ func (w *Webhook) onSecretChange(obj interface{}) error {
 	return nil
 }
 
+// serveGitJob handles deliveries to the endpoint of a single GitJob, /hooks/<namespace>/<name>. They are validated with
+// the token of the secret referenced by spec.webhookSecretName, or with the gitjob-webhook secret if none is referenced,
+// and only update that GitJob.
+func (w *Webhook) serveGitJob(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := ktypes.NamespacedName{Namespace: vars["namespace"], Name: vars["name"]}
+	var gitJob v1.GitJob
+	if err := w.client.Get(r.Context(), key, &gitJob); errors.IsNotFound(err) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logAndReturn(rw, err)
+		return
+	}
+
+	hook := *w
+	hook.gitJob = &key
+	if gitJob.Spec.WebhookSecretName != "" {
+		token := gitJob.Status.ValidationToken
+		if token == "" {
+			logrus.Warnf("Rejecting webhook for %s/%s, the token of secret %s is not available", key.Namespace, key.Name, gitJob.Spec.WebhookSecretName)
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// Azure DevOps uses basic auth, only the password is validated
+		username, _, _ := r.BasicAuth()
+		if err := hook.setGitProviders(map[string][]byte{
+			githubKey:          []byte(token),
+			gitlabKey:          []byte(token),
+			bitbucketKey:       []byte(token),
+			bitbucketServerKey: []byte(token),
+			gogsKey:            []byte(token),
+			giteaKey:           []byte(token),
+			forgejoKey:         []byte(token),
+			azureUsername:      []byte(username),
+			azurePassword:      []byte(token),
+		}); err != nil {
+			logAndReturn(rw, err)
+			return
+		}
+		// generic providers are authenticated with their own secrets
+		hook.generic = w.generic
+	}
+
+	hook.ServeHTTP(rw, r)
+}
+
 func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	// credit from https://github.com/argoproj/argo-cd/blob/97003caebcaafe1683e71934eb483a88026a4c33/util/webhook/webhook.go#L327-L350
 	var payload interface{}
 	var err error
 	ctx := r.Context()
 
+	generic := w.genericProvider(r)
 	switch {
+	// generic providers are checked first, as they may be selected by the headers of other providers
+	case generic != nil:
+		payload, err = generic.Parse(r)
+	case mux.Vars(r)[genericProviderVar] != "":
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	// Forgejo carries Forgejo and Gitea headers, Gitea carries Gitea, Gogs and Github headers
+	case r.Header.Get(gitea.ForgejoEventHeader) != "":
+		payload, err = w.forgejo.Parse(r, goPlaygroundGitea.PushEvent, goPlaygroundGitea.CreateEvent, goPlaygroundGitea.DeleteEvent,
+			goPlaygroundGitea.PullRequestEvent)
+	case r.Header.Get(gitea.GiteaEventHeader) != "":
+		payload, err = w.gitea.Parse(r, goPlaygroundGitea.PushEvent, goPlaygroundGitea.CreateEvent, goPlaygroundGitea.DeleteEvent,
+			goPlaygroundGitea.PullRequestEvent)
 	//Gogs needs to be checked before Github since it carries both Gogs and (incompatible) Github headers
 	case r.Header.Get("X-Gogs-Event") != "":
-		payload, err = w.gogs.Parse(r, gogs.PushEvent)
+		payload, err = w.gogs.Parse(r, gogs.PushEvent, gogs.DeleteEvent, gogs.PullRequestEvent)
 	case r.Header.Get("X-GitHub-Event") != "":
-		payload, err = w.github.Parse(r, github.PushEvent)
+		payload, err = w.github.Parse(r, github.PushEvent, github.PullRequestEvent)
 	case r.Header.Get("X-Gitlab-Event") != "":
-		payload, err = w.gitlab.Parse(r, gitlab.PushEvents, gitlab.TagEvents)
+		payload, err = w.gitlab.Parse(r, gitlab.PushEvents, gitlab.TagEvents, gitlab.MergeRequestEvents)
 	case r.Header.Get("X-Hook-UUID") != "":
-		payload, err = w.bitbucket.Parse(r, bitbucket.RepoPushEvent)
+		payload, err = w.bitbucket.Parse(r, bitbucket.RepoPushEvent, bitbucket.PullRequestCreatedEvent, bitbucket.PullRequestUpdatedEvent,
+			bitbucket.PullRequestMergedEvent, bitbucket.PullRequestDeclinedEvent)
 	case r.Header.Get("X-Event-Key") != "":
-		payload, err = w.bitbucketServer.Parse(r, bitbucketserver.RepositoryReferenceChangedEvent)
+		payload, err = w.bitbucketServer.Parse(r, bitbucketserver.RepositoryReferenceChangedEvent, bitbucketserver.PullRequestOpenedEvent,
+			bitbucketserver.PullRequestFromReferenceUpdatedEvent, bitbucketserver.PullRequestMergedEvent, bitbucketserver.PullRequestDeclinedEvent,
+			bitbucketserver.PullRequestDeletedEvent)
 	case r.Header.Get("X-Vss-Activityid") != "" || r.Header.Get("X-Vss-Subscriptionid") != "":
-		payload, err = w.azureDevops.Parse(r, goPlaygroundAzuredevops.GitPushEventType)
+		payload, err = w.azureDevops.Parse(r, goPlaygroundAzuredevops.GitPushEventType, goPlaygroundAzuredevops.GitPullRequestCreatedEventType,
+			goPlaygroundAzuredevops.GitPullRequestUpdatedEventType, goPlaygroundAzuredevops.GitPullRequestMergedEventType)
 	default:
 		logrus.Debug("Ignoring unknown webhook event")
 		return
@@ -182,148 +320,454 @@ func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var revision, branch, tag string
-	var repoURLs []string
+	// only validated deliveries are recorded, failed deliveries are released to be processed when retried
+	delivery := deliveryID(r, generic)
+	if !w.deliveries.claim(delivery) {
+		logrus.Debugf("Ignoring duplicate webhook delivery %s", delivery)
+		rw.WriteHeader(200)
+		rw.Write([]byte("duplicate delivery"))
+		return
+	}
+
+	e := newEvent(payload)
+	e.claim = delivery
+	e.gitJob = w.gitJob
+
+	// without a queue, deliveries are processed before responding
+	if w.queue == nil {
+		if _, err := w.process(ctx, e); err != nil {
+			w.deliveries.release(delivery)
+			logAndReturn(rw, err)
+			return
+		}
+		rw.WriteHeader(200)
+		rw.Write([]byte("succeeded"))
+		return
+	}
+
+	e.id = providerDeliveryID(r, generic)
+	if e.id == "" {
+		e.id = string(uuid.NewUUID())
+	}
+	writeOutcome(rw, http.StatusAccepted, w.enqueue(e))
+}
+
+// refUpdate is the update of a single ref in a push, from the commit before to the commit after the push.
+type refUpdate struct {
+	ref    string
+	before string
+	after  string
+}
+
+// deleted returns whether the ref was deleted, which git providers send as an update to the zero SHA.
+func (u refUpdate) deleted() bool {
+	return isZeroSHA(u.after)
+}
+
+func isZeroSHA(sha string) bool {
+	return sha != "" && strings.Trim(sha, "0") == ""
+}
+
+// newEvent returns the event of a push payload, with an update per pushed ref, and the pull request of a pull request
+// payload.
+func newEvent(payload interface{}) *event {
+	e := &event{}
 	// credit from https://github.com/argoproj/argo-cd/blob/97003caebcaafe1683e71934eb483a88026a4c33/util/webhook/webhook.go#L84-L87
 	switch t := payload.(type) {
 	case github.PushPayload:
-		branch, tag = getBranchTagFromRef(t.Ref)
-		revision = t.After
-		repoURLs = append(repoURLs, t.Repository.HTMLURL)
+		e.repoURLs = append(e.repoURLs, t.Repository.HTMLURL)
+		e.updates = append(e.updates, refUpdate{ref: t.Ref, before: t.Before, after: t.After})
 	case gitlab.PushEventPayload:
-		branch, tag = getBranchTagFromRef(t.Ref)
-		revision = t.CheckoutSHA
-		repoURLs = append(repoURLs, t.Project.WebURL)
+		e.repoURLs = append(e.repoURLs, t.Project.WebURL)
+		e.updates = append(e.updates, refUpdate{ref: t.Ref, before: t.Before, after: gitlabRevision(t.CheckoutSHA, t.After)})
 	case gitlab.TagEventPayload:
-		branch, tag = getBranchTagFromRef(t.Ref)
-		revision = t.CheckoutSHA
-		repoURLs = append(repoURLs, t.Project.WebURL)
+		e.repoURLs = append(e.repoURLs, t.Project.WebURL)
+		e.updates = append(e.updates, refUpdate{ref: t.Ref, before: t.Before, after: gitlabRevision(t.CheckoutSHA, t.After)})
 	// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Push
 	case bitbucket.RepoPushPayload:
-		repoURLs = append(repoURLs, t.Repository.Links.HTML.Href)
+		e.repoURLs = append(e.repoURLs, t.Repository.Links.HTML.Href)
 		for _, change := range t.Push.Changes {
-			revision = change.New.Target.Hash
-			if change.New.Type == "branch" {
-				branch = change.New.Name
-			} else if change.New.Type == "tag" {
-				tag = change.New.Name
+			// new is empty if the ref was deleted
+			refType, name := change.New.Type, change.New.Name
+			if name == "" {
+				refType, name = change.Old.Type, change.Old.Name
+			}
+			var ref string
+			switch refType {
+			case "branch":
+				ref = branchRefPrefix + name
+			case "tag":
+				ref = tagRefPrefix + name
+			default:
+				continue
+			}
+			after := change.New.Target.Hash
+			if change.New.Name == "" {
+				after = zeroSHA
 			}
-			break
+			e.updates = append(e.updates, refUpdate{ref: ref, before: change.Old.Target.Hash, after: after})
 		}
 	case bitbucketserver.RepositoryReferenceChangedPayload:
 		for _, l := range t.Repository.Links["clone"].([]interface{}) {
 			link := l.(map[string]interface{})
 			if link["name"] == "http" {
-				repoURLs = append(repoURLs, link["href"].(string))
+				e.repoURLs = append(e.repoURLs, link["href"].(string))
 			}
 			if link["name"] == "ssh" {
-				repoURLs = append(repoURLs, link["href"].(string))
+				e.repoURLs = append(e.repoURLs, link["href"].(string))
 			}
 		}
 		for _, change := range t.Changes {
-			revision = change.ToHash
-			branch, tag = getBranchTagFromRef(change.ReferenceId)
-			break
+			e.updates = append(e.updates, refUpdate{ref: change.ReferenceId, before: change.FromHash, after: change.ToHash})
 		}
 	case gogsclient.PushPayload:
-		repoURLs = append(repoURLs, t.Repo.HTMLURL)
-		branch, tag = getBranchTagFromRef(t.Ref)
-		revision = t.After
+		e.repoURLs = append(e.repoURLs, t.Repo.HTMLURL)
+		e.updates = append(e.updates, refUpdate{ref: t.Ref, before: t.Before, after: t.After})
+	case gogsclient.DeletePayload:
+		if t.Repo != nil {
+			e.repoURLs = append(e.repoURLs, t.Repo.HTMLURL)
+			e.updates = append(e.updates, deleteUpdate(string(t.RefType), t.Ref))
+		}
+	case genericPayload:
+		e.repoURLs = append(e.repoURLs, t.repoURL)
+		e.updates = append(e.updates, refUpdate{ref: t.fullRef(), after: t.revision})
+	case goPlaygroundGitea.PushPayload:
+		if t.Repo != nil {
+			e.repoURLs = append(e.repoURLs, t.Repo.HTMLURL)
+		}
+		e.updates = append(e.updates, refUpdate{ref: t.Ref, before: t.Before, after: t.After})
+	case goPlaygroundGitea.CreatePayload:
+		// branches are handled by the push event sent along with the create event
+		if t.RefType == "tag" && t.Repo != nil {
+			e.repoURLs = append(e.repoURLs, t.Repo.HTMLURL)
+			e.updates = append(e.updates, refUpdate{ref: tagRefPrefix + strings.TrimPrefix(t.Ref, tagRefPrefix), after: t.Sha})
+		}
+	case goPlaygroundGitea.DeletePayload:
+		if t.Repo != nil {
+			e.repoURLs = append(e.repoURLs, t.Repo.HTMLURL)
+			e.updates = append(e.updates, deleteUpdate(string(t.RefType), t.Ref))
+		}
 	case goPlaygroundAzuredevops.GitPushEvent:
-		repoURLs = append(repoURLs, t.Resource.Repository.RemoteURL)
-		for _, refUpdate := range t.Resource.RefUpdates {
-			branch, tag = getBranchTagFromRef(refUpdate.Name)
-			revision = refUpdate.NewObjectID
-			break
+		e.repoURLs = append(e.repoURLs, t.Resource.Repository.RemoteURL)
+		for _, u := range t.Resource.RefUpdates {
+			e.updates = append(e.updates, refUpdate{ref: u.Name, before: u.OldObjectID, after: u.NewObjectID})
+		}
+	}
+
+	if pr, ok := parsePullRequest(payload); ok {
+		e.pr = pr
+	}
+
+	return e
+}
+
+// gitlabRevision returns the checkout SHA of a GitLab push, which is empty for deleted refs. Their after SHA is the zero
+// SHA.
+func gitlabRevision(checkoutSHA, after string) string {
+	if checkoutSHA == "" && isZeroSHA(after) {
+		return after
+	}
+
+	return checkoutSHA
+}
+
+// deleteUpdate returns the update of a delete event, which contains the ref type and the short ref, but not the commit
+// of the deleted ref.
+func deleteUpdate(refType, ref string) refUpdate {
+	prefix := branchRefPrefix
+	if refType == "tag" {
+		prefix = tagRefPrefix
+	}
+
+	return refUpdate{ref: prefix + strings.TrimPrefix(ref, prefix), after: zeroSHA}
+}
+
+// process updates the status of the GitJobs matching the updates of the event. It returns the number of updated
+// GitJobs.
+func (w *Webhook) process(ctx context.Context, e *event) (int, error) {
+	if e.pr != nil {
+		if err := w.handlePullRequest(ctx, e.gitJob, e.pr); err != nil {
+			return 0, err
 		}
 	}
+	if len(e.updates) == 0 {
+		return 0, nil
+	}
 
-	var gitJobList v1.GitJobList
-	err = w.client.List(ctx, &gitJobList, &client.ListOptions{LabelSelector: labels.Everything()})
+	gitJobs, err := w.gitJobsForRepos(ctx, e.gitJob, e.repoURLs)
 	if err != nil {
-		logAndReturn(rw, err)
-		return
+		return 0, err
 	}
+	updated := 0
+	for _, gitjob := range gitJobs {
+		if gitjob.Spec.Git.Revision != "" {
+			continue
+		}
 
-	for _, repo := range repoURLs {
-		u, err := url.Parse(repo)
+		var ok bool
+		if gitjob.Spec.Git.OnTag == "" && gitjob.Spec.Git.BranchPattern != "" {
+			ok, err = w.updateBranches(ctx, &gitjob, e.updates)
+		} else {
+			ok, err = w.updateCommit(ctx, &gitjob, e.updates)
+		}
 		if err != nil {
-			logAndReturn(rw, err)
-			return
+			return updated, err
 		}
-		regexpStr := `(?i)(http://|https://|\w+@|ssh://(\w+@)?)` + u.Hostname() + "(:[0-9]+|)[:/]" + u.Path[1:] + "(\\.git)?"
-		repoRegexp, err := regexp.Compile(regexpStr)
+		if ok {
+			updated++
+		}
+	}
+
+	return updated, nil
+}
+
+// updateCommit sets the commit of the GitJob to the revision of the matching update, see commitUpdate. If the watched
+// ref was deleted instead, the deletion is recorded in the status, see deletedRefUpdate.
+func (w *Webhook) updateCommit(ctx context.Context, gitjob *v1.GitJob, updates []refUpdate) (bool, error) {
+	if update, ok := deletedRefUpdate(gitjob, updates); ok {
+		return w.setDeletedRef(ctx, gitjob, update)
+	}
+
+	update, ok := commitUpdate(gitjob, updates)
+	if !ok || update.after == "" || update.after == gitjob.Status.Commit && gitjob.Status.DeletedRef == nil {
+		return false, nil
+	}
+	branch, _ := getBranchTagFromRef(update.ref)
+	revision := update.after
+	// a recreated ref doesn't have to descend from the commit before the deletion
+	current := gitjob.Status.Commit
+	if gitjob.Status.DeletedRef != nil {
+		current = ""
+	}
+	if ok, err := w.isDescendant(ctx, gitjob, branch, current, revision); err != nil || !ok {
+		return false, err
+	}
+	rewrite, err := w.historyRewrite(ctx, gitjob, revision)
+	if err != nil {
+		return false, err
+	}
+
+	return true, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var gitJobFomCluster v1.GitJob
+		err := w.client.Get(ctx, ktypes.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, &gitJobFomCluster)
 		if err != nil {
-			logAndReturn(rw, err)
-			return
+			return err
+		}
+		gitJobFomCluster.Status.Commit = revision
+		setDeletedRef(&gitJobFomCluster, nil)
+		git.SetHistoryRewrite(&gitJobFomCluster, rewrite)
+		// if syncInterval is not set and webhook is configured, set it to 1 hour
+		if gitjob.Spec.SyncInterval == 0 {
+			gitJobFomCluster.Spec.SyncInterval = webhookDefaultSyncInterval
 		}
-		for _, gitjob := range gitJobList.Items {
-			if gitjob.Spec.Git.Revision != "" {
+		return w.client.Status().Update(ctx, &gitJobFomCluster)
+	})
+}
+
+// commitUpdate returns the update which sets the commit of the GitJob. If onTag is set, it is the update of the highest
+// tag matching the semver constraint, as tags can be pushed from any branch. Otherwise it is the update of the GitJob's
+// branch, or the first update if the GitJob has no branch. Deleted refs are skipped.
+func commitUpdate(gitjob *v1.GitJob, updates []refUpdate) (refUpdate, bool) {
+	if gitjob.Spec.Git.OnTag != "" {
+		contraints, err := semver.NewConstraint(gitjob.Spec.Git.OnTag)
+		if err != nil {
+			logrus.Warnf("Failed to parsing onTag semver from %s/%s, err: %v, skipping", gitjob.Namespace, gitjob.Name, err)
+			return refUpdate{}, false
+		}
+		var latest *semver.Version
+		var found refUpdate
+		for _, update := range updates {
+			// skipping if gitjob is watching tag only and tag is empty(not a tag event)
+			_, tag := getBranchTagFromRef(update.ref)
+			if tag == "" || update.deleted() {
 				continue
 			}
-
-			if !repoRegexp.MatchString(gitjob.Spec.Git.Repo) {
+			v, err := semver.NewVersion(tag)
+			if err != nil {
+				logrus.Warnf("Failed to parsing semver on incoming tag, err: %v, skipping", err)
 				continue
 			}
+			if !contraints.Check(v) || latest != nil && !v.GreaterThan(latest) {
+				continue
+			}
+			latest, found = v, update
+		}
+		return found, latest != nil
+	}
+
+	for _, update := range updates {
+		if update.deleted() {
+			continue
+		}
+		if gitjob.Spec.Git.Branch == "" {
+			return update, true
+		}
+		// we check if the branch from webhook matches gitjob's branch
+		if branch, _ := getBranchTagFromRef(update.ref); branch == gitjob.Spec.Git.Branch {
+			return update, true
+		}
+	}
+
+	return refUpdate{}, false
+}
 
-			// if onTag is enabled, we only watch tag event, as it can be coming from any branch
-			if gitjob.Spec.Git.OnTag != "" {
-				// skipping if gitjob is watching tag only and tag is empty(not a tag event)
-				if tag == "" {
-					continue
-				}
-				contraints, err := semver.NewConstraint(gitjob.Spec.Git.OnTag)
-				if err != nil {
-					logrus.Warnf("Failed to parsing onTag semver from %s/%s, err: %v, skipping", gitjob.Namespace, gitjob.Name, err)
-					continue
-				}
-				v, err := semver.NewVersion(tag)
-				if err != nil {
-					logrus.Warnf("Failed to parsing semver on incoming tag, err: %v, skipping", err)
-					continue
-				}
-				if !contraints.Check(v) {
-					continue
-				}
-			} else if gitjob.Spec.Git.Branch != "" {
-				// else we check if the branch from webhook matches gitjob's branch
-				if branch == "" || branch != gitjob.Spec.Git.Branch {
-					continue
-				}
+// deletedRefUpdate returns the deletion of the GitJob's branch or, if onTag is set, of the tag of the GitJob's current
+// commit.
+func deletedRefUpdate(gitjob *v1.GitJob, updates []refUpdate) (refUpdate, bool) {
+	for _, update := range updates {
+		if !update.deleted() {
+			continue
+		}
+		branch, tag := getBranchTagFromRef(update.ref)
+		if gitjob.Spec.Git.OnTag != "" {
+			if tag != "" && update.before != "" && update.before == gitjob.Status.Commit {
+				return update, true
 			}
+			continue
+		}
+		if branch != "" && branch == gitjob.Spec.Git.Branch {
+			return update, true
+		}
+	}
+
+	return refUpdate{}, false
+}
 
-			if gitjob.Status.Commit != revision && revision != "" {
-				if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-					var gitJobFomCluster v1.GitJob
-					err := w.client.Get(ctx, ktypes.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, &gitJobFomCluster)
-					if err != nil {
-						return err
-					}
-					gitJobFomCluster.Status.Commit = revision
-					// if syncInterval is not set and webhook is configured, set it to 1 hour
-					if gitjob.Spec.SyncInterval == 0 {
-						gitJobFomCluster.Spec.SyncInterval = webhookDefaultSyncInterval
-					}
-					return w.client.Status().Update(ctx, &gitJobFomCluster)
-				}); err != nil {
-					logAndReturn(rw, err)
-					return
-				}
+// setDeletedRef records the deletion of the GitJob's ref in its status, which stops polling the ref and runs the
+// cleanup job. The commit is kept, so no job runs for the zero SHA of the deletion.
+func (w *Webhook) setDeletedRef(ctx context.Context, gitjob *v1.GitJob, update refUpdate) (bool, error) {
+	if gitjob.Status.DeletedRef != nil && gitjob.Status.DeletedRef.Ref == update.ref {
+		return false, nil
+	}
+	logrus.Infof("Watched ref %s of %s/%s was deleted", update.ref, gitjob.Namespace, gitjob.Name)
+
+	return true, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var gitJobFomCluster v1.GitJob
+		err := w.client.Get(ctx, ktypes.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, &gitJobFomCluster)
+		if err != nil {
+			return err
+		}
+		deleted := &v1.DeletedRefStatus{Ref: update.ref}
+		if !isZeroSHA(update.before) {
+			deleted.Commit = update.before
+		}
+		setDeletedRef(&gitJobFomCluster, deleted)
+		return w.client.Status().Update(ctx, &gitJobFomCluster)
+	})
+}
+
+// setDeletedRef sets the deleted ref and the RefDeleted condition. A nil ref clears the condition, if it was set.
+func setDeletedRef(gitJob *v1.GitJob, deleted *v1.DeletedRefStatus) {
+	if deleted == nil {
+		git.ClearDeletedRef(gitJob)
+		return
+	}
+
+	gitJob.Status.DeletedRef = deleted
+	c := condition.Cond(v1.RefDeletedCondition)
+	c.SetStatusBool(gitJob, true)
+	c.Reason(gitJob, refDeletedReason)
+	c.Message(gitJob, fmt.Sprintf("%s was deleted in the git repo", deleted.Ref))
+}
+
+// updateBranches sets the commits of the branches matching the GitJob's branch pattern. Deleted branches are removed.
+func (w *Webhook) updateBranches(ctx context.Context, gitjob *v1.GitJob, updates []refUpdate) (bool, error) {
+	matcher, err := git.NewBranchMatcher(gitjob.Spec.Git.BranchPattern)
+	if err != nil {
+		logrus.Warnf("Failed to parse branchPattern from %s/%s, err: %v, skipping", gitjob.Namespace, gitjob.Name, err)
+		return false, nil
+	}
+
+	var matched []refUpdate
+	for _, update := range updates {
+		branch, _ := getBranchTagFromRef(update.ref)
+		if branch == "" || !matcher.Match(branch) {
+			continue
+		}
+		current := branchCommit(gitjob.Status.Branches, branch)
+		if update.deleted() {
+			if current != "" {
+				matched = append(matched, update)
 			}
+			continue
 		}
+		if update.after == "" || current == update.after {
+			continue
+		}
+		if ok, err := w.isDescendant(ctx, gitjob, branch, current, update.after); err != nil {
+			return false, err
+		} else if !ok {
+			continue
+		}
+		matched = append(matched, update)
+	}
+	if len(matched) == 0 {
+		return false, nil
 	}
-	rw.WriteHeader(200)
-	rw.Write([]byte("succeeded"))
+
+	return true, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var gitJobFomCluster v1.GitJob
+		err := w.client.Get(ctx, ktypes.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, &gitJobFomCluster)
+		if err != nil {
+			return err
+		}
+		for _, update := range matched {
+			branch, _ := getBranchTagFromRef(update.ref)
+			if update.deleted() {
+				gitJobFomCluster.Status.Branches = removeBranch(gitJobFomCluster.Status.Branches, branch)
+				continue
+			}
+			gitJobFomCluster.Status.Branches = setBranchCommit(gitJobFomCluster.Status.Branches, branch, update.after)
+		}
+		return w.client.Status().Update(ctx, &gitJobFomCluster)
+	})
 }
 
-func HandleHooks(ctx context.Context, namespace string, client client.Client, clientCache cache.Cache) (http.Handler, error) {
+// historyRewrite returns the rewrite of the GitJob's branch, if revision doesn't descend from the last executed commit.
+// A failed check fails the delivery, so it is retried instead of running a job for a possibly rewritten history.
+func (w *Webhook) historyRewrite(ctx context.Context, gitjob *v1.GitJob, revision string) (*v1.HistoryRewriteStatus, error) {
+	if w.history == nil {
+		return nil, nil
+	}
+	rewrite, err := git.HistoryRewrite(ctx, w.history, gitjob, w.client, revision)
+	if err != nil || rewrite == nil {
+		return nil, err
+	}
+	logrus.Warnf("History of %s/%s was rewritten, %s doesn't descend from the last executed commit %s",
+		gitjob.Namespace, gitjob.Name, rewrite.NewCommit, rewrite.OldCommit)
+
+	return rewrite, nil
+}
+
+// isDescendant returns whether revision descends from the current commit of the GitJob's branch. It is always true if
+// the ancestry isn't verified, e.g. for tags.
+func (w *Webhook) isDescendant(ctx context.Context, gitjob *v1.GitJob, branch, current, revision string) (bool, error) {
+	if w.ancestry == nil || branch == "" || current == "" {
+		return true, nil
+	}
+	ok, err := w.ancestry.IsAncestor(ctx, gitjob, w.client, branch, current, revision)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		logrus.Warnf("Ignoring webhook revision %s for %s/%s, it doesn't descend from the current commit %s of branch %s",
+			revision, gitjob.Namespace, gitjob.Name, current, branch)
+	}
+
+	return ok, nil
+}
+
+func HandleHooks(ctx context.Context, namespace string, client client.Client, clientCache cache.Cache, opts Options) (http.Handler, error) {
 	root := mux.NewRouter()
-	webhook, err := New(namespace, client)
+	webhook, err := New(namespace, client, opts)
 	if err != nil {
 		return nil, err
 	}
 	root.UseEncodedPath()
 	root.Handle("/", webhook)
+	root.HandleFunc("/hooks/{namespace}/{name}", webhook.serveGitJob)
+	root.Handle("/generic/{"+genericProviderVar+"}", webhook)
+	root.HandleFunc("/deliveries/{"+deliveryIDVar+"}", webhook.serveDelivery)
 
 	var secret corev1.Secret
 	informer, err := clientCache.GetInformer(ctx, &secret)
@@ -355,6 +799,8 @@ func HandleHooks(ctx context.Context, namespace string, client client.Client, cl
 		return nil, err
 	}
 
+	go webhook.run(ctx, opts.Workers)
+
 	return root, nil
 }
 
@@ -365,6 +811,45 @@ func logAndReturn(rw http.ResponseWriter, err error) {
 	return
 }
 
+func branchCommit(branches []v1.BranchStatus, branch string) string {
+	for _, b := range branches {
+		if b.Name == branch {
+			return b.Commit
+		}
+	}
+
+	return ""
+}
+
+// removeBranch removes branch from branches.
+func removeBranch(branches []v1.BranchStatus, branch string) []v1.BranchStatus {
+	var result []v1.BranchStatus
+	for _, b := range branches {
+		if b.Name != branch {
+			result = append(result, b)
+		}
+	}
+
+	return result
+}
+
+// setBranchCommit sets the commit of branch in branches, adding the branch if it is not present yet.
+func setBranchCommit(branches []v1.BranchStatus, branch, commit string) []v1.BranchStatus {
+	for i := range branches {
+		if branches[i].Name == branch {
+			branches[i].Commit = commit
+			return branches
+		}
+	}
+
+	branches = append(branches, v1.BranchStatus{Name: branch, Commit: commit})
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Name < branches[j].Name
+	})
+
+	return branches
+}
+
 // git ref docs: https://git-scm.com/book/en/v2/Git-Internals-Git-References
 func getBranchTagFromRef(ref string) (string, string) {
 	if strings.HasPrefix(ref, branchRefPrefix) {
@@ -3,12 +3,31 @@ package webhook
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // GitHub signs webhooks with HMAC-SHA1
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 
+	goPlaygroundGitea "github.com/go-playground/webhooks/v6/gitea"
+	gogsclient "github.com/gogits/go-gogs-client"
 	v1 "github.com/rancher/gitjob/pkg/apis/gitjob.cattle.io/v1"
 	"github.com/rancher/gitjob/pkg/webhook/azuredevops"
+	"github.com/rancher/gitjob/pkg/webhook/gitea"
+	"github.com/rancher/wrangler/v2/pkg/condition"
+	"gopkg.in/go-playground/webhooks.v5/bitbucket"
+	bitbucketserver "gopkg.in/go-playground/webhooks.v5/bitbucket-server"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"gopkg.in/go-playground/webhooks.v5/gitlab"
+	"gopkg.in/go-playground/webhooks.v5/gogs"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	cfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
 
@@ -63,7 +82,7 @@ func TestAzureDevopsWebhook(t *testing.T) {
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
-	client := cfake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).Build()
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).Build()
 	w := &Webhook{client: client}
 	w.azureDevops, _ = azuredevops.New()
 	jsonBody := []byte(`{"subscriptionId":"xxx","notificationId":1,"id":"xxx","eventType":"git.push","publisherId":"tfs","message":{"text":"commit pushed","html":"commit pushed"},"detailedMessage":{"text":"pushed a commit to git-test"},"resource":{"commits":[{"commitId":"` + commit + `","author":{"name":"fleet","email":"fleet@suse.com","date":"2024-01-05T10:16:56Z"},"committer":{"name":"fleet","email":"fleet@suse.com","date":"2024-01-05T10:16:56Z"},"comment":"test commit","url":"https://dev.azure.com/fleet/_apis/git/repositories/xxx/commits/f00c3a181697bb3829a6462e931c7456bbed557b"}],"refUpdates":[{"name":"refs/heads/main","oldObjectId":"135f8a827edae980466f72eef385881bb4e158d8","newObjectId":"` + commit + `"}],"repository":{"id":"xxx","name":"git-test","url":"https://dev.azure.com/fleet/_apis/git/repositories/xxx","project":{"id":"xxx","name":"git-test","url":"https://dev.azure.com/fleet/_apis/projects/xxx","state":"wellFormed","visibility":"unchanged","lastUpdateTime":"0001-01-01T00:00:00"},"defaultBranch":"refs/heads/main","remoteUrl":"` + repoURL + `"},"pushedBy":{"displayName":"Fleet","url":"https://spsprodneu1.vssps.visualstudio.com/xxx/_apis/Identities/xxx","_links":{"avatar":{"href":"https://dev.azure.com/fleet/_apis/GraphProfile/MemberAvatars/msa.xxxx"}},"id":"xxx","uniqueName":"fleet@suse.com","imageUrl":"https://dev.azure.com/fleet/_api/_common/identityImage?id=xxx","descriptor":"xxxx"},"pushId":22,"date":"2024-01-05T10:17:18.735088Z","url":"https://dev.azure.com/fleet/_apis/git/repositories/xxx/pushes/22","_links":{"self":{"href":"https://dev.azure.com/fleet/_apis/git/repositories/xxx/pushes/22"},"repository":{"href":"https://dev.azure.com/fleet/xxx/_apis/git/repositories/xxx"},"commits":{"href":"https://dev.azure.com/fleet/_apis/git/repositories/xxx/pushes/22/commits"},"pusher":{"href":"https://spsprodneu1.vssps.visualstudio.com/xxx/_apis/Identities/xxx"},"refs":{"href":"https://dev.azure.com/fleet/xxx/_apis/git/repositories/xxx/refs/heads/main"}}},"resourceVersion":"1.0","resourceContainers":{"collection":{"id":"xxx","baseUrl":"https://dev.azure.com/fleet/"},"account":{"id":"ec365173-fce3-4dfc-8fc2-950f0b5728b1","baseUrl":"https://dev.azure.com/fleet/"},"project":{"id":"xxx","baseUrl":"https://dev.azure.com/fleet/"}},"createdDate":"2024-01-05T10:17:26.0098694Z"}`)
@@ -88,6 +107,707 @@ func TestAzureDevopsWebhook(t *testing.T) {
 	}
 }
 
+func TestGitHubWebhookBranchPattern(t *testing.T) {
+	const commit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+	const repoURL = "https://github.com/rancher/gitjob"
+	globGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "glob",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:          repoURL,
+				BranchPattern: "release/*",
+			},
+		},
+		Status: v1.GitJobStatus{
+			Branches: []v1.BranchStatus{{Name: "release/1.0", Commit: "oldCommit"}},
+		},
+	}
+	regexpGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "regexp",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:          repoURL,
+				BranchPattern: "regexp:^feature/.*$",
+			},
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).WithRuntimeObjects(globGitJob, regexpGitJob).WithStatusSubresource(globGitJob, regexpGitJob).Build()
+	w := &Webhook{client: client}
+	w.github, _ = github.New()
+	jsonBody := []byte(`{"ref":"refs/heads/release/1.1","before":"0000000000000000000000000000000000000000","after":"` + commit + `","repository":{"name":"gitjob","html_url":"` + repoURL + `"}}`)
+	req, err := http.NewRequest(http.MethodPost, repoURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	h := http.Header{}
+	h.Add("X-GitHub-Event", "push")
+	req.Header = h
+
+	w.ServeHTTP(&responseWriter{}, req)
+
+	updatedGitJob := &v1.GitJob{}
+	err = client.Get(context.TODO(), types.NamespacedName{Name: globGitJob.Name, Namespace: globGitJob.Namespace}, updatedGitJob)
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	expected := []v1.BranchStatus{{Name: "release/1.0", Commit: "oldCommit"}, {Name: "release/1.1", Commit: commit}}
+	assert.DeepEqual(t, updatedGitJob.Status.Branches, expected)
+
+	err = client.Get(context.TODO(), types.NamespacedName{Name: regexpGitJob.Name, Namespace: regexpGitJob.Namespace}, updatedGitJob)
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	if len(updatedGitJob.Status.Branches) != 0 {
+		t.Errorf("expected no branches, but got %v", updatedGitJob.Status.Branches)
+	}
+}
+
+func TestGitHubWebhookPullRequest(t *testing.T) {
+	const headCommit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+	const repoURL = "https://github.com/rancher/gitjob"
+	teardownGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "teardown",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:        repoURL,
+				Branch:      "main",
+				PullRequest: v1.PullRequestInfo{Enabled: true, Teardown: true, AllowForks: true},
+			},
+		},
+	}
+	noTeardownGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "no-teardown",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:        repoURL,
+				Branch:      "main",
+				PullRequest: v1.PullRequestInfo{Enabled: true, BaseBranch: "main", AllowForks: true},
+			},
+		},
+	}
+	noForksGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "no-forks",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:        "git@github.com:rancher/gitjob.git",
+				PullRequest: v1.PullRequestInfo{Enabled: true},
+			},
+		},
+	}
+	otherBaseGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "other-base",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:        repoURL,
+				PullRequest: v1.PullRequestInfo{Enabled: true, BaseBranch: "release"},
+			},
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(teardownGitJob, noTeardownGitJob, otherBaseGitJob, noForksGitJob).
+		WithStatusSubresource(teardownGitJob, noTeardownGitJob, otherBaseGitJob, noForksGitJob).Build()
+	w := &Webhook{client: client}
+	w.github, _ = github.New()
+
+	send := func(action, number, headRepo string) {
+		jsonBody := []byte(`{"action":"` + action + `","number":` + number + `,"pull_request":{"number":` + number + `,` +
+			`"head":{"ref":"feature","sha":"` + headCommit + `","repo":{"clone_url":"` + headRepo + `"}},` +
+			`"base":{"ref":"main","sha":"135f8a827edae980466f72eef385881bb4e158d8"}},` +
+			`"repository":{"name":"gitjob","html_url":"` + repoURL + `"}}`)
+		req, err := http.NewRequest(http.MethodPost, repoURL, bytes.NewReader(jsonBody))
+		if err != nil {
+			t.Errorf("unexpected err %v", err)
+		}
+		h := http.Header{}
+		h.Add("X-GitHub-Event", "pull_request")
+		req.Header = h
+		w.ServeHTTP(&responseWriter{}, req)
+	}
+	pullRequests := func(gitjob *v1.GitJob) []v1.PullRequestStatus {
+		updatedGitJob := &v1.GitJob{}
+		err := client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+		if err != nil {
+			t.Errorf("unexpected err %v", err)
+		}
+		return updatedGitJob.Status.PullRequests
+	}
+
+	send("opened", "7", "https://github.com/fork/gitjob.git")
+	open := []v1.PullRequestStatus{{
+		Number:     7,
+		HeadCommit: headCommit,
+		HeadBranch: "feature",
+		HeadRepo:   "https://github.com/fork/gitjob.git",
+		BaseBranch: "main",
+	}}
+	assert.DeepEqual(t, pullRequests(teardownGitJob), open)
+	assert.DeepEqual(t, pullRequests(noTeardownGitJob), open)
+	assert.Equal(t, len(pullRequests(otherBaseGitJob)), 0)
+	assert.Equal(t, len(pullRequests(noForksGitJob)), 0)
+
+	send("opened", "8", "https://github.com/rancher/gitjob.git")
+	sameRepo := v1.PullRequestStatus{
+		Number:     8,
+		HeadCommit: headCommit,
+		HeadBranch: "feature",
+		BaseBranch: "main",
+	}
+	assert.DeepEqual(t, pullRequests(noForksGitJob), []v1.PullRequestStatus{sameRepo})
+
+	send("closed", "7", "https://github.com/fork/gitjob.git")
+	closed := []v1.PullRequestStatus{open[0], sameRepo}
+	closed[0].Closed = true
+	assert.DeepEqual(t, pullRequests(teardownGitJob), closed)
+	assert.DeepEqual(t, pullRequests(noTeardownGitJob), []v1.PullRequestStatus{sameRepo})
+}
+
+func TestWebhookPullRequestProviders(t *testing.T) {
+	type delivery struct {
+		payload string
+		header  map[string]string
+	}
+	tests := map[string]struct {
+		repoURL    string
+		open       delivery
+		close      delivery
+		headCommit string
+	}{
+		"gitlab": {
+			repoURL:    "https://gitlab.example.com/rancher/gitjob",
+			open:       delivery{payload: "gitlab-merge-request-open.json", header: map[string]string{"X-Gitlab-Event": "Merge Request Hook"}},
+			close:      delivery{payload: "gitlab-merge-request-merge.json", header: map[string]string{"X-Gitlab-Event": "Merge Request Hook"}},
+			headCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+		"bitbucket": {
+			repoURL:    "https://bitbucket.org/rancher/gitjob",
+			open:       delivery{payload: "bitbucket-pull-request-updated.json", header: map[string]string{"X-Hook-UUID": "xxx", "X-Event-Key": "pullrequest:updated"}},
+			close:      delivery{payload: "bitbucket-pull-request-fulfilled.json", header: map[string]string{"X-Hook-UUID": "xxx", "X-Event-Key": "pullrequest:fulfilled"}},
+			headCommit: "f00c3a181697",
+		},
+		"bitbucket server": {
+			repoURL:    "https://bitbucket.example.com/scm/rancher/gitjob.git",
+			open:       delivery{payload: "bitbucket-server-pr-from-ref-updated.json", header: map[string]string{"X-Event-Key": "pr:from_ref_updated"}},
+			close:      delivery{payload: "bitbucket-server-pr-merged.json", header: map[string]string{"X-Event-Key": "pr:merged"}},
+			headCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+		// gogs doesn't send the head commit of the pull request
+		"gogs": {
+			repoURL: "https://gogs.example.com/rancher/gitjob",
+			open:    delivery{payload: "gogs-pull-request-synchronized.json", header: map[string]string{"X-Gogs-Event": "pull_request"}},
+			close:   delivery{payload: "gogs-pull-request-closed.json", header: map[string]string{"X-Gogs-Event": "pull_request"}},
+		},
+		"gitea": {
+			repoURL:    "https://gitea.example.com/rancher/gitjob",
+			open:       delivery{payload: "gitea-pull-request-synchronized.json", header: map[string]string{"X-Gitea-Event": "pull_request"}},
+			close:      delivery{payload: "gitea-pull-request-closed.json", header: map[string]string{"X-Gitea-Event": "pull_request"}},
+			headCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+		"forgejo": {
+			repoURL:    "https://gitea.example.com/rancher/gitjob",
+			open:       delivery{payload: "gitea-pull-request-synchronized.json", header: map[string]string{"X-Forgejo-Event": "pull_request", "X-Gitea-Event": "pull_request"}},
+			close:      delivery{payload: "gitea-pull-request-closed.json", header: map[string]string{"X-Forgejo-Event": "pull_request", "X-Gitea-Event": "pull_request"}},
+			headCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+		"azure devops": {
+			repoURL:    "https://dev.azure.com/rancher/gitjob/_git/gitjob",
+			open:       delivery{payload: "azure-pull-request-updated.json", header: map[string]string{"X-Vss-Activityid": "xxx"}},
+			close:      delivery{payload: "azure-pull-request-merged.json", header: map[string]string{"X-Vss-Activityid": "xxx"}},
+			headCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			teardownGitJob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "teardown"},
+				Spec: v1.GitJobSpec{Git: v1.GitInfo{
+					Repo:        test.repoURL,
+					PullRequest: v1.PullRequestInfo{Enabled: true, Teardown: true},
+				}},
+			}
+			noTeardownGitJob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "no-teardown"},
+				Spec: v1.GitJobSpec{Git: v1.GitInfo{
+					Repo:        test.repoURL,
+					PullRequest: v1.PullRequestInfo{Enabled: true},
+				}},
+			}
+			scheme := runtime.NewScheme()
+			err := v1.AddToScheme(scheme)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+				WithRuntimeObjects(teardownGitJob, noTeardownGitJob).
+				WithStatusSubresource(teardownGitJob, noTeardownGitJob).Build()
+			w := &Webhook{client: client}
+			w.gitlab, _ = gitlab.New()
+			w.bitbucket, _ = bitbucket.New()
+			w.bitbucketServer, _ = bitbucketserver.New()
+			w.gogs, _ = gogs.New()
+			w.gitea, _ = gitea.New()
+			w.forgejo, _ = gitea.New()
+			w.azureDevops, _ = azuredevops.New()
+
+			send := func(d delivery) {
+				jsonBody, err := os.ReadFile(filepath.Join("testdata", d.payload))
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+				for k, v := range d.header {
+					req.Header.Set(k, v)
+				}
+				rec := httptest.NewRecorder()
+				w.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected status %d, but got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+				}
+			}
+			pullRequests := func(gitjob *v1.GitJob) []v1.PullRequestStatus {
+				updatedGitJob := &v1.GitJob{}
+				err := client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+				if err != nil {
+					t.Errorf("unexpected err %v", err)
+				}
+				return updatedGitJob.Status.PullRequests
+			}
+
+			send(test.open)
+			open := []v1.PullRequestStatus{{
+				Number:     7,
+				HeadCommit: test.headCommit,
+				HeadBranch: "feature",
+				BaseBranch: "main",
+			}}
+			assert.DeepEqual(t, pullRequests(teardownGitJob), open)
+			assert.DeepEqual(t, pullRequests(noTeardownGitJob), open)
+
+			send(test.close)
+			closed := []v1.PullRequestStatus{open[0]}
+			closed[0].Closed = true
+			assert.DeepEqual(t, pullRequests(teardownGitJob), closed)
+			assert.Equal(t, len(pullRequests(noTeardownGitJob)), 0)
+		})
+	}
+}
+
+func TestGiteaPullRequestRecordedPayload(t *testing.T) {
+	gitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "example"},
+		Spec: v1.GitJobSpec{Git: v1.GitInfo{
+			Repo:        "http://localhost:3000/example/example.git",
+			PullRequest: v1.PullRequestInfo{Enabled: true, AllowForks: true},
+		}},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(gitJob).WithStatusSubresource(gitJob).Build()
+	w := &Webhook{client: client}
+	w.gitea, _ = gitea.New()
+
+	// recorded by go-playground/webhooks, the pull request is opened from the fork example2/example
+	jsonBody, err := os.ReadFile(filepath.Join("testdata", "gitea-pull-request-opened.json"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+	req.Header.Set("X-Gitea-Event", "pull_request")
+	req.Header.Set("X-Gogs-Event", "pull_request")
+	req.Header.Set("X-GitHub-Event", "pull_request")
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	updatedGitJob := &v1.GitJob{}
+	err = client.Get(context.TODO(), types.NamespacedName{Name: gitJob.Name}, updatedGitJob)
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	assert.DeepEqual(t, updatedGitJob.Status.PullRequests, []v1.PullRequestStatus{{
+		Number:     2,
+		HeadCommit: "48e773f892a831faa47c0a160d1b7f0cd369ae2a",
+		HeadBranch: "master",
+		HeadRepo:   "http://localhost:3000/example2/example.git",
+		BaseBranch: "master",
+	}})
+}
+
+func TestBitbucketServerPullRequestHeadRepo(t *testing.T) {
+	repo := func(id uint64, project string) bitbucketserver.Repository {
+		return bitbucketserver.Repository{ID: id, Links: map[string]interface{}{"clone": []interface{}{
+			map[string]interface{}{"name": "http", "href": "https://bitbucket.example.com/scm/" + project + "/gitjob.git"},
+		}}}
+	}
+	pr := bitbucketserver.PullRequest{
+		FromRef: bitbucketserver.RepositoryReference{Repository: repo(1, "rancher")},
+		ToRef:   bitbucketserver.RepositoryReference{Repository: repo(1, "rancher")},
+	}
+	assert.Equal(t, bitbucketServerPullRequest(pr, false).headRepo, "")
+
+	pr.FromRef.Repository = repo(2, "fork")
+	assert.Equal(t, bitbucketServerPullRequest(pr, false).headRepo, "https://bitbucket.example.com/scm/fork/gitjob.git")
+}
+
+func TestGitHubWebhookRepoIndex(t *testing.T) {
+	const commit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+	sshGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ssh",
+			Namespace: "a",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "git@github.com:Rancher/GitJob.git",
+				Branch: "main",
+			},
+		},
+	}
+	httpsGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "https",
+			Namespace: "b",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "https://github.com/rancher/gitjob/",
+				Branch: "main",
+			},
+		},
+	}
+	otherGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: "a",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   "https://github.com/rancher/gitjob-other",
+				Branch: "main",
+			},
+		},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(sshGitJob, httpsGitJob, otherGitJob).
+		WithStatusSubresource(sshGitJob, httpsGitJob, otherGitJob).Build()
+	w := &Webhook{client: client}
+	w.github, _ = github.New()
+	jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + commit + `","repository":{"name":"gitjob","html_url":"https://github.com/rancher/gitjob"}}`)
+	req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	h := http.Header{}
+	h.Add("X-GitHub-Event", "push")
+	req.Header = h
+
+	w.ServeHTTP(&responseWriter{}, req)
+
+	expected := map[*v1.GitJob]string{sshGitJob: commit, httpsGitJob: commit, otherGitJob: ""}
+	for gitjob, expectedCommit := range expected {
+		updatedGitJob := &v1.GitJob{}
+		err = client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+		if err != nil {
+			t.Errorf("unexpected err %v", err)
+		}
+		if updatedGitJob.Status.Commit != expectedCommit {
+			t.Errorf("expected commit %q for %s, but got %q", expectedCommit, gitjob.Name, updatedGitJob.Status.Commit)
+		}
+	}
+}
+
+func TestGitJobWebhookEndpoint(t *testing.T) {
+	const commit = "f00c3a181697bb3829a6462e931c7456bbed557b"
+	const repoURL = "https://github.com/rancher/gitjob"
+	securedGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "secured",
+			Namespace: "team",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   repoURL,
+				Branch: "main",
+			},
+			WebhookSecretName: "webhook",
+		},
+		Status: v1.GitJobStatus{
+			GitEvent: v1.GitEvent{GithubMeta: v1.GithubMeta{ValidationToken: "token"}},
+		},
+	}
+	otherGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: "team",
+		},
+		Spec: v1.GitJobSpec{
+			Git: v1.GitInfo{
+				Repo:   repoURL,
+				Branch: "main",
+			},
+		},
+	}
+	tests := map[string]struct {
+		path            string
+		token           string
+		expectedStatus  int
+		expectedCommits map[string]string
+	}{
+		"valid signature": {
+			path:            "/hooks/team/secured",
+			token:           "token",
+			expectedStatus:  http.StatusOK,
+			expectedCommits: map[string]string{"secured": commit, "other": ""},
+		},
+		"invalid signature": {
+			path:            "/hooks/team/secured",
+			token:           "wrong",
+			expectedStatus:  http.StatusInternalServerError,
+			expectedCommits: map[string]string{"secured": "", "other": ""},
+		},
+		"gitjob without secret": {
+			path:            "/hooks/team/other",
+			expectedStatus:  http.StatusOK,
+			expectedCommits: map[string]string{"secured": "", "other": commit},
+		},
+		"global endpoint": {
+			path:            "/",
+			expectedStatus:  http.StatusOK,
+			expectedCommits: map[string]string{"secured": "", "other": commit},
+		},
+		"unknown gitjob": {
+			path:            "/hooks/team/unknown",
+			expectedStatus:  http.StatusNotFound,
+			expectedCommits: map[string]string{"secured": "", "other": ""},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			err := v1.AddToScheme(scheme)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+				WithRuntimeObjects(securedGitJob.DeepCopy(), otherGitJob.DeepCopy()).
+				WithStatusSubresource(securedGitJob, otherGitJob).Build()
+			w := &Webhook{client: client}
+			if err := w.initGitProviders(); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			router := mux.NewRouter()
+			router.Handle("/", w)
+			router.HandleFunc("/hooks/{namespace}/{name}", w.serveGitJob)
+
+			jsonBody := []byte(`{"ref":"refs/heads/main","after":"` + commit + `","repository":{"name":"gitjob","html_url":"` + repoURL + `"}}`)
+			req := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader(jsonBody))
+			req.Header.Set("X-GitHub-Event", "push")
+			if test.token != "" {
+				mac := hmac.New(sha1.New, []byte(test.token))
+				_, _ = mac.Write(jsonBody)
+				req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedStatus {
+				t.Errorf("expected status %d, but got %d", test.expectedStatus, rec.Code)
+			}
+			for name, expectedCommit := range test.expectedCommits {
+				var gitjob v1.GitJob
+				err := client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "team"}, &gitjob)
+				if err != nil {
+					t.Errorf("unexpected err %v", err)
+				}
+				if gitjob.Status.Commit != expectedCommit {
+					t.Errorf("expected commit %q for %s, but got %q", expectedCommit, name, gitjob.Status.Commit)
+				}
+			}
+		})
+	}
+}
+
+func TestGiteaWebhook(t *testing.T) {
+	const repoURL = "https://gitea.example.com/fleet/gitjob-example.git"
+	const forgejoRepoURL = "git@codeberg.org:fleet/gitjob-example"
+	tests := map[string]struct {
+		payload        string
+		forgejo        bool
+		event          string
+		secret         string
+		signature      string
+		repo           string
+		branch         string
+		onTag          string
+		expectedStatus int
+		expectedCommit string
+	}{
+		"gitea push": {
+			payload:        "gitea-push.json",
+			event:          "push",
+			secret:         "secret",
+			signature:      "secret",
+			repo:           repoURL,
+			branch:         "main",
+			expectedStatus: http.StatusOK,
+			expectedCommit: "f00c3a181697bb3829a6462e931c7456bbed557b",
+		},
+		"gitea push other branch": {
+			payload:        "gitea-push.json",
+			event:          "push",
+			repo:           repoURL,
+			branch:         "dev",
+			expectedStatus: http.StatusOK,
+		},
+		"gitea invalid signature": {
+			payload:        "gitea-push.json",
+			event:          "push",
+			secret:         "secret",
+			signature:      "wrong",
+			repo:           repoURL,
+			branch:         "main",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		"gitea missing signature": {
+			payload:        "gitea-push.json",
+			event:          "push",
+			secret:         "secret",
+			repo:           repoURL,
+			branch:         "main",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		"gitea create tag": {
+			payload:        "gitea-create-tag.json",
+			event:          "create",
+			repo:           repoURL,
+			onTag:          ">=1.0.0",
+			expectedStatus: http.StatusOK,
+			expectedCommit: "8a1d4c5b6e7f8091a2b3c4d5e6f708192a3b4c5d",
+		},
+		"forgejo push tag": {
+			payload:        "forgejo-push-tag.json",
+			forgejo:        true,
+			event:          "push",
+			secret:         "secret",
+			signature:      "secret",
+			repo:           forgejoRepoURL,
+			onTag:          ">=1.0.0",
+			expectedStatus: http.StatusOK,
+			expectedCommit: "8a1d4c5b6e7f8091a2b3c4d5e6f708192a3b4c5d",
+		},
+		"forgejo push tag not matching": {
+			payload:        "forgejo-push-tag.json",
+			forgejo:        true,
+			event:          "push",
+			repo:           forgejoRepoURL,
+			onTag:          ">=2.0.0",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gitjob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: v1.GitJobSpec{
+					Git: v1.GitInfo{
+						Repo:   test.repo,
+						Branch: test.branch,
+						OnTag:  test.onTag,
+					},
+				},
+			}
+			scheme := runtime.NewScheme()
+			err := v1.AddToScheme(scheme)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+				WithRuntimeObjects(gitjob).WithStatusSubresource(gitjob).Build()
+			w := &Webhook{client: client}
+			secretKey := giteaKey
+			if test.forgejo {
+				secretKey = forgejoKey
+			}
+			if err := w.setGitProviders(map[string][]byte{secretKey: []byte(test.secret)}); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			jsonBody, err := os.ReadFile(filepath.Join("testdata", test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+			// Gitea and Forgejo send the headers of Gogs and GitHub as well
+			req.Header.Set("X-Gitea-Event", test.event)
+			req.Header.Set("X-Gogs-Event", test.event)
+			req.Header.Set("X-GitHub-Event", test.event)
+			if test.forgejo {
+				req.Header.Set("X-Forgejo-Event", test.event)
+			}
+			if test.signature != "" {
+				mac := hmac.New(sha256.New, []byte(test.signature))
+				_, _ = mac.Write(jsonBody)
+				signature := hex.EncodeToString(mac.Sum(nil))
+				req.Header.Set("X-Gitea-Signature", signature)
+				if test.forgejo {
+					req.Header.Set("X-Forgejo-Signature", signature)
+				}
+			}
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedStatus {
+				t.Errorf("expected status %d, but got %d: %s", test.expectedStatus, rec.Code, rec.Body.String())
+			}
+			updatedGitJob := &v1.GitJob{}
+			err = client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name, Namespace: gitjob.Namespace}, updatedGitJob)
+			if err != nil {
+				t.Errorf("unexpected err %v", err)
+			}
+			if updatedGitJob.Status.Commit != test.expectedCommit {
+				t.Errorf("expected commit %q, but got %q", test.expectedCommit, updatedGitJob.Status.Commit)
+			}
+		})
+	}
+}
+
 type responseWriter struct{}
 
 func (r *responseWriter) Header() http.Header {
@@ -98,3 +818,210 @@ func (r *responseWriter) Write([]byte) (int, error) {
 }
 
 func (r *responseWriter) WriteHeader(statusCode int) {}
+
+func TestMultipleRefUpdates(t *testing.T) {
+	const (
+		mainCommit    = "f00c3a181697bb3829a6462e931c7456bbed557b"
+		releaseCommit = "9d1e4a2b7c3f5e6d8a0b1c2d3e4f5a6b7c8d9e0f"
+		tagCommit     = "6ac9bd0d61b7a9a64a1ad8f3b5e3c1fd0a5e2b7c"
+	)
+	tests := map[string]struct {
+		payload string
+		header  map[string]string
+		repoURL string
+	}{
+		"bitbucket": {
+			payload: "bitbucket-push-multiple.json",
+			header:  map[string]string{"X-Hook-UUID": "xxx", "X-Event-Key": "repo:push"},
+			repoURL: "https://bitbucket.org/rancher/gitjob",
+		},
+		"bitbucket server": {
+			payload: "bitbucket-server-refs-changed.json",
+			header:  map[string]string{"X-Event-Key": "repo:refs_changed"},
+			repoURL: "https://bitbucket.example.com/scm/rancher/gitjob.git",
+		},
+		"azure devops": {
+			payload: "azure-push-multiple.json",
+			header:  map[string]string{"X-Vss-Activityid": "xxx"},
+			repoURL: "https://dev.azure.com/rancher/gitjob/_git/gitjob",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			branchGitJob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "branch"},
+				Spec:       v1.GitJobSpec{Git: v1.GitInfo{Repo: test.repoURL, Branch: "main"}},
+			}
+			patternGitJob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "pattern"},
+				Spec:       v1.GitJobSpec{Git: v1.GitInfo{Repo: test.repoURL, BranchPattern: "release/*"}},
+			}
+			tagGitJob := &v1.GitJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "tag"},
+				Spec:       v1.GitJobSpec{Git: v1.GitInfo{Repo: test.repoURL, OnTag: ">=1.0.0"}},
+			}
+			scheme := runtime.NewScheme()
+			err := v1.AddToScheme(scheme)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+				WithRuntimeObjects(branchGitJob, patternGitJob, tagGitJob).
+				WithStatusSubresource(branchGitJob, patternGitJob, tagGitJob).Build()
+			w := &Webhook{client: client}
+			w.bitbucket, _ = bitbucket.New()
+			w.bitbucketServer, _ = bitbucketserver.New()
+			w.azureDevops, _ = azuredevops.New()
+
+			jsonBody, err := os.ReadFile(filepath.Join("testdata", test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d, but got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+
+			assertCommit(t, client, branchGitJob, mainCommit)
+			// the highest matching tag is used, regardless of the order of the changes
+			assertCommit(t, client, tagGitJob, tagCommit)
+			updatedGitJob := &v1.GitJob{}
+			err = client.Get(context.TODO(), types.NamespacedName{Name: patternGitJob.Name}, updatedGitJob)
+			if err != nil {
+				t.Errorf("unexpected err %v", err)
+			}
+			assert.DeepEqual(t, updatedGitJob.Status.Branches, []v1.BranchStatus{{Name: "release/1.1", Commit: releaseCommit}})
+		})
+	}
+}
+
+func TestDeletedRefs(t *testing.T) {
+	const repoURL = "https://github.com/rancher/gitjob"
+	branchGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "branch"},
+		Spec:       v1.GitJobSpec{Git: v1.GitInfo{Repo: repoURL, Branch: "feature"}},
+		Status:     v1.GitJobStatus{GitEvent: v1.GitEvent{Commit: oldCommit}},
+	}
+	patternGitJob := &v1.GitJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "pattern"},
+		Spec:       v1.GitJobSpec{Git: v1.GitInfo{Repo: repoURL, BranchPattern: "feature*"}},
+		Status: v1.GitJobStatus{Branches: []v1.BranchStatus{
+			{Name: "feature", Commit: oldCommit},
+			{Name: "feature-2", Commit: oldCommit},
+		}},
+	}
+	scheme := runtime.NewScheme()
+	err := v1.AddToScheme(scheme)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	client := cfake.NewClientBuilder().WithScheme(scheme).WithIndex(&v1.GitJob{}, RepoIndex, repoIndexFunc).
+		WithRuntimeObjects(branchGitJob, patternGitJob).WithStatusSubresource(branchGitJob, patternGitJob).Build()
+	w := &Webhook{client: client}
+	w.github, _ = github.New()
+
+	push := func(before, after string) {
+		jsonBody := []byte(`{"ref":"refs/heads/feature","before":"` + before + `","after":"` + after + `","repository":{"name":"gitjob","html_url":"` + repoURL + `"}}`)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
+		req.Header.Set("X-GitHub-Event", "push")
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status %d, but got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+	get := func(gitjob *v1.GitJob) *v1.GitJob {
+		updatedGitJob := &v1.GitJob{}
+		err := client.Get(context.TODO(), types.NamespacedName{Name: gitjob.Name}, updatedGitJob)
+		if err != nil {
+			t.Errorf("unexpected err %v", err)
+		}
+		return updatedGitJob
+	}
+
+	push(oldCommit, zeroSHA)
+
+	// the zero SHA is not stored as commit
+	updated := get(branchGitJob)
+	if updated.Status.Commit != oldCommit {
+		t.Errorf("expected commit %v, but got %v", oldCommit, updated.Status.Commit)
+	}
+	assert.DeepEqual(t, updated.Status.DeletedRef, &v1.DeletedRefStatus{Ref: "refs/heads/feature", Commit: oldCommit})
+	if !condition.Cond(v1.RefDeletedCondition).IsTrue(updated) {
+		t.Errorf("expected condition %s to be true, but got %v", v1.RefDeletedCondition, updated.Status.Conditions)
+	}
+	assert.DeepEqual(t, get(patternGitJob).Status.Branches, []v1.BranchStatus{{Name: "feature-2", Commit: oldCommit}})
+
+	// the branch is pushed again
+	push(zeroSHA, newCommit)
+
+	updated = get(branchGitJob)
+	if updated.Status.Commit != newCommit {
+		t.Errorf("expected commit %v, but got %v", newCommit, updated.Status.Commit)
+	}
+	if updated.Status.DeletedRef != nil {
+		t.Errorf("expected no deleted ref, but got %v", updated.Status.DeletedRef)
+	}
+	if !condition.Cond(v1.RefDeletedCondition).IsFalse(updated) {
+		t.Errorf("expected condition %s to be false, but got %v", v1.RefDeletedCondition, updated.Status.Conditions)
+	}
+	assert.DeepEqual(t, get(patternGitJob).Status.Branches, []v1.BranchStatus{
+		{Name: "feature", Commit: newCommit},
+		{Name: "feature-2", Commit: oldCommit},
+	})
+}
+
+func TestNewEventDeletedRefs(t *testing.T) {
+	tests := map[string]struct {
+		payload  func() interface{}
+		expected refUpdate
+	}{
+		"gitlab": {
+			payload: func() interface{} {
+				return gitlab.PushEventPayload{Ref: "refs/heads/feature", Before: oldCommit, After: zeroSHA}
+			},
+			expected: refUpdate{ref: "refs/heads/feature", before: oldCommit, after: zeroSHA},
+		},
+		"bitbucket": {
+			payload: func() interface{} {
+				var p bitbucket.RepoPushPayload
+				_ = json.Unmarshal([]byte(`{"push":{"changes":[{"new":null,"old":{"type":"branch","name":"feature","target":{"hash":"`+oldCommit+`"}}}]}}`), &p)
+				return p
+			},
+			expected: refUpdate{ref: "refs/heads/feature", before: oldCommit, after: zeroSHA},
+		},
+		"gitea": {
+			payload: func() interface{} {
+				return goPlaygroundGitea.DeletePayload{Ref: "v1.0.0", RefType: "tag", Repo: &goPlaygroundGitea.Repository{}}
+			},
+			expected: refUpdate{ref: "refs/tags/v1.0.0", after: zeroSHA},
+		},
+		"gogs": {
+			payload: func() interface{} {
+				return gogsclient.DeletePayload{Ref: "feature", RefType: "branch", Repo: &gogsclient.Repository{}}
+			},
+			expected: refUpdate{ref: "refs/heads/feature", after: zeroSHA},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := newEvent(test.payload())
+			if len(e.updates) != 1 {
+				t.Fatalf("expected a single update, but got %v", e.updates)
+			}
+			if e.updates[0] != test.expected {
+				t.Errorf("expected %+v, but got %+v", test.expected, e.updates[0])
+			}
+			if !e.updates[0].deleted() {
+				t.Errorf("expected update to be a deletion")
+			}
+		})
+	}
+}